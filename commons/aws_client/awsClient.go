@@ -30,10 +30,12 @@ type IAWSClient interface {
 	InvokeLambda(ctx context.Context, lambdafunctionArn string, payload map[string]interface{}, isAsyncInvocation bool) (*lambda.InvokeOutput, error)
 	StoreDataToS3(ctx context.Context, bucketName, s3KeyPath string, responseBody []byte) error
 	InvokeSFN(Input, StateMachineArn, Name *string) (string, error)
+	DescribeExecution(ctx context.Context, executionArn string) (*sfn.DescribeExecutionOutput, error)
 	GetDataFromS3(ctx context.Context, bucketName, s3KeyPath string) ([]byte, error)
 	FetchS3BucketPath(s3Path string) (string, string, error)
 	CloseWaitTask(ctx context.Context, status, TaskToken, Output, Cause, Error string) error
 	PushMessageToSQS(ctx context.Context, queueUrl, messageBody string) error
+	ChangeMessageVisibility(ctx context.Context, queueUrl, receiptHandle string, timeoutSeconds int64) error
 }
 
 type AWSClient struct{}
@@ -181,6 +183,19 @@ func (ac *AWSClient) InvokeSFN(Input, StateMachineArn, Name *string) (string, er
 	return *out.ExecutionArn, nil
 }
 
+func (ac *AWSClient) DescribeExecution(ctx context.Context, executionArn string) (*sfn.DescribeExecutionOutput, error) {
+	mySession := session.Must(session.NewSession())
+	svc := sfn.New(mySession)
+	out, err := svc.DescribeExecutionWithContext(ctx, &sfn.DescribeExecutionInput{
+		ExecutionArn: aws.String(executionArn),
+	})
+	if err != nil {
+		log.Error(ctx, "Unable to describe execution ", executionArn, err)
+		return nil, err
+	}
+	return out, nil
+}
+
 func (ac *AWSClient) GetDataFromS3(ctx context.Context, bucketName, s3KeyPath string) ([]byte, error) {
 	sess, err := session.NewSession()
 	if err != nil {
@@ -236,6 +251,18 @@ func (ac *AWSClient) CloseWaitTask(ctx context.Context, status, TaskToken, Outpu
 	}
 }
 
+// ChangeMessageVisibility hides a received message for timeoutSeconds from now, it is received again afterwards.
+func (ac *AWSClient) ChangeMessageVisibility(ctx context.Context, queueUrl, receiptHandle string, timeoutSeconds int64) error {
+	mySession := session.Must(session.NewSession())
+	sqsClient := sqs.New(mySession)
+	_, err := sqsClient.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueUrl),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: aws.Int64(timeoutSeconds),
+	})
+	return err
+}
+
 func (ac *AWSClient) PushMessageToSQS(ctx context.Context, queueUrl, messageBody string) error {
 	mySession := session.Must(session.NewSession())
 	sqsClient := sqs.New(mySession)
@@ -9,7 +9,6 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.eagleview.com/engineering/assess-platform-library/httpservice"
 	"github.eagleview.com/engineering/platform-gosdk/log"
@@ -37,18 +36,21 @@ type CommonHandler struct {
 	Secrets     map[string]interface{}
 }
 
-func New(awsClient, httpClient, dbClient, slackClient, secretsRequired bool) CommonHandler {
+// New builds the clients a lambda asks for. A missing secret, an invalid DB config or an unreachable DB is returned
+// to the caller, which decides whether the lambda can start without it.
+func New(awsClient, httpClient, dbClient, slackClient, secretsRequired bool) (CommonHandler, error) {
 	CommonHandlerObject := CommonHandler{}
 	var secrets map[string]interface{}
 	var err error
-	if secretsRequired || dbClient || slackClient {
-		SecretARN := os.Getenv(DBSecretARN)
+	SecretARN := os.Getenv(DBSecretARN)
+	// without a secret the DB config comes from the environment alone, as for a local mongod
+	if secretsRequired || slackClient || (dbClient && SecretARN != "") {
 		log.Info("fetching db secrets")
 		CommonHandlerObject.AwsClient = &aws_client.AWSClient{}
 		secrets, err = CommonHandlerObject.AwsClient.GetSecret(context.Background(), SecretARN, "us-east-2")
 		if err != nil {
 			log.Error(context.Background(), err)
-			panic(err)
+			return CommonHandlerObject, err
 		}
 		CommonHandlerObject.Secrets = secrets
 	}
@@ -63,20 +65,37 @@ func New(awsClient, httpClient, dbClient, slackClient, secretsRequired bool) Com
 	}
 
 	if dbClient {
-		CommonHandlerObject.DBClient = documentDB_client.NewDBClientService(secrets)
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		config, err := documentDB_client.LoadDBConfig(secrets)
+		if err != nil {
+			log.Error(context.Background(), err)
+			return CommonHandlerObject, err
+		}
+		DBClient, err := documentDB_client.NewDBClientService(context.Background(), config)
+		if err != nil {
+			log.Error(context.Background(), err)
+			return CommonHandlerObject, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
 		defer cancel()
-		if err = CommonHandlerObject.DBClient.CheckConnection(ctx); err != nil {
-			panic(err)
+		if err = DBClient.CheckConnection(ctx); err != nil {
+			log.Error(context.Background(), err)
+			return CommonHandlerObject, err
 		}
+		CommonHandlerObject.DBClient = DBClient
 	}
 
 	if slackClient {
+		slackToken, ok := secrets[slackKey].(string)
+		if !ok {
+			err = fmt.Errorf("secret %s has no %s", SecretARN, slackKey)
+			log.Error(context.Background(), err)
+			return CommonHandlerObject, err
+		}
 		slackErrChannel := os.Getenv(slackChannel)
-		CommonHandlerObject.SlackClient = slack.NewSlackClient(secrets[slackKey].(string), slackErrChannel)
+		CommonHandlerObject.SlackClient = slack.NewSlackClient(slackToken, slackErrChannel)
 	}
 
-	return CommonHandlerObject
+	return CommonHandlerObject, nil
 }
 
 func (CommonHandler *CommonHandler) MakePostCall(ctx context.Context, URL string, payload []byte, headers map[string]string) ([]byte, error) {
@@ -0,0 +1,92 @@
+package config_loader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+)
+
+// S3Reader fetches the S3 object a config is stored in, IAWSClient is one.
+type S3Reader interface {
+	FetchS3BucketPath(s3Path string) (string, string, error)
+	GetDataFromS3(ctx context.Context, bucketName, s3KeyPath string) ([]byte, error)
+}
+
+// Validator is a config checking itself once decoded.
+type Validator interface {
+	Validate() error
+}
+
+// Source is where a JSON config is read from, the Env variable holding the JSON itself or else the S3 object at
+// the path held by S3Env. Every failure to load it is reported under Code, Name says what the config is.
+type Source struct {
+	Name  string
+	Env   string
+	S3Env string
+	Code  int
+}
+
+// Read returns the JSON of the source and false when none of its variables is set.
+func (source Source) Read(ctx context.Context, s3 S3Reader) ([]byte, bool, error) {
+	if data := os.Getenv(source.Env); data != "" {
+		return []byte(data), true, nil
+	}
+	s3Path := ""
+	if source.S3Env != "" {
+		s3Path = os.Getenv(source.S3Env)
+	}
+	if s3Path == "" {
+		return nil, false, nil
+	}
+	bucket, key, err := s3.FetchS3BucketPath(s3Path)
+	if err != nil {
+		return nil, false, error_handler.NewServiceError(source.Code, err.Error())
+	}
+	data, err := s3.GetDataFromS3(ctx, bucket, key)
+	if err != nil {
+		return nil, false, error_handler.NewServiceError(source.Code, err.Error())
+	}
+	return data, true, nil
+}
+
+// Decode reads the source into config and validates it. It returns false, leaving config as it was, when the
+// source is not set.
+func (source Source) Decode(ctx context.Context, s3 S3Reader, config Validator) (bool, error) {
+	data, found, err := source.Read(ctx, s3)
+	if err != nil || !found {
+		return false, err
+	}
+	if err = json.Unmarshal(data, config); err != nil {
+		return true, error_handler.NewServiceError(source.Code, fmt.Sprintf("invalid %s: %s", source.Name, err))
+	}
+	return true, source.Validate(config)
+}
+
+// Validate checks config, a built-in default for instance, and reports its problems under the code of the source.
+func (source Source) Validate(config Validator) error {
+	if err := config.Validate(); err != nil {
+		return error_handler.NewServiceError(source.Code, err.Error())
+	}
+	return nil
+}
+
+// Problems collects every problem found while validating a config so they are all reported at once.
+type Problems []string
+
+// Add records a problem, formatted as with fmt.Sprintf.
+func (problems *Problems) Add(format string, args ...interface{}) {
+	*problems = append(*problems, fmt.Sprintf(format, args...))
+}
+
+// Err joins the problems after "invalid <name>: ", it is nil when there are none.
+func (problems Problems) Err(name string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid " + name + ": " + strings.Join(problems, "; "))
+}
@@ -0,0 +1,104 @@
+package config_loader
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+)
+
+const testCode = 4999
+
+type limits struct {
+	Max int `json:"max"`
+}
+
+func (config *limits) Validate() error {
+	problems := Problems{}
+	if config.Max < 0 {
+		problems.Add("max %d should not be negative", config.Max)
+	}
+	if config.Max > 10 {
+		problems.Add("max %d should be at most 10", config.Max)
+	}
+	return problems.Err("limits")
+}
+
+// objects is an S3Reader serving objects from memory, the path s3://<bucket>/<key> is read from objects[key].
+type objects map[string][]byte
+
+func (objects objects) FetchS3BucketPath(s3Path string) (string, string, error) {
+	return "config", s3Path[len("s3://config/"):], nil
+}
+
+func (objects objects) GetDataFromS3(_ context.Context, bucketName, s3KeyPath string) ([]byte, error) {
+	data, ok := objects[s3KeyPath]
+	if !ok {
+		return nil, errors.New("access denied")
+	}
+	return data, nil
+}
+
+var source = Source{Name: "limits", Env: "Limits", S3Env: "LimitsS3Path", Code: testCode}
+
+func TestDecode(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("not set", func(t *testing.T) {
+		config := &limits{Max: 3}
+		found, err := source.Decode(ctx, nil, config)
+		assert.NoError(t, err)
+		assert.False(t, found)
+		assert.Equal(t, 3, config.Max)
+	})
+
+	t.Run("from the variable", func(t *testing.T) {
+		t.Setenv("Limits", `{"max": 5}`)
+		t.Setenv("LimitsS3Path", "s3://config/limits.json")
+		config := &limits{}
+		found, err := source.Decode(ctx, nil, config)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, 5, config.Max)
+	})
+
+	t.Run("from S3", func(t *testing.T) {
+		t.Setenv("LimitsS3Path", "s3://config/limits.json")
+		config := &limits{}
+		found, err := source.Decode(ctx, objects{"limits.json": []byte(`{"max": 7}`)}, config)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, 7, config.Max)
+	})
+
+	t.Run("S3 failure", func(t *testing.T) {
+		t.Setenv("LimitsS3Path", "s3://config/limits.json")
+		_, err := source.Decode(ctx, objects{}, &limits{})
+		assert.Contains(t, err.Error(), "access denied")
+		assert.Equal(t, testCode, err.(error_handler.ICodedError).GetErrorCode())
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		t.Setenv("Limits", `{"max": "five"}`)
+		_, err := source.Decode(ctx, nil, &limits{})
+		assert.Contains(t, err.Error(), "invalid limits: json: cannot unmarshal string")
+		assert.Equal(t, testCode, err.(error_handler.ICodedError).GetErrorCode())
+	})
+
+	t.Run("every problem", func(t *testing.T) {
+		t.Setenv("Limits", `{"max": -1}`)
+		_, err := source.Decode(ctx, nil, &limits{})
+		assert.Contains(t, err.Error(), "invalid limits: max -1 should not be negative")
+		assert.Equal(t, testCode, err.(error_handler.ICodedError).GetErrorCode())
+	})
+}
+
+func TestProblems(t *testing.T) {
+	problems := Problems{}
+	assert.NoError(t, problems.Err("limits"))
+	problems.Add("first")
+	problems.Add("%s of %d", "second", 2)
+	assert.EqualError(t, problems.Err("limits"), "invalid limits: first; second of 2")
+}
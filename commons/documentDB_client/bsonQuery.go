@@ -0,0 +1,584 @@
+package documentDB_client
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.eagleview.com/engineering/symphony-service/commons/field_path"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The evaluator below covers the subset of the query and update language used against WorkflowData and StepsData,
+// it backs InMemoryDocDBClient so the queries built in this package can be exercised without a cluster.
+
+// normalizeDocument round trips v through BSON so typed values such as enums or structs become plain BSON values.
+func normalizeDocument(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(b, &doc)
+	return doc, err
+}
+
+// normalizeValue round trips a single value through BSON.
+func normalizeValue(v interface{}) interface{} {
+	doc, err := normalizeDocument(bson.M{"v": v})
+	if err != nil {
+		return v
+	}
+	return doc["v"]
+}
+
+func asDocument(v interface{}) (bson.M, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return bson.M(d), true
+	case bson.D:
+		return d.Map(), true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case bson.A:
+		return a, true
+	case []interface{}:
+		return a, true
+	}
+	return nil, false
+}
+
+func isOperatorDocument(v interface{}) bool {
+	doc, ok := asDocument(v)
+	if !ok || len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDocument reports whether doc satisfies query, an operator it does not implement is an error.
+func matchDocument(doc bson.M, query bson.M) (bool, error) {
+	for key, cond := range query {
+		switch {
+		case key == "$and" || key == "$or" || key == "$nor":
+			clauses, _ := asArray(cond)
+			matched := 0
+			for _, clause := range clauses {
+				sub, _ := asDocument(clause)
+				ok, err := matchDocument(doc, sub)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					matched++
+				}
+			}
+			if (key == "$and" && matched != len(clauses)) || (key == "$or" && matched == 0) || (key == "$nor" && matched > 0) {
+				return false, nil
+			}
+		case strings.HasPrefix(key, "$"):
+			return false, fmt.Errorf("unsupported query operator %s", key)
+		default:
+			ok, err := matchField(doc, key, cond)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+func matchField(doc bson.M, path string, cond interface{}) (bool, error) {
+	values := field_path.Keys(strings.Split(path, ".")...).Values(doc)
+	if !isOperatorDocument(cond) {
+		return anyEquals(values, cond), nil
+	}
+	ops, _ := asDocument(cond)
+	for op, arg := range ops {
+		ok, err := matchOperator(values, op, arg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}) (bool, error) {
+	switch op {
+	case "$eq":
+		return anyEquals(values, arg), nil
+	case "$ne":
+		return !anyEquals(values, arg), nil
+	case "$in", "$nin":
+		candidates, ok := asArray(arg)
+		if !ok {
+			return false, fmt.Errorf("%s expects an array", op)
+		}
+		found := false
+		for _, c := range candidates {
+			if anyEquals(values, c) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range expandArrays(values) {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				continue
+			}
+			if (op == "$gt" && c > 0) || (op == "$gte" && c >= 0) || (op == "$lt" && c < 0) || (op == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$exists":
+		exists, _ := arg.(bool)
+		return (len(values) > 0) == exists, nil
+	case "$elemMatch":
+		for _, v := range values {
+			arr, ok := asArray(v)
+			if !ok {
+				continue
+			}
+			for _, elem := range arr {
+				ok, err := matchElement(elem, arg)
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unsupported query operator %s", op)
+}
+
+// matchElement matches an array element against an $elemMatch argument, a sub query for documents
+// or operator conditions for scalars.
+func matchElement(elem interface{}, cond interface{}) (bool, error) {
+	if doc, ok := asDocument(elem); ok && !isOperatorDocument(cond) {
+		query, _ := asDocument(cond)
+		return matchDocument(doc, query)
+	}
+	ops, _ := asDocument(cond)
+	for op, arg := range ops {
+		ok, err := matchOperator([]interface{}{elem}, op, arg)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// expandArrays adds the elements of array values, a condition on an array field matches any of its elements.
+func expandArrays(values []interface{}) []interface{} {
+	expanded := append([]interface{}{}, values...)
+	for _, v := range values {
+		if arr, ok := asArray(v); ok {
+			expanded = append(expanded, arr...)
+		}
+	}
+	return expanded
+}
+
+// anyEquals follows the equality semantics of a query, null also matches a missing field.
+func anyEquals(values []interface{}, target interface{}) bool {
+	if target == nil && len(values) == 0 {
+		return true
+	}
+	for _, v := range expandArrays(values) {
+		if valuesEqual(v, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	if docA, ok := asDocument(a); ok {
+		docB, ok := asDocument(b)
+		if !ok || len(docA) != len(docB) {
+			return false
+		}
+		for k, v := range docA {
+			if !valuesEqual(v, docB[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	if arrA, ok := asArray(a); ok {
+		arrB, ok := asArray(b)
+		if !ok || len(arrA) != len(arrB) {
+			return false
+		}
+		for i := range arrA {
+			if !valuesEqual(arrA[i], arrB[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two scalars of the same kind, ok is false when they cannot be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0, true
+		}
+		return 0, false
+	}
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	if sa, ok := toString(a); ok {
+		sb, ok := toString(b)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(sa, sb), true
+	}
+	if ta, ok := toTime(a); ok {
+		tb, ok := toTime(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case ta.Before(tb):
+			return -1, true
+		case ta.After(tb):
+			return 1, true
+		}
+		return 0, true
+	}
+	if ba, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if ba == bb {
+			return 0, true
+		}
+		if !ba {
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toString(v interface{}) (string, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.String {
+		return rv.String(), true
+	}
+	return "", false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case primitive.DateTime:
+		return t.Time(), true
+	}
+	return time.Time{}, false
+}
+
+// applyUpdate applies $set, $unset, $inc, $push and $pull to doc, the positional $ resolves against query.
+func applyUpdate(doc bson.M, update bson.M, query bson.M) error {
+	if !isOperatorDocument(update) {
+		id := doc["_id"]
+		for k := range doc {
+			delete(doc, k)
+		}
+		for k, v := range update {
+			doc[k] = v
+		}
+		doc["_id"] = id
+		return nil
+	}
+	for op, arg := range update {
+		fields, ok := asDocument(arg)
+		if !ok {
+			return fmt.Errorf("%s expects a document", op)
+		}
+		for path, value := range fields {
+			parts, err := resolvePositional(doc, path, query)
+			if err != nil {
+				return err
+			}
+			switch op {
+			case "$set":
+				setPath(doc, parts, value)
+			case "$unset":
+				unsetPath(doc, parts)
+			case "$inc":
+				current := field_path.Keys(parts...).Values(doc)
+				sum, _ := toFloat(value)
+				if len(current) > 0 {
+					c, _ := toFloat(current[0])
+					sum += c
+				}
+				if _, isFloat := value.(float64); isFloat {
+					setPath(doc, parts, sum)
+				} else {
+					setPath(doc, parts, int64(sum))
+				}
+			case "$push":
+				current := field_path.Keys(parts...).Values(doc)
+				arr := bson.A{}
+				if len(current) > 0 {
+					existing, ok := asArray(current[0])
+					if !ok {
+						return fmt.Errorf("cannot push to non array field %s", path)
+					}
+					arr = append(arr, existing...)
+				}
+				if each, ok := asDocument(value); ok && each["$each"] != nil {
+					items, _ := asArray(each["$each"])
+					arr = append(arr, items...)
+				} else {
+					arr = append(arr, value)
+				}
+				setPath(doc, parts, arr)
+			case "$pull":
+				current := field_path.Keys(parts...).Values(doc)
+				if len(current) == 0 {
+					continue
+				}
+				existing, ok := asArray(current[0])
+				if !ok {
+					return fmt.Errorf("cannot pull from non array field %s", path)
+				}
+				// a document of fields is a condition on the elements, like the slots of a hipster quota
+				condition, byCondition := asDocument(value)
+				arr := bson.A{}
+				for _, elem := range existing {
+					matched := valuesEqual(elem, value)
+					if fields, isDocument := asDocument(elem); isDocument && byCondition {
+						if matched, err = matchDocument(fields, condition); err != nil {
+							return err
+						}
+					}
+					if !matched {
+						arr = append(arr, elem)
+					}
+				}
+				setPath(doc, parts, arr)
+			default:
+				return fmt.Errorf("unsupported update operator %s", op)
+			}
+		}
+	}
+	return nil
+}
+
+// resolvePositional replaces "$" in an update path by the index of the first array element matched by query.
+func resolvePositional(doc bson.M, path string, query bson.M) ([]string, error) {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if part != "$" {
+			continue
+		}
+		arrayPath := strings.Join(parts[:i], ".")
+		values := field_path.Keys(parts[:i]...).Values(doc)
+		if len(values) == 0 {
+			return nil, fmt.Errorf("positional operator did not find the array %s", arrayPath)
+		}
+		arr, _ := asArray(values[0])
+		index, err := matchedIndex(arr, arrayPath, query)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("positional operator did not find the match needed from the query for %s", arrayPath)
+		}
+		parts[i] = strconv.Itoa(index)
+	}
+	return parts, nil
+}
+
+func matchedIndex(arr []interface{}, arrayPath string, query bson.M) (int, error) {
+	for i, elem := range arr {
+		ok, err := elementMatchesQuery(elem, arrayPath, query)
+		if err != nil {
+			return -1, err
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// elementMatchesQuery reports whether elem satisfies every condition query puts on arrayPath,
+// either through $elemMatch or through dotted paths below it.
+func elementMatchesQuery(elem interface{}, arrayPath string, query bson.M) (bool, error) {
+	matched := false
+	for key, cond := range query {
+		switch {
+		case key == arrayPath && isOperatorDocument(cond):
+			ops, _ := asDocument(cond)
+			if elemMatch, ok := ops["$elemMatch"]; ok {
+				ok, err := matchElement(elem, elemMatch)
+				if err != nil || !ok {
+					return false, err
+				}
+				matched = true
+			}
+		case strings.HasPrefix(key, arrayPath+"."):
+			sub, ok := asDocument(elem)
+			if !ok {
+				return false, nil
+			}
+			ok, err := matchField(sub, strings.TrimPrefix(key, arrayPath+"."), cond)
+			if err != nil || !ok {
+				return false, err
+			}
+			matched = true
+		}
+	}
+	return matched, nil
+}
+
+func setPath(doc bson.M, parts []string, value interface{}) {
+	var current interface{} = doc
+	for i, part := range parts {
+		last := i == len(parts)-1
+		if d, ok := asDocument(current); ok {
+			if last {
+				d[part] = value
+				return
+			}
+			child, ok := d[part]
+			if !ok || child == nil {
+				child = bson.M{}
+				d[part] = child
+			}
+			current = child
+			continue
+		}
+		if arr, ok := asArray(current); ok {
+			index, err := strconv.Atoi(part)
+			if err != nil || index >= len(arr) {
+				return
+			}
+			if last {
+				arr[index] = value
+				return
+			}
+			current = arr[index]
+		}
+	}
+}
+
+func unsetPath(doc bson.M, parts []string) {
+	values := field_path.Keys(parts[:len(parts)-1]...).Values(doc)
+	if len(values) == 0 {
+		return
+	}
+	if d, ok := asDocument(values[0]); ok {
+		delete(d, parts[len(parts)-1])
+	}
+}
+
+// sortDocuments orders docs on the keys of sortSpec, a missing field sorts before any value as in DocumentDB.
+func sortDocuments(docs []bson.M, sortSpec bson.D) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range sortSpec {
+			direction := 1
+			if d, ok := toFloat(key.Value); ok && d < 0 {
+				direction = -1
+			}
+			a := firstValue(field_path.Keys(strings.Split(key.Key, ".")...).Values(docs[i]))
+			b := firstValue(field_path.Keys(strings.Split(key.Key, ".")...).Values(docs[j]))
+			c, ok := compareValues(a, b)
+			if !ok {
+				switch {
+				case a == nil && b != nil:
+					c = -1
+				case a != nil && b == nil:
+					c = 1
+				default:
+					c = strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+				}
+			}
+			if c != 0 {
+				return c*direction < 0
+			}
+		}
+		return false
+	})
+}
+
+func firstValue(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// projectDocument keeps _id and the included paths of doc.
+func projectDocument(doc bson.M, projection bson.D) bson.M {
+	projected := bson.M{"_id": doc["_id"]}
+	for _, field := range projection {
+		parts := strings.Split(field.Key, ".")
+		values := field_path.Keys(parts...).Values(doc)
+		if len(values) == 0 {
+			continue
+		}
+		setPath(projected, parts, values[0])
+	}
+	return projected
+}
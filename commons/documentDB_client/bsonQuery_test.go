@@ -0,0 +1,173 @@
+package documentDB_client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMatchOperator(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []interface{}
+		op      string
+		arg     interface{}
+		want    bool
+		wantErr string
+	}{
+		{"$eq matches", []interface{}{"a"}, "$eq", "a", true, ""},
+		{"$eq matches an array element", []interface{}{bson.A{"a", "b"}}, "$eq", "b", true, ""},
+		{"$eq compares numbers across types", []interface{}{int32(3)}, "$eq", int64(3), true, ""},
+		{"$ne on a missing field", []interface{}{}, "$ne", "a", true, ""},
+		{"$ne on an equal value", []interface{}{"a"}, "$ne", "a", false, ""},
+		{"$in matches", []interface{}{"b"}, "$in", bson.A{"a", "b"}, true, ""},
+		{"$in misses", []interface{}{"c"}, "$in", bson.A{"a", "b"}, false, ""},
+		{"$nin misses", []interface{}{"c"}, "$nin", bson.A{"a", "b"}, true, ""},
+		{"$in needs an array", []interface{}{"a"}, "$in", "a", false, "$in expects an array"},
+		{"$gt", []interface{}{5}, "$gt", 4, true, ""},
+		{"$gte on equal", []interface{}{5}, "$gte", 5, true, ""},
+		{"$lt checks array elements", []interface{}{bson.A{9, 2}}, "$lt", 3, true, ""},
+		{"$lte misses", []interface{}{5}, "$lte", 4, false, ""},
+		{"$lt skips values of another type", []interface{}{"5"}, "$lt", 9, false, ""},
+		{"$exists true", []interface{}{nil}, "$exists", true, true, ""},
+		{"$exists false", []interface{}{}, "$exists", false, true, ""},
+		{"$elemMatch on documents", []interface{}{bson.A{bson.M{"k": 1}, bson.M{"k": 2}}}, "$elemMatch", bson.M{"k": 2}, true, ""},
+		{"$elemMatch on scalars", []interface{}{bson.A{1, 7}}, "$elemMatch", bson.M{"$gt": 5}, true, ""},
+		{"$elemMatch misses", []interface{}{bson.A{1, 2}}, "$elemMatch", bson.M{"$gt": 5}, false, ""},
+		{"$elemMatch reports nested errors", []interface{}{bson.A{1}}, "$elemMatch", bson.M{"$regex": "x"}, false, "unsupported query operator $regex"},
+		{"unsupported operator", []interface{}{"a"}, "$regex", "a", false, "unsupported query operator $regex"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := matchOperator(test.values, test.op, test.arg)
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestMatchDocumentReportsUnsupportedOperators(t *testing.T) {
+	doc := bson.M{"status": "SUCCESS"}
+
+	_, err := matchDocument(doc, bson.M{"status": bson.M{"$regex": "^SUC"}})
+	assert.EqualError(t, err, "unsupported query operator $regex")
+
+	_, err = matchDocument(doc, bson.M{"$where": "this.status == 'SUCCESS'"})
+	assert.EqualError(t, err, "unsupported query operator $where")
+
+	_, err = matchDocument(doc, bson.M{"$or": bson.A{bson.M{"status": bson.M{"$size": 1}}}})
+	assert.EqualError(t, err, "unsupported query operator $size")
+
+	ok, err := matchDocument(doc, bson.M{"$or": bson.A{bson.M{"status": "FAILED"}, bson.M{"status": "SUCCESS"}}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestApplyUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     bson.M
+		update  bson.M
+		query   bson.M
+		want    bson.M
+		wantErr string
+	}{
+		{
+			name:   "$set creates nested fields",
+			doc:    bson.M{"_id": "1"},
+			update: bson.M{"$set": bson.M{"a.b": "x"}},
+			want:   bson.M{"_id": "1", "a": bson.M{"b": "x"}},
+		},
+		{
+			name:   "$unset removes a field",
+			doc:    bson.M{"_id": "1", "a": "x", "b": "y"},
+			update: bson.M{"$unset": bson.M{"a": ""}},
+			want:   bson.M{"_id": "1", "b": "y"},
+		},
+		{
+			name:   "$inc adds to an integer",
+			doc:    bson.M{"_id": "1", "count": int32(2)},
+			update: bson.M{"$inc": bson.M{"count": 3}},
+			want:   bson.M{"_id": "1", "count": int64(5)},
+		},
+		{
+			name:   "$inc starts a missing field",
+			doc:    bson.M{"_id": "1"},
+			update: bson.M{"$inc": bson.M{"count": -1}},
+			want:   bson.M{"_id": "1", "count": int64(-1)},
+		},
+		{
+			name:   "$push appends",
+			doc:    bson.M{"_id": "1", "tags": bson.A{"a"}},
+			update: bson.M{"$push": bson.M{"tags": "b"}},
+			want:   bson.M{"_id": "1", "tags": bson.A{"a", "b"}},
+		},
+		{
+			name:   "$push with $each",
+			doc:    bson.M{"_id": "1"},
+			update: bson.M{"$push": bson.M{"tags": bson.M{"$each": bson.A{"a", "b"}}}},
+			want:   bson.M{"_id": "1", "tags": bson.A{"a", "b"}},
+		},
+		{
+			name:    "$push to a scalar",
+			doc:     bson.M{"_id": "1", "tags": "a"},
+			update:  bson.M{"$push": bson.M{"tags": "b"}},
+			wantErr: "cannot push to non array field tags",
+		},
+		{
+			name:   "$pull removes equal elements",
+			doc:    bson.M{"_id": "1", "tags": bson.A{"a", "b", "a"}},
+			update: bson.M{"$pull": bson.M{"tags": "a"}},
+			want:   bson.M{"_id": "1", "tags": bson.A{"b"}},
+		},
+		{
+			name:   "positional $ resolves against the query",
+			doc:    bson.M{"_id": "1", "steps": bson.A{bson.M{"name": "a", "status": "RUNNING"}, bson.M{"name": "b", "status": "RUNNING"}}},
+			update: bson.M{"$set": bson.M{"steps.$.status": "SUCCESS"}},
+			query:  bson.M{"steps.name": "b"},
+			want:   bson.M{"_id": "1", "steps": bson.A{bson.M{"name": "a", "status": "RUNNING"}, bson.M{"name": "b", "status": "SUCCESS"}}},
+		},
+		{
+			name:    "positional $ without a match",
+			doc:     bson.M{"_id": "1", "steps": bson.A{bson.M{"name": "a"}}},
+			update:  bson.M{"$set": bson.M{"steps.$.status": "SUCCESS"}},
+			query:   bson.M{"steps.name": "b"},
+			wantErr: "positional operator did not find the match needed from the query for steps",
+		},
+		{
+			name:    "positional $ reports unsupported query operators",
+			doc:     bson.M{"_id": "1", "steps": bson.A{bson.M{"name": "a"}}},
+			update:  bson.M{"$set": bson.M{"steps.$.status": "SUCCESS"}},
+			query:   bson.M{"steps.name": bson.M{"$regex": "a"}},
+			wantErr: "unsupported query operator $regex",
+		},
+		{
+			name:    "unsupported update operator",
+			doc:     bson.M{"_id": "1"},
+			update:  bson.M{"$rename": bson.M{"a": "b"}},
+			wantErr: "unsupported update operator $rename",
+		},
+		{
+			name:   "replacement keeps the _id",
+			doc:    bson.M{"_id": "1", "a": "x"},
+			update: bson.M{"b": "y"},
+			want:   bson.M{"_id": "1", "b": "y"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := applyUpdate(test.doc, test.update, test.query)
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, test.doc)
+		})
+	}
+}
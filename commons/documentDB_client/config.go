@@ -0,0 +1,191 @@
+package documentDB_client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	DefaultCAFilePath     = "/rds-combined-ca-bundle.pem"
+	DefaultDatabase       = "test"
+	DefaultReplicaSet     = "rs0"
+	DefaultReadPreference = "primary"
+	DefaultMaxPoolSize    = 100
+
+	envDBHost           = "dbHost"
+	envDBName           = "dbName"
+	envDBReplicaSet     = "dbReplicaSet"
+	envDBReadPreference = "dbReadPreference"
+	envDBMinPoolSize    = "dbMinPoolSize"
+	envDBMaxPoolSize    = "dbMaxPoolSize"
+	envDBConnectTimeout = "dbConnectTimeout"
+	envDBQueryTimeout   = "dbQueryTimeout"
+	envDBCAFilePath     = "dbCAFilePath"
+	envDBTLS            = "dbTLS"
+)
+
+var ErrInvalidDBConfig = errors.New("invalid documentDB configuration")
+
+// DBConfig describes how to reach DocumentDB. Credentials and the endpoint come from the DB secret, every other field
+// can be set through the environment. With TLS off and no credentials it connects to a plain local mongod.
+type DBConfig struct {
+	Username       string
+	Password       string
+	Host           string
+	Database       string
+	ReplicaSet     string
+	ReadPreference string
+	MinPoolSize    uint64
+	MaxPoolSize    uint64
+	ConnectTimeout time.Duration
+	QueryTimeout   time.Duration
+	CAFilePath     string
+	TLS            bool
+}
+
+func DefaultDBConfig() DBConfig {
+	return DBConfig{
+		Database:       DefaultDatabase,
+		ReplicaSet:     DefaultReplicaSet,
+		ReadPreference: DefaultReadPreference,
+		MaxPoolSize:    DefaultMaxPoolSize,
+		ConnectTimeout: ConnectTimeout * time.Second,
+		QueryTimeout:   QueryTimeout * time.Second,
+		CAFilePath:     DefaultCAFilePath,
+		TLS:            true,
+	}
+}
+
+// LoadDBConfig reads username, password, host, port and the optional dbname from secrets, then applies the
+// environment overrides on top of the defaults. All problems are reported together.
+func LoadDBConfig(secrets map[string]interface{}) (DBConfig, error) {
+	config := DefaultDBConfig()
+	errs := []string{}
+
+	config.Username = secretString(secrets, "username")
+	config.Password = secretString(secrets, "password")
+	if host := secretString(secrets, "host"); host != "" {
+		config.Host = host
+		if port := secretString(secrets, "port"); port != "" {
+			config.Host = host + ":" + port
+		}
+	}
+	if name := secretString(secrets, "dbname"); name != "" {
+		config.Database = name
+	}
+
+	stringEnv(envDBHost, &config.Host)
+	stringEnv(envDBName, &config.Database)
+	stringEnv(envDBReplicaSet, &config.ReplicaSet)
+	stringEnv(envDBReadPreference, &config.ReadPreference)
+	stringEnv(envDBCAFilePath, &config.CAFilePath)
+	errs = appendIfError(errs, uintEnv(envDBMinPoolSize, &config.MinPoolSize))
+	errs = appendIfError(errs, uintEnv(envDBMaxPoolSize, &config.MaxPoolSize))
+	errs = appendIfError(errs, secondsEnv(envDBConnectTimeout, &config.ConnectTimeout))
+	errs = appendIfError(errs, secondsEnv(envDBQueryTimeout, &config.QueryTimeout))
+	errs = appendIfError(errs, boolEnv(envDBTLS, &config.TLS))
+	if len(errs) > 0 {
+		return config, fmt.Errorf("%w: %s", ErrInvalidDBConfig, strings.Join(errs, "; "))
+	}
+	return config, config.Validate()
+}
+
+func (config DBConfig) Validate() error {
+	errs := []string{}
+	if config.Host == "" {
+		errs = append(errs, "host is required")
+	}
+	if config.Database == "" {
+		errs = append(errs, "database is required")
+	}
+	if (config.Username == "") != (config.Password == "") {
+		errs = append(errs, "username and password should be set together")
+	}
+	if _, err := readpref.ModeFromString(config.ReadPreference); err != nil {
+		errs = append(errs, fmt.Sprintf("read preference %q is not supported", config.ReadPreference))
+	}
+	if config.MaxPoolSize == 0 {
+		errs = append(errs, "max pool size should be positive")
+	} else if config.MinPoolSize > config.MaxPoolSize {
+		errs = append(errs, fmt.Sprintf("min pool size %d is above max pool size %d", config.MinPoolSize, config.MaxPoolSize))
+	}
+	if config.ConnectTimeout <= 0 {
+		errs = append(errs, "connect timeout should be positive")
+	}
+	if config.QueryTimeout <= 0 {
+		errs = append(errs, "query timeout should be positive")
+	}
+	if config.TLS && config.CAFilePath == "" {
+		errs = append(errs, "CA file path is required when TLS is on")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidDBConfig, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func secretString(secrets map[string]interface{}, key string) string {
+	value, ok := secrets[key]
+	if !ok || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func stringEnv(key string, target *string) {
+	if value := os.Getenv(key); value != "" {
+		*target = value
+	}
+}
+
+func uintEnv(key string, target *uint64) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s should be a non negative integer, got %q", key, value)
+	}
+	*target = parsed
+	return nil
+}
+
+func secondsEnv(key string, target *time.Duration) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s should be a number of seconds, got %q", key, value)
+	}
+	*target = time.Duration(seconds) * time.Second
+	return nil
+}
+
+func boolEnv(key string, target *bool) error {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s should be true or false, got %q", key, value)
+	}
+	*target = parsed
+	return nil
+}
+
+func appendIfError(errs []string, err error) []string {
+	if err != nil {
+		return append(errs, err.Error())
+	}
+	return errs
+}
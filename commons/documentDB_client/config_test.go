@@ -0,0 +1,106 @@
+package documentDB_client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDBConfig(t *testing.T) {
+	t.Run("secrets and defaults", func(t *testing.T) {
+		config, err := LoadDBConfig(map[string]interface{}{"username": "user", "password": "secret", "host": "docdb", "port": 27017})
+		assert.NoError(t, err)
+		assert.Equal(t, "user", config.Username)
+		assert.Equal(t, "secret", config.Password)
+		assert.Equal(t, "docdb:27017", config.Host)
+		assert.Equal(t, DefaultDatabase, config.Database)
+		assert.Equal(t, DefaultCAFilePath, config.CAFilePath)
+		assert.True(t, config.TLS)
+	})
+
+	t.Run("environment overrides", func(t *testing.T) {
+		t.Setenv(envDBHost, "localhost:27017")
+		t.Setenv(envDBName, "symphony")
+		t.Setenv(envDBReadPreference, "secondaryPreferred")
+		t.Setenv(envDBMinPoolSize, "5")
+		t.Setenv(envDBMaxPoolSize, "20")
+		t.Setenv(envDBConnectTimeout, "3")
+		t.Setenv(envDBQueryTimeout, "7")
+		t.Setenv(envDBTLS, "false")
+		config, err := LoadDBConfig(map[string]interface{}{"host": "docdb", "dbname": "fromSecret"})
+		assert.NoError(t, err)
+		assert.Equal(t, "localhost:27017", config.Host)
+		assert.Equal(t, "symphony", config.Database)
+		assert.Equal(t, "secondaryPreferred", config.ReadPreference)
+		assert.Equal(t, uint64(5), config.MinPoolSize)
+		assert.Equal(t, uint64(20), config.MaxPoolSize)
+		assert.Equal(t, 3*time.Second, config.ConnectTimeout)
+		assert.Equal(t, 7*time.Second, config.QueryTimeout)
+		assert.False(t, config.TLS)
+	})
+
+	t.Run("reports every malformed variable", func(t *testing.T) {
+		t.Setenv(envDBMaxPoolSize, "-1")
+		t.Setenv(envDBConnectTimeout, "soon")
+		t.Setenv(envDBTLS, "maybe")
+		_, err := LoadDBConfig(map[string]interface{}{"host": "docdb"})
+		assert.True(t, errors.Is(err, ErrInvalidDBConfig))
+		assert.Contains(t, err.Error(), envDBMaxPoolSize)
+		assert.Contains(t, err.Error(), envDBConnectTimeout)
+		assert.Contains(t, err.Error(), envDBTLS)
+	})
+
+	t.Run("validates the loaded config", func(t *testing.T) {
+		_, err := LoadDBConfig(map[string]interface{}{})
+		assert.EqualError(t, err, "invalid documentDB configuration: host is required")
+	})
+}
+
+func TestDBConfigValidate(t *testing.T) {
+	valid := DefaultDBConfig()
+	valid.Host = "localhost:27017"
+
+	tests := []struct {
+		name    string
+		change  func(config *DBConfig)
+		wantErr string
+	}{
+		{"defaults with a host", func(config *DBConfig) {}, ""},
+		{"plain local mongod", func(config *DBConfig) { config.TLS = false; config.CAFilePath = "" }, ""},
+		{"missing host and database", func(config *DBConfig) { config.Host = ""; config.Database = "" }, "host is required; database is required"},
+		{"username without password", func(config *DBConfig) { config.Username = "user" }, "username and password should be set together"},
+		{"unknown read preference", func(config *DBConfig) { config.ReadPreference = "closest" }, `read preference "closest" is not supported`},
+		{"no max pool size", func(config *DBConfig) { config.MaxPoolSize = 0 }, "max pool size should be positive"},
+		{"min pool above max", func(config *DBConfig) { config.MinPoolSize = 200 }, "min pool size 200 is above max pool size 100"},
+		{"timeouts", func(config *DBConfig) { config.ConnectTimeout = 0; config.QueryTimeout = -time.Second }, "connect timeout should be positive; query timeout should be positive"},
+		{"TLS without CA bundle", func(config *DBConfig) { config.CAFilePath = "" }, "CA file path is required when TLS is on"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := valid
+			test.change(&config)
+			err := config.Validate()
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrInvalidDBConfig))
+			assert.EqualError(t, err, "invalid documentDB configuration: "+test.wantErr)
+		})
+	}
+}
+
+func TestClientKeyChangesWithPassword(t *testing.T) {
+	config := DefaultDBConfig()
+	config.Host = "docdb:27017"
+	config.Username = "user"
+	config.Password = "old"
+	rotated := config
+	rotated.Password = "new"
+
+	assert.NotEqual(t, config.clientKey(), rotated.clientKey())
+	assert.Equal(t, config.clientKey(), config.clientKey())
+	assert.NotContains(t, config.clientKey(), config.Password)
+}
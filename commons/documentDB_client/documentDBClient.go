@@ -2,31 +2,31 @@ package documentDB_client
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/execution_path"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 const (
-	CaFilePath                    = "/rds-combined-ca-bundle.pem"
 	ConnectTimeout                = 5
 	QueryTimeout                  = 30
-	ConnectionStringTemplate      = "mongodb://%s:%s@%s/%s?replicaSet=rs0&readpreference=%s"
-	Database                      = "test"
 	WorkflowDataCollection        = "WorkflowData"
 	StepsDataCollection           = "StepsData"
-	success                       = "success"
-	failure                       = "failure"
-	Submitted                     = "submitted"
-	running                       = "running"
 	UpdateStepExecution           = "UpdateStepExecution"
 	UpdateWorkflowExecutionSteps  = "UpdateWorkflowExecutionSteps"
 	UpdateWorkflowExecutionStatus = "UpdateWorkflowExecutionStatus"
@@ -34,35 +34,49 @@ const (
 )
 
 var (
-	Username        string
-	Password        string
-	ClusterEndpoint string
-	ReadPreference  string
+	clientsMu sync.Mutex
+	clients   = map[string]*mongo.Client{}
 )
 
 type IDocDBClient interface {
 	FetchStepExecutionData(ctx context.Context, StepId string) (StepExecutionDataBody, error)
+	FetchStepsByWorkflow(ctx context.Context, workflowId string) ([]StepExecutionDataBody, error)
 	InsertStepExecutionData(ctx context.Context, StepExecutionData StepExecutionDataBody) error
 	InsertWorkflowExecutionData(ctx context.Context, Data WorkflowExecutionDataBody) error
 	UpdateDocumentDB(ctx context.Context, query, update interface{}, collectionName string) error
+	DeleteDocuments(ctx context.Context, query interface{}, collectionName string) (int64, error)
+	FetchDocuments(ctx context.Context, query interface{}, collectionName string) ([]bson.M, error)
+	InsertDocuments(ctx context.Context, documents []bson.M, collectionName string) error
 	FetchWorkflowExecutionData(ctx context.Context, workFlowId string) (WorkflowExecutionDataBody, error)
-	BuildQueryForCallBack(ctx context.Context, event, status, workflowID, stepID, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{})
-	BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName, stepID, status string, starttime int64, IsWaitTask bool) interface{}
+	BuildQueryForCallBack(ctx context.Context, event string, status enums.StepStatus, workflowID, stepID, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{})
+	BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName, stepID string, status enums.StepStatus, starttime int64, IsWaitTask bool) interface{}
 	CheckConnection(ctx context.Context) error
 	GetHipsterCountPerDay(ctx context.Context) (int64, error)
+	ReserveHipsterSlot(ctx context.Context, quota, workflowId string, limit int64, expireAt time.Time) (HipsterReservation, error)
+	ReleaseHipsterSlot(ctx context.Context, workflowId string) (bool, error)
+	FetchGeocode(ctx context.Context, location string) (GeocodeCacheBody, error)
+	SaveGeocode(ctx context.Context, geocode GeocodeCacheBody) error
 	GetTimedoutTask(ctx context.Context, WorkflowId string) string
 	FetchWorkflowExecutionDataByListOfWorkflows(ctx context.Context, SummaryFilters SummaryFilters, onlyWorkflowIds bool) ([]bson.M, error)
+	FetchWorkflowSummary(ctx context.Context, filters SummaryFilters) (WorkflowSummaryPage, error)
+	ReservePriorityLane(ctx context.Context, workflowId string, priority enums.Priority, limits LaneLimits) (bool, error)
+	ReleasePriorityLane(ctx context.Context, workflowId string) (bool, error)
+	FetchWorkflowMetrics(ctx context.Context, window TimeRange) (WorkflowMetrics, error)
+	BootstrapSchema(ctx context.Context, config SchemaConfig) ([]string, error)
+	FetchArchivalPolicy(ctx context.Context) (ArchivalPolicy, error)
 }
 
 type DocDBClient struct {
 	DBClient *mongo.Client
+	config   DBConfig
 }
 
 type WorkflowExecutionDataBody struct {
 	WorkflowId         string                   `json:"_id" bson:"_id"`
-	Status             string                   `bson:"status"`
+	Status             enums.WorkflowStatus     `bson:"status"`
 	OrderId            string                   `bson:"orderId"`
 	FlowType           string                   `bson:"flowType"`
+	Priority           enums.Priority           `bson:"priority,omitempty"`
 	UpdatedAt          int64                    `bson:"updatedAt"`
 	CreatedAt          int64                    `bson:"createdAt"`
 	FinishedAt         int64                    `bson:"finishedAt"`
@@ -70,6 +84,7 @@ type WorkflowExecutionDataBody struct {
 	InitialInput       map[string]interface{}   `bson:"initialInput"`
 	FinalOutput        map[string]interface{}   `bson:"finalOutput"`
 	StepsPassedThrough []StepsPassedThroughBody `bson:"stepsPassedThrough"`
+	RestoredAt         int64                    `bson:"restoredAt,omitempty"`
 }
 
 type StepExecutionDataBody struct {
@@ -80,56 +95,152 @@ type StepExecutionDataBody struct {
 	Input              interface{}            `bson:"input"`
 	Output             map[string]interface{} `bson:"output"`
 	IntermediateOutput map[string]interface{} `bson:"intermediateOutput"`
-	Status             string                 `bson:"status"`
+	Status             enums.StepStatus       `bson:"status"`
 	TaskToken          string                 `bson:"taskToken"`
 	WorkflowId         string                 `bson:"workflowId"`
 	TaskName           string                 `bson:"taskName"`
 	ReportId           string                 `bson:"reportId"`
+	CancelRequest      map[string]interface{} `bson:"cancelRequest,omitempty"`
+	Cancellation       *CancellationBody      `bson:"cancellation,omitempty"`
+}
+
+// CancellationBody records the outcome of cancelling the vendor job started by a step.
+type CancellationBody struct {
+	Status      string `bson:"status"`
+	Message     string `bson:"message"`
+	AttemptedAt int64  `bson:"attemptedAt"`
 }
 
 type StepsPassedThroughBody struct {
-	TaskName  string `bson:"taskName"`
-	StepId    string `bson:"stepId"`
-	StartTime int64  `bson:"startTime"`
-	Status    string `bson:"status"`
+	TaskName  string           `bson:"taskName"`
+	StepId    string           `bson:"stepId"`
+	StartTime int64            `bson:"startTime"`
+	Status    enums.StepStatus `bson:"status"`
 }
 
 type SummaryFilters struct {
-	OrderIDs    []string `json:"orderIds"`
-	WorkflowIDs []string `json:"workflowIds"`
-	Source      string   `json:"source"`
-	StartTime   int64    `json:"startTime"`
-	EndTime     int64    `json:"endTime"`
-	MaxCount    int64    `json:"maxCount"`
+	OrderIDs    []string   `json:"orderIds"`
+	WorkflowIDs []string   `json:"workflowIds"`
+	Source      string     `json:"source"`
+	StartTime   int64      `json:"startTime"`
+	EndTime     int64      `json:"endTime"`
+	MaxCount    int64      `json:"maxCount"`
+	ReportIDs   []string   `json:"reportIds"`
+	Statuses    []string   `json:"statuses"`
+	FlowTypes   []string   `json:"flowTypes"`
+	CreatedAt   *TimeRange `json:"createdAt"`
+	FinishedAt  *TimeRange `json:"finishedAt"`
+	// StuckInTask matches workflows still in progress whose task of that name has not called back yet
+	StuckInTask string `json:"stuckInTask"`
+	// Legacy keeps the original modes where MaxCount ignores the other filters and StartTime/EndTime are inverted
+	Legacy bool `json:"legacy"`
+	// PageSize and PageToken page through the summary, the token is the nextPageToken of the previous page
+	PageSize  int64    `json:"pageSize"`
+	PageToken string   `json:"pageToken"`
+	Fields    []string `json:"fields"`
+	SortBy    string   `json:"sortBy"`
+	SortOrder string   `json:"sortOrder"`
+}
+
+// TimeRange bounds a unix timestamp field, From is inclusive and To exclusive, a zero bound is open.
+type TimeRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
 }
 
 type WorkflowID struct {
 	WorkflowID string `json:"_id"`
 }
 
-func NewDBClientService(secrets map[string]interface{}) *DocDBClient {
-	Username = secrets["username"].(string)
-	Password = secrets["password"].(string)
-	ClusterEndpoint = fmt.Sprintf("%v:%v", secrets["host"], secrets["port"])
-	connectionURI := fmt.Sprintf(ConnectionStringTemplate, Username, Password, ClusterEndpoint, Database, ReadPreference)
-	tlsConfig, err := getCustomTLSConfig(CaFilePath)
+// NewDBClientService returns a client connected with config. Connections are pooled by the driver, so clients are
+// cached per endpoint and reused by every handler and warm invocation of the lambda instead of reconnecting.
+func NewDBClientService(ctx context.Context, config DBConfig) (*DocDBClient, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	key := config.clientKey()
+	if client, ok := clients[key]; ok {
+		return &DocDBClient{DBClient: client, config: config}, nil
+	}
+	clientOptions, err := config.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, config.ConnectTimeout)
+	defer cancel()
+	client, err := mongo.Connect(connectCtx, clientOptions)
+	if err != nil {
+		log.Errorf(ctx, "Failed connecting to %s: %v", config.Host, err)
+		return nil, err
+	}
+	clients[key] = client
+	return &DocDBClient{DBClient: client, config: config}, nil
+}
+
+// clientKey identifies a cached client, it carries a hash of the password so a rotated secret connects a new client
+// instead of reusing the stale credentials.
+func (config DBConfig) clientKey() string {
+	password := sha256.Sum256([]byte(config.Password))
+	return fmt.Sprintf("%s:%x/%s@%s?replicaSet=%s&readPreference=%s&tls=%t", config.Username, password[:8], config.Database, config.Host, config.ReplicaSet, config.ReadPreference, config.TLS)
+}
+
+func (config DBConfig) clientOptions() (*options.ClientOptions, error) {
+	mode, err := readpref.ModeFromString(config.ReadPreference)
 	if err != nil {
-		log.Errorf(context.Background(), "Failed getting TLS configuration: %v", err)
+		return nil, err
 	}
-	DBClient, err := mongo.NewClient(options.Client().ApplyURI(connectionURI).SetTLSConfig(tlsConfig))
+	readPreference, err := readpref.New(mode)
 	if err != nil {
-		log.Errorf(context.Background(), "Error= %v", err)
+		return nil, err
+	}
+	clientOptions := options.Client().
+		ApplyURI("mongodb://" + config.Host).
+		SetReadPreference(readPreference).
+		SetMinPoolSize(config.MinPoolSize).
+		SetMaxPoolSize(config.MaxPoolSize).
+		SetConnectTimeout(config.ConnectTimeout).
+		SetServerSelectionTimeout(config.ConnectTimeout)
+	if config.ReplicaSet != "" {
+		clientOptions.SetReplicaSet(config.ReplicaSet)
 	}
-	return &DocDBClient{DBClient: DBClient}
+	if config.Username != "" {
+		clientOptions.SetAuth(options.Credential{Username: config.Username, Password: config.Password})
+	}
+	if config.TLS {
+		tlsConfig, err := getCustomTLSConfig(config.CAFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading CA bundle %s: %v", ErrInvalidDBConfig, config.CAFilePath, err)
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+	return clientOptions, nil
 }
 
 func (DBClient *DocDBClient) CheckConnection(ctx context.Context) error {
-	return DBClient.DBClient.Connect(ctx)
+	return DBClient.DBClient.Ping(ctx, nil)
+}
+
+func (DBClient *DocDBClient) collection(name string) *mongo.Collection {
+	database := DBClient.config.Database
+	if database == "" {
+		database = DefaultDatabase
+	}
+	return DBClient.DBClient.Database(database).Collection(name)
+}
+
+func (DBClient *DocDBClient) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := DBClient.config.QueryTimeout
+	if timeout <= 0 {
+		timeout = QueryTimeout * time.Second
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 func (DBClient *DocDBClient) FetchStepExecutionData(ctx context.Context, StepId string) (StepExecutionDataBody, error) {
-	collection := DBClient.DBClient.Database(Database).Collection(StepsDataCollection)
+	collection := DBClient.collection(StepsDataCollection)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := DBClient.queryContext(ctx)
 	defer cancel()
 	var StepExecutionData StepExecutionDataBody
 	err := collection.FindOne(ctx, bson.M{"_id": StepId}).Decode(&StepExecutionData)
@@ -140,10 +251,26 @@ func (DBClient *DocDBClient) FetchStepExecutionData(ctx context.Context, StepId
 	log.Infof(ctx, "Exection Data: %+v", StepExecutionData)
 	return StepExecutionData, nil
 }
+func (DBClient *DocDBClient) FetchStepsByWorkflow(ctx context.Context, workflowId string) ([]StepExecutionDataBody, error) {
+	collection := DBClient.collection(StepsDataCollection)
+
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	steps := []StepExecutionDataBody{}
+	curr, err := collection.Find(ctx, bson.M{"workflowId": workflowId}, options.Find().SetSort(bson.D{{Key: "startTime", Value: 1}}))
+	if err != nil {
+		log.Errorf(ctx, "Failed to run find query: %v", err)
+		return steps, err
+	}
+	if err = curr.All(ctx, &steps); err != nil {
+		log.Errorf(ctx, "Failed to decode steps: %v", err)
+	}
+	return steps, err
+}
 func (DBClient *DocDBClient) InsertStepExecutionData(ctx context.Context, StepExecutionData StepExecutionDataBody) error {
-	collection := DBClient.DBClient.Database(Database).Collection(StepsDataCollection)
+	collection := DBClient.collection(StepsDataCollection)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := DBClient.queryContext(ctx)
 	defer cancel()
 	res, err := collection.InsertOne(ctx, StepExecutionData)
 	if err != nil {
@@ -155,9 +282,9 @@ func (DBClient *DocDBClient) InsertStepExecutionData(ctx context.Context, StepEx
 	return nil
 }
 func (DBClient *DocDBClient) InsertWorkflowExecutionData(ctx context.Context, Data WorkflowExecutionDataBody) error {
-	collection := DBClient.DBClient.Database(Database).Collection(WorkflowDataCollection)
+	collection := DBClient.collection(WorkflowDataCollection)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := DBClient.queryContext(ctx)
 	defer cancel()
 	res, err := collection.InsertOne(ctx, Data)
 	if err != nil {
@@ -169,9 +296,9 @@ func (DBClient *DocDBClient) InsertWorkflowExecutionData(ctx context.Context, Da
 	return nil
 }
 func (DBClient *DocDBClient) UpdateDocumentDB(ctx context.Context, query, update interface{}, collectionName string) error {
-	collection := DBClient.DBClient.Database(Database).Collection(collectionName)
+	collection := DBClient.collection(collectionName)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := DBClient.queryContext(ctx)
 	defer cancel()
 
 	res, err := collection.UpdateMany(ctx, query, update)
@@ -181,15 +308,84 @@ func (DBClient *DocDBClient) UpdateDocumentDB(ctx context.Context, query, update
 		return err
 	}
 	if res.MatchedCount == 0 {
+		if err = unmatchedUpdateError(query); err != nil {
+			log.Errorf(ctx, "Rejected update: %v", err)
+			return err
+		}
 		log.Errorf(ctx, "Unable to update document as no such document exist")
 	}
 	log.Infof(ctx, "Updated document ID: %s", res.UpsertedID)
 	return nil
 }
+
+// unmatchedUpdateError reports an update guarded by a StepTransitionFilter that matched nothing as an illegal
+// transition, the step already finished or does not exist. Other updates matching nothing are not an error.
+func unmatchedUpdateError(query interface{}) error {
+	filter, ok := query.(StepTransitionFilter)
+	if !ok {
+		return nil
+	}
+	return error_handler.NewServiceError(error_codes.IllegalStepStatusTransition, fmt.Sprintf("no step matching %v can move to the new status", bson.M(filter)))
+}
+func (DBClient *DocDBClient) DeleteDocuments(ctx context.Context, query interface{}, collectionName string) (int64, error) {
+	collection := DBClient.collection(collectionName)
+
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+
+	res, err := collection.DeleteMany(ctx, query)
+	if err != nil {
+		log.Errorf(ctx, "Failed to delete documents: %v", err)
+		return 0, err
+	}
+	log.Infof(ctx, "Deleted %d documents from %s", res.DeletedCount, collectionName)
+	return res.DeletedCount, nil
+}
+
+// FetchDocuments returns the documents matching query as stored, fields unknown to the typed bodies included.
+func (DBClient *DocDBClient) FetchDocuments(ctx context.Context, query interface{}, collectionName string) ([]bson.M, error) {
+	collection := DBClient.collection(collectionName)
+
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+
+	documents := []bson.M{}
+	curr, err := collection.Find(ctx, query)
+	if err != nil {
+		log.Errorf(ctx, "Failed to run find query: %v", err)
+		return documents, err
+	}
+	if err = curr.All(ctx, &documents); err != nil {
+		log.Errorf(ctx, "Failed to decode documents from %s: %v", collectionName, err)
+	}
+	return documents, err
+}
+
+func (DBClient *DocDBClient) InsertDocuments(ctx context.Context, documents []bson.M, collectionName string) error {
+	if len(documents) == 0 {
+		return nil
+	}
+	collection := DBClient.collection(collectionName)
+
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+
+	many := make([]interface{}, len(documents))
+	for i, document := range documents {
+		many[i] = document
+	}
+	res, err := collection.InsertMany(ctx, many)
+	if err != nil {
+		log.Errorf(ctx, "Failed to insert documents: %v", err)
+		return err
+	}
+	log.Infof(ctx, "Inserted %d documents into %s", len(res.InsertedIDs), collectionName)
+	return nil
+}
 func (DBClient *DocDBClient) FetchWorkflowExecutionData(ctx context.Context, workFlowId string) (WorkflowExecutionDataBody, error) {
-	collection := DBClient.DBClient.Database(Database).Collection(WorkflowDataCollection)
+	collection := DBClient.collection(WorkflowDataCollection)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := DBClient.queryContext(ctx)
 	defer cancel()
 	var WorkflowExecutionData WorkflowExecutionDataBody
 	err := collection.FindOne(ctx, bson.M{"_id": workFlowId}).Decode(&WorkflowExecutionData)
@@ -201,11 +397,10 @@ func (DBClient *DocDBClient) FetchWorkflowExecutionData(ctx context.Context, wor
 }
 
 func (db *DocDBClient) FetchWorkflowExecutionDataByListOfWorkflows(ctx context.Context, SummaryFilters SummaryFilters, onlyWorkflowIds bool) ([]bson.M, error) {
-	collection := db.DBClient.Database(Database).Collection(WorkflowDataCollection)
+	collection := db.collection(WorkflowDataCollection)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := db.queryContext(ctx)
 	defer cancel()
-	finalQuery := bson.M{}
 	var results []bson.M
 	findOptions := options.Find()
 	if onlyWorkflowIds {
@@ -214,8 +409,31 @@ func (db *DocDBClient) FetchWorkflowExecutionDataByListOfWorkflows(ctx context.C
 	if SummaryFilters.MaxCount != 0 {
 		findOptions.SetLimit(SummaryFilters.MaxCount)
 		findOptions.SetSort(bson.D{{"createdAt", -1}})
-		finalQuery = bson.M{"initialInput.source": SummaryFilters.Source}
+	}
+	finalQuery, err := buildSummaryQuery(ctx, SummaryFilters)
+	if err != nil {
+		return results, err
+	}
+	log.Infof(ctx, "Final Query: %+v", finalQuery)
+	curr, err := collection.Find(ctx, finalQuery, findOptions)
+	if err != nil {
+		log.Errorf(ctx, "Failed to run find query: %v", err)
+		return results, err
+	}
+
+	// check for errors in the conversion
+	if err = curr.All(ctx, &results); err != nil {
+		log.Errorf(ctx, "Failed to run find query: %v", err)
+	}
+	return results, err
+}
 
+// legacySummaryQuery is the original translation where MaxCount only keeps the source filter
+// and StartTime/EndTime select createdAt below StartTime and above EndTime.
+func legacySummaryQuery(SummaryFilters SummaryFilters) bson.M {
+	finalQuery := bson.M{}
+	if SummaryFilters.MaxCount != 0 {
+		finalQuery = bson.M{"initialInput.source": SummaryFilters.Source}
 	} else if SummaryFilters.EndTime != 0 {
 		if SummaryFilters.StartTime != 0 {
 			finalQuery = bson.M{"createdAt": bson.M{"$lt": SummaryFilters.StartTime, "$gt": SummaryFilters.EndTime}, "initialInput.source": SummaryFilters.Source}
@@ -240,36 +458,21 @@ func (db *DocDBClient) FetchWorkflowExecutionDataByListOfWorkflows(ctx context.C
 		}
 		finalQuery = bson.M{"$and": queryArray}
 	}
-	log.Infof(ctx, "Final Query: %+v", finalQuery)
-	curr, err := collection.Find(ctx, finalQuery, findOptions)
-	if err != nil {
-		log.Errorf(ctx, "Failed to run find query: %v", err)
-		return results, err
-	}
-
-	// check for errors in the conversion
-	if err = curr.All(ctx, &results); err != nil {
-		log.Errorf(ctx, "Failed to run find query: %v", err)
-	}
-	return results, err
+	return finalQuery
 }
 
-func (DBClient *DocDBClient) BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName, stepID, status string, starttime int64, IsWaitTask bool) interface{} {
+func (DBClient *DocDBClient) BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName, stepID string, status enums.StepStatus, starttime int64, IsWaitTask bool) interface{} {
 	var setrecord interface{}
-	var stepstatus string = failure
+	stepstatus := enums.StepStatusAfterCallout(IsWaitTask, status == enums.StepSuccess)
 	updatedAt := time.Now().Unix()
-	if IsWaitTask && status == success {
-		stepstatus = running
+	if stepstatus == enums.StepRunning {
 		setrecord = bson.M{
 			"updatedAt": updatedAt,
 			"runningState": bson.M{
-				TaskName: Submitted,
+				TaskName: enums.StepSubmitted,
 			},
 		}
 	} else {
-		if !IsWaitTask && status == success {
-			stepstatus = success
-		}
 		setrecord = bson.M{
 			"updatedAt": updatedAt,
 		}
@@ -286,12 +489,20 @@ func (DBClient *DocDBClient) BuildQueryForUpdateWorkflowDataCallout(ctx context.
 		"$set": setrecord,
 	}
 }
-func (DBClient *DocDBClient) BuildQueryForCallBack(ctx context.Context, event, status, workflowID, stepID, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{}) {
+
+// StepTransitionFilter matches a step only while it can still move to the status being set, UpdateDocumentDB
+// returns IllegalStepStatusTransition when an update with it matches nothing.
+type StepTransitionFilter bson.M
+
+// BuildQueryForCallBack filters only match while the step can still move to status,
+// so an illegal transition such as failure to success leaves the document untouched and is reported by UpdateDocumentDB.
+func (DBClient *DocDBClient) BuildQueryForCallBack(ctx context.Context, event string, status enums.StepStatus, workflowID, stepID, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{}) {
 	var filter interface{}
 	var query interface{}
 	if event == UpdateStepExecution {
-		filter = bson.M{
-			"_id": stepID,
+		filter = StepTransitionFilter{
+			"_id":    stepID,
+			"status": stepTransitionCondition(status),
 		}
 		query = bson.M{
 			"$set": bson.M{
@@ -301,9 +512,14 @@ func (DBClient *DocDBClient) BuildQueryForCallBack(ctx context.Context, event, s
 			},
 		}
 	} else if event == UpdateWorkflowExecutionSteps {
-		filter = bson.M{
-			"_id":                       workflowID,
-			"stepsPassedThrough.stepId": stepID,
+		filter = StepTransitionFilter{
+			"_id": workflowID,
+			"stepsPassedThrough": bson.M{
+				"$elemMatch": bson.M{
+					"stepId": stepID,
+					"status": stepTransitionCondition(status),
+				},
+			},
 		}
 
 		query = bson.M{
@@ -312,8 +528,9 @@ func (DBClient *DocDBClient) BuildQueryForCallBack(ctx context.Context, event, s
 			},
 		}
 	} else if event == UpdateWorkflowExecutionStatus {
-		filter = bson.M{
-			"_id": workflowID,
+		filter = StepTransitionFilter{
+			"_id":                      workflowID,
+			"runningState." + TaskName: stepTransitionCondition(status),
 		}
 		query = bson.M{
 			"$set": bson.M{
@@ -326,6 +543,35 @@ func (DBClient *DocDBClient) BuildQueryForCallBack(ctx context.Context, event, s
 	}
 	return filter, query
 }
+
+// WorkflowTransitionFilter matches the workflow only while it can still move to status.
+func WorkflowTransitionFilter(workflowID string, status enums.WorkflowStatus) bson.M {
+	from := bson.A{}
+	for _, s := range enums.WorkflowStatusesBefore(status) {
+		if s == "" {
+			from = append(from, nil)
+		}
+		from = append(from, s)
+	}
+	return bson.M{
+		"_id":    workflowID,
+		"status": bson.M{"$in": from},
+	}
+}
+
+// stepTransitionCondition matches a step status field holding any status that can move to next,
+// a missing field is treated as a step that is not recorded yet.
+func stepTransitionCondition(next enums.StepStatus) bson.M {
+	from := bson.A{}
+	for _, s := range enums.StepStatusesBefore(next) {
+		if s == "" {
+			from = append(from, nil)
+		}
+		from = append(from, s)
+	}
+	return bson.M{"$in": from}
+}
+
 func getCustomTLSConfig(caFile string) (*tls.Config, error) {
 	tlsConfig := new(tls.Config)
 	certs, err := ioutil.ReadFile(caFile)
@@ -341,28 +587,35 @@ func getCustomTLSConfig(caFile string) (*tls.Config, error) {
 }
 
 func (DBClient *DocDBClient) GetHipsterCountPerDay(ctx context.Context) (int64, error) {
-	collection := DBClient.DBClient.Database(Database).Collection(WorkflowDataCollection)
+	collection := DBClient.collection(WorkflowDataCollection)
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeout*time.Second)
+	ctx, cancel := DBClient.queryContext(ctx)
 	defer cancel()
-	endedTime := time.Now().Unix()
-	loc, err := time.LoadLocation(PSTTimeZone)
+	query, err := hipsterCountQuery(time.Now())
 	if err != nil {
 		log.Errorf(ctx, "Failed to load time location: %v", err)
 		return 0, err
 	}
-	y, m, d := (time.Now().In(loc).Date())
-	pst_midnight := time.Date(y, m, d, 0, 0, 1, 0, loc).Unix()
-	startTime := pst_midnight
-
-	count, err := collection.CountDocuments(ctx, bson.M{"createdAt": bson.M{"$gt": startTime, "$lt": endedTime}, "flowType": "Hipster"})
-	log.Infof(ctx, "No of documents with flowtype as hipster = %v since  %+v = ", count, startTime)
+	count, err := collection.CountDocuments(ctx, query)
+	log.Infof(ctx, "No of documents with flowtype as hipster = %v, query %+v", count, query)
 	if err != nil {
 		log.Errorf(ctx, "Failed to run find query: %v", err)
 		return 0, err
 	}
 	return count, nil
 }
+
+// hipsterCountQuery matches the Hipster workflows created since midnight PST.
+func hipsterCountQuery(now time.Time) (bson.M, error) {
+	loc, err := time.LoadLocation(PSTTimeZone)
+	if err != nil {
+		return nil, err
+	}
+	y, m, d := (now.In(loc).Date())
+	pst_midnight := time.Date(y, m, d, 0, 0, 1, 0, loc).Unix()
+	return bson.M{"createdAt": bson.M{"$gt": pst_midnight, "$lt": now.Unix()}, "flowType": execution_path.Hipster}, nil
+}
+
 func (DBClient *DocDBClient) GetTimedoutTask(ctx context.Context, WorkflowId string) string {
 	wfExecData, err := DBClient.FetchWorkflowExecutionData(ctx, WorkflowId)
 	if err != nil {
@@ -371,7 +624,7 @@ func (DBClient *DocDBClient) GetTimedoutTask(ctx context.Context, WorkflowId str
 	}
 	var timedOutStep *StepsPassedThroughBody
 	for _, state := range wfExecData.StepsPassedThrough {
-		if state.Status == running {
+		if state.Status == enums.StepRunning {
 			timedOutStep = &state
 			break
 		}
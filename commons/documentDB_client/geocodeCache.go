@@ -0,0 +1,57 @@
+package documentDB_client
+
+import (
+	"context"
+	"time"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const GeocodeCacheCollection = "GeocodeCache"
+
+// GeocodeCacheBody is a reverse geocoding result stored under the rounded coordinates it was asked for. Provider
+// is the geocoder that answered, ExpireAt the date after which the result is no longer used.
+type GeocodeCacheBody struct {
+	Location  string     `bson:"_id"`
+	Address   string     `bson:"address"`
+	ParcelId  string     `bson:"parcelId"`
+	Provider  string     `bson:"provider"`
+	CreatedAt int64      `bson:"createdAt"`
+	ExpireAt  *time.Time `bson:"expireAt,omitempty"`
+}
+
+// FetchGeocode returns the result cached for location, mongo.ErrNoDocuments when there is none or it expired
+// but was not removed by the TTL index yet.
+func (DBClient *DocDBClient) FetchGeocode(ctx context.Context, location string) (GeocodeCacheBody, error) {
+	collection := DBClient.collection(GeocodeCacheCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	var geocode GeocodeCacheBody
+	err := collection.FindOne(ctx, bson.M{"_id": location}).Decode(&geocode)
+	if err != nil {
+		return GeocodeCacheBody{}, err
+	}
+	if geocode.expired(time.Now()) {
+		return GeocodeCacheBody{}, mongo.ErrNoDocuments
+	}
+	return geocode, nil
+}
+
+// SaveGeocode stores geocode, replacing the result cached for the same location.
+func (DBClient *DocDBClient) SaveGeocode(ctx context.Context, geocode GeocodeCacheBody) error {
+	collection := DBClient.collection(GeocodeCacheCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": geocode.Location}, geocode, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Errorf(ctx, "Failed to save the geocode of %s: %v", geocode.Location, err)
+	}
+	return err
+}
+
+func (geocode GeocodeCacheBody) expired(now time.Time) bool {
+	return geocode.ExpireAt != nil && !geocode.ExpireAt.After(now)
+}
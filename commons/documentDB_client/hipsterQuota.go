@@ -0,0 +1,176 @@
+package documentDB_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const HipsterQuotaCollection = "HipsterQuota"
+
+// maxHipsterSlotAttempts bounds the reservations lost to other workflows reserving in the same quota at once.
+const maxHipsterSlotAttempts = 10
+
+// HipsterQuotaBody counts the Hipster slots taken in one quota, such as a throttle rule over one day or hour. Count
+// always equals the number of workflows holding a slot so a conditional increment on it can never go over the limit.
+// Issued is the number of slots handed out in the window, released ones included, and only grows, Slots keeps the
+// number each holder was given. ExpireAt lets the TTL index remove the quota some time after its window is over.
+type HipsterQuotaBody struct {
+	Quota       string        `bson:"_id"`
+	Count       int64         `bson:"count"`
+	Issued      int64         `bson:"issued"`
+	WorkflowIds []string      `bson:"workflowIds"`
+	Slots       []HipsterSlot `bson:"slots"`
+	ExpireAt    time.Time     `bson:"expireAt"`
+}
+
+// HipsterSlot is the slot number given to a workflow when it reserved, releases of other workflows leave it as is.
+type HipsterSlot struct {
+	WorkflowId string `bson:"workflowId"`
+	Slot       int64  `bson:"slot"`
+}
+
+// HipsterReservation is the outcome of ReserveHipsterSlot. Slot is the 1 based number the workflow was given in the
+// quota and is 0 when no slot was reserved, Count is the number of slots held after the call.
+type HipsterReservation struct {
+	Quota    string
+	Slot     int64
+	Count    int64
+	Reserved bool
+}
+
+// ReserveHipsterSlot atomically takes one of the limit slots of quota for workflowId. A workflow already holding
+// a slot gets the same slot back, so a retried throttle task does not take two. The quota is kept until expireAt.
+func (DBClient *DocDBClient) ReserveHipsterSlot(ctx context.Context, quota, workflowId string, limit int64, expireAt time.Time) (HipsterReservation, error) {
+	collection := DBClient.collection(HipsterQuotaCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+
+	// an attempt is only repeated when another workflow reserved in the quota or created it between our reads
+	for attempt := 0; attempt < maxHipsterSlotAttempts; attempt++ {
+		var counter HipsterQuotaBody
+		err := collection.FindOne(ctx, bson.M{"_id": quota}).Decode(&counter)
+		if err == nil {
+			if counter.holds(workflowId) || counter.Count >= limit {
+				return counter.reservation(workflowId), nil
+			}
+			err = collection.FindOneAndUpdate(ctx, reserveHipsterSlotFilter(counter, workflowId, limit), reserveHipsterSlotUpdate(counter, workflowId, expireAt),
+				options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&counter)
+			if err == nil {
+				return counter.reservation(workflowId), nil
+			}
+			if !errors.Is(err, mongo.ErrNoDocuments) {
+				log.Errorf(ctx, "Failed to reserve a hipster slot: %v", err)
+				return HipsterReservation{Quota: quota}, err
+			}
+			continue
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Errorf(ctx, "Failed to fetch the hipster quota: %v", err)
+			return HipsterReservation{Quota: quota}, err
+		}
+		if limit <= 0 {
+			return HipsterReservation{Quota: quota}, nil
+		}
+		counter = newHipsterQuota(quota, workflowId, expireAt)
+		_, err = collection.InsertOne(ctx, counter)
+		if err == nil {
+			return counter.reservation(workflowId), nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Errorf(ctx, "Failed to create the hipster quota: %v", err)
+			return HipsterReservation{Quota: quota}, err
+		}
+	}
+	return HipsterReservation{Quota: quota}, fmt.Errorf("hipster quota %s kept changing while reserving a slot", quota)
+}
+
+// ReleaseHipsterSlot frees every slot held by workflowId, whatever the quota it was reserved in. It returns false
+// when the workflow holds no slot, which makes releasing twice harmless.
+func (DBClient *DocDBClient) ReleaseHipsterSlot(ctx context.Context, workflowId string) (bool, error) {
+	collection := DBClient.collection(HipsterQuotaCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	result, err := collection.UpdateMany(ctx, releaseHipsterSlotFilter(workflowId), releaseHipsterSlotUpdate(workflowId))
+	if err != nil {
+		log.Errorf(ctx, "Failed to release the hipster slot: %v", err)
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func newHipsterQuota(quota, workflowId string, expireAt time.Time) HipsterQuotaBody {
+	return HipsterQuotaBody{Quota: quota, Count: 1, Issued: 1, WorkflowIds: []string{workflowId}, Slots: []HipsterSlot{{WorkflowId: workflowId, Slot: 1}}, ExpireAt: expireAt}
+}
+
+// reserveHipsterSlotFilter only matches the quota as it was read, so the slot number computed from it is not
+// handed out twice. Quotas stored before slots were numbered have no issued count yet.
+func reserveHipsterSlotFilter(counter HipsterQuotaBody, workflowId string, limit int64) bson.M {
+	filter := bson.M{"_id": counter.Quota, "count": bson.M{"$lt": limit}, "workflowIds": bson.M{"$ne": workflowId}, "issued": counter.Issued}
+	if counter.Issued == 0 {
+		filter["issued"] = bson.M{"$exists": false}
+	}
+	return filter
+}
+
+// the expiry is set on every reservation so quotas stored before they had one expire as well
+func reserveHipsterSlotUpdate(counter HipsterQuotaBody, workflowId string, expireAt time.Time) bson.M {
+	slot := counter.nextSlot()
+	return bson.M{
+		"$inc":  bson.M{"count": 1},
+		"$push": bson.M{"workflowIds": workflowId, "slots": HipsterSlot{WorkflowId: workflowId, Slot: slot}},
+		"$set":  bson.M{"issued": slot, ExpireAtField: expireAt},
+	}
+}
+
+func releaseHipsterSlotFilter(workflowId string) bson.M {
+	return bson.M{"workflowIds": workflowId}
+}
+
+func releaseHipsterSlotUpdate(workflowId string) bson.M {
+	return bson.M{"$inc": bson.M{"count": -1}, "$pull": bson.M{"workflowIds": workflowId, "slots": bson.M{"workflowId": workflowId}}}
+}
+
+// nextSlot numbers the next reservation, quotas stored before slots were numbered continue after their holders.
+func (counter HipsterQuotaBody) nextSlot() int64 {
+	if counter.Issued == 0 {
+		return counter.Count + 1
+	}
+	return counter.Issued + 1
+}
+
+func (counter HipsterQuotaBody) holds(workflowId string) bool {
+	for _, id := range counter.WorkflowIds {
+		if id == workflowId {
+			return true
+		}
+	}
+	return false
+}
+
+// reservation reports the slot number stored for workflowId, holders of quotas stored before slots were numbered
+// get their position instead.
+func (counter HipsterQuotaBody) reservation(workflowId string) HipsterReservation {
+	reservation := HipsterReservation{Quota: counter.Quota, Count: counter.Count}
+	for _, slot := range counter.Slots {
+		if slot.WorkflowId == workflowId {
+			reservation.Slot = slot.Slot
+			reservation.Reserved = true
+			return reservation
+		}
+	}
+	for i, id := range counter.WorkflowIds {
+		if id == workflowId {
+			reservation.Slot = int64(i + 1)
+			reservation.Reserved = true
+			break
+		}
+	}
+	return reservation
+}
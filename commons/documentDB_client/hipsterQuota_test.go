@@ -0,0 +1,48 @@
+package documentDB_client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestReserveHipsterSlotKeepsSlotsAcrossReleases(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDocDBClient()
+	reserve := func(workflowId string) HipsterReservation {
+		reservation, err := db.ReserveHipsterSlot(ctx, "daily", workflowId, 3, time.Time{})
+		assert.NoError(t, err)
+		return reservation
+	}
+	for _, workflowId := range []string{"wf-1", "wf-2", "wf-3"} {
+		assert.True(t, reserve(workflowId).Reserved)
+	}
+	assert.Equal(t, HipsterReservation{Quota: "daily", Count: 3}, reserve("wf-4"))
+
+	released, err := db.ReleaseHipsterSlot(ctx, "wf-1")
+	assert.NoError(t, err)
+	assert.True(t, released)
+	// the next workflow is numbered after every slot handed out, the holders keep theirs
+	assert.Equal(t, HipsterReservation{Quota: "daily", Slot: 4, Count: 3, Reserved: true}, reserve("wf-4"))
+	assert.Equal(t, HipsterReservation{Quota: "daily", Slot: 2, Count: 3, Reserved: true}, reserve("wf-2"))
+	assert.Equal(t, HipsterReservation{Quota: "daily", Slot: 3, Count: 3, Reserved: true}, reserve("wf-3"))
+}
+
+func TestReserveHipsterSlotInQuotaStoredWithoutSlots(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDocDBClient()
+	assert.NoError(t, db.insert(HipsterQuotaCollection, bson.M{"_id": "daily", "count": int64(2), "workflowIds": bson.A{"wf-1", "wf-2"}}))
+
+	reservation, err := db.ReserveHipsterSlot(ctx, "daily", "wf-2", 5, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, HipsterReservation{Quota: "daily", Slot: 2, Count: 2, Reserved: true}, reservation)
+	reservation, err = db.ReserveHipsterSlot(ctx, "daily", "wf-3", 5, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, HipsterReservation{Quota: "daily", Slot: 3, Count: 3, Reserved: true}, reservation)
+	reservation, err = db.ReserveHipsterSlot(ctx, "daily", "wf-4", 5, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, HipsterReservation{Quota: "daily", Slot: 4, Count: 4, Reserved: true}, reservation)
+}
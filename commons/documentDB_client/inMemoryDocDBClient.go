@@ -0,0 +1,548 @@
+package documentDB_client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const duplicateKeyErrorCode = 11000
+
+// InMemoryDocDBClient is an IDocDBClient keeping WorkflowData and StepsData in memory. It evaluates the queries
+// and applies the updates built by this package to the stored documents, so tests can chain lambdas against it
+// and assert on the resulting documents instead of on mock expectations.
+type InMemoryDocDBClient struct {
+	mu          sync.Mutex
+	collections map[string][]bson.M
+	indexes     map[string]bool
+	builder     DocDBClient
+}
+
+var _ IDocDBClient = (*InMemoryDocDBClient)(nil)
+
+func NewInMemoryDocDBClient() *InMemoryDocDBClient {
+	return &InMemoryDocDBClient{
+		collections: map[string][]bson.M{},
+		indexes:     map[string]bool{},
+	}
+}
+
+func (db *InMemoryDocDBClient) CheckConnection(ctx context.Context) error {
+	return nil
+}
+
+func (db *InMemoryDocDBClient) BootstrapSchema(ctx context.Context, config SchemaConfig) ([]string, error) {
+	created := []string{}
+	var policy bson.M
+	if config.Archival != nil {
+		if err := config.Archival.Validate(); err != nil {
+			return created, err
+		}
+		doc, err := normalizeDocument(config.Archival)
+		if err != nil {
+			return created, err
+		}
+		doc["_id"] = archivalPolicyId
+		policy = doc
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, spec := range RequiredIndexes(config) {
+		name := spec.Collection + "." + spec.Name
+		if !db.indexes[name] {
+			db.indexes[name] = true
+			created = append(created, name)
+		}
+	}
+	if policy != nil {
+		db.collections[SchemaPolicyCollection] = []bson.M{policy}
+	}
+	return created, nil
+}
+
+func (db *InMemoryDocDBClient) FetchArchivalPolicy(ctx context.Context) (ArchivalPolicy, error) {
+	var policy ArchivalPolicy
+	err := db.findOne(SchemaPolicyCollection, bson.M{"_id": archivalPolicyId}, &policy)
+	return policy, err
+}
+
+func (db *InMemoryDocDBClient) InsertStepExecutionData(ctx context.Context, StepExecutionData StepExecutionDataBody) error {
+	return db.insert(StepsDataCollection, StepExecutionData)
+}
+
+func (db *InMemoryDocDBClient) InsertWorkflowExecutionData(ctx context.Context, Data WorkflowExecutionDataBody) error {
+	return db.insert(WorkflowDataCollection, Data)
+}
+
+func (db *InMemoryDocDBClient) FetchStepExecutionData(ctx context.Context, StepId string) (StepExecutionDataBody, error) {
+	var step StepExecutionDataBody
+	err := db.findOne(StepsDataCollection, bson.M{"_id": StepId}, &step)
+	return step, err
+}
+
+func (db *InMemoryDocDBClient) FetchStepsByWorkflow(ctx context.Context, workflowId string) ([]StepExecutionDataBody, error) {
+	steps := []StepExecutionDataBody{}
+	docs, err := db.find(StepsDataCollection, bson.M{"workflowId": workflowId}, bson.D{{Key: "startTime", Value: 1}}, nil, 0)
+	if err != nil {
+		return steps, err
+	}
+	err = decodeDocuments(docs, &steps)
+	return steps, err
+}
+
+func (db *InMemoryDocDBClient) FetchWorkflowExecutionData(ctx context.Context, workFlowId string) (WorkflowExecutionDataBody, error) {
+	var workflow WorkflowExecutionDataBody
+	err := db.findOne(WorkflowDataCollection, bson.M{"_id": workFlowId}, &workflow)
+	return workflow, err
+}
+
+// UpdateDocumentDB applies update to every matching document like UpdateMany, matching nothing is only an error
+// for a StepTransitionFilter.
+func (db *InMemoryDocDBClient) UpdateDocumentDB(ctx context.Context, query, update interface{}, collectionName string) error {
+	filter, err := normalizeDocument(query)
+	if err != nil {
+		return err
+	}
+	changes, err := normalizeDocument(update)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	matched := false
+	for _, doc := range db.collections[collectionName] {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matched = true
+			if err = applyUpdate(doc, changes, filter); err != nil {
+				return err
+			}
+		}
+	}
+	if !matched {
+		return unmatchedUpdateError(query)
+	}
+	return nil
+}
+
+func (db *InMemoryDocDBClient) DeleteDocuments(ctx context.Context, query interface{}, collectionName string) (int64, error) {
+	filter, err := normalizeDocument(query)
+	if err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	kept := []bson.M{}
+	for _, doc := range db.collections[collectionName] {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			kept = append(kept, doc)
+		}
+	}
+	deleted := int64(len(db.collections[collectionName]) - len(kept))
+	db.collections[collectionName] = kept
+	return deleted, nil
+}
+
+func (db *InMemoryDocDBClient) FetchDocuments(ctx context.Context, query interface{}, collectionName string) ([]bson.M, error) {
+	filter, err := normalizeDocument(query)
+	if err != nil {
+		return nil, err
+	}
+	return db.find(collectionName, filter, nil, nil, 0)
+}
+
+func (db *InMemoryDocDBClient) InsertDocuments(ctx context.Context, documents []bson.M, collectionName string) error {
+	for _, document := range documents {
+		if err := db.insert(collectionName, document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *InMemoryDocDBClient) BuildQueryForCallBack(ctx context.Context, event string, status enums.StepStatus, workflowID, stepID, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{}) {
+	return db.builder.BuildQueryForCallBack(ctx, event, status, workflowID, stepID, TaskName, callbackResponse)
+}
+
+func (db *InMemoryDocDBClient) BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName, stepID string, status enums.StepStatus, starttime int64, IsWaitTask bool) interface{} {
+	return db.builder.BuildQueryForUpdateWorkflowDataCallout(ctx, TaskName, stepID, status, starttime, IsWaitTask)
+}
+
+func (db *InMemoryDocDBClient) GetHipsterCountPerDay(ctx context.Context) (int64, error) {
+	query, err := hipsterCountQuery(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	docs, err := db.find(WorkflowDataCollection, query, nil, nil, 0)
+	return int64(len(docs)), err
+}
+
+// ReserveHipsterSlot runs the reservation of the DocumentDB client under the client lock, which stands in for
+// the atomicity of find-and-modify.
+func (db *InMemoryDocDBClient) ReserveHipsterSlot(ctx context.Context, quota, workflowId string, limit int64, expireAt time.Time) (HipsterReservation, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, doc := range db.collections[HipsterQuotaCollection] {
+		if !valuesEqual(doc["_id"], quota) {
+			continue
+		}
+		var counter HipsterQuotaBody
+		if err := decodeDocument(doc, &counter); err != nil {
+			return HipsterReservation{Quota: quota}, err
+		}
+		if counter.holds(workflowId) || counter.Count >= limit {
+			return counter.reservation(workflowId), nil
+		}
+		filter, err := normalizeDocument(reserveHipsterSlotFilter(counter, workflowId, limit))
+		if err != nil {
+			return HipsterReservation{Quota: quota}, err
+		}
+		update, err := normalizeDocument(reserveHipsterSlotUpdate(counter, workflowId, expireAt))
+		if err != nil {
+			return HipsterReservation{Quota: quota}, err
+		}
+		if err = applyUpdate(doc, update, filter); err != nil {
+			return HipsterReservation{Quota: quota}, err
+		}
+		err = decodeDocument(doc, &counter)
+		return counter.reservation(workflowId), err
+	}
+	if limit <= 0 {
+		return HipsterReservation{Quota: quota}, nil
+	}
+	counter := newHipsterQuota(quota, workflowId, expireAt)
+	doc, err := normalizeDocument(counter)
+	if err != nil {
+		return HipsterReservation{Quota: quota}, err
+	}
+	db.collections[HipsterQuotaCollection] = append(db.collections[HipsterQuotaCollection], doc)
+	return counter.reservation(workflowId), nil
+}
+
+func (db *InMemoryDocDBClient) ReleaseHipsterSlot(ctx context.Context, workflowId string) (bool, error) {
+	filter, err := normalizeDocument(releaseHipsterSlotFilter(workflowId))
+	if err != nil {
+		return false, err
+	}
+	update, err := normalizeDocument(releaseHipsterSlotUpdate(workflowId))
+	if err != nil {
+		return false, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	released := false
+	for _, doc := range db.collections[HipsterQuotaCollection] {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return released, err
+		}
+		if ok {
+			if err = applyUpdate(doc, update, filter); err != nil {
+				return released, err
+			}
+			released = true
+		}
+	}
+	return released, nil
+}
+
+// ReservePriorityLane runs the reservation of the DocumentDB client under the client lock, which stands in for
+// the atomicity of find-and-modify.
+func (db *InMemoryDocDBClient) ReservePriorityLane(ctx context.Context, workflowId string, priority enums.Priority, limits LaneLimits) (bool, error) {
+	filter, err := normalizeDocument(reservePriorityLaneFilter(workflowId, priority, limits))
+	if err != nil {
+		return false, err
+	}
+	update, err := normalizeDocument(reservePriorityLaneUpdate(workflowId, priority))
+	if err != nil {
+		return false, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var doc bson.M
+	for _, existing := range db.collections[PriorityLanesCollection] {
+		if valuesEqual(existing["_id"], priorityLanesId) {
+			doc = existing
+		}
+	}
+	if doc == nil {
+		if doc, err = normalizeDocument(newPriorityLanes()); err != nil {
+			return false, err
+		}
+		db.collections[PriorityLanesCollection] = append(db.collections[PriorityLanesCollection], doc)
+	}
+	ok, err := matchDocument(doc, filter)
+	if err != nil || !ok {
+		var lanes PriorityLanesBody
+		if err == nil {
+			err = decodeDocument(doc, &lanes)
+		}
+		return lanes.holds(workflowId), err
+	}
+	return true, applyUpdate(doc, update, filter)
+}
+
+func (db *InMemoryDocDBClient) ReleasePriorityLane(ctx context.Context, workflowId string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, priority := range enums.PriorityList() {
+		filter, err := normalizeDocument(releasePriorityLaneFilter(workflowId, enums.Priority(priority)))
+		if err != nil {
+			return false, err
+		}
+		update, err := normalizeDocument(releasePriorityLaneUpdate(workflowId, enums.Priority(priority)))
+		if err != nil {
+			return false, err
+		}
+		for _, doc := range db.collections[PriorityLanesCollection] {
+			ok, err := matchDocument(doc, filter)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, applyUpdate(doc, update, filter)
+			}
+		}
+	}
+	return false, nil
+}
+
+func (db *InMemoryDocDBClient) FetchGeocode(ctx context.Context, location string) (GeocodeCacheBody, error) {
+	var geocode GeocodeCacheBody
+	if err := db.findOne(GeocodeCacheCollection, bson.M{"_id": location}, &geocode); err != nil {
+		return GeocodeCacheBody{}, err
+	}
+	if geocode.expired(time.Now()) {
+		return GeocodeCacheBody{}, mongo.ErrNoDocuments
+	}
+	return geocode, nil
+}
+
+// SaveGeocode replaces the document cached for the location like the upsert of the DocumentDB client.
+func (db *InMemoryDocDBClient) SaveGeocode(ctx context.Context, geocode GeocodeCacheBody) error {
+	doc, err := normalizeDocument(geocode)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, existing := range db.collections[GeocodeCacheCollection] {
+		if valuesEqual(existing["_id"], doc["_id"]) {
+			db.collections[GeocodeCacheCollection][i] = doc
+			return nil
+		}
+	}
+	db.collections[GeocodeCacheCollection] = append(db.collections[GeocodeCacheCollection], doc)
+	return nil
+}
+
+func (db *InMemoryDocDBClient) GetTimedoutTask(ctx context.Context, WorkflowId string) string {
+	workflow, err := db.FetchWorkflowExecutionData(ctx, WorkflowId)
+	if err != nil {
+		return ""
+	}
+	for _, state := range workflow.StepsPassedThrough {
+		if state.Status == enums.StepRunning {
+			return state.TaskName
+		}
+	}
+	return ""
+}
+
+func (db *InMemoryDocDBClient) FetchWorkflowExecutionDataByListOfWorkflows(ctx context.Context, SummaryFilters SummaryFilters, onlyWorkflowIds bool) ([]bson.M, error) {
+	query, err := buildSummaryQuery(ctx, SummaryFilters)
+	if err != nil {
+		return nil, err
+	}
+	var sortSpec, projection bson.D
+	if onlyWorkflowIds {
+		projection = bson.D{{Key: "_id", Value: 1}}
+	}
+	if SummaryFilters.MaxCount != 0 {
+		sortSpec = bson.D{{Key: "createdAt", Value: -1}}
+	}
+	return db.find(WorkflowDataCollection, query, sortSpec, projection, SummaryFilters.MaxCount)
+}
+
+func (db *InMemoryDocDBClient) FetchWorkflowSummary(ctx context.Context, filters SummaryFilters) (WorkflowSummaryPage, error) {
+	workflows := []WorkflowExecutionDataBody{}
+	plan, err := newSummaryPlan(ctx, filters)
+	if err != nil {
+		return WorkflowSummaryPage{Workflows: workflows}, err
+	}
+	docs, err := db.find(WorkflowDataCollection, plan.query, plan.sort, plan.projection, plan.limit)
+	if err == nil {
+		err = decodeDocuments(docs, &workflows)
+	}
+	return plan.page(workflows), err
+}
+
+// FetchWorkflowMetrics computes in Go what the DocumentDB client computes with aggregation pipelines.
+func (db *InMemoryDocDBClient) FetchWorkflowMetrics(ctx context.Context, window TimeRange) (WorkflowMetrics, error) {
+	metrics := WorkflowMetrics{Workflows: []WorkflowCount{}, Tasks: []TaskMetrics{}}
+	window, err := metricsWindow(window)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.Window = window
+
+	docs, err := db.find(WorkflowDataCollection, bson.M{"createdAt": bson.M{"$gte": window.From, "$lt": window.To}}, nil, nil, 0)
+	if err != nil {
+		return metrics, err
+	}
+	counts := map[WorkflowCount]int64{}
+	for _, doc := range docs {
+		var workflow WorkflowExecutionDataBody
+		if err = decodeDocument(doc, &workflow); err != nil {
+			return metrics, err
+		}
+		source, _ := workflow.InitialInput["source"].(string)
+		counts[WorkflowCount{
+			Day:      time.Unix(workflow.CreatedAt, 0).UTC().Format("2006-01-02"),
+			Source:   source,
+			FlowType: workflow.FlowType,
+			Status:   workflow.Status.String(),
+		}]++
+	}
+	for key, count := range counts {
+		key.Count = count
+		metrics.Workflows = append(metrics.Workflows, key)
+	}
+	sort.Slice(metrics.Workflows, func(i, j int) bool {
+		a, b := metrics.Workflows[i], metrics.Workflows[j]
+		return fmt.Sprint(a.Day, a.Source, a.FlowType, a.Status) < fmt.Sprint(b.Day, b.Source, b.FlowType, b.Status)
+	})
+
+	docs, err = db.find(StepsDataCollection, bson.M{"startTime": bson.M{"$gte": window.From, "$lt": window.To}}, bson.D{{Key: "taskName", Value: 1}}, nil, 0)
+	if err != nil {
+		return metrics, err
+	}
+	groups := []taskGroup{}
+	for _, doc := range docs {
+		var step StepExecutionDataBody
+		if err = decodeDocument(doc, &step); err != nil {
+			return metrics, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].TaskName != step.TaskName {
+			groups = append(groups, taskGroup{TaskName: step.TaskName})
+		}
+		group := &groups[len(groups)-1]
+		group.Total++
+		if step.Status.IsTerminal() {
+			group.Completed++
+		}
+		if step.Status == enums.StepFailure {
+			group.Failed++
+		}
+		duration := int64(-1)
+		if step.EndTime > 0 {
+			duration = durationBucket(step.EndTime - step.StartTime)
+		}
+		group.addDuration(duration)
+	}
+	for _, group := range groups {
+		metrics.Tasks = append(metrics.Tasks, newTaskMetrics(group))
+	}
+	return metrics, nil
+}
+
+func (db *InMemoryDocDBClient) insert(collectionName string, document interface{}) error {
+	doc, err := normalizeDocument(document)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, existing := range db.collections[collectionName] {
+		if valuesEqual(existing["_id"], doc["_id"]) {
+			return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+				Code:    duplicateKeyErrorCode,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", collectionName, doc["_id"]),
+			}}}
+		}
+	}
+	db.collections[collectionName] = append(db.collections[collectionName], doc)
+	return nil
+}
+
+func (db *InMemoryDocDBClient) findOne(collectionName string, query bson.M, result interface{}) error {
+	docs, err := db.find(collectionName, query, nil, nil, 1)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return decodeDocument(docs[0], result)
+}
+
+// find returns copies of the matching documents so callers never alias the stored ones.
+func (db *InMemoryDocDBClient) find(collectionName string, query bson.M, sortSpec, projection bson.D, limit int64) ([]bson.M, error) {
+	filter, err := normalizeDocument(query)
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	docs := []bson.M{}
+	for _, doc := range db.collections[collectionName] {
+		ok, err := matchDocument(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			copied, err := normalizeDocument(doc)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, copied)
+		}
+	}
+	if sortSpec != nil {
+		sortDocuments(docs, sortSpec)
+	}
+	if limit > 0 && int64(len(docs)) > limit {
+		docs = docs[:limit]
+	}
+	if projection != nil {
+		for i := range docs {
+			docs[i] = projectDocument(docs[i], projection)
+		}
+	}
+	return docs, nil
+}
+
+func decodeDocument(doc bson.M, result interface{}) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, result)
+}
+
+func decodeDocuments(docs []bson.M, results interface{}) error {
+	b, err := bson.Marshal(bson.M{"docs": docs})
+	if err != nil {
+		return err
+	}
+	var wrapper struct {
+		Docs bson.RawValue `bson:"docs"`
+	}
+	if err = bson.Unmarshal(b, &wrapper); err != nil {
+		return err
+	}
+	return wrapper.Docs.Unmarshal(results)
+}
@@ -0,0 +1,263 @@
+package documentDB_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MaxMetricsWindow bounds the window of a metrics request.
+const MaxMetricsWindow = 31 * 24 * time.Hour
+
+// durationBuckets round task durations down to Width seconds below UpTo, longer durations to longDurationWidth, so
+// the histogram pulled back per task stays a few thousand entries whatever the number of steps in the window.
+var durationBuckets = []struct{ UpTo, Width int64 }{{600, 1}, {3600, 10}, {86400, 60}}
+
+const longDurationWidth = 600
+
+var ErrInvalidMetricsWindow = errors.New("invalid metrics window")
+
+type WorkflowMetrics struct {
+	Window    TimeRange       `json:"window"`
+	Workflows []WorkflowCount `json:"workflows"`
+	Tasks     []TaskMetrics   `json:"tasks"`
+}
+
+// WorkflowCount is the number of workflows created on Day (UTC) per source, flowType and status.
+type WorkflowCount struct {
+	Day      string `json:"day" bson:"day"`
+	Source   string `json:"source" bson:"source"`
+	FlowType string `json:"flowType" bson:"flowType"`
+	Status   string `json:"status" bson:"status"`
+	Count    int64  `json:"count"`
+}
+
+// TaskMetrics summarises the steps of a task started in the window, FailureRate is over completed steps
+// and the duration percentiles are in seconds.
+type TaskMetrics struct {
+	TaskName    string  `json:"taskName"`
+	Total       int64   `json:"total"`
+	Completed   int64   `json:"completed"`
+	Failed      int64   `json:"failed"`
+	FailureRate float64 `json:"failureRate"`
+	P50Duration int64   `json:"p50Duration"`
+	P95Duration int64   `json:"p95Duration"`
+}
+
+type workflowCountGroup struct {
+	ID    WorkflowCount `bson:"_id"`
+	Count int64         `bson:"count"`
+}
+
+type taskGroup struct {
+	TaskName  string          `bson:"_id"`
+	Total     int64           `bson:"total"`
+	Completed int64           `bson:"completed"`
+	Failed    int64           `bson:"failed"`
+	Durations []durationCount `bson:"durations"`
+}
+
+// durationCount is the number of steps whose duration falls in the bucket starting at Duration, -1 for steps that
+// have not ended.
+type durationCount struct {
+	Duration int64 `bson:"duration"`
+	Count    int64 `bson:"count"`
+}
+
+// FetchWorkflowMetrics aggregates the workflows created and the steps started within window.
+func (db *DocDBClient) FetchWorkflowMetrics(ctx context.Context, window TimeRange) (WorkflowMetrics, error) {
+	metrics := WorkflowMetrics{Workflows: []WorkflowCount{}, Tasks: []TaskMetrics{}}
+	window, err := metricsWindow(window)
+	if err != nil {
+		return metrics, err
+	}
+	metrics.Window = window
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var workflowGroups []workflowCountGroup
+	err = db.aggregate(ctx, WorkflowDataCollection, workflowCountPipeline(window), &workflowGroups)
+	if err != nil {
+		return metrics, err
+	}
+	for _, group := range workflowGroups {
+		count := group.ID
+		count.Count = group.Count
+		metrics.Workflows = append(metrics.Workflows, count)
+	}
+
+	var taskGroups []taskGroup
+	err = db.aggregate(ctx, StepsDataCollection, taskMetricsPipeline(window), &taskGroups)
+	if err != nil {
+		return metrics, err
+	}
+	for _, group := range taskGroups {
+		metrics.Tasks = append(metrics.Tasks, newTaskMetrics(group))
+	}
+	return metrics, nil
+}
+
+func (db *DocDBClient) aggregate(ctx context.Context, collectionName string, pipeline mongo.Pipeline, results interface{}) error {
+	collection := db.collection(collectionName)
+	log.Infof(ctx, "Aggregating %s: %+v", collectionName, pipeline)
+	curr, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Errorf(ctx, "Failed to run aggregation on %s: %v", collectionName, err)
+		return err
+	}
+	if err = curr.All(ctx, results); err != nil {
+		log.Errorf(ctx, "Failed to decode aggregation on %s: %v", collectionName, err)
+	}
+	return err
+}
+
+func metricsWindow(window TimeRange) (TimeRange, error) {
+	if window.To == 0 {
+		window.To = time.Now().Unix()
+	}
+	if window.From <= 0 || window.From >= window.To {
+		return window, fmt.Errorf("%w: from is required and should be before to", ErrInvalidMetricsWindow)
+	}
+	if time.Duration(window.To-window.From)*time.Second > MaxMetricsWindow {
+		return window, fmt.Errorf("%w: window should not exceed %v", ErrInvalidMetricsWindow, MaxMetricsWindow)
+	}
+	return window, nil
+}
+
+func workflowCountPipeline(window TimeRange) mongo.Pipeline {
+	// createdAt is stored in unix seconds, it is turned into a date to group by day
+	createdDate := bson.M{"$add": bson.A{time.Unix(0, 0).UTC(), bson.M{"$multiply": bson.A{"$createdAt", 1000}}}}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"createdAt": bson.M{"$gte": window.From, "$lt": window.To}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"day":      bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": createdDate}},
+				"source":   "$initialInput.source",
+				"flowType": "$flowType",
+				"status":   "$status",
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.day", Value: 1}, {Key: "_id.source", Value: 1}, {Key: "_id.flowType", Value: 1}, {Key: "_id.status", Value: 1}}}},
+	}
+}
+
+// taskMetricsPipeline counts the steps per task and duration bucket first, then gathers the buckets of each task so
+// the durations are never pushed one by one.
+func taskMetricsPipeline(window TimeRange) mongo.Pipeline {
+	completed := bson.M{"$in": bson.A{"$status", bson.A{enums.StepSuccess, enums.StepFailure}}}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"startTime": bson.M{"$gte": window.From, "$lt": window.To}}}},
+		{{Key: "$project", Value: bson.M{
+			"taskName": 1,
+			"status":   1,
+			// steps that have not ended count as -1 and are left out of the percentiles
+			"duration": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$endTime", 0}}, durationBucketExpression(bson.M{"$subtract": bson.A{"$endTime", "$startTime"}}), -1}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       bson.M{"taskName": "$taskName", "duration": "$duration"},
+			"count":     bson.M{"$sum": 1},
+			"completed": bson.M{"$sum": bson.M{"$cond": bson.A{completed, 1, 0}}},
+			"failed":    bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$status", enums.StepFailure}}, 1, 0}}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       "$_id.taskName",
+			"total":     bson.M{"$sum": "$count"},
+			"completed": bson.M{"$sum": "$completed"},
+			"failed":    bson.M{"$sum": "$failed"},
+			"durations": bson.M{"$push": bson.M{"duration": "$_id.duration", "count": "$count"}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+}
+
+// durationBucket is the start of the durationBuckets bucket holding duration.
+func durationBucket(duration int64) int64 {
+	width := int64(longDurationWidth)
+	for _, bucket := range durationBuckets {
+		if duration < bucket.UpTo {
+			width = bucket.Width
+			break
+		}
+	}
+	return duration - duration%width
+}
+
+// durationBucketExpression computes durationBucket in an aggregation.
+func durationBucketExpression(duration interface{}) interface{} {
+	roundDown := func(width int64) interface{} {
+		if width == 1 {
+			return duration
+		}
+		return bson.M{"$subtract": bson.A{duration, bson.M{"$mod": bson.A{duration, width}}}}
+	}
+	expression := roundDown(longDurationWidth)
+	for i := len(durationBuckets) - 1; i >= 0; i-- {
+		expression = bson.M{"$cond": bson.A{bson.M{"$lt": bson.A{duration, durationBuckets[i].UpTo}}, roundDown(durationBuckets[i].Width), expression}}
+	}
+	return expression
+}
+
+func newTaskMetrics(group taskGroup) TaskMetrics {
+	task := TaskMetrics{
+		TaskName:  group.TaskName,
+		Total:     group.Total,
+		Completed: group.Completed,
+		Failed:    group.Failed,
+	}
+	if group.Completed > 0 {
+		task.FailureRate = float64(group.Failed) / float64(group.Completed)
+	}
+	durations := []durationCount{}
+	for _, d := range group.Durations {
+		if d.Duration >= 0 && d.Count > 0 {
+			durations = append(durations, d)
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i].Duration < durations[j].Duration })
+	task.P50Duration = percentile(durations, 50)
+	task.P95Duration = percentile(durations, 95)
+	return task
+}
+
+func (group *taskGroup) addDuration(duration int64) {
+	for i := range group.Durations {
+		if group.Durations[i].Duration == duration {
+			group.Durations[i].Count++
+			return
+		}
+	}
+	group.Durations = append(group.Durations, durationCount{Duration: duration, Count: 1})
+}
+
+// percentile uses the nearest rank method on the histogram sorted by duration.
+func percentile(sorted []durationCount, p float64) int64 {
+	var total int64
+	for _, d := range sorted {
+		total += d.Count
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, d := range sorted {
+		seen += d.Count
+		if seen >= rank {
+			return d.Duration
+		}
+	}
+	return sorted[len(sorted)-1].Duration
+}
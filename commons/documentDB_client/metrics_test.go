@@ -0,0 +1,121 @@
+package documentDB_client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+)
+
+func TestPercentile(t *testing.T) {
+	histogram := []durationCount{{Duration: 10, Count: 5}, {Duration: 20, Count: 4}, {Duration: 600, Count: 1}}
+	tests := []struct {
+		name   string
+		sorted []durationCount
+		p      float64
+		want   int64
+	}{
+		{"empty", []durationCount{}, 50, 0},
+		{"single step", []durationCount{{Duration: 42, Count: 1}}, 95, 42},
+		{"median falls in the first bucket", histogram, 50, 10},
+		{"rank past the first bucket", histogram, 60, 20},
+		{"p95", histogram, 95, 600},
+		{"p100 is the largest", histogram, 100, 600},
+		{"p0 is the smallest", histogram, 0, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, percentile(test.sorted, test.p))
+		})
+	}
+}
+
+func TestNewTaskMetrics(t *testing.T) {
+	task := newTaskMetrics(taskGroup{
+		TaskName:  "BuildingDetection",
+		Total:     6,
+		Completed: 4,
+		Failed:    1,
+		// unsorted as pushed by the aggregation, -1 holds the steps still running
+		Durations: []durationCount{{Duration: 30, Count: 1}, {Duration: -1, Count: 2}, {Duration: 10, Count: 3}},
+	})
+	assert.Equal(t, TaskMetrics{
+		TaskName:    "BuildingDetection",
+		Total:       6,
+		Completed:   4,
+		Failed:      1,
+		FailureRate: 0.25,
+		P50Duration: 10,
+		P95Duration: 30,
+	}, task)
+
+	assert.Equal(t, TaskMetrics{TaskName: "Idle"}, newTaskMetrics(taskGroup{TaskName: "Idle"}))
+}
+
+func TestMetricsWindow(t *testing.T) {
+	window, err := metricsWindow(TimeRange{From: 100, To: 200})
+	assert.NoError(t, err)
+	assert.Equal(t, TimeRange{From: 100, To: 200}, window)
+
+	from := time.Now().Add(-time.Hour).Unix()
+	window, err = metricsWindow(TimeRange{From: from})
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Unix(), window.To, 5)
+
+	for _, invalid := range []TimeRange{
+		{},
+		{From: 200, To: 100},
+		{From: 100, To: 100},
+		{From: 100, To: 100 + int64(MaxMetricsWindow/time.Second) + 1},
+	} {
+		_, err = metricsWindow(invalid)
+		assert.ErrorIs(t, err, ErrInvalidMetricsWindow, "%+v", invalid)
+	}
+}
+
+func TestDurationBucket(t *testing.T) {
+	for duration, want := range map[int64]int64{
+		0:      0,
+		599:    599,
+		600:    600,
+		615:    610,
+		3599:   3590,
+		3600:   3600,
+		3659:   3600,
+		86399:  86340,
+		86400:  86400,
+		90100:  90000,
+		604800: 604800,
+	} {
+		assert.Equal(t, want, durationBucket(duration), "duration %d", duration)
+	}
+}
+
+func TestFetchWorkflowMetricsInMemory(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDocDBClient()
+	for i, step := range []StepExecutionDataBody{
+		{StartTime: 1000, EndTime: 1010, Status: enums.StepSuccess},
+		{StartTime: 1000, EndTime: 1012, Status: enums.StepSuccess},
+		{StartTime: 1000, EndTime: 1000 + 700, Status: enums.StepFailure},
+		{StartTime: 1000, Status: enums.StepRunning},
+	} {
+		step.StepId = string(rune('a' + i))
+		step.TaskName = "BuildingDetection"
+		assert.NoError(t, db.InsertStepExecutionData(ctx, step))
+	}
+
+	metrics, err := db.FetchWorkflowMetrics(ctx, TimeRange{From: 900, To: 2000})
+	assert.NoError(t, err)
+	assert.Equal(t, []TaskMetrics{{
+		TaskName:    "BuildingDetection",
+		Total:       4,
+		Completed:   3,
+		Failed:      1,
+		FailureRate: 1.0 / 3,
+		P50Duration: 12,
+		P95Duration: 700,
+	}}, metrics.Tasks)
+}
@@ -0,0 +1,195 @@
+package documentDB_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	PriorityLanesCollection = "PriorityLanes"
+	priorityLanesId         = "lanes"
+)
+
+// PriorityLanesBody counts the executions running in each priority lane in a single document, so one conditional
+// update checks the lane and the shared capacity together. Count and Running always equal the number of workflows
+// held, in total and per lane.
+type PriorityLanesBody struct {
+	Id          string                      `bson:"_id"`
+	Count       int64                       `bson:"count"`
+	Running     map[enums.Priority]int64    `bson:"running"`
+	WorkflowIds map[enums.Priority][]string `bson:"workflowIds"`
+}
+
+// LaneLimits bounds a lane reservation, zero values leave it unbounded. Once Capacity is used up only a lane
+// running fewer than Share executions may start another.
+type LaneLimits struct {
+	MaxRunning int64
+	Capacity   int64
+	Share      int64
+}
+
+// ReservePriorityLane atomically takes a running execution of priority for workflowId within limits. It returns
+// false when the lane has no room, a workflow already holding a slot gets true back without taking another.
+func (DBClient *DocDBClient) ReservePriorityLane(ctx context.Context, workflowId string, priority enums.Priority, limits LaneLimits) (bool, error) {
+	collection := DBClient.collection(PriorityLanesCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+
+	// the second attempt only runs when the counter document had to be created first
+	for attempt := 0; attempt < 2; attempt++ {
+		err := collection.FindOneAndUpdate(ctx, reservePriorityLaneFilter(workflowId, priority, limits), reservePriorityLaneUpdate(workflowId, priority),
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Err()
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Errorf(ctx, "Failed to reserve a %s lane slot: %v", priority, err)
+			return false, err
+		}
+		// the lane is full, already holds the workflow or the counter does not exist yet
+		var lanes PriorityLanesBody
+		err = collection.FindOne(ctx, bson.M{"_id": priorityLanesId}).Decode(&lanes)
+		if err == nil {
+			return lanes.holds(workflowId), nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Errorf(ctx, "Failed to fetch the priority lanes: %v", err)
+			return false, err
+		}
+		_, err = collection.InsertOne(ctx, newPriorityLanes())
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			log.Errorf(ctx, "Failed to create the priority lanes: %v", err)
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("priority lanes kept changing while reserving a %s slot", priority)
+}
+
+// ReleasePriorityLane frees the lane slot held by workflowId. It returns false when the workflow holds none, which
+// makes releasing twice harmless.
+func (DBClient *DocDBClient) ReleasePriorityLane(ctx context.Context, workflowId string) (bool, error) {
+	collection := DBClient.collection(PriorityLanesCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	for _, priority := range enums.PriorityList() {
+		result, err := collection.UpdateOne(ctx, releasePriorityLaneFilter(workflowId, enums.Priority(priority)), releasePriorityLaneUpdate(workflowId, enums.Priority(priority)))
+		if err != nil {
+			log.Errorf(ctx, "Failed to release the %s lane slot: %v", priority, err)
+			return false, err
+		}
+		if result.ModifiedCount > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newPriorityLanes starts every lane at zero, a condition on the count of a missing lane would never match.
+func newPriorityLanes() PriorityLanesBody {
+	lanes := PriorityLanesBody{Id: priorityLanesId, Running: map[enums.Priority]int64{}, WorkflowIds: map[enums.Priority][]string{}}
+	for _, priority := range enums.PriorityList() {
+		lanes.Running[enums.Priority(priority)] = 0
+		lanes.WorkflowIds[enums.Priority(priority)] = []string{}
+	}
+	return lanes
+}
+
+func reservePriorityLaneFilter(workflowId string, priority enums.Priority, limits LaneLimits) bson.M {
+	running := "running." + string(priority)
+	filter := bson.M{"_id": priorityLanesId}
+	for _, p := range enums.PriorityList() {
+		filter["workflowIds."+p] = bson.M{"$ne": workflowId}
+	}
+	conditions := bson.A{}
+	if limits.MaxRunning > 0 {
+		conditions = append(conditions, bson.M{running: bson.M{"$lt": limits.MaxRunning}})
+	}
+	if limits.Capacity > 0 {
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{"count": bson.M{"$lt": limits.Capacity}},
+			bson.M{running: bson.M{"$lt": limits.Share}},
+		}})
+	}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+	return filter
+}
+
+func reservePriorityLaneUpdate(workflowId string, priority enums.Priority) bson.M {
+	return bson.M{
+		"$inc":  bson.M{"count": 1, "running." + string(priority): 1},
+		"$push": bson.M{"workflowIds." + string(priority): workflowId},
+	}
+}
+
+func releasePriorityLaneFilter(workflowId string, priority enums.Priority) bson.M {
+	return bson.M{"_id": priorityLanesId, "workflowIds." + string(priority): workflowId}
+}
+
+func releasePriorityLaneUpdate(workflowId string, priority enums.Priority) bson.M {
+	return bson.M{
+		"$inc":  bson.M{"count": -1, "running." + string(priority): -1},
+		"$pull": bson.M{"workflowIds." + string(priority): workflowId},
+	}
+}
+
+func (lanes PriorityLanesBody) holds(workflowId string) bool {
+	for _, ids := range lanes.WorkflowIds {
+		for _, id := range ids {
+			if id == workflowId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReconcilePriorityLanes releases the slots still held by workflows WorkflowData records as finished or aborted,
+// so a release missed when an execution stopped does not hold its slot for good. Workflows not recorded yet keep
+// theirs, they may just have started. It returns the workflows released.
+func ReconcilePriorityLanes(ctx context.Context, db IDocDBClient) ([]string, error) {
+	documents, err := db.FetchDocuments(ctx, bson.M{"_id": priorityLanesId}, PriorityLanesCollection)
+	if err != nil || len(documents) == 0 {
+		return nil, err
+	}
+	var lanes PriorityLanesBody
+	if err = decodeDocument(documents[0], &lanes); err != nil {
+		return nil, err
+	}
+	held := bson.A{}
+	for _, ids := range lanes.WorkflowIds {
+		for _, id := range ids {
+			held = append(held, id)
+		}
+	}
+	if len(held) == 0 {
+		return nil, nil
+	}
+	stopped, err := db.FetchDocuments(ctx, bson.M{
+		"_id":    bson.M{"$in": held},
+		"status": bson.M{"$in": bson.A{string(enums.WorkflowFinished), string(enums.WorkflowAborted)}},
+	}, WorkflowDataCollection)
+	if err != nil {
+		return nil, err
+	}
+	released := []string{}
+	for _, workflow := range stopped {
+		workflowId, _ := workflow["_id"].(string)
+		ok, err := db.ReleasePriorityLane(ctx, workflowId)
+		if err != nil {
+			return released, err
+		}
+		if ok {
+			released = append(released, workflowId)
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,214 @@
+package documentDB_client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExpireAtField holds the date after which a document is removed by the TTL index, documents without it never expire.
+const ExpireAtField = "expireAt"
+
+const (
+	SchemaPolicyCollection = "SchemaPolicy"
+	archivalPolicyId       = "archival"
+)
+
+type IndexSpec struct {
+	Collection         string
+	Name               string
+	Keys               bson.D
+	ExpireAfterSeconds *int32
+}
+
+type SchemaConfig struct {
+	// EnableTTL creates TTL indexes on expireAt so documents stamped with it are removed by DocumentDB
+	EnableTTL bool `json:"enableTTL"`
+	// Archival is stored for the datastore archive action, which uses its env defaults until a policy is stored
+	Archival *ArchivalPolicy `json:"archival,omitempty"`
+}
+
+// ArchivalPolicy moves workflows finished more than AfterDays ago out of DocumentDB, at most BatchSize per run.
+type ArchivalPolicy struct {
+	AfterDays int `json:"afterDays" bson:"afterDays"`
+	BatchSize int `json:"batchSize" bson:"batchSize"`
+}
+
+func (policy ArchivalPolicy) Validate() error {
+	problems := []string{}
+	if policy.AfterDays <= 0 {
+		problems = append(problems, "afterDays must be positive")
+	}
+	if policy.BatchSize <= 0 {
+		problems = append(problems, "batchSize must be positive")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid archival policy: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+type existingIndex struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+}
+
+// RequiredIndexes lists the indexes backing the queries run against WorkflowData, StepsData and HipsterQuota, and
+// the TTL indexes removing expired documents.
+func RequiredIndexes(config SchemaConfig) []IndexSpec {
+	var expireNow int32 = 0
+	indexes := []IndexSpec{
+		// GetHipsterCountPerDay, equality on flowType before the createdAt range
+		{Collection: WorkflowDataCollection, Name: "flowType_1_createdAt_1", Keys: bson.D{{Key: "flowType", Value: 1}, {Key: "createdAt", Value: 1}}},
+		// FetchWorkflowExecutionDataByListOfWorkflows
+		{Collection: WorkflowDataCollection, Name: "orderId_1", Keys: bson.D{{Key: "orderId", Value: 1}}},
+		{Collection: WorkflowDataCollection, Name: "initialInput.source_1_createdAt_-1", Keys: bson.D{{Key: "initialInput.source", Value: 1}, {Key: "createdAt", Value: -1}}},
+		// finished workflows selected for archival
+		{Collection: WorkflowDataCollection, Name: "status_1_finishedAt_1", Keys: bson.D{{Key: "status", Value: 1}, {Key: "finishedAt", Value: 1}}},
+		{Collection: StepsDataCollection, Name: "workflowId_1", Keys: bson.D{{Key: "workflowId", Value: 1}}},
+		// ReleaseHipsterSlot
+		{Collection: HipsterQuotaCollection, Name: "workflowIds_1", Keys: bson.D{{Key: "workflowIds", Value: 1}}},
+		// quotas of past windows, they are stamped whatever the workflow retention is
+		{Collection: HipsterQuotaCollection, Name: ExpireAtField + "_1", Keys: bson.D{{Key: ExpireAtField, Value: 1}}, ExpireAfterSeconds: &expireNow},
+		// geocodes past the GeocodeCacheDays of querypdw, they are stamped whatever the workflow retention is
+		{Collection: GeocodeCacheCollection, Name: ExpireAtField + "_1", Keys: bson.D{{Key: ExpireAtField, Value: 1}}, ExpireAfterSeconds: &expireNow},
+	}
+	if config.EnableTTL {
+		indexes = append(indexes,
+			IndexSpec{Collection: WorkflowDataCollection, Name: ExpireAtField + "_1", Keys: bson.D{{Key: ExpireAtField, Value: 1}}, ExpireAfterSeconds: &expireNow},
+			IndexSpec{Collection: StepsDataCollection, Name: ExpireAtField + "_1", Keys: bson.D{{Key: ExpireAtField, Value: 1}}, ExpireAfterSeconds: &expireNow},
+		)
+	}
+	return indexes
+}
+
+// BootstrapSchema creates the required indexes and stores the archival policy, indexes that already exist with the
+// same definition are left as is and an index that exists with a different definition fails the bootstrap instead of
+// being replaced.
+func (DBClient *DocDBClient) BootstrapSchema(ctx context.Context, config SchemaConfig) ([]string, error) {
+	created := []string{}
+	if config.Archival != nil {
+		if err := config.Archival.Validate(); err != nil {
+			return created, err
+		}
+	}
+	for _, spec := range RequiredIndexes(config) {
+		collection := DBClient.collection(spec.Collection)
+		ok, err := DBClient.indexExists(ctx, collection, spec)
+		if err != nil {
+			return created, err
+		}
+		if ok {
+			continue
+		}
+		indexOptions := options.Index().SetName(spec.Name)
+		if spec.ExpireAfterSeconds != nil {
+			indexOptions.SetExpireAfterSeconds(*spec.ExpireAfterSeconds)
+		}
+		queryCtx, cancel := DBClient.queryContext(ctx)
+		_, err = collection.Indexes().CreateOne(queryCtx, mongo.IndexModel{Keys: spec.Keys, Options: indexOptions})
+		cancel()
+		if err != nil {
+			log.Errorf(ctx, "Failed to create index %s on %s: %v", spec.Name, spec.Collection, err)
+			return created, err
+		}
+		log.Infof(ctx, "Created index %s on %s", spec.Name, spec.Collection)
+		created = append(created, spec.Collection+"."+spec.Name)
+	}
+	if config.Archival != nil {
+		collection := DBClient.collection(SchemaPolicyCollection)
+		queryCtx, cancel := DBClient.queryContext(ctx)
+		defer cancel()
+		_, err := collection.ReplaceOne(queryCtx, bson.M{"_id": archivalPolicyId}, config.Archival, options.Replace().SetUpsert(true))
+		if err != nil {
+			log.Errorf(ctx, "Failed to store the archival policy: %v", err)
+			return created, err
+		}
+		log.Infof(ctx, "Stored archival policy, after %d days in batches of %d", config.Archival.AfterDays, config.Archival.BatchSize)
+	}
+	return created, nil
+}
+
+// FetchArchivalPolicy returns the policy stored by the last bootstrap, mongo.ErrNoDocuments when archival is not set up.
+func (DBClient *DocDBClient) FetchArchivalPolicy(ctx context.Context) (ArchivalPolicy, error) {
+	collection := DBClient.collection(SchemaPolicyCollection)
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	var policy ArchivalPolicy
+	err := collection.FindOne(ctx, bson.M{"_id": archivalPolicyId}).Decode(&policy)
+	return policy, err
+}
+
+func (DBClient *DocDBClient) indexExists(ctx context.Context, collection *mongo.Collection, spec IndexSpec) (bool, error) {
+	ctx, cancel := DBClient.queryContext(ctx)
+	defer cancel()
+	curr, err := collection.Indexes().List(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Failed to list indexes on %s: %v", spec.Collection, err)
+		return false, err
+	}
+	var indexes []existingIndex
+	if err = curr.All(ctx, &indexes); err != nil {
+		return false, err
+	}
+	return matchIndex(indexes, spec)
+}
+
+// matchIndex reports whether spec is already among the existing indexes, an index sharing its name or its keys with a
+// different definition is a conflict.
+func matchIndex(indexes []existingIndex, spec IndexSpec) (bool, error) {
+	for _, index := range indexes {
+		sameKeys := sameIndexKeys(index.Key, spec.Keys)
+		sameTTL := sameExpiry(index.ExpireAfterSeconds, spec.ExpireAfterSeconds)
+		switch {
+		case index.Name == spec.Name && sameKeys && sameTTL:
+			return true, nil
+		case index.Name == spec.Name:
+			return false, fmt.Errorf("conflicting index %s on %s: existing keys %s, expireAfterSeconds %s, want keys %s, expireAfterSeconds %s",
+				spec.Name, spec.Collection, formatIndexKeys(index.Key), formatExpiry(index.ExpireAfterSeconds), formatIndexKeys(spec.Keys), formatExpiry(spec.ExpireAfterSeconds))
+		case sameKeys:
+			return false, fmt.Errorf("conflicting index on %s: keys %s already indexed as %s, want %s", spec.Collection, formatIndexKeys(spec.Keys), index.Name, spec.Name)
+		}
+	}
+	return false, nil
+}
+
+func sameIndexKeys(existing, wanted bson.D) bool {
+	if len(existing) != len(wanted) {
+		return false
+	}
+	for i := range existing {
+		if existing[i].Key != wanted[i].Key || fmt.Sprint(existing[i].Value) != fmt.Sprint(wanted[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameExpiry(existing, wanted *int32) bool {
+	if existing == nil || wanted == nil {
+		return existing == wanted
+	}
+	return *existing == *wanted
+}
+
+func formatIndexKeys(keys bson.D) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s:%v", k.Key, k.Value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func formatExpiry(expiry *int32) string {
+	if expiry == nil {
+		return "none"
+	}
+	return fmt.Sprint(*expiry)
+}
@@ -0,0 +1,101 @@
+package documentDB_client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestSameIndexKeys(t *testing.T) {
+	wanted := bson.D{{Key: "flowType", Value: 1}, {Key: "createdAt", Value: 1}}
+	tests := []struct {
+		name     string
+		existing bson.D
+		want     bool
+	}{
+		{"same keys", bson.D{{Key: "flowType", Value: 1}, {Key: "createdAt", Value: 1}}, true},
+		// DocumentDB lists the index directions as doubles
+		{"numeric type differs", bson.D{{Key: "flowType", Value: float64(1)}, {Key: "createdAt", Value: int32(1)}}, true},
+		{"order differs", bson.D{{Key: "createdAt", Value: 1}, {Key: "flowType", Value: 1}}, false},
+		{"direction differs", bson.D{{Key: "flowType", Value: 1}, {Key: "createdAt", Value: -1}}, false},
+		{"prefix", bson.D{{Key: "flowType", Value: 1}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, sameIndexKeys(test.existing, wanted))
+		})
+	}
+}
+
+func TestMatchIndex(t *testing.T) {
+	var day, week int32 = 86400, 604800
+	spec := IndexSpec{Collection: WorkflowDataCollection, Name: "orderId_1", Keys: bson.D{{Key: "orderId", Value: 1}}}
+	ttl := IndexSpec{Collection: StepsDataCollection, Name: "expireAt_1", Keys: bson.D{{Key: "expireAt", Value: 1}}, ExpireAfterSeconds: &day}
+	tests := []struct {
+		name     string
+		spec     IndexSpec
+		existing []existingIndex
+		want     bool
+		conflict bool
+	}{
+		{"missing", spec, []existingIndex{{Name: "_id_", Key: bson.D{{Key: "_id", Value: 1}}}}, false, false},
+		{"same definition", spec, []existingIndex{{Name: "orderId_1", Key: bson.D{{Key: "orderId", Value: 1}}}}, true, false},
+		{"same name other keys", spec, []existingIndex{{Name: "orderId_1", Key: bson.D{{Key: "orderId", Value: -1}}}}, false, true},
+		{"same keys other name", spec, []existingIndex{{Name: "order", Key: bson.D{{Key: "orderId", Value: 1}}}}, false, true},
+		{"same ttl", ttl, []existingIndex{{Name: "expireAt_1", Key: bson.D{{Key: "expireAt", Value: 1}}, ExpireAfterSeconds: &day}}, true, false},
+		{"other ttl", ttl, []existingIndex{{Name: "expireAt_1", Key: bson.D{{Key: "expireAt", Value: 1}}, ExpireAfterSeconds: &week}}, false, true},
+		{"ttl missing on existing index", ttl, []existingIndex{{Name: "expireAt_1", Key: bson.D{{Key: "expireAt", Value: 1}}}}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := matchIndex(test.existing, test.spec)
+			assert.Equal(t, test.want, ok)
+			if test.conflict {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRequiredIndexesFollowEqualitySortRange(t *testing.T) {
+	names := map[string]bool{}
+	for _, spec := range RequiredIndexes(SchemaConfig{}) {
+		names[spec.Collection+"."+spec.Name] = true
+	}
+	assert.True(t, names[WorkflowDataCollection+".flowType_1_createdAt_1"])
+	assert.False(t, names[WorkflowDataCollection+".createdAt_1_flowType_1"])
+}
+
+func TestRequiredIndexesExpireQuotasAndGeocodesWithoutTTL(t *testing.T) {
+	ttl := map[string]bool{}
+	for _, spec := range RequiredIndexes(SchemaConfig{}) {
+		if spec.ExpireAfterSeconds != nil {
+			ttl[spec.Collection] = true
+		}
+	}
+	assert.Equal(t, map[string]bool{HipsterQuotaCollection: true, GeocodeCacheCollection: true}, ttl)
+}
+
+func TestBootstrapStoresArchivalPolicy(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDocDBClient()
+
+	_, err := db.FetchArchivalPolicy(ctx)
+	assert.Equal(t, mongo.ErrNoDocuments, err)
+
+	_, err = db.BootstrapSchema(ctx, SchemaConfig{Archival: &ArchivalPolicy{AfterDays: 0, BatchSize: 10}})
+	assert.Error(t, err)
+
+	_, err = db.BootstrapSchema(ctx, SchemaConfig{Archival: &ArchivalPolicy{AfterDays: 90, BatchSize: 10}})
+	assert.NoError(t, err)
+	_, err = db.BootstrapSchema(ctx, SchemaConfig{Archival: &ArchivalPolicy{AfterDays: 30, BatchSize: 20}})
+	assert.NoError(t, err)
+	policy, err := db.FetchArchivalPolicy(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, ArchivalPolicy{AfterDays: 30, BatchSize: 20}, policy)
+}
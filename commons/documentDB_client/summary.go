@@ -0,0 +1,340 @@
+package documentDB_client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultSummarySortField = "createdAt"
+	MaxSummaryPageSize      = 500
+
+	SortAscending  = "asc"
+	SortDescending = "desc"
+)
+
+var ErrInvalidSummaryFilters = errors.New("invalid summary filters")
+
+// summarySortFields maps the fields a summary can be sorted on to their value, used to build the continuation token.
+var summarySortFields = map[string]func(WorkflowExecutionDataBody) int64{
+	"createdAt":  func(w WorkflowExecutionDataBody) int64 { return w.CreatedAt },
+	"updatedAt":  func(w WorkflowExecutionDataBody) int64 { return w.UpdatedAt },
+	"finishedAt": func(w WorkflowExecutionDataBody) int64 { return w.FinishedAt },
+}
+
+// optionalSummarySortFields stay 0 until a workflow reaches them and are missing on documents written before they
+// existed, sorting on them only lists the workflows that set them. A range on the field keeps its sort index usable.
+var optionalSummarySortFields = map[string]bool{"finishedAt": true}
+
+// summaryProjectionFields are the WorkflowData fields that can be selected, nested paths under them are allowed.
+var summaryProjectionFields = []string{"status", "orderId", "flowType", "priority", "updatedAt", "createdAt", "finishedAt", "runningState", "initialInput", "finalOutput", "stepsPassedThrough"}
+
+type WorkflowSummaryPage struct {
+	Workflows     []WorkflowExecutionDataBody `json:"workflows"`
+	NextPageToken string                      `json:"nextPageToken,omitempty"`
+}
+
+// summaryPageToken is the position after the last workflow of a page, it is handed out base64 encoded and opaque.
+type summaryPageToken struct {
+	SortBy    string `json:"s"`
+	SortOrder string `json:"o"`
+	Value     int64  `json:"v"`
+	ID        string `json:"id"`
+}
+
+// Paginated reports whether the caller asked for a page instead of the full result.
+func (f SummaryFilters) Paginated() bool {
+	return f.PageSize > 0 || f.PageToken != ""
+}
+
+// summaryPlan is the query, options and paging of a summary request, shared by every IDocDBClient implementation.
+type summaryPlan struct {
+	query      bson.M
+	sort       bson.D
+	projection bson.D
+	limit      int64
+	pageSize   int64
+	paginated  bool
+	sortBy     string
+	sortOrder  string
+}
+
+// FetchWorkflowSummary returns the workflows matching filters sorted on SortBy with _id as tie breaker,
+// when paginated it returns at most PageSize workflows and a token to fetch the next page.
+func (db *DocDBClient) FetchWorkflowSummary(ctx context.Context, filters SummaryFilters) (WorkflowSummaryPage, error) {
+	plan, err := newSummaryPlan(ctx, filters)
+	if err != nil {
+		return WorkflowSummaryPage{Workflows: []WorkflowExecutionDataBody{}}, err
+	}
+	findOptions := options.Find().SetSort(plan.sort)
+	if plan.projection != nil {
+		findOptions.SetProjection(plan.projection)
+	}
+	if plan.limit > 0 {
+		findOptions.SetLimit(plan.limit)
+	}
+
+	collection := db.collection(WorkflowDataCollection)
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+	log.Infof(ctx, "Final Query: %+v", plan.query)
+	workflows := []WorkflowExecutionDataBody{}
+	curr, err := collection.Find(ctx, plan.query, findOptions)
+	if err != nil {
+		log.Errorf(ctx, "Failed to run find query: %v", err)
+		return plan.page(workflows), err
+	}
+	defer curr.Close(ctx)
+	for curr.Next(ctx) {
+		var workflow WorkflowExecutionDataBody
+		if err = curr.Decode(&workflow); err != nil {
+			log.Errorf(ctx, "Failed to decode workflow: %v", err)
+			return plan.page(workflows), err
+		}
+		workflows = append(workflows, workflow)
+	}
+	if err = curr.Err(); err != nil {
+		log.Errorf(ctx, "Failed to run find query: %v", err)
+	}
+	return plan.page(workflows), err
+}
+
+func newSummaryPlan(ctx context.Context, filters SummaryFilters) (summaryPlan, error) {
+	plan := summaryPlan{paginated: filters.Paginated()}
+	var err error
+	plan.sortBy, plan.sortOrder, err = summarySort(filters)
+	if err != nil {
+		return plan, err
+	}
+	direction := -1
+	if plan.sortOrder == SortAscending {
+		direction = 1
+	}
+	plan.sort = bson.D{{Key: plan.sortBy, Value: direction}, {Key: "_id", Value: direction}}
+	if plan.projection, err = summaryProjection(filters.Fields, plan.sortBy); err != nil {
+		return plan, err
+	}
+	if plan.query, err = buildSummaryQuery(ctx, filters); err != nil {
+		return plan, err
+	}
+	if optionalSummarySortFields[plan.sortBy] {
+		plan.query = bson.M{"$and": bson.A{plan.query, bson.M{plan.sortBy: bson.M{"$gt": 0}}}}
+	}
+	if !plan.paginated {
+		plan.limit = filters.MaxCount
+		return plan, nil
+	}
+	plan.pageSize = filters.PageSize
+	if plan.pageSize <= 0 || plan.pageSize > MaxSummaryPageSize {
+		plan.pageSize = MaxSummaryPageSize
+	}
+	if filters.PageToken != "" {
+		token, err := decodeSummaryPageToken(filters.PageToken, plan.sortBy, plan.sortOrder)
+		if err != nil {
+			return plan, err
+		}
+		plan.query = bson.M{"$and": bson.A{plan.query, summaryCursorFilter(token, direction)}}
+	}
+	// one extra document tells whether there is a next page
+	plan.limit = plan.pageSize + 1
+	return plan, nil
+}
+
+// page trims the extra workflow fetched to detect a next page and turns it into the continuation token.
+func (plan summaryPlan) page(workflows []WorkflowExecutionDataBody) WorkflowSummaryPage {
+	page := WorkflowSummaryPage{Workflows: workflows}
+	if plan.paginated && int64(len(workflows)) > plan.pageSize {
+		page.Workflows = workflows[:plan.pageSize]
+		last := page.Workflows[plan.pageSize-1]
+		page.NextPageToken = encodeSummaryPageToken(summaryPageToken{
+			SortBy:    plan.sortBy,
+			SortOrder: plan.sortOrder,
+			Value:     summarySortFields[plan.sortBy](last),
+			ID:        last.WorkflowId,
+		})
+	}
+	return page
+}
+
+// buildSummaryQuery ANDs every filter that is set into one query, ids of different kinds select their union.
+// StartTime/EndTime are a createdAt range unless Legacy is set, in which case the original translation is kept.
+func buildSummaryQuery(ctx context.Context, filters SummaryFilters) (bson.M, error) {
+	if filters.Legacy {
+		return legacySummaryQuery(filters), nil
+	}
+	conditions := bson.A{}
+	ids := bson.A{}
+	if len(filters.OrderIDs) > 0 {
+		ids = append(ids, bson.M{"orderId": bson.M{"$in": filters.OrderIDs}})
+	}
+	if len(filters.WorkflowIDs) > 0 {
+		ids = append(ids, bson.M{"_id": bson.M{"$in": filters.WorkflowIDs}})
+	}
+	if len(filters.ReportIDs) > 0 {
+		ids = append(ids, bson.M{"initialInput.reportId": bson.M{"$in": filters.ReportIDs}})
+	}
+	if len(ids) > 0 {
+		conditions = append(conditions, bson.M{"$or": ids})
+	}
+	if filters.Source != "" {
+		conditions = append(conditions, bson.M{"initialInput.source": filters.Source})
+	}
+	if len(filters.Statuses) > 0 {
+		for _, status := range filters.Statuses {
+			if !isWorkflowStatus(status) {
+				return nil, fmt.Errorf("%w: status should be one of %v", ErrInvalidSummaryFilters, enums.WorkflowStatusList())
+			}
+		}
+		conditions = append(conditions, bson.M{"status": bson.M{"$in": filters.Statuses}})
+	}
+	if len(filters.FlowTypes) > 0 {
+		conditions = append(conditions, bson.M{"flowType": bson.M{"$in": filters.FlowTypes}})
+	}
+
+	createdAt := filters.CreatedAt
+	if filters.StartTime != 0 || filters.EndTime != 0 {
+		if createdAt != nil {
+			return nil, fmt.Errorf("%w: use either createdAt or startTime/endTime", ErrInvalidSummaryFilters)
+		}
+		createdAt = &TimeRange{From: filters.StartTime, To: filters.EndTime}
+		if filters.StartTime != 0 && filters.EndTime != 0 && filters.StartTime > filters.EndTime {
+			// clients written against the legacy translation send the newest time as startTime
+			log.Infof(ctx, "Deprecated: startTime %d after endTime %d, send the oldest time as startTime", filters.StartTime, filters.EndTime)
+			createdAt = &TimeRange{From: filters.EndTime, To: filters.StartTime}
+		}
+	}
+	for _, r := range []struct {
+		field     string
+		timeRange *TimeRange
+	}{{"createdAt", createdAt}, {"finishedAt", filters.FinishedAt}} {
+		condition, err := timeRangeCondition(r.field, r.timeRange)
+		if err != nil {
+			return nil, err
+		}
+		if condition != nil {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	if filters.StuckInTask != "" {
+		conditions = append(conditions, bson.M{
+			"status":                              enums.WorkflowInProgress,
+			"runningState." + filters.StuckInTask: bson.M{"$in": bson.A{enums.StepSubmitted, enums.StepRunning}},
+		})
+	}
+	if len(conditions) == 0 {
+		return bson.M{}, nil
+	}
+	return bson.M{"$and": conditions}, nil
+}
+
+func timeRangeCondition(field string, timeRange *TimeRange) (bson.M, error) {
+	if timeRange == nil || (timeRange.From == 0 && timeRange.To == 0) {
+		return nil, nil
+	}
+	if timeRange.From != 0 && timeRange.To != 0 && timeRange.From >= timeRange.To {
+		return nil, fmt.Errorf("%w: %s range should start before it ends", ErrInvalidSummaryFilters, field)
+	}
+	bounds := bson.M{}
+	if timeRange.From != 0 {
+		bounds["$gte"] = timeRange.From
+	}
+	if timeRange.To != 0 {
+		bounds["$lt"] = timeRange.To
+	}
+	return bson.M{field: bounds}, nil
+}
+
+func isWorkflowStatus(status string) bool {
+	for _, s := range enums.WorkflowStatusList() {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func summarySort(filters SummaryFilters) (string, string, error) {
+	sortBy, sortOrder := filters.SortBy, filters.SortOrder
+	if sortBy == "" {
+		sortBy = DefaultSummarySortField
+	}
+	if sortOrder == "" {
+		sortOrder = SortDescending
+	}
+	if _, ok := summarySortFields[sortBy]; !ok {
+		return "", "", fmt.Errorf("%w: cannot sort on %s", ErrInvalidSummaryFilters, sortBy)
+	}
+	if sortOrder != SortAscending && sortOrder != SortDescending {
+		return "", "", fmt.Errorf("%w: sortOrder should be %s or %s", ErrInvalidSummaryFilters, SortAscending, SortDescending)
+	}
+	return sortBy, sortOrder, nil
+}
+
+// summaryProjection always keeps the sort field so the continuation token can be built from the last workflow.
+func summaryProjection(fields []string, sortBy string) (bson.D, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	projection := bson.D{{Key: "_id", Value: 1}, {Key: sortBy, Value: 1}}
+	for _, field := range fields {
+		root := strings.Split(field, ".")[0]
+		if !isSummaryProjectionField(root) {
+			return nil, fmt.Errorf("%w: unknown field %s", ErrInvalidSummaryFilters, field)
+		}
+		if field == sortBy {
+			continue
+		}
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+	return projection, nil
+}
+
+func isSummaryProjectionField(field string) bool {
+	for _, f := range summaryProjectionFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func summaryCursorFilter(token summaryPageToken, direction int) bson.M {
+	op := "$lt"
+	if direction == 1 {
+		op = "$gt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{token.SortBy: bson.M{op: token.Value}},
+		bson.M{token.SortBy: token.Value, "_id": bson.M{op: token.ID}},
+	}}
+}
+
+func encodeSummaryPageToken(token summaryPageToken) string {
+	b, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSummaryPageToken(encoded, sortBy, sortOrder string) (summaryPageToken, error) {
+	var token summaryPageToken
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(b, &token)
+	}
+	if err != nil {
+		return token, fmt.Errorf("%w: malformed pageToken", ErrInvalidSummaryFilters)
+	}
+	if token.SortBy != sortBy || token.SortOrder != sortOrder {
+		return token, fmt.Errorf("%w: pageToken was issued for a different sort", ErrInvalidSummaryFilters)
+	}
+	return token, nil
+}
@@ -0,0 +1,138 @@
+package documentDB_client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFetchWorkflowSummaryPagesOnFinishedAt(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDocDBClient()
+	for _, workflow := range []bson.M{
+		{"_id": "wf-1", "status": "finished", "createdAt": int64(100), "finishedAt": int64(300)},
+		{"_id": "wf-2", "status": "finished", "createdAt": int64(110), "finishedAt": int64(200)},
+		// written before finishedAt existed
+		{"_id": "wf-3", "status": "inProgress", "createdAt": int64(120)},
+		{"_id": "wf-4", "status": "finished", "createdAt": int64(130), "finishedAt": int64(200)},
+		{"_id": "wf-5", "status": "inProgress", "createdAt": int64(140)},
+		{"_id": "wf-6", "status": "inProgress", "createdAt": int64(150), "finishedAt": int64(0)},
+	} {
+		assert.NoError(t, db.insert(WorkflowDataCollection, workflow))
+	}
+
+	for _, sortOrder := range []string{SortAscending, SortDescending} {
+		t.Run(sortOrder, func(t *testing.T) {
+			filters := SummaryFilters{SortBy: "finishedAt", SortOrder: sortOrder, PageSize: 1}
+			ids := []string{}
+			for pages := 0; pages < 10; pages++ {
+				page, err := db.FetchWorkflowSummary(ctx, filters)
+				assert.NoError(t, err)
+				for _, workflow := range page.Workflows {
+					ids = append(ids, workflow.WorkflowId)
+				}
+				if page.NextPageToken == "" {
+					break
+				}
+				filters.PageToken = page.NextPageToken
+			}
+			if sortOrder == SortAscending {
+				assert.Equal(t, []string{"wf-2", "wf-4", "wf-1"}, ids)
+			} else {
+				assert.Equal(t, []string{"wf-1", "wf-4", "wf-2"}, ids)
+			}
+		})
+	}
+}
+
+func TestNewSummaryPlanListsWorkflowsSettingOptionalSortField(t *testing.T) {
+	plan, err := newSummaryPlan(context.Background(), SummaryFilters{SortBy: "finishedAt", Source: "SIM"})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"$and": bson.A{
+		bson.M{"$and": bson.A{bson.M{"initialInput.source": "SIM"}}},
+		bson.M{"finishedAt": bson.M{"$gt": 0}},
+	}}, plan.query)
+
+	plan, err = newSummaryPlan(context.Background(), SummaryFilters{SortBy: "createdAt", Source: "SIM"})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"$and": bson.A{bson.M{"initialInput.source": "SIM"}}}, plan.query)
+}
+
+func TestBuildSummaryQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters SummaryFilters
+		want    bson.M
+		invalid bool
+	}{
+		{name: "no filters", filters: SummaryFilters{}, want: bson.M{}},
+		{
+			name:    "ids of different kinds select their union",
+			filters: SummaryFilters{OrderIDs: []string{"o1"}, WorkflowIDs: []string{"w1"}, ReportIDs: []string{"r1"}},
+			want: bson.M{"$and": bson.A{bson.M{"$or": bson.A{
+				bson.M{"orderId": bson.M{"$in": []string{"o1"}}},
+				bson.M{"_id": bson.M{"$in": []string{"w1"}}},
+				bson.M{"initialInput.reportId": bson.M{"$in": []string{"r1"}}},
+			}}}},
+		},
+		{
+			name:    "ids combine with a time window",
+			filters: SummaryFilters{OrderIDs: []string{"o1"}, StartTime: 100, EndTime: 200},
+			want: bson.M{"$and": bson.A{
+				bson.M{"$or": bson.A{bson.M{"orderId": bson.M{"$in": []string{"o1"}}}}},
+				bson.M{"createdAt": bson.M{"$gte": int64(100), "$lt": int64(200)}},
+			}},
+		},
+		{
+			name:    "inverted startTime and endTime are still accepted",
+			filters: SummaryFilters{Source: "SIM", StartTime: 200, EndTime: 100},
+			want: bson.M{"$and": bson.A{
+				bson.M{"initialInput.source": "SIM"},
+				bson.M{"createdAt": bson.M{"$gte": int64(100), "$lt": int64(200)}},
+			}},
+		},
+		{
+			name:    "open ended range",
+			filters: SummaryFilters{FinishedAt: &TimeRange{From: 100}},
+			want:    bson.M{"$and": bson.A{bson.M{"finishedAt": bson.M{"$gte": int64(100)}}}},
+		},
+		{
+			name:    "status and flowType",
+			filters: SummaryFilters{Statuses: []string{"finished"}, FlowTypes: []string{"Twister"}},
+			want: bson.M{"$and": bson.A{
+				bson.M{"status": bson.M{"$in": []string{"finished"}}},
+				bson.M{"flowType": bson.M{"$in": []string{"Twister"}}},
+			}},
+		},
+		{
+			name:    "stuck in task",
+			filters: SummaryFilters{StuckInTask: "BuildingDetection"},
+			want: bson.M{"$and": bson.A{bson.M{
+				"status":                         enums.WorkflowInProgress,
+				"runningState.BuildingDetection": bson.M{"$in": bson.A{enums.StepSubmitted, enums.StepRunning}},
+			}}},
+		},
+		{
+			name:    "legacy keeps the inverted translation",
+			filters: SummaryFilters{Legacy: true, Source: "SIM", StartTime: 200, EndTime: 100},
+			want:    bson.M{"createdAt": bson.M{"$lt": int64(200), "$gt": int64(100)}, "initialInput.source": "SIM"},
+		},
+		{name: "unknown status", filters: SummaryFilters{Statuses: []string{"done"}}, invalid: true},
+		{name: "createdAt with startTime", filters: SummaryFilters{CreatedAt: &TimeRange{From: 1}, StartTime: 2}, invalid: true},
+		{name: "empty range", filters: SummaryFilters{CreatedAt: &TimeRange{From: 200, To: 100}}, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := buildSummaryQuery(context.Background(), test.filters)
+			if test.invalid {
+				assert.ErrorIs(t, err, ErrInvalidSummaryFilters)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, query)
+		})
+	}
+}
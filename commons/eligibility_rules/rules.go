@@ -0,0 +1,279 @@
+package eligibility_rules
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
+	"github.eagleview.com/engineering/symphony-service/commons/field_path"
+)
+
+const (
+	// KnownFields lists, comma separated, the fields of the parcel in the SIM job callback rules may use on top of
+	// the ones the default rules read. A field is written without its selectors, structures.roof._outline.value.
+	KnownFields = "EligibilityKnownFields"
+
+	SingleBuildingRule  = "singleBuilding"
+	MainFacetCountRule  = "mainStructureFacetCount"
+	BuildingCountField  = "_detectedBuildingCount.value"
+	MainFacetCountField = "structures[_type.value=main].roof._countRoofFacets.value"
+)
+
+// operators a rule compares the parcel field with
+const (
+	OperatorEq         = "eq"
+	OperatorNe         = "ne"
+	OperatorIn         = "in"
+	OperatorNotIn      = "notIn"
+	OperatorGt         = "gt"
+	OperatorGte        = "gte"
+	OperatorLt         = "lt"
+	OperatorLte        = "lte"
+	OperatorExists     = "exists"
+	OperatorMissing    = "missing"
+	OperatorMaxAgeDays = "maxAgeDays"
+)
+
+var (
+	dateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+	// attributeFields are the fields PDW reports on every detected attribute
+	attributeFields = []string{"imagery", "marker", "meta", "source", "value"}
+	// defaultFields are the attributes of the parcel the default rules read, any other field comes from KnownFields
+	defaultFields = []string{"_detectedBuildingCount", "structures._type", "structures.roof._countRoofFacets"}
+)
+
+// Rule checks one field of the PDW parcel. Field is a dotted path where a list segment is followed by an index,
+// [0], or by the filter of the element to pick, [_type.value=main]. MaxAgeDays reads the field as a date and passes
+// when it is at most Value days old.
+type Rule struct {
+	Name     string        `json:"name"`
+	Field    string        `json:"field"`
+	Operator string        `json:"operator"`
+	Value    interface{}   `json:"value"`
+	Values   []interface{} `json:"values"`
+}
+
+// Result is the outcome of one rule, Value is the parcel field it was evaluated against.
+type Result struct {
+	Name   string      `json:"name"`
+	Passed bool        `json:"passed"`
+	Value  interface{} `json:"value"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// RuleSet holds the rules an order has to pass to be measured by Hipster.
+type RuleSet []Rule
+
+// Default accepts parcels with a single building whose main structure has 1, 2 or 4 roof facets.
+func Default() RuleSet {
+	return RuleSet{
+		{Name: SingleBuildingRule, Field: BuildingCountField, Operator: OperatorEq, Value: 1.0},
+		{Name: MainFacetCountRule, Field: MainFacetCountField, Operator: OperatorIn, Values: []interface{}{1.0, 2.0, 4.0}},
+	}
+}
+
+// Fields returns the fields rules may use, the ones of the attributes the default rules read and the ones listed
+// in KnownFields.
+func Fields() map[string]bool {
+	fields := map[string]bool{}
+	for _, attribute := range defaultFields {
+		for _, field := range attributeFields {
+			fields[attribute+"."+field] = true
+		}
+	}
+	for _, field := range strings.Split(os.Getenv(KnownFields), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields[field] = true
+		}
+	}
+	return fields
+}
+
+// Validate reports every problem of the rules, a rule reading a field that is not known would never pass.
+func (ruleSet RuleSet) Validate() error {
+	problems := config_loader.Problems{}
+	names := map[string]bool{}
+	known := Fields()
+	if len(ruleSet) == 0 {
+		problems.Add("at least one rule is needed")
+	}
+	for i, rule := range ruleSet {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+			problems.Add("%s has no name", name)
+		} else if names[name] {
+			problems.Add("%s is used by several rules", name)
+		}
+		names[name] = true
+		if path, err := field_path.Parse(rule.Field); err != nil {
+			problems.Add("%s has an invalid field: %s", name, err)
+		} else {
+			for _, field := range unknownFields(path, known) {
+				problems.Add("%s reads %s which is not a known parcel field, list it in %s", name, field, KnownFields)
+			}
+		}
+		switch rule.Operator {
+		case OperatorEq, OperatorNe:
+			if rule.Value == nil {
+				problems.Add("%s has no value", name)
+			}
+		case OperatorIn, OperatorNotIn:
+			if len(rule.Values) == 0 {
+				problems.Add("%s has no values", name)
+			}
+		case OperatorGt, OperatorGte, OperatorLt, OperatorLte, OperatorMaxAgeDays:
+			if _, ok := toNumber(rule.Value); !ok {
+				problems.Add("%s should compare with a number", name)
+			}
+		case OperatorExists, OperatorMissing:
+		default:
+			problems.Add("%s has unsupported operator %s", name, rule.Operator)
+		}
+	}
+	return problems.Err("eligibility rules")
+}
+
+// unknownFields returns the field of path and the fields its filters read when they are not known. A field is
+// known when it, or a field below it, is.
+func unknownFields(path field_path.Path, known map[string]bool) []string {
+	fields := []string{path.Shape()}
+	for i, segment := range path {
+		if segment.FilterField == "" {
+			continue
+		}
+		filter, err := field_path.Parse(segment.FilterField)
+		if err != nil {
+			fields = append(fields, segment.FilterField)
+			continue
+		}
+		fields = append(fields, path[:i+1].Shape()+"."+filter.Shape())
+	}
+	unknown := []string{}
+	for _, field := range fields {
+		if !isKnown(field, known) {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func isKnown(field string, known map[string]bool) bool {
+	if known[field] {
+		return true
+	}
+	for knownField := range known {
+		if strings.HasPrefix(knownField, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs every rule against the parcel document, the order is Hipster compatible when all of them pass.
+func (ruleSet RuleSet) Evaluate(document map[string]interface{}, now time.Time) []Result {
+	results := []Result{}
+	for _, rule := range ruleSet {
+		results = append(results, rule.evaluate(document, now))
+	}
+	return results
+}
+
+func (rule Rule) evaluate(document map[string]interface{}, now time.Time) Result {
+	value, found := field_path.Lookup(document, rule.Field)
+	result := Result{Name: rule.Name, Value: value}
+	switch rule.Operator {
+	case OperatorExists:
+		result.Passed = found
+	case OperatorMissing:
+		result.Passed = !found
+	default:
+		if !found {
+			result.Reason = rule.Field + " is missing"
+			return result
+		}
+	}
+	switch rule.Operator {
+	case OperatorEq:
+		result.Passed = sameValue(value, rule.Value)
+	case OperatorNe:
+		result.Passed = !sameValue(value, rule.Value)
+	case OperatorIn, OperatorNotIn:
+		in := false
+		for _, allowed := range rule.Values {
+			in = in || sameValue(value, allowed)
+		}
+		result.Passed = in == (rule.Operator == OperatorIn)
+	case OperatorGt, OperatorGte, OperatorLt, OperatorLte:
+		number, ok := toNumber(value)
+		if !ok {
+			result.Reason = rule.Field + " is not a number"
+			return result
+		}
+		limit, _ := toNumber(rule.Value)
+		result.Passed = compare(number, limit, rule.Operator)
+	case OperatorMaxAgeDays:
+		date, ok := toDate(value)
+		if !ok {
+			result.Reason = rule.Field + " is not a date"
+			return result
+		}
+		days, _ := toNumber(rule.Value)
+		result.Passed = now.Sub(date).Hours() <= days*24
+	}
+	if !result.Passed {
+		result.Reason = fmt.Sprintf("%s %v does not satisfy %s", rule.Field, value, rule.Operator)
+	}
+	return result
+}
+
+func compare(number, limit float64, operator string) bool {
+	switch operator {
+	case OperatorGt:
+		return number > limit
+	case OperatorGte:
+		return number >= limit
+	case OperatorLt:
+		return number < limit
+	}
+	return number <= limit
+}
+
+func sameValue(value, expected interface{}) bool {
+	number, isNumber := toNumber(value)
+	expectedNumber, expectedIsNumber := toNumber(expected)
+	if isNumber && expectedIsNumber {
+		return number == expectedNumber
+	}
+	return fmt.Sprint(value) == fmt.Sprint(expected)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func toDate(value interface{}) (time.Time, bool) {
+	text, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, text); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,134 @@
+package eligibility_rules
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/mocks"
+)
+
+func TestDefaultRulesAreValid(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+}
+
+func TestEvaluate(t *testing.T) {
+	document := map[string]interface{}{
+		"_detectedBuildingCount": map[string]interface{}{"value": 1.0},
+		"structures": []interface{}{
+			map[string]interface{}{"_type": map[string]interface{}{"value": "garage"}, "roof": map[string]interface{}{"_countRoofFacets": map[string]interface{}{"value": 2.0}}},
+			map[string]interface{}{"_type": map[string]interface{}{"value": "main"}, "roof": map[string]interface{}{"_countRoofFacets": map[string]interface{}{"value": 6.0}}},
+		},
+	}
+	assert.Equal(t, []Result{
+		{Name: SingleBuildingRule, Passed: true, Value: 1.0},
+		{Name: MainFacetCountRule, Value: 6.0, Reason: MainFacetCountField + " 6 does not satisfy in"},
+	}, Default().Evaluate(document, time.Now()))
+
+	ruleSet := RuleSet{
+		{Name: "outlined", Field: "structures[1]._outline.value", Operator: OperatorMissing},
+		{Name: "smallGarage", Field: "structures[_type.value=garage].roof._countRoofFacets.value", Operator: OperatorLte, Value: 2.0},
+		{Name: "noPool", Field: "_detectedPoolCount.value", Operator: OperatorEq, Value: 0.0},
+	}
+	assert.Equal(t, []Result{
+		{Name: "outlined", Passed: true},
+		{Name: "smallGarage", Passed: true, Value: 2.0},
+		{Name: "noPool", Reason: "_detectedPoolCount.value is missing"},
+	}, ruleSet.Evaluate(document, time.Now()))
+}
+
+func TestEvaluateMarkerAge(t *testing.T) {
+	ruleSet := RuleSet{{Name: "freshDetection", Field: "_detectedBuildingCount.marker", Operator: OperatorMaxAgeDays, Value: 30.0}}
+	now := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	for marker, passed := range map[string]bool{"2022-04-10": true, "2022-04-09T23:00:00Z": false, "2022-05-01T08:00:00": true} {
+		results := ruleSet.Evaluate(map[string]interface{}{"_detectedBuildingCount": map[string]interface{}{"marker": marker}}, now)
+		assert.Equal(t, passed, results[0].Passed, marker)
+	}
+	results := ruleSet.Evaluate(map[string]interface{}{"_detectedBuildingCount": map[string]interface{}{"marker": "last spring"}}, now)
+	assert.Equal(t, Result{Name: "freshDetection", Value: "last spring", Reason: "_detectedBuildingCount.marker is not a date"}, results[0])
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	t.Setenv(EligibilityRules, `[
+		{"name": "pool", "field": "_detectedPoolCount.value", "operator": "like", "value": 0},
+		{"name": "pool", "field": "structures[main.roof", "operator": "exists"},
+		{"field": "_detectedBuildingCount.value", "operator": "gt", "value": "one"},
+		{"name": "facets", "field": "structures[_type.value=main].roof._countRoofFacets.value", "operator": "in"}
+	]`)
+	_, err := Load(context.Background(), nil)
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.ErrorLoadingEligibilityRules, err.(error_handler.ICodedError).GetErrorCode())
+	for _, problem := range []string{
+		"pool has unsupported operator like",
+		"pool is used by several rules",
+		"pool has an invalid field: unbalanced brackets in structures[main.roof",
+		"rule 3 has no name",
+		"rule 3 should compare with a number",
+		"facets has no values",
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	t.Setenv(EligibilityRules, `[
+		{"name": "noPool", "field": "_hasPool.value", "operator": "ne", "value": true},
+		{"name": "simpleRoof", "field": "structures[_kind.value=main].roof._roofComplexity.value", "operator": "eq", "value": "simple"},
+		{"name": "outlined", "field": "structures[0]._outline", "operator": "exists"}
+	]`)
+	_, err := Load(context.Background(), nil)
+	assert.Contains(t, err.Error(), "invalid eligibility rules: noPool reads _hasPool.value which is not a known parcel field, list it in EligibilityKnownFields; "+
+		"simpleRoof reads structures._kind.value which is not a known parcel field, list it in EligibilityKnownFields; "+
+		"simpleRoof reads structures.roof._roofComplexity.value which is not a known parcel field, list it in EligibilityKnownFields; "+
+		"outlined reads structures._outline which is not a known parcel field, list it in EligibilityKnownFields")
+
+	t.Setenv(KnownFields, "_hasPool.value,structures._kind.value, structures.roof._roofComplexity.value,structures._outline.value")
+	loaded, err := Load(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Len(t, loaded, 3)
+}
+
+func TestLoadFromS3(t *testing.T) {
+	awsClient := new(mocks.IAWSClient)
+	t.Setenv(EligibilityRulesS3Path, "s3://config/eligibility.json")
+	t.Setenv(KnownFields, "structures._outline.value")
+	awsClient.On("FetchS3BucketPath", "s3://config/eligibility.json").Return("config", "/eligibility.json", nil)
+	awsClient.On("GetDataFromS3", mock.Anything, "config", "/eligibility.json").Return([]byte(`[{"name": "outlined", "field": "structures[0]._outline.value", "operator": "exists"}]`), nil)
+
+	loaded, err := Load(context.Background(), awsClient)
+	assert.NoError(t, err)
+	assert.Equal(t, RuleSet{{Name: "outlined", Field: "structures[0]._outline.value", Operator: OperatorExists}}, loaded)
+}
+
+func TestStoreRefreshesRules(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	outlined := RuleSet{{Name: "outlined", Field: "structures[0]._outline.value", Operator: OperatorExists}}
+	awsClient := new(mocks.IAWSClient)
+	t.Setenv(EligibilityRulesS3Path, "s3://config/eligibility.json")
+	t.Setenv(RefreshMinutes, "10")
+	t.Setenv(KnownFields, "structures._outline.value")
+	awsClient.On("FetchS3BucketPath", "s3://config/eligibility.json").Return("config", "/eligibility.json", nil)
+	awsClient.On("GetDataFromS3", mock.Anything, "config", "/eligibility.json").Return([]byte(`[{"name": "singleBuilding", "field": "_detectedBuildingCount.value", "operator": "eq", "value": 1}]`), nil).Once()
+	awsClient.On("GetDataFromS3", mock.Anything, "config", "/eligibility.json").Return([]byte(`[{"name": "outlined", "field": "structures[0]._outline.value", "operator": "exists"}]`), nil).Once()
+	awsClient.On("GetDataFromS3", mock.Anything, "config", "/eligibility.json").Return(nil, errors.New("access denied")).Once()
+
+	store, err := NewStore(ctx, awsClient, start)
+	assert.NoError(t, err)
+	assert.Equal(t, SingleBuildingRule, store.Rules(ctx, start.Add(9*time.Minute))[0].Name)
+	assert.Equal(t, outlined, store.Rules(ctx, start.Add(10*time.Minute)))
+	assert.Equal(t, outlined, store.Rules(ctx, start.Add(20*time.Minute)), "a failed refresh keeps the previous rules")
+	assert.Equal(t, outlined, store.Rules(ctx, start.Add(25*time.Minute)))
+	awsClient.AssertNumberOfCalls(t, "GetDataFromS3", 3)
+}
+
+func TestNewStoreRejectsInvalidRefreshInterval(t *testing.T) {
+	t.Setenv(RefreshMinutes, "often")
+	_, err := NewStore(context.Background(), nil, time.Now())
+	assert.Equal(t, error_codes.ErrorLoadingEligibilityRules, err.(error_handler.ICodedError).GetErrorCode())
+}
@@ -0,0 +1,94 @@
+package eligibility_rules
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+)
+
+const (
+	EligibilityRules       = "EligibilityRules"
+	EligibilityRulesS3Path = "EligibilityRulesS3Path"
+	// RefreshMinutes is how long loaded rules are used before they are read again, 0 reads them only once.
+	RefreshMinutes = "EligibilityRulesRefreshMinutes"
+
+	defaultRefreshMinutes = 15
+)
+
+// Source is where the rules are read from.
+var Source = config_loader.Source{
+	Name:  "eligibility rules",
+	Env:   EligibilityRules,
+	S3Env: EligibilityRulesS3Path,
+	Code:  error_codes.ErrorLoadingEligibilityRules,
+}
+
+// Load reads the rules from the EligibilityRules JSON, or from the S3 object at EligibilityRulesS3Path, and falls
+// back to the default rules without either.
+func Load(ctx context.Context, s3 config_loader.S3Reader) (RuleSet, error) {
+	loaded := RuleSet{}
+	found, err := Source.Decode(ctx, s3, &loaded)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		loaded = Default()
+		if err = Source.Validate(loaded); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// Store keeps the loaded rules and reads them again once they are older than its refresh interval, so a change of
+// the S3 object is picked up without a deploy.
+type Store struct {
+	s3       config_loader.S3Reader
+	interval time.Duration
+
+	mutex    sync.Mutex
+	rules    RuleSet
+	loadedAt time.Time
+}
+
+// NewStore loads the rules, failing like Load, and refreshes them every EligibilityRulesRefreshMinutes.
+func NewStore(ctx context.Context, s3 config_loader.S3Reader, now time.Time) (*Store, error) {
+	minutes := defaultRefreshMinutes
+	if value := os.Getenv(RefreshMinutes); value != "" {
+		var err error
+		if minutes, err = strconv.Atoi(value); err != nil || minutes < 0 {
+			return nil, error_handler.NewServiceError(error_codes.ErrorLoadingEligibilityRules,
+				RefreshMinutes+" should be a number of minutes, got "+value)
+		}
+	}
+	rules, err := Load(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{s3: s3, interval: time.Duration(minutes) * time.Minute, rules: rules, loadedAt: now}, nil
+}
+
+// Rules returns the current rules, read again when the refresh interval has passed. A failed refresh is logged and
+// keeps the previous rules until the next interval.
+func (store *Store) Rules(ctx context.Context, now time.Time) RuleSet {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.interval == 0 || now.Sub(store.loadedAt) < store.interval {
+		return store.rules
+	}
+	store.loadedAt = now
+	rules, err := Load(ctx, store.s3)
+	if err != nil {
+		log.Error(ctx, "error refreshing the eligibility rules, keeping the previous ones", err)
+		return store.rules
+	}
+	store.rules = rules
+	return rules
+}
@@ -0,0 +1,30 @@
+package enums
+
+type Priority string
+
+const (
+	PriorityRush     Priority = "rush"
+	PriorityStandard Priority = "standard"
+	PriorityBulk     Priority = "bulk"
+)
+
+func PriorityList() []string {
+	return []string{string(PriorityRush), string(PriorityStandard), string(PriorityBulk)}
+}
+
+// ParsePriority returns the priority named by value, orders without one are standard.
+func ParsePriority(value string) (Priority, bool) {
+	if value == "" {
+		return PriorityStandard, true
+	}
+	for _, p := range PriorityList() {
+		if p == value {
+			return Priority(value), true
+		}
+	}
+	return "", false
+}
+
+func (p Priority) String() string {
+	return string(p)
+}
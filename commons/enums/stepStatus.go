@@ -0,0 +1,64 @@
+package enums
+
+type StepStatus string
+
+const (
+	StepRunning   StepStatus = "running"
+	StepSubmitted StepStatus = "submitted"
+	StepSuccess   StepStatus = "success"
+	StepFailure   StepStatus = "failure"
+)
+
+// stepTransitions lists the statuses a step can move to, "" is a step that is not recorded yet.
+var stepTransitions = map[StepStatus][]StepStatus{
+	"":            {StepRunning, StepSubmitted, StepSuccess, StepFailure},
+	StepRunning:   {StepSuccess, StepFailure},
+	StepSubmitted: {StepSuccess, StepFailure},
+	StepSuccess:   {},
+	StepFailure:   {},
+}
+
+func StepStatusList() []string {
+	return []string{string(StepRunning), string(StepSubmitted), string(StepSuccess), string(StepFailure)}
+}
+
+func (s StepStatus) String() string {
+	return string(s)
+}
+
+func (s StepStatus) IsTerminal() bool {
+	next, ok := stepTransitions[s]
+	return ok && len(next) == 0
+}
+
+func (s StepStatus) CanTransitionTo(next StepStatus) bool {
+	for _, v := range stepTransitions[s] {
+		if v == next {
+			return true
+		}
+	}
+	return false
+}
+
+// StepStatusesBefore returns every status from which a step can move to next.
+func StepStatusesBefore(next StepStatus) []StepStatus {
+	from := []StepStatus{}
+	for _, s := range []StepStatus{"", StepRunning, StepSubmitted, StepSuccess, StepFailure} {
+		if s.CanTransitionTo(next) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
+
+// StepStatusAfterCallout is the status recorded for a step once its callout returns,
+// a wait task that was called out successfully keeps running until its callback.
+func StepStatusAfterCallout(isWaitTask, succeeded bool) StepStatus {
+	if !succeeded {
+		return StepFailure
+	}
+	if isWaitTask {
+		return StepRunning
+	}
+	return StepSuccess
+}
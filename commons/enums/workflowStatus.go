@@ -0,0 +1,50 @@
+package enums
+
+type WorkflowStatus string
+
+const (
+	WorkflowInProgress WorkflowStatus = "inprogress"
+	WorkflowFinished   WorkflowStatus = "finished"
+	WorkflowAborted    WorkflowStatus = "aborted"
+)
+
+// workflowTransitions lists the statuses a workflow can move to, "" is a workflow that is not recorded yet.
+var workflowTransitions = map[WorkflowStatus][]WorkflowStatus{
+	"":                 {WorkflowInProgress},
+	WorkflowInProgress: {WorkflowFinished, WorkflowAborted},
+	WorkflowFinished:   {},
+	WorkflowAborted:    {},
+}
+
+func WorkflowStatusList() []string {
+	return []string{string(WorkflowInProgress), string(WorkflowFinished), string(WorkflowAborted)}
+}
+
+func (s WorkflowStatus) String() string {
+	return string(s)
+}
+
+func (s WorkflowStatus) IsTerminal() bool {
+	next, ok := workflowTransitions[s]
+	return ok && len(next) == 0
+}
+
+func (s WorkflowStatus) CanTransitionTo(next WorkflowStatus) bool {
+	for _, v := range workflowTransitions[s] {
+		if v == next {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkflowStatusesBefore returns every status from which a workflow can move to next.
+func WorkflowStatusesBefore(next WorkflowStatus) []WorkflowStatus {
+	from := []WorkflowStatus{}
+	for _, s := range []WorkflowStatus{"", WorkflowInProgress, WorkflowFinished, WorkflowAborted} {
+		if s.CanTransitionTo(next) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
@@ -83,6 +83,18 @@ const (
 	ErrorRetrievingMsgCode        = 4066
 	ErrorUnknownSource            = 4067
 	ErrorFromGeocodingService     = 4068
+
+	ErrorValidatingCallBackResponse = 4069
+	ErrorCancellingVendorJob        = 4070
+	IllegalStepStatusTransition     = 4071
+	ErrorBootstrappingDBSchema      = 4072
+	InvalidSummaryFilters           = 4073
+	InvalidMetricsWindow            = 4074
+	ErrorFetchingWorkflowMetrics    = 4075
+	WorkflowExecutionAborted        = 4076
+	ErrorArchivingWorkflow          = 4077
+	ErrorRestoringWorkflow          = 4078
+	ErrorLoadingSourceRoutes        = 4079
 )
 
 // Messagecodes map for async tasks from callback range 4080-4100
@@ -98,3 +110,22 @@ var AsyncTaskMsgCodeMap = map[string]interface{}{
 	"UpdateHipsterJobAndWaitForQC":          4088,
 	"ConvertPropertyModelToEVJson":          4089,
 }
+
+// Service errors from 4101 on, after the callback message code range
+const (
+	DuplicateExecutionConflict   = 4101
+	ErrorLoadingPriorityLanes    = 4102
+	ErrorReservingHipsterSlot    = 4103
+	ErrorReleasingHipsterSlot    = 4104
+	ErrorLoadingThrottlePolicy   = 4105
+	ErrorLoadingExecutionPaths   = 4106
+	ErrorLoadingEligibilityRules = 4107
+	ErrorBuildingGraphQuery      = 4108
+	InvalidPDWBatch              = 4109
+	ErrorLoadingFreshAttributes  = 4110
+	InvalidVintage               = 4111
+	ErrorLoadingGeocoders        = 4112
+	ErrorLoadingGeometryPolicy   = 4113
+	ErrorReservingPriorityLane   = 4114
+	ErrorReleasingPriorityLane   = 4115
+)
@@ -0,0 +1,369 @@
+package execution_path
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+)
+
+const (
+	Hipster = "Hipster"
+	Twister = "Twister"
+
+	WindowDay  = "day"
+	WindowHour = "hour"
+
+	// ExecutionPaths is the JSON list of paths added to, or replacing by name, the built-in ones
+	ExecutionPaths = "ExecutionPaths"
+	// ExecutionRoutes lists, comma separated, the routes the Hipster/Twister Choice state of the state machine
+	// matches, terraform reads them from the machine definition. Without it only RouteHipster is matched.
+	ExecutionRoutes = "ExecutionRoutes"
+	// legacyPMFTasks is the comma separated PMF task list read before the registry, PMFTasks replaced it
+	legacyPMFTasks = "tasksWithPMFOutput"
+)
+
+// Routes are the branches of the state machine a path sends its workflows down, the Hipster/Twister Choice state
+// matches on them. RouteHipster runs the Hipster jobs, RouteDefault is the Default of the Choice and goes straight
+// to the PMF conversion. A vendor gets its own branch with a Choice on its route, listed in ExecutionRoutes.
+const (
+	RouteHipster = "hipster"
+	RouteDefault = "default"
+)
+
+var (
+	pathsSource = config_loader.Source{Name: "execution paths", Env: ExecutionPaths, Code: error_codes.ErrorLoadingExecutionPaths}
+)
+
+// Eligibility tells which orders may take a path, an empty ProductTypes list accepts every product. EnabledFlag
+// names an execution input flag that has to be true for the order to take the path.
+type Eligibility struct {
+	ProductTypes     []string `json:"productTypes"`
+	AllowPenetration bool     `json:"allowPenetration"`
+	EnabledFlag      string   `json:"enabledFlag"`
+}
+
+// Quota is the limit applied to the path when no throttle policy is configured, read from the LimitEnv variable.
+type Quota struct {
+	LimitEnv string `json:"limitEnv"`
+	Window   string `json:"window"`
+}
+
+// LegacyStatus holds the legacy status keys reported for the path. Incomplete is reported when the first PMF task
+// of the path ran but its last one was never reached.
+type LegacyStatus struct {
+	Completed  string `json:"completed"`
+	Incomplete string `json:"incomplete"`
+}
+
+// FailedTask is the legacy status reported when a task of the path fails and the task the workflow falls back to.
+type FailedTask struct {
+	StatusKey        string `json:"statusKey"`
+	FallbackTaskName string `json:"fallbackTaskName"`
+}
+
+// Path is an execution path a workflow can take to get measured. PMFTasks are the tasks producing a property
+// model file, in the order they run. Exactly one path is the Default one, taken by orders no other path accepts.
+// Route is the state machine branch running the tasks of the path.
+type Path struct {
+	Name         string                `json:"name"`
+	Default      bool                  `json:"default"`
+	Route        string                `json:"route"`
+	Eligibility  Eligibility           `json:"eligibility"`
+	Quota        *Quota                `json:"quota"`
+	LegacyStatus LegacyStatus          `json:"legacyStatus"`
+	PMFTasks     []string              `json:"pmfTasks"`
+	FailedTasks  map[string]FailedTask `json:"failedTasks"`
+}
+
+// Order is what the eligibility of a path is checked against.
+type Order struct {
+	ProductType   string
+	IsPenetration bool
+	Flags         map[string]bool
+}
+
+// Registry is the ordered list of execution paths, the first eligible path is the preferred one.
+type Registry []Path
+
+var registry = DefaultRegistry()
+
+// DefaultRegistry returns the built-in paths, Hipster for its compatible products and Twister for every order.
+func DefaultRegistry() Registry {
+	return Registry{
+		{
+			Name:  Hipster,
+			Route: RouteHipster,
+			Eligibility: Eligibility{
+				ProductTypes: enums.ProductTypeList(),
+				EnabledFlag:  "isHipsterEnabled",
+			},
+			Quota:        &Quota{LimitEnv: "AllowedHipsterCount", Window: WindowDay},
+			LegacyStatus: LegacyStatus{Completed: "QCCompleted", Incomplete: "MeasurementFailed"},
+			PMFTasks:     []string{"CreateHipsterJobAndWaitForMeasurement", "UpdateHipsterJobAndWaitForQC"},
+			FailedTasks: map[string]FailedTask{
+				"CreateHipsterJobAndWaitForMeasurement": {
+					StatusKey:        "MeasurementFailed",
+					FallbackTaskName: "3DModellingService",
+				},
+				"UpdateHipsterJobAndWaitForQC": {
+					StatusKey:        "QCFailed",
+					FallbackTaskName: "CreateHipsterJobAndWaitForMeasurement",
+				},
+				"UpdateHipsterJobAndWaitForMeasurement": {
+					StatusKey:        "MeasurementFailed",
+					FallbackTaskName: "3DModellingService",
+				},
+				"UpdateHipsterMeasurementCompleteInLegacy": {
+					StatusKey:        "MeasurementFailed",
+					FallbackTaskName: "3DModellingService",
+				},
+				"CheckIsMultiStructure": {
+					StatusKey:        "MACompleted",
+					FallbackTaskName: "3DModellingService",
+				},
+			},
+		},
+		{
+			Name:         Twister,
+			Default:      true,
+			Route:        RouteDefault,
+			Eligibility:  Eligibility{AllowPenetration: true},
+			LegacyStatus: LegacyStatus{Completed: "MACompleted"},
+			PMFTasks:     []string{"3DModellingService"},
+		},
+	}
+}
+
+// Paths returns the registry used by this process, the built-in one unless Load replaced it.
+func Paths() Registry {
+	return registry
+}
+
+// Use makes paths the registry returned by Paths.
+func Use(paths Registry) {
+	registry = paths
+}
+
+// Load adds the paths of the ExecutionPaths JSON to the built-in ones, a path named like a built-in one replaces
+// it. The result is validated and becomes the registry returned by Paths. A leftover tasksWithPMFOutput variable
+// is ignored, the tasks it lists that no path produces a PMF in are logged.
+func Load() (Registry, error) {
+	paths := DefaultRegistry()
+	data, found, err := pathsSource.Read(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		configured := []Path{}
+		if err = json.Unmarshal(data, &configured); err != nil {
+			return nil, error_handler.NewServiceError(error_codes.ErrorLoadingExecutionPaths, "invalid execution paths: "+err.Error())
+		}
+		for _, path := range configured {
+			paths = paths.with(path)
+		}
+	}
+	if err = pathsSource.Validate(paths); err != nil {
+		return nil, err
+	}
+	warnLegacyPMFTasks(paths)
+	Use(paths)
+	return paths, nil
+}
+
+func warnLegacyPMFTasks(paths Registry) {
+	tasks := os.Getenv(legacyPMFTasks)
+	if tasks == "" {
+		return
+	}
+	ignored := []string{}
+	for _, task := range strings.Split(tasks, ",") {
+		if task = strings.TrimSpace(task); task != "" {
+			if _, ok := paths.PMFTaskOwner(task); !ok {
+				ignored = append(ignored, task)
+			}
+		}
+	}
+	message := fmt.Sprintf("%s is deprecated and no longer read, the pmfTasks of the %s paths replace it", legacyPMFTasks, ExecutionPaths)
+	if len(ignored) > 0 {
+		message += fmt.Sprintf(", no path produces a PMF in %s", strings.Join(ignored, ", "))
+	}
+	log.Error(context.Background(), message)
+}
+
+// Routes returns the routes a path may take, the ones of ExecutionRoutes, RouteHipster without it, and RouteDefault.
+func Routes() []string {
+	routes := []string{RouteHipster}
+	if configured := os.Getenv(ExecutionRoutes); configured != "" {
+		routes = []string{}
+		for _, route := range strings.Split(configured, ",") {
+			if route = strings.TrimSpace(route); route != "" && route != RouteDefault {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return append(routes, RouteDefault)
+}
+
+func (paths Registry) with(path Path) Registry {
+	for i := range paths {
+		if paths[i].Name == path.Name {
+			paths[i] = path
+			return paths
+		}
+	}
+	return append(paths, path)
+}
+
+// Validate reports every problem of the registry.
+func (paths Registry) Validate() error {
+	problems := config_loader.Problems{}
+	names := map[string]bool{}
+	tasks := map[string]string{}
+	routes := Routes()
+	defaults := 0
+	for i, path := range paths {
+		name := path.Name
+		if name == "" {
+			name = fmt.Sprintf("path %d", i+1)
+			problems.Add("%s has no name", name)
+		} else if names[name] {
+			problems.Add("%s is registered several times", name)
+		}
+		names[name] = true
+		if path.Default {
+			defaults++
+			if path.Quota != nil {
+				problems.Add("%s is the default path and cannot have a quota", name)
+			}
+		}
+		if path.Quota != nil && path.Quota.Window != WindowDay && path.Quota.Window != WindowHour {
+			problems.Add("%s has unsupported quota window %s", name, path.Quota.Window)
+		}
+		if !knownRoute(routes, path.Route) {
+			problems.Add("%s has unsupported route %q, expected one of %s", name, path.Route, strings.Join(routes, ", "))
+		}
+		if path.LegacyStatus.Completed == "" {
+			problems.Add("%s has no completed legacy status", name)
+		}
+		if len(path.PMFTasks) == 0 {
+			problems.Add("%s has no PMF task", name)
+		}
+		for _, task := range path.PMFTasks {
+			if owner, ok := tasks[task]; ok && owner != name {
+				problems.Add("%s and %s both produce a PMF in %s", owner, name, task)
+			}
+			tasks[task] = name
+		}
+	}
+	if defaults != 1 {
+		problems.Add("exactly one path should be the default one, found %d", defaults)
+	}
+	return problems.Err("execution paths")
+}
+
+func knownRoute(routes []string, route string) bool {
+	for _, known := range routes {
+		if route == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the path registered as name.
+func (paths Registry) Get(name string) (Path, bool) {
+	for _, path := range paths {
+		if path.Name == name {
+			return path, true
+		}
+	}
+	return Path{}, false
+}
+
+// Default returns the path taken by orders no other path accepts.
+func (paths Registry) Default() Path {
+	for _, path := range paths {
+		if path.Default {
+			return path
+		}
+	}
+	return Path{}
+}
+
+// Names lists the registered paths in order.
+func (paths Registry) Names() []string {
+	names := []string{}
+	for _, path := range paths {
+		names = append(names, path.Name)
+	}
+	return names
+}
+
+// Eligible returns the paths order may take, in registry order.
+func (paths Registry) Eligible(order Order) Registry {
+	eligible := Registry{}
+	for _, path := range paths {
+		if path.Accepts(order) {
+			eligible = append(eligible, path)
+		}
+	}
+	return eligible
+}
+
+// PMFTaskOwner returns the path whose PMF tasks include task.
+func (paths Registry) PMFTaskOwner(task string) (Path, bool) {
+	for _, path := range paths {
+		if path.ProducesPMF(task) {
+			return path, true
+		}
+	}
+	return Path{}, false
+}
+
+// FailedTasks merges the failed tasks of every path.
+func (paths Registry) FailedTasks() map[string]FailedTask {
+	failed := map[string]FailedTask{}
+	for _, path := range paths {
+		for task, status := range path.FailedTasks {
+			failed[task] = status
+		}
+	}
+	return failed
+}
+
+// Accepts tells whether order is eligible for the path.
+func (path Path) Accepts(order Order) bool {
+	if order.IsPenetration && !path.Eligibility.AllowPenetration {
+		return false
+	}
+	if path.Eligibility.EnabledFlag != "" && !order.Flags[path.Eligibility.EnabledFlag] {
+		return false
+	}
+	if len(path.Eligibility.ProductTypes) == 0 {
+		return true
+	}
+	for _, productType := range path.Eligibility.ProductTypes {
+		if productType == order.ProductType {
+			return true
+		}
+	}
+	return false
+}
+
+// ProducesPMF tells whether task is one of the PMF tasks of the path.
+func (path Path) ProducesPMF(task string) bool {
+	for _, pmfTask := range path.PMFTasks {
+		if pmfTask == task {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package execution_path
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+)
+
+const mobilePath = `[{"name": "Mobile", "route": "default", "eligibility": {"productTypes": ["Mobile"]}, "legacyStatus": {"completed": "MobileCompleted"}, "pmfTasks": ["MobileCapture"]}]`
+
+func TestDefaultRegistryIsValid(t *testing.T) {
+	paths := DefaultRegistry()
+	assert.NoError(t, paths.Validate())
+	assert.Equal(t, []string{Hipster, Twister}, paths.Names())
+	assert.Equal(t, Twister, paths.Default().Name)
+	for _, path := range paths {
+		assert.NotEmpty(t, path.Route, path.Name)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer Use(DefaultRegistry())
+
+	t.Run("built-in paths", func(t *testing.T) {
+		paths, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultRegistry(), paths)
+	})
+
+	t.Run("adds and replaces paths by name", func(t *testing.T) {
+		t.Setenv(ExecutionPaths, `[{"name": "Twister", "default": true, "route": "default", "legacyStatus": {"completed": "Modelled"}, "pmfTasks": ["3DModellingService"]}, `+mobilePath[1:])
+		paths, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{Hipster, Twister, "Mobile"}, paths.Names())
+		assert.Equal(t, "Modelled", paths.Default().LegacyStatus.Completed)
+		assert.Equal(t, paths, Paths())
+	})
+
+	t.Run("ignores the legacy PMF task list", func(t *testing.T) {
+		t.Setenv(legacyPMFTasks, "3DModellingService,CreateHipsterJobAndWaitForMeasurement,PMFConverter")
+		paths, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultRegistry(), paths)
+	})
+
+	t.Run("routes of the state machine", func(t *testing.T) {
+		vendorPath := `[{"name": "Vendor", "route": "vendor", "legacyStatus": {"completed": "VendorCompleted"}, "pmfTasks": ["VendorJob"]}]`
+		t.Setenv(ExecutionPaths, vendorPath)
+		_, err := Load()
+		assert.Contains(t, err.Error(), `Vendor has unsupported route \"vendor\", expected one of hipster, default`)
+
+		t.Setenv(ExecutionRoutes, "hipster, vendor")
+		paths, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{Hipster, Twister, "Vendor"}, paths.Names())
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		t.Setenv(ExecutionPaths, `{"name": "Mobile"}`)
+		_, err := Load()
+		assert.Equal(t, error_codes.ErrorLoadingExecutionPaths, err.(error_handler.ICodedError).GetErrorCode())
+	})
+}
+
+func TestRegistryValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(paths Registry) Registry
+		wantErr string
+	}{
+		{"no route", func(paths Registry) Registry { paths[0].Route = ""; return paths }, `Hipster has unsupported route "", expected one of hipster, default`},
+		{"unknown route", func(paths Registry) Registry { paths[0].Route = "vendor"; return paths }, `Hipster has unsupported route "vendor", expected one of hipster, default`},
+		{"quota on the default path", func(paths Registry) Registry {
+			paths[1].Quota = &Quota{LimitEnv: "AllowedTwisterCount", Window: WindowDay}
+			return paths
+		}, "Twister is the default path and cannot have a quota"},
+		{"unsupported window", func(paths Registry) Registry { paths[0].Quota.Window = "week"; return paths }, "Hipster has unsupported quota window week"},
+		{"shared PMF task", func(paths Registry) Registry {
+			paths[1].PMFTasks = []string{"UpdateHipsterJobAndWaitForQC"}
+			return paths
+		}, "Hipster and Twister both produce a PMF in UpdateHipsterJobAndWaitForQC"},
+		{"two defaults and a duplicate", func(paths Registry) Registry {
+			paths[0].Default, paths[0].Quota, paths[0].Name = true, nil, Twister
+			return paths
+		}, "Twister is registered several times; exactly one path should be the default one, found 2"},
+		{"missing statuses and tasks", func(paths Registry) Registry {
+			return append(paths, Path{Route: RouteDefault})
+		}, "path 3 has no name; path 3 has no completed legacy status; path 3 has no PMF task"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.change(DefaultRegistry()).Validate()
+			assert.EqualError(t, err, "invalid execution paths: "+test.wantErr)
+		})
+	}
+}
+
+func TestRegistryEligible(t *testing.T) {
+	paths := DefaultRegistry()
+	product := paths[0].Eligibility.ProductTypes[0]
+	enabled := map[string]bool{"isHipsterEnabled": true}
+
+	assert.Equal(t, []string{Hipster, Twister}, paths.Eligible(Order{ProductType: product, Flags: enabled}).Names())
+	assert.Equal(t, []string{Twister}, paths.Eligible(Order{ProductType: product}).Names())
+	assert.Equal(t, []string{Twister}, paths.Eligible(Order{ProductType: product, IsPenetration: true, Flags: enabled}).Names())
+	assert.Equal(t, []string{Twister}, paths.Eligible(Order{ProductType: "Unknown", Flags: enabled}).Names())
+}
+
+func TestRegistryTasks(t *testing.T) {
+	paths := DefaultRegistry()
+
+	owner, ok := paths.PMFTaskOwner("3DModellingService")
+	assert.True(t, ok)
+	assert.Equal(t, Twister, owner.Name)
+	_, ok = paths.PMFTaskOwner("CheckIsMultiStructure")
+	assert.False(t, ok)
+
+	failed := paths.FailedTasks()
+	assert.Equal(t, FailedTask{StatusKey: "QCFailed", FallbackTaskName: "CreateHipsterJobAndWaitForMeasurement"}, failed["UpdateHipsterJobAndWaitForQC"])
+	assert.Len(t, failed, 5)
+}
@@ -0,0 +1,184 @@
+package field_path
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Segment is one step of a path, the key of an object possibly followed by the index or the filter picking one
+// element of the list stored there.
+type Segment struct {
+	Key         string
+	Index       int
+	FilterField string
+	FilterValue string
+	Selects     bool
+}
+
+// Path is a dotted path into a decoded JSON or BSON document.
+type Path []Segment
+
+// Parse reads a dotted path where a key may be followed by an index, structures[0], or by the filter of the
+// element to pick, structures[_type.value=main].
+func Parse(path string) (Path, error) {
+	if path == "" {
+		return nil, errors.New("field is empty")
+	}
+	parts := []string{}
+	depth, start := 0, 0
+	for i, c := range path {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '.' && depth == 0:
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+		if depth < 0 || depth > 1 {
+			return nil, fmt.Errorf("unbalanced brackets in %s", path)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced brackets in %s", path)
+	}
+	parts = append(parts, path[start:])
+	segments := Path{}
+	for _, part := range parts {
+		segment := Segment{Key: part}
+		if open := strings.Index(part, "["); open >= 0 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, fmt.Errorf("%s should end with its selector", part)
+			}
+			segment.Key, segment.Selects = part[:open], true
+			selector := part[open+1 : len(part)-1]
+			if eq := strings.Index(selector, "="); eq > 0 {
+				segment.FilterField, segment.FilterValue = selector[:eq], selector[eq+1:]
+				segment.Index = -1
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				segment.Index = index
+			} else {
+				return nil, fmt.Errorf("selector %s should be an index or field=value", selector)
+			}
+		}
+		if segment.Key == "" {
+			return nil, fmt.Errorf("%s has an empty segment", path)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// Keys is the path through keys, for callers splitting their paths themselves.
+func Keys(keys ...string) Path {
+	path := Path{}
+	for _, key := range keys {
+		path = append(path, Segment{Key: key})
+	}
+	return path
+}
+
+// Lookup returns the first value at path in document and whether it is set to something else than null, an
+// invalid path finds nothing.
+func Lookup(document interface{}, path string) (interface{}, bool) {
+	parsed, err := Parse(path)
+	if err != nil {
+		return nil, false
+	}
+	for _, value := range parsed.Values(document) {
+		if value != nil {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Values returns every value found at the path, a key set to null included. A list met on the way is indexed by
+// a numeric key, picked from by a selector, or else walked element by element.
+func (path Path) Values(document interface{}) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{document}
+	}
+	segment := path[0]
+	if object, ok := asDocument(document); ok {
+		child, found := object[segment.Key]
+		if !found {
+			return nil
+		}
+		if segment.Selects {
+			if child, found = segment.pick(child); !found {
+				return nil
+			}
+		}
+		return path[1:].Values(child)
+	}
+	if list, ok := asArray(document); ok {
+		if index, err := strconv.Atoi(segment.Key); err == nil && !segment.Selects {
+			if index >= 0 && index < len(list) {
+				return path[1:].Values(list[index])
+			}
+			return nil
+		}
+		values := []interface{}{}
+		for _, element := range list {
+			values = append(values, path.Values(element)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// Shape is the path without its selectors, the path of the field in the schema of the document.
+func (path Path) Shape() string {
+	keys := []string{}
+	for _, segment := range path {
+		keys = append(keys, segment.Key)
+	}
+	return strings.Join(keys, ".")
+}
+
+func (segment Segment) pick(value interface{}) (interface{}, bool) {
+	list, ok := asArray(value)
+	if !ok {
+		return nil, false
+	}
+	if segment.Index >= 0 {
+		if segment.Index < len(list) {
+			return list[segment.Index], true
+		}
+		return nil, false
+	}
+	for _, element := range list {
+		if value, found := Lookup(element, segment.FilterField); found && fmt.Sprint(value) == segment.FilterValue {
+			return element, true
+		}
+	}
+	return nil, false
+}
+
+func asDocument(v interface{}) (map[string]interface{}, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return d, true
+	case bson.D:
+		return d.Map(), true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case bson.A:
+		return a, true
+	case []interface{}:
+		return a, true
+	}
+	return nil, false
+}
@@ -0,0 +1,67 @@
+package field_path
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParse(t *testing.T) {
+	path, err := Parse("structures[_type.value=main].roof.facets[1]")
+	assert.NoError(t, err)
+	assert.Equal(t, Path{
+		{Key: "structures", Index: -1, FilterField: "_type.value", FilterValue: "main", Selects: true},
+		{Key: "roof"},
+		{Key: "facets", Index: 1, Selects: true},
+	}, path)
+	assert.Equal(t, "structures.roof.facets", path.Shape())
+
+	for field, problem := range map[string]string{
+		"":                  "field is empty",
+		"structures[main":   "unbalanced brackets in structures[main",
+		"structures[[0]]":   "unbalanced brackets in structures[[0]]",
+		"structures[0]x.id": "structures[0]x should end with its selector",
+		"structures[-1].id": "selector -1 should be an index or field=value",
+		"structures..id":    "structures..id has an empty segment",
+		"[0].id":            "[0].id has an empty segment",
+	} {
+		_, err := Parse(field)
+		assert.EqualError(t, err, problem, field)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	document := map[string]interface{}{
+		"count": nil,
+		"structures": []interface{}{
+			map[string]interface{}{"_type": map[string]interface{}{"value": "garage"}, "id": "s1"},
+			map[string]interface{}{"_type": map[string]interface{}{"value": "main"}, "id": "s2", "facets": 4.0},
+		},
+	}
+	for field, want := range map[string]interface{}{
+		"structures[_type.value=main].id": "s2",
+		"structures[0].id":                "s1",
+		"structures.facets":               4.0,
+	} {
+		value, found := Lookup(document, field)
+		assert.True(t, found, field)
+		assert.Equal(t, want, value, field)
+	}
+	for _, field := range []string{"count", "structures[2].id", "structures[_type.value=barn].id", "structures[0].id.value", "structures[main"} {
+		_, found := Lookup(document, field)
+		assert.False(t, found, field)
+	}
+}
+
+func TestValuesWalksBSONLists(t *testing.T) {
+	document := bson.M{"tasks": bson.A{
+		bson.D{{Key: "name", Value: "PMF"}, {Key: "duration", Value: 3}},
+		bson.M{"name": "QC"},
+	}}
+	assert.Equal(t, []interface{}{"PMF", "QC"}, Keys("tasks", "name").Values(document))
+	assert.Equal(t, []interface{}{3}, Keys("tasks", "duration").Values(document))
+	assert.Equal(t, []interface{}{"QC"}, Keys("tasks", "1", "name").Values(document))
+	assert.Empty(t, Keys("tasks", "2", "name").Values(document))
+	assert.Equal(t, []interface{}{document}, Path{}.Values(document))
+}
@@ -6,6 +6,7 @@ import (
 	context "context"
 
 	lambda "github.com/aws/aws-sdk-go/service/lambda"
+	sfn "github.com/aws/aws-sdk-go/service/sfn"
 	mock "github.com/stretchr/testify/mock"
 )
 
@@ -14,6 +15,20 @@ type IAWSClient struct {
 	mock.Mock
 }
 
+// ChangeMessageVisibility provides a mock function with given fields: ctx, queueUrl, receiptHandle, timeoutSeconds
+func (_m *IAWSClient) ChangeMessageVisibility(ctx context.Context, queueUrl string, receiptHandle string, timeoutSeconds int64) error {
+	ret := _m.Called(ctx, queueUrl, receiptHandle, timeoutSeconds)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int64) error); ok {
+		r0 = rf(ctx, queueUrl, receiptHandle, timeoutSeconds)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CloseWaitTask provides a mock function with given fields: ctx, status, TaskToken, Output, Cause, Error
 func (_m *IAWSClient) CloseWaitTask(ctx context.Context, status string, TaskToken string, Output string, Cause string, Error string) error {
 	ret := _m.Called(ctx, status, TaskToken, Output, Cause, Error)
@@ -28,6 +43,29 @@ func (_m *IAWSClient) CloseWaitTask(ctx context.Context, status string, TaskToke
 	return r0
 }
 
+// DescribeExecution provides a mock function with given fields: ctx, executionArn
+func (_m *IAWSClient) DescribeExecution(ctx context.Context, executionArn string) (*sfn.DescribeExecutionOutput, error) {
+	ret := _m.Called(ctx, executionArn)
+
+	var r0 *sfn.DescribeExecutionOutput
+	if rf, ok := ret.Get(0).(func(context.Context, string) *sfn.DescribeExecutionOutput); ok {
+		r0 = rf(ctx, executionArn)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*sfn.DescribeExecutionOutput)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, executionArn)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // FetchS3BucketPath provides a mock function with given fields: s3Path
 func (_m *IAWSClient) FetchS3BucketPath(s3Path string) (string, string, error) {
 	ret := _m.Called(s3Path)
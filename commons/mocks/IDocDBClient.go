@@ -8,7 +8,11 @@ import (
 	mock "github.com/stretchr/testify/mock"
 	documentDB_client "github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
 
+	enums "github.eagleview.com/engineering/symphony-service/commons/enums"
+
 	primitive "go.mongodb.org/mongo-driver/bson/primitive"
+
+	time "time"
 )
 
 // IDocDBClient is an autogenerated mock type for the IDocDBClient type
@@ -16,12 +20,35 @@ type IDocDBClient struct {
 	mock.Mock
 }
 
+// BootstrapSchema provides a mock function with given fields: ctx, config
+func (_m *IDocDBClient) BootstrapSchema(ctx context.Context, config documentDB_client.SchemaConfig) ([]string, error) {
+	ret := _m.Called(ctx, config)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, documentDB_client.SchemaConfig) []string); ok {
+		r0 = rf(ctx, config)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, documentDB_client.SchemaConfig) error); ok {
+		r1 = rf(ctx, config)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // BuildQueryForCallBack provides a mock function with given fields: ctx, event, status, workflowID, stepID, TaskName, callbackResponse
-func (_m *IDocDBClient) BuildQueryForCallBack(ctx context.Context, event string, status string, workflowID string, stepID string, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{}) {
+func (_m *IDocDBClient) BuildQueryForCallBack(ctx context.Context, event string, status enums.StepStatus, workflowID string, stepID string, TaskName string, callbackResponse map[string]interface{}) (interface{}, interface{}) {
 	ret := _m.Called(ctx, event, status, workflowID, stepID, TaskName, callbackResponse)
 
 	var r0 interface{}
-	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, string, string, map[string]interface{}) interface{}); ok {
+	if rf, ok := ret.Get(0).(func(context.Context, string, enums.StepStatus, string, string, string, map[string]interface{}) interface{}); ok {
 		r0 = rf(ctx, event, status, workflowID, stepID, TaskName, callbackResponse)
 	} else {
 		if ret.Get(0) != nil {
@@ -30,7 +57,7 @@ func (_m *IDocDBClient) BuildQueryForCallBack(ctx context.Context, event string,
 	}
 
 	var r1 interface{}
-	if rf, ok := ret.Get(1).(func(context.Context, string, string, string, string, string, map[string]interface{}) interface{}); ok {
+	if rf, ok := ret.Get(1).(func(context.Context, string, enums.StepStatus, string, string, string, map[string]interface{}) interface{}); ok {
 		r1 = rf(ctx, event, status, workflowID, stepID, TaskName, callbackResponse)
 	} else {
 		if ret.Get(1) != nil {
@@ -42,11 +69,11 @@ func (_m *IDocDBClient) BuildQueryForCallBack(ctx context.Context, event string,
 }
 
 // BuildQueryForUpdateWorkflowDataCallout provides a mock function with given fields: ctx, TaskName, stepID, status, starttime, IsWaitTask
-func (_m *IDocDBClient) BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName string, stepID string, status string, starttime int64, IsWaitTask bool) interface{} {
+func (_m *IDocDBClient) BuildQueryForUpdateWorkflowDataCallout(ctx context.Context, TaskName string, stepID string, status enums.StepStatus, starttime int64, IsWaitTask bool) interface{} {
 	ret := _m.Called(ctx, TaskName, stepID, status, starttime, IsWaitTask)
 
 	var r0 interface{}
-	if rf, ok := ret.Get(0).(func(context.Context, string, string, string, int64, bool) interface{}); ok {
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, enums.StepStatus, int64, bool) interface{}); ok {
 		r0 = rf(ctx, TaskName, stepID, status, starttime, IsWaitTask)
 	} else {
 		if ret.Get(0) != nil {
@@ -71,6 +98,92 @@ func (_m *IDocDBClient) CheckConnection(ctx context.Context) error {
 	return r0
 }
 
+// DeleteDocuments provides a mock function with given fields: ctx, query, collectionName
+func (_m *IDocDBClient) DeleteDocuments(ctx context.Context, query interface{}, collectionName string) (int64, error) {
+	ret := _m.Called(ctx, query, collectionName)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, interface{}, string) int64); ok {
+		r0 = rf(ctx, query, collectionName)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, interface{}, string) error); ok {
+		r1 = rf(ctx, query, collectionName)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchArchivalPolicy provides a mock function with given fields: ctx
+func (_m *IDocDBClient) FetchArchivalPolicy(ctx context.Context) (documentDB_client.ArchivalPolicy, error) {
+	ret := _m.Called(ctx)
+
+	var r0 documentDB_client.ArchivalPolicy
+	if rf, ok := ret.Get(0).(func(context.Context) documentDB_client.ArchivalPolicy); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(documentDB_client.ArchivalPolicy)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchDocuments provides a mock function with given fields: ctx, query, collectionName
+func (_m *IDocDBClient) FetchDocuments(ctx context.Context, query interface{}, collectionName string) ([]primitive.M, error) {
+	ret := _m.Called(ctx, query, collectionName)
+
+	var r0 []primitive.M
+	if rf, ok := ret.Get(0).(func(context.Context, interface{}, string) []primitive.M); ok {
+		r0 = rf(ctx, query, collectionName)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]primitive.M)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, interface{}, string) error); ok {
+		r1 = rf(ctx, query, collectionName)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchGeocode provides a mock function with given fields: ctx, location
+func (_m *IDocDBClient) FetchGeocode(ctx context.Context, location string) (documentDB_client.GeocodeCacheBody, error) {
+	ret := _m.Called(ctx, location)
+
+	var r0 documentDB_client.GeocodeCacheBody
+	if rf, ok := ret.Get(0).(func(context.Context, string) documentDB_client.GeocodeCacheBody); ok {
+		r0 = rf(ctx, location)
+	} else {
+		r0 = ret.Get(0).(documentDB_client.GeocodeCacheBody)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, location)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // FetchStepExecutionData provides a mock function with given fields: ctx, StepId
 func (_m *IDocDBClient) FetchStepExecutionData(ctx context.Context, StepId string) (documentDB_client.StepExecutionDataBody, error) {
 	ret := _m.Called(ctx, StepId)
@@ -92,6 +205,29 @@ func (_m *IDocDBClient) FetchStepExecutionData(ctx context.Context, StepId strin
 	return r0, r1
 }
 
+// FetchStepsByWorkflow provides a mock function with given fields: ctx, workflowId
+func (_m *IDocDBClient) FetchStepsByWorkflow(ctx context.Context, workflowId string) ([]documentDB_client.StepExecutionDataBody, error) {
+	ret := _m.Called(ctx, workflowId)
+
+	var r0 []documentDB_client.StepExecutionDataBody
+	if rf, ok := ret.Get(0).(func(context.Context, string) []documentDB_client.StepExecutionDataBody); ok {
+		r0 = rf(ctx, workflowId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]documentDB_client.StepExecutionDataBody)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, workflowId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // FetchWorkflowExecutionData provides a mock function with given fields: ctx, workFlowId
 func (_m *IDocDBClient) FetchWorkflowExecutionData(ctx context.Context, workFlowId string) (documentDB_client.WorkflowExecutionDataBody, error) {
 	ret := _m.Called(ctx, workFlowId)
@@ -136,6 +272,48 @@ func (_m *IDocDBClient) FetchWorkflowExecutionDataByListOfWorkflows(ctx context.
 	return r0, r1
 }
 
+// FetchWorkflowMetrics provides a mock function with given fields: ctx, window
+func (_m *IDocDBClient) FetchWorkflowMetrics(ctx context.Context, window documentDB_client.TimeRange) (documentDB_client.WorkflowMetrics, error) {
+	ret := _m.Called(ctx, window)
+
+	var r0 documentDB_client.WorkflowMetrics
+	if rf, ok := ret.Get(0).(func(context.Context, documentDB_client.TimeRange) documentDB_client.WorkflowMetrics); ok {
+		r0 = rf(ctx, window)
+	} else {
+		r0 = ret.Get(0).(documentDB_client.WorkflowMetrics)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, documentDB_client.TimeRange) error); ok {
+		r1 = rf(ctx, window)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// FetchWorkflowSummary provides a mock function with given fields: ctx, filters
+func (_m *IDocDBClient) FetchWorkflowSummary(ctx context.Context, filters documentDB_client.SummaryFilters) (documentDB_client.WorkflowSummaryPage, error) {
+	ret := _m.Called(ctx, filters)
+
+	var r0 documentDB_client.WorkflowSummaryPage
+	if rf, ok := ret.Get(0).(func(context.Context, documentDB_client.SummaryFilters) documentDB_client.WorkflowSummaryPage); ok {
+		r0 = rf(ctx, filters)
+	} else {
+		r0 = ret.Get(0).(documentDB_client.WorkflowSummaryPage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, documentDB_client.SummaryFilters) error); ok {
+		r1 = rf(ctx, filters)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetHipsterCountPerDay provides a mock function with given fields: ctx
 func (_m *IDocDBClient) GetHipsterCountPerDay(ctx context.Context) (int64, error) {
 	ret := _m.Called(ctx)
@@ -171,6 +349,20 @@ func (_m *IDocDBClient) GetTimedoutTask(ctx context.Context, WorkflowId string)
 	return r0
 }
 
+// InsertDocuments provides a mock function with given fields: ctx, documents, collectionName
+func (_m *IDocDBClient) InsertDocuments(ctx context.Context, documents []primitive.M, collectionName string) error {
+	ret := _m.Called(ctx, documents, collectionName)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []primitive.M, string) error); ok {
+		r0 = rf(ctx, documents, collectionName)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // InsertStepExecutionData provides a mock function with given fields: ctx, StepExecutionData
 func (_m *IDocDBClient) InsertStepExecutionData(ctx context.Context, StepExecutionData documentDB_client.StepExecutionDataBody) error {
 	ret := _m.Called(ctx, StepExecutionData)
@@ -199,6 +391,104 @@ func (_m *IDocDBClient) InsertWorkflowExecutionData(ctx context.Context, Data do
 	return r0
 }
 
+// ReleaseHipsterSlot provides a mock function with given fields: ctx, workflowId
+func (_m *IDocDBClient) ReleaseHipsterSlot(ctx context.Context, workflowId string) (bool, error) {
+	ret := _m.Called(ctx, workflowId)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, workflowId)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, workflowId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReleasePriorityLane provides a mock function with given fields: ctx, workflowId
+func (_m *IDocDBClient) ReleasePriorityLane(ctx context.Context, workflowId string) (bool, error) {
+	ret := _m.Called(ctx, workflowId)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string) bool); ok {
+		r0 = rf(ctx, workflowId)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, workflowId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReserveHipsterSlot provides a mock function with given fields: ctx, quota, workflowId, limit, expireAt
+func (_m *IDocDBClient) ReserveHipsterSlot(ctx context.Context, quota string, workflowId string, limit int64, expireAt time.Time) (documentDB_client.HipsterReservation, error) {
+	ret := _m.Called(ctx, quota, workflowId, limit, expireAt)
+
+	var r0 documentDB_client.HipsterReservation
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int64, time.Time) documentDB_client.HipsterReservation); ok {
+		r0 = rf(ctx, quota, workflowId, limit, expireAt)
+	} else {
+		r0 = ret.Get(0).(documentDB_client.HipsterReservation)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int64, time.Time) error); ok {
+		r1 = rf(ctx, quota, workflowId, limit, expireAt)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReservePriorityLane provides a mock function with given fields: ctx, workflowId, priority, limits
+func (_m *IDocDBClient) ReservePriorityLane(ctx context.Context, workflowId string, priority enums.Priority, limits documentDB_client.LaneLimits) (bool, error) {
+	ret := _m.Called(ctx, workflowId, priority, limits)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string, enums.Priority, documentDB_client.LaneLimits) bool); ok {
+		r0 = rf(ctx, workflowId, priority, limits)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, enums.Priority, documentDB_client.LaneLimits) error); ok {
+		r1 = rf(ctx, workflowId, priority, limits)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SaveGeocode provides a mock function with given fields: ctx, geocode
+func (_m *IDocDBClient) SaveGeocode(ctx context.Context, geocode documentDB_client.GeocodeCacheBody) error {
+	ret := _m.Called(ctx, geocode)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, documentDB_client.GeocodeCacheBody) error); ok {
+		r0 = rf(ctx, geocode)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // UpdateDocumentDB provides a mock function with given fields: ctx, query, update, collectionName
 func (_m *IDocDBClient) UpdateDocumentDB(ctx context.Context, query interface{}, update interface{}, collectionName string) error {
 	ret := _m.Called(ctx, query, update, collectionName)
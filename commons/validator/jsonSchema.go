@@ -0,0 +1,142 @@
+package validator
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// JSONSchema is the subset of JSON Schema used to describe request payloads: type, required, properties, items,
+// enum, minimum, maximum, minLength, pattern and the date-time format. Other keywords are not supported.
+type JSONSchema struct {
+	Type       FieldType              `json:"type,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Items      *JSONSchema            `json:"items,omitempty"`
+	Enum       []interface{}          `json:"enum,omitempty"`
+	Minimum    *float64               `json:"minimum,omitempty"`
+	Maximum    *float64               `json:"maximum,omitempty"`
+	MinLength  *int                   `json:"minLength,omitempty"`
+	Pattern    string                 `json:"pattern,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+const FormatDateTime = "date-time"
+
+// Compile checks the schema itself and prepares its patterns, it has to succeed before Validate is used.
+func (schema *JSONSchema) Compile() error {
+	errs := []error{}
+	schema.compile("", &errs)
+	return combinedError(errs)
+}
+
+func (schema *JSONSchema) compile(path string, errs *[]error) {
+	switch schema.Type {
+	case "", FieldTypeString, FieldTypeNumber, FieldTypeBool, FieldTypeObject, FieldTypeArray:
+	default:
+		*errs = append(*errs, fmt.Errorf("%s has unsupported type %s", schemaPath(path), schema.Type))
+	}
+	if schema.Pattern != "" {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s has invalid pattern: %v", schemaPath(path), err))
+		}
+		schema.pattern = pattern
+	}
+	if schema.Format != "" && schema.Format != FormatDateTime {
+		*errs = append(*errs, fmt.Errorf("%s has unsupported format %s", schemaPath(path), schema.Format))
+	}
+	for name, property := range schema.Properties {
+		property.compile(path+name+".", errs)
+	}
+	if schema.Items != nil {
+		schema.Items.compile(trimDot(path)+"[].", errs)
+	}
+}
+
+// Validate checks a decoded JSON value against the schema and reports every violation with its path.
+func (schema *JSONSchema) Validate(value interface{}) error {
+	errs := []error{}
+	schema.validate("", value, &errs)
+	return combinedError(errs)
+}
+
+func (schema *JSONSchema) validate(path string, value interface{}, errs *[]error) {
+	if schema.Type != "" && !schema.Type.matches(value) {
+		*errs = append(*errs, fmt.Errorf("%s should be of type %s", schemaPath(path), schema.Type))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		*errs = append(*errs, fmt.Errorf("%s should be one of %v", schemaPath(path), schema.Enum))
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if field, ok := v[name]; !ok || field == nil {
+				*errs = append(*errs, fmt.Errorf("%s is a required field", path+name))
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if field, ok := v[name]; ok && field != nil {
+				schema.Properties[name].validate(path+name+".", field, errs)
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				schema.Items.validate(fmt.Sprintf("%s[%d].", trimDot(path), i), item, errs)
+			}
+		}
+	case string:
+		if schema.MinLength != nil && len(v) < *schema.MinLength {
+			*errs = append(*errs, fmt.Errorf("%s should be at least %d characters", schemaPath(path), *schema.MinLength))
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(v) {
+			*errs = append(*errs, fmt.Errorf("%s should match %s", schemaPath(path), schema.Pattern))
+		}
+		if schema.Format == FormatDateTime {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				*errs = append(*errs, fmt.Errorf("%s should be an RFC3339 date-time", schemaPath(path)))
+			}
+		}
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			*errs = append(*errs, fmt.Errorf("%s should be at least %v", schemaPath(path), *schema.Minimum))
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			*errs = append(*errs, fmt.Errorf("%s should be at most %v", schemaPath(path), *schema.Maximum))
+		}
+	}
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "input"
+	}
+	return trimDot(path)
+}
+
+func trimDot(path string) string {
+	if len(path) > 0 && path[len(path)-1] == '.' {
+		return path[:len(path)-1]
+	}
+	return path
+}
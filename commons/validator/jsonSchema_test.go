@@ -0,0 +1,91 @@
+package validator
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"properties": {
+		"id": {"type": "string", "pattern": "^[0-9]+$", "minLength": 2},
+		"pitch": {"type": "number", "minimum": 0, "maximum": 24},
+		"rush": {"type": "boolean"},
+		"priority": {"type": "string", "enum": ["low", "high"]},
+		"placedAt": {"type": "string", "format": "date-time"},
+		"items": {
+			"type": "array",
+			"items": {"type": "object", "required": ["sku"], "properties": {"sku": {"type": "string"}}}
+		}
+	}
+}`
+
+func compiledSchema(t *testing.T, raw string) *JSONSchema {
+	schema := &JSONSchema{}
+	assert.NoError(t, json.Unmarshal([]byte(raw), schema))
+	assert.NoError(t, schema.Compile())
+	return schema
+}
+
+func TestJSONSchemaCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string
+	}{
+		{"valid", orderSchema, ""},
+		{"unsupported type", `{"type": "text"}`, "input has unsupported type text"},
+		{"invalid pattern", `{"properties": {"id": {"pattern": "("}}}`, "id has invalid pattern: error parsing regexp: missing closing ): `(`"},
+		{"unsupported format", `{"properties": {"at": {"format": "date"}}}`, "at has unsupported format date"},
+		{"nested items", `{"properties": {"items": {"items": {"properties": {"sku": {"type": "int"}}}}}}`, "items[].sku has unsupported type int"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := &JSONSchema{}
+			assert.NoError(t, json.Unmarshal([]byte(test.schema), schema))
+			err := schema.Compile()
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema := compiledSchema(t, orderSchema)
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{"valid", `{"id": "42", "pitch": 6, "rush": true, "priority": "low", "placedAt": "2021-03-04T05:06:07.5Z", "items": [{"sku": "a"}]}`, ""},
+		{"null optional fields are skipped", `{"id": "42", "pitch": null, "items": []}`, ""},
+		{"not an object", `[]`, "input should be of type object"},
+		{"missing required fields", `{}`, "id is a required field,items is a required field"},
+		{"null required field", `{"id": null, "items": []}`, "id is a required field"},
+		{"wrong type", `{"id": 42, "items": []}`, "id should be of type string"},
+		{"pattern and minLength", `{"id": "x", "items": []}`, "id should be at least 2 characters,id should match ^[0-9]+$"},
+		{"bounds", `{"id": "42", "pitch": -1, "items": []}`, "pitch should be at least 0"},
+		{"maximum", `{"id": "42", "pitch": 30, "items": []}`, "pitch should be at most 24"},
+		{"enum", `{"id": "42", "priority": "urgent", "items": []}`, "priority should be one of [low high]"},
+		{"date-time", `{"id": "42", "placedAt": "2021-03-04", "items": []}`, "placedAt should be an RFC3339 date-time"},
+		{"array items report their index", `{"id": "42", "items": [{"sku": "a"}, {}, {"sku": 1}]}`, "items[1].sku is a required field,items[2].sku should be of type string"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var value interface{}
+			assert.NoError(t, json.Unmarshal([]byte(test.value), &value))
+			err := schema.Validate(value)
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.wantErr)
+		})
+	}
+}
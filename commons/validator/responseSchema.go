@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+)
+
+type FieldType string
+
+const (
+	FieldTypeString FieldType = "string"
+	FieldTypeNumber FieldType = "number"
+	FieldTypeBool   FieldType = "boolean"
+	FieldTypeObject FieldType = "object"
+	FieldTypeArray  FieldType = "array"
+)
+
+type ResponseField struct {
+	Name     string
+	Type     FieldType
+	Required bool
+}
+
+type ResponseSchema []ResponseField
+
+// CallbackResponseSchemas holds the expected callback response per async task name.
+// Tasks without an entry are not checked.
+var CallbackResponseSchemas = map[string]ResponseSchema{
+	"FacetKeyPointDetection": {
+		{Name: "facetKeyPointLocation", Type: FieldTypeString, Required: true},
+	},
+	"3DModellingService": {
+		{Name: "propertyModelLocation", Type: FieldTypeString, Required: true},
+	},
+	// Hipster callbacks only carry the job, the PMF path is fetched later by GetPMFPath
+	"CreateHipsterJobAndWaitForMeasurement": {
+		{Name: "jobId", Type: FieldTypeString, Required: true},
+		{Name: "propertyModelLocation", Type: FieldTypeString},
+	},
+	"UpdateHipsterJobAndWaitForMeasurement": {
+		{Name: "jobId", Type: FieldTypeString},
+		{Name: "propertyModelLocation", Type: FieldTypeString},
+	},
+	"UpdateHipsterJobAndWaitForQC": {
+		{Name: "propertyModelLocation", Type: FieldTypeString},
+	},
+	"CheckIsMultiStructure": {
+		{Name: "isHipsterCompatible", Type: FieldTypeBool, Required: true},
+	},
+	"BuildingDetection": {
+		{Name: "orthoImagePath", Type: FieldTypeString, Required: true},
+		{Name: "cropImagePath", Type: FieldTypeString, Required: true},
+	},
+	"ConvertPropertyModelToEVJson": {
+		{Name: "evJsonLocation", Type: FieldTypeString, Required: true},
+	},
+}
+
+// ValidateCallBackResponse checks a callback response against the schema registered for taskName.
+func ValidateCallBackResponse(ctx context.Context, taskName string, response map[string]interface{}) error {
+	schema, ok := CallbackResponseSchemas[taskName]
+	if !ok {
+		return nil
+	}
+	errs := []error{}
+	for _, field := range schema {
+		value, ok := response[field.Name]
+		if !ok || value == nil || value == "" {
+			if field.Required {
+				errs = append(errs, fmt.Errorf("%s is a required field", field.Name))
+			}
+			continue
+		}
+		if !field.Type.matches(value) {
+			errs = append(errs, fmt.Errorf("%s should be of type %s", field.Name, field.Type))
+		}
+	}
+	if err := combinedError(errs); err != nil {
+		return fmt.Errorf("invalid response for %s: %s", taskName, err.Error())
+	}
+	return nil
+}
+
+func (ft FieldType) matches(value interface{}) bool {
+	switch ft {
+	case FieldTypeString:
+		_, ok := value.(string)
+		return ok
+	case FieldTypeNumber:
+		switch value.(type) {
+		case float64, float32, int, int32, int64:
+			return true
+		}
+		return false
+	case FieldTypeBool:
+		_, ok := value.(bool)
+		return ok
+	case FieldTypeObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case FieldTypeArray:
+		_, ok := value.([]interface{})
+		return ok
+	}
+	return true
+}
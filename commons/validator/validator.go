@@ -96,35 +96,6 @@ func ValidateCallOutRequest(ctx context.Context, data interface{}) error {
 	return combinedError(errs)
 }
 
-func ValidateInvokeSfnRequest(ctx context.Context, data interface{}) error {
-	fmt.Printf("ValidateInvokeSfnRequest reached %+v\n", data)
-	v, trans := initStructValidation()
-	_ = v.RegisterValidation("source", func(fl validator.FieldLevel) bool {
-		_, ok := util.FindInStringArray(enums.SourcesList(), fl.Field().String(), true)
-		return ok
-	})
-
-	_ = v.RegisterTranslation("source", trans, func(ut ut.Translator) error {
-		return ut.Add("source", "unsupported authentication type", true)
-	}, func(ut ut.Translator, fe validator.FieldError) string {
-		t, _ := ut.T("source", fe.Field())
-		return t
-	})
-
-	_ = v.RegisterTranslation("required", trans,
-		func(ut ut.Translator) error {
-			return ut.Add("required", "{0} is a required field", true)
-		},
-		func(ut ut.Translator, fe validator.FieldError) string {
-			t, _ := ut.T("required", fe.Field())
-			return t
-		})
-
-	err := v.Struct(data)
-	errs := translateError(err, trans)
-	return combinedError(errs)
-}
-
 func ValidateCallBackRequest(ctx context.Context, data interface{}) error {
 	v, trans := initStructValidation()
 
@@ -58,7 +58,7 @@ func Handler(ctx context.Context, CallbackRequest RequestBody) (map[string]inter
 	log_config.SetTraceIdInContext(ctx, reportId, workflowId)
 	log.Info(ctx, "Callback Status: ", CallbackRequest.Status.String())
 
-	var stepstatus string = failure
+	var stepstatus enums.StepStatus = enums.StepFailure
 	var ReworkRequired bool = true
 	if CallbackRequest.Status.String() != rework {
 		ReworkRequired = false
@@ -68,8 +68,36 @@ func Handler(ctx context.Context, CallbackRequest RequestBody) (map[string]inter
 	} else {
 		CallbackRequest.Response = map[string]interface{}{isReworkRequired: ReworkRequired}
 	}
+	var schemaErr error
 	if CallbackRequest.Status.String() == success || CallbackRequest.Status.String() == rework {
-		stepstatus = success
+		schemaErr = validator.ValidateCallBackResponse(ctx, StepExecutionData.TaskName, CallbackRequest.Response)
+		if schemaErr == nil {
+			stepstatus = enums.StepSuccess
+		}
+	}
+	// the step update is guarded by the transition table, so a callback for a step that already finished is
+	// rejected here before its task is closed
+	stepOutput := CallbackRequest.Response
+	if stepstatus == enums.StepFailure {
+		stepOutput = failureOutput(CallbackRequest, schemaErr)
+	}
+	filter, query := commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateStepExecution, stepstatus, StepExecutionData.WorkflowId, StepExecutionData.StepId, StepExecutionData.TaskName, stepOutput)
+	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, query, documentDB_client.StepsDataCollection)
+	if err != nil {
+		log.Error(ctx, DocDBUpdateError, err.Error())
+		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, updateError(err, error_codes.ErrorUpdatingStepsDataInDB)
+	}
+	if schemaErr != nil {
+		log.Error(ctx, "Callback response failed schema validation, error: ", schemaErr.Error())
+		cause := Cause{
+			ErrorMessage: ErrorMessage{
+				Message:     fmt.Sprintf("failed at %s with Message: %s", StepExecutionData.TaskName, schemaErr.Error()),
+				MessageCode: error_codes.ErrorValidatingCallBackResponse,
+			},
+		}
+		causebyteData, _ := json.Marshal(cause)
+		err = commonHandler.AwsClient.CloseWaitTask(ctx, failure, StepExecutionData.TaskToken, "", string(causebyteData), fmt.Sprintf("invalid response at %s", StepExecutionData.TaskName))
+	} else if stepstatus == enums.StepSuccess {
 		byteData, _ := json.Marshal(CallbackRequest.Response)
 		jsonResponse := string(byteData)
 		err = commonHandler.AwsClient.CloseWaitTask(ctx, success, StepExecutionData.TaskToken, jsonResponse, "", "")
@@ -96,33 +124,63 @@ func Handler(ctx context.Context, CallbackRequest RequestBody) (map[string]inter
 		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, error_handler.NewServiceError(error_codes.ErrorWhileClosingWaitTaskInSFN, err.Error())
 	}
 
-	filter, query := commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateStepExecution, stepstatus, StepExecutionData.WorkflowId, StepExecutionData.StepId, StepExecutionData.TaskName, CallbackRequest.Response)
-	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, query, documentDB_client.StepsDataCollection)
-	if err != nil {
-		log.Error(ctx, DocDBUpdateError, err.Error())
-		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, error_handler.NewServiceError(error_codes.ErrorUpdatingStepsDataInDB, err.Error())
-	}
 	filter, query = commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateWorkflowExecutionSteps, stepstatus, StepExecutionData.WorkflowId, StepExecutionData.StepId, StepExecutionData.TaskName, CallbackRequest.Response)
 	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, query, documentDB_client.WorkflowDataCollection)
 	if err != nil {
 		log.Error(ctx, DocDBUpdateError, err.Error())
-		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
+		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, updateError(err, error_codes.ErrorUpdatingWorkflowDataInDB)
 	}
 	filter, query = commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateWorkflowExecutionStatus, stepstatus, StepExecutionData.WorkflowId, StepExecutionData.StepId, StepExecutionData.TaskName, CallbackRequest.Response)
 	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, query, documentDB_client.WorkflowDataCollection)
 	if err != nil {
 		log.Error(ctx, DocDBUpdateError, err.Error())
-		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
+		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, updateError(err, error_codes.ErrorUpdatingWorkflowDataInDB)
+	}
+	if schemaErr != nil {
+		return map[string]interface{}{"status": failure}, reportId, workflowId, taskName, error_handler.NewServiceError(error_codes.ErrorValidatingCallBackResponse, schemaErr.Error())
 	}
 	return map[string]interface{}{"status": success}, reportId, workflowId, taskName, nil
 }
 
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(true, false, true, true, false)
+	var err error
+	commonHandler, err = common_handler.New(true, false, true, true, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notificationWrapper)
 }
 
+// failureOutput is the response recorded on a failed step with the message and messageCode of the callback,
+// or of the schema validation that rejected it, unless the response already carries them.
+func failureOutput(CallbackRequest RequestBody, schemaErr error) map[string]interface{} {
+	output := make(map[string]interface{}, len(CallbackRequest.Response)+2)
+	for k, v := range CallbackRequest.Response {
+		output[k] = v
+	}
+	message, messageCode := CallbackRequest.Message, CallbackRequest.MessageCode
+	if schemaErr != nil {
+		message, messageCode = schemaErr.Error(), error_codes.ErrorValidatingCallBackResponse
+	}
+	if _, ok := output["message"]; !ok && message != "" {
+		output["message"] = message
+	}
+	if _, ok := output["messageCode"]; !ok && messageCode != nil && messageCode != "" {
+		output["messageCode"] = messageCode
+	}
+	return output
+}
+
+// updateError keeps the illegal transition reported by a guarded update, other failures are reported with code.
+func updateError(err error, code int) error {
+	if coded, ok := err.(error_handler.ICodedError); ok && coded.GetErrorCode() == error_codes.IllegalStepStatusTransition {
+		return err
+	}
+	return error_handler.NewServiceError(code, err.Error())
+}
+
 func notificationWrapper(ctx context.Context, req RequestBody) (map[string]interface{}, error) {
 	resp, reportId, workflowId, taskName, err := Handler(ctx, req)
 	if err != nil {
@@ -9,7 +9,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var RequestBodyString string = `{
@@ -124,6 +128,8 @@ func TestCallbackFailureClosingWaitTaks(t *testing.T) {
 	RequestBodyObj.Status = success
 	expectedResp := map[string]interface{}{"status": failure}
 	dBClient.Mock.On("FetchStepExecutionData", context.Background(), "callbackId").Return(documentDB_client.StepExecutionDataBody{TaskToken: "TaskToken"}, nil)
+	dBClient.Mock.On("BuildQueryForCallBack", mock.Anything, documentDB_client.UpdateStepExecution, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, "filter", "query", documentDB_client.StepsDataCollection).Return(nil)
 	aws_client.Mock.On("CloseWaitTask", context.Background(), success, "TaskToken", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("some error"))
 	commonHandler.DBClient = dBClient
 	commonHandler.AwsClient = aws_client
@@ -151,3 +157,171 @@ func TestCallbackFailedUpdatingDB(t *testing.T) {
 	assert.Equal(t, expectedResp, resp)
 
 }
+
+func TestCallbackInvalidResponseSchema(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	aws_client := new(mocks.IAWSClient)
+	RequestBodyObj := RequestBody{}
+	mydata := []byte(RequestBodyString)
+	json.Unmarshal(mydata, &RequestBodyObj)
+
+	expectedResp := map[string]interface{}{"status": failure}
+	dBClient.Mock.On("FetchStepExecutionData", context.Background(), "callbackId").Return(documentDB_client.StepExecutionDataBody{TaskToken: "TaskToken", TaskName: "3DModellingService"}, nil)
+	aws_client.Mock.On("CloseWaitTask", context.Background(), failure, "TaskToken", "", mock.Anything, "invalid response at 3DModellingService").Return(nil)
+	dBClient.Mock.On("BuildQueryForCallBack", context.Background(), mock.Anything, enums.StepFailure, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("UpdateDocumentDB", context.Background(), "filter", "query", mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+	resp, _, _, _, err := Handler(context.Background(), RequestBodyObj)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "propertyModelLocation is a required field")
+	assert.Equal(t, expectedResp, resp)
+	aws_client.AssertExpectations(t)
+}
+
+func TestCallbackValidResponseSchema(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	aws_client := new(mocks.IAWSClient)
+	RequestBodyObj := RequestBody{}
+	mydata := []byte(RequestBodyString)
+	json.Unmarshal(mydata, &RequestBodyObj)
+	RequestBodyObj.Response = map[string]interface{}{"propertyModelLocation": "s3://bucket/pmf.json"}
+
+	expectedResp := map[string]interface{}{"status": success}
+	dBClient.Mock.On("FetchStepExecutionData", context.Background(), "callbackId").Return(documentDB_client.StepExecutionDataBody{TaskToken: "TaskToken", TaskName: "3DModellingService"}, nil)
+	aws_client.Mock.On("CloseWaitTask", context.Background(), success, "TaskToken", mock.Anything, "", "").Return(nil)
+	dBClient.Mock.On("BuildQueryForCallBack", context.Background(), mock.Anything, enums.StepSuccess, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("UpdateDocumentDB", context.Background(), "filter", "query", mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+	resp, _, _, _, err := Handler(context.Background(), RequestBodyObj)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedResp, resp)
+}
+
+func TestCallbackHipsterResponseWithOnlyJobId(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	aws_client := new(mocks.IAWSClient)
+	RequestBodyObj := RequestBody{}
+	mydata := []byte(RequestBodyString)
+	json.Unmarshal(mydata, &RequestBodyObj)
+	RequestBodyObj.Response = map[string]interface{}{"jobId": "hipster-job"}
+
+	expectedResp := map[string]interface{}{"status": success}
+	dBClient.Mock.On("FetchStepExecutionData", context.Background(), "callbackId").Return(documentDB_client.StepExecutionDataBody{TaskToken: "TaskToken", TaskName: "CreateHipsterJobAndWaitForMeasurement"}, nil)
+	aws_client.Mock.On("CloseWaitTask", context.Background(), success, "TaskToken", mock.Anything, "", "").Return(nil)
+	dBClient.Mock.On("BuildQueryForCallBack", context.Background(), mock.Anything, enums.StepSuccess, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("UpdateDocumentDB", context.Background(), "filter", "query", mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+	resp, _, _, _, err := Handler(context.Background(), RequestBodyObj)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedResp, resp)
+}
+
+func TestCallbackRejectedForFinishedStep(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	aws_client := new(mocks.IAWSClient)
+	RequestBodyObj := RequestBody{}
+	mydata := []byte(RequestBodyString)
+	json.Unmarshal(mydata, &RequestBodyObj)
+
+	expectedResp := map[string]interface{}{"status": failure}
+	dBClient.Mock.On("FetchStepExecutionData", context.Background(), "callbackId").Return(documentDB_client.StepExecutionDataBody{TaskToken: "TaskToken", Status: enums.StepFailure}, nil)
+	dBClient.Mock.On("BuildQueryForCallBack", mock.Anything, documentDB_client.UpdateStepExecution, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, "filter", "query", documentDB_client.StepsDataCollection).Return(error_handler.NewServiceError(error_codes.IllegalStepStatusTransition, "no step matching filter can move to the new status"))
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+	resp, _, _, _, err := Handler(context.Background(), RequestBodyObj)
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.IllegalStepStatusTransition, err.(error_handler.ICodedError).GetErrorCode())
+	assert.Equal(t, expectedResp, resp)
+	aws_client.AssertNotCalled(t, "CloseWaitTask", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCallbackRejectedForFinishedStepInMemory(t *testing.T) {
+	ctx := context.Background()
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	aws_client := new(mocks.IAWSClient)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+
+	assert.NoError(t, dBClient.InsertStepExecutionData(ctx, documentDB_client.StepExecutionDataBody{StepId: "callbackId", WorkflowId: "workflowId", TaskName: "taskName", TaskToken: "TaskToken", Status: enums.StepFailure}))
+
+	RequestBodyObj := RequestBody{}
+	json.Unmarshal([]byte(RequestBodyString), &RequestBodyObj)
+	_, _, _, _, err := Handler(ctx, RequestBodyObj)
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.IllegalStepStatusTransition, err.(error_handler.ICodedError).GetErrorCode())
+	aws_client.AssertNotCalled(t, "CloseWaitTask", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	step, err := dBClient.FetchStepExecutionData(ctx, "callbackId")
+	assert.NoError(t, err)
+	assert.Equal(t, enums.StepFailure, step.Status)
+}
+
+func TestCallbackFailureRecordsMessageInMemory(t *testing.T) {
+	ctx := context.Background()
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	aws_client := new(mocks.IAWSClient)
+	aws_client.Mock.On("CloseWaitTask", mock.Anything, "failure", "TaskToken", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+
+	assert.NoError(t, dBClient.InsertWorkflowExecutionData(ctx, documentDB_client.WorkflowExecutionDataBody{WorkflowId: "workflowId", Status: enums.WorkflowInProgress, StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{}}))
+	assert.NoError(t, dBClient.InsertStepExecutionData(ctx, documentDB_client.StepExecutionDataBody{StepId: "callbackId", WorkflowId: "workflowId", TaskName: "taskName", TaskToken: "TaskToken", Status: enums.StepRunning}))
+	update := dBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, "taskName", "callbackId", enums.StepSuccess, 1000, true)
+	assert.NoError(t, dBClient.UpdateDocumentDB(ctx, bson.M{"_id": "workflowId"}, update, documentDB_client.WorkflowDataCollection))
+
+	RequestBodyObj := RequestBody{}
+	json.Unmarshal([]byte(RequestBodyString), &RequestBodyObj)
+	RequestBodyObj.Status = failure
+	RequestBodyObj.Message = "roof not visible"
+	RequestBodyObj.MessageCode = "E42"
+	_, _, _, _, err := Handler(ctx, RequestBodyObj)
+	assert.NoError(t, err)
+
+	step, err := dBClient.FetchStepExecutionData(ctx, "callbackId")
+	assert.NoError(t, err)
+	assert.Equal(t, enums.StepFailure, step.Status)
+	assert.Equal(t, "roof not visible", step.Output["message"])
+	assert.Equal(t, "E42", step.Output["messageCode"])
+	assert.Equal(t, "S3 link for facet_key_point_detection ", step.Output["facetKeyPointLocation"])
+}
+
+func TestCallbackUpdatesDocumentsInMemory(t *testing.T) {
+	ctx := context.Background()
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	aws_client := new(mocks.IAWSClient)
+	aws_client.Mock.On("CloseWaitTask", mock.Anything, "success", "TaskToken", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = aws_client
+
+	// documents as left by datastore insert and the callout of a wait task
+	assert.NoError(t, dBClient.InsertWorkflowExecutionData(ctx, documentDB_client.WorkflowExecutionDataBody{WorkflowId: "workflowId", Status: enums.WorkflowInProgress, StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{}}))
+	assert.NoError(t, dBClient.InsertStepExecutionData(ctx, documentDB_client.StepExecutionDataBody{StepId: "callbackId", WorkflowId: "workflowId", TaskName: "taskName", TaskToken: "TaskToken", Status: enums.StepRunning}))
+	update := dBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, "taskName", "callbackId", enums.StepSuccess, 1000, true)
+	assert.NoError(t, dBClient.UpdateDocumentDB(ctx, bson.M{"_id": "workflowId"}, update, documentDB_client.WorkflowDataCollection))
+
+	RequestBodyObj := RequestBody{}
+	json.Unmarshal([]byte(RequestBodyString), &RequestBodyObj)
+	resp, _, _, _, err := Handler(ctx, RequestBodyObj)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": "success"}, resp)
+
+	step, err := dBClient.FetchStepExecutionData(ctx, "callbackId")
+	assert.NoError(t, err)
+	assert.Equal(t, enums.StepSuccess, step.Status)
+	assert.NotZero(t, step.EndTime)
+	assert.Equal(t, map[string]interface{}{"facetKeyPointLocation": "S3 link for facet_key_point_detection ", isReworkRequired: false}, step.Output)
+
+	workflow, err := dBClient.FetchWorkflowExecutionData(ctx, "workflowId")
+	assert.NoError(t, err)
+	assert.Equal(t, []documentDB_client.StepsPassedThroughBody{{TaskName: "taskName", StepId: "callbackId", StartTime: 1000, Status: enums.StepSuccess}}, workflow.StepsPassedThrough)
+	assert.Equal(t, string(enums.StepSuccess), workflow.RunningState["taskName"])
+
+	// a repeated callback is rejected and leaves the documents as they are
+	_, _, _, _, err = Handler(ctx, RequestBodyObj)
+	assert.Error(t, err)
+	aws_client.AssertNumberOfCalls(t, "CloseWaitTask", 1)
+}
@@ -52,28 +52,32 @@ type AuthData struct {
 }
 
 type MyEvent struct {
-	Payload              interface{}         `json:"requestData"`
-	URL                  string              `json:"url" validate:"omitempty,url"`
-	ARN                  string              `json:"arn"`
-	QueueUrl             string              `json:"queueUrl"`
-	RequestMethod        enums.RequestMethod `json:"requestMethod" validate:"omitempty,httpMethod"`
-	Headers              map[string]string   `json:"headers"`
-	IsWaitTask           bool                `json:"isWaitTask"`
-	Timeout              int                 `json:"timeout"`
-	GetRequestBodyFromS3 string              `json:"getRequestBodyFromS3"`
-	S3RequestBodyType    string              `json:"s3RequestBodyType"`
-	StoreDataToS3        string              `json:"storeDataToS3"`
-	TaskName             string              `json:"taskName"`
-	CallType             enums.CallType      `json:"callType" validate:"omitempty,callTypes"`
-	OrderID              string              `json:"orderId"`
-	ReportID             string              `json:"reportId"`
-	WorkflowID           string              `json:"workflowId" validate:"required"`
-	TaskToken            string              `json:"taskToken" validate:"required_if=IsWaitTask true"`
-	HipsterJobID         string              `json:"hipsterJobId,omitempty"`
-	QueryParam           map[string]string   `json:"queryParam,omitempty"`
-	Auth                 AuthData            `json:"auth"`
-	Status               string              `json:"status"`
-	ErrorMessage         ErrorMessage        `json:"errorMessage"`
+	Payload              interface{}            `json:"requestData"`
+	URL                  string                 `json:"url" validate:"omitempty,url"`
+	ARN                  string                 `json:"arn"`
+	QueueUrl             string                 `json:"queueUrl"`
+	RequestMethod        enums.RequestMethod    `json:"requestMethod" validate:"omitempty,httpMethod"`
+	Headers              map[string]string      `json:"headers"`
+	IsWaitTask           bool                   `json:"isWaitTask"`
+	Timeout              int                    `json:"timeout"`
+	GetRequestBodyFromS3 string                 `json:"getRequestBodyFromS3"`
+	S3RequestBodyType    string                 `json:"s3RequestBodyType"`
+	StoreDataToS3        string                 `json:"storeDataToS3"`
+	TaskName             string                 `json:"taskName"`
+	CallType             enums.CallType         `json:"callType" validate:"omitempty,callTypes"`
+	OrderID              string                 `json:"orderId"`
+	ReportID             string                 `json:"reportId"`
+	WorkflowID           string                 `json:"workflowId" validate:"required"`
+	TaskToken            string                 `json:"taskToken" validate:"required_if=IsWaitTask true"`
+	HipsterJobID         string                 `json:"hipsterJobId,omitempty"`
+	QueryParam           map[string]string      `json:"queryParam,omitempty"`
+	Auth                 AuthData               `json:"auth"`
+	Status               string                 `json:"status"`
+	ErrorMessage         ErrorMessage           `json:"errorMessage"`
+	Cancel               map[string]interface{} `json:"cancel,omitempty"`
+	// SkipStepRecord makes the call without recording it as a step of the workflow, datastore cancels the vendor
+	// job of a step this way
+	SkipStepRecord bool `json:"skipStepRecord,omitempty"`
 }
 
 type ErrorMessage struct {
@@ -94,7 +98,6 @@ const DBSecretARN = "DBSecretARN"
 const envLegacyUpdatefunction = "envLegacyUpdatefunction"
 const envCallbackLambdaFunction = "envCallbackLambdaFunction"
 const success = "success"
-const running = "running"
 const failure = "failure"
 const loglevel = "info"
 const RetriableError = "RetriableError"
@@ -718,6 +721,9 @@ func HandleRequest(ctx context.Context, data MyEvent) (map[string]interface{}, e
 
 	log.Info(ctx, "callout lambda reached...")
 
+	if data.SkipStepRecord {
+		return CallService(ctx, data, stepID)
+	}
 	response, serviceerr := CallService(ctx, data, stepID)
 	StepExecutionData := documentDB_client.StepExecutionDataBody{
 		StepId:     stepID,
@@ -729,13 +735,13 @@ func HandleRequest(ctx context.Context, data MyEvent) (map[string]interface{}, e
 		TaskName:   data.TaskName,
 		ReportId:   data.ReportID,
 	}
+	StepExecutionData.Status = enums.StepStatusAfterCallout(data.IsWaitTask, serviceerr == nil)
 	if serviceerr != nil {
-		StepExecutionData.Status = failure
 		StepExecutionData.Output = response
 	}
 	if data.IsWaitTask {
 		StepExecutionData.IntermediateOutput = response
-		StepExecutionData.Status = running
+		StepExecutionData.CancelRequest = data.Cancel
 	} else {
 		StepExecutionData.Output = response
 		StepExecutionData.EndTime = time.Now().Unix()
@@ -747,12 +753,12 @@ func HandleRequest(ctx context.Context, data MyEvent) (map[string]interface{}, e
 	}
 	filter := bson.M{"_id": data.WorkflowID}
 	if serviceerr != nil {
-		update := commonHandler.DBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, data.TaskName, stepID, failure, starttime, data.IsWaitTask)
+		update := commonHandler.DBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, data.TaskName, stepID, enums.StepFailure, starttime, data.IsWaitTask)
 		commonHandler.DBClient.UpdateDocumentDB(ctx, filter, update, documentDB_client.WorkflowDataCollection)
 		return response, serviceerr
 		// Have to handle this
 	} else {
-		update := commonHandler.DBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, data.TaskName, stepID, success, starttime, data.IsWaitTask)
+		update := commonHandler.DBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, data.TaskName, stepID, enums.StepSuccess, starttime, data.IsWaitTask)
 		err := commonHandler.DBClient.UpdateDocumentDB(ctx, filter, update, documentDB_client.WorkflowDataCollection)
 		if err != nil {
 			response["status"] = failure
@@ -764,7 +770,8 @@ func HandleRequest(ctx context.Context, data MyEvent) (map[string]interface{}, e
 
 func notifcationWrapper(ctx context.Context, req MyEvent) (map[string]interface{}, error) {
 	resp, err := HandleRequest(ctx, req)
-	if err != nil {
+	// the caller of a call not recorded as a step reports its failure
+	if err != nil && !req.SkipStepRecord {
 		errT := err.(error_handler.ICodedError)
 		commonHandler.SlackClient.SendErrorMessage(errT.GetErrorCode(), req.ReportID, req.WorkflowID, "callout", req.TaskName, err.Error(), nil)
 	}
@@ -773,6 +780,11 @@ func notifcationWrapper(ctx context.Context, req MyEvent) (map[string]interface{
 
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(true, true, true, true, true)
+	var err error
+	commonHandler, err = common_handler.New(true, true, true, true, true)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notifcationWrapper)
 }
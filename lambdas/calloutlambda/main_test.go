@@ -11,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
 	"github.eagleview.com/engineering/symphony-service/commons/enums"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
 )
@@ -150,7 +151,7 @@ func TestCompleteCalloutSuccess(t *testing.T) {
 	}, nil)
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, success, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepSuccess, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -160,7 +161,7 @@ func TestCompleteCalloutSuccess(t *testing.T) {
 
 	// handle sync task
 	req = MyEvent{ReportID: reportID, IsWaitTask: false, TaskToken: "taskToken", WorkflowID: workflowId, CallType: "", RequestMethod: "POST", URL: "http://google.com", Payload: map[string]interface{}{"key": "value"}}
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, success, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepSuccess, mock.Anything, req.IsWaitTask).Return("update")
 	commonHandler.DBClient = dBClient
 	_, err = notifcationWrapper(context.Background(), req)
 	assert.NoError(t, err)
@@ -186,7 +187,7 @@ func TestCompleteCalloutFailure(t *testing.T) {
 	}, nil)
 	slackClient.On("SendErrorMessage", mock.Anything, reportID, workflowId, "callout", mock.Anything, mock.Anything, map[string]string(nil)).Return(nil)
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, failure, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepFailure, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -239,7 +240,7 @@ func TestCompleteCalloutFailureGetRequest(t *testing.T) {
 	}, nil)
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, failure, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepFailure, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -266,7 +267,7 @@ func TestCompleteCalloutFailureStatus(t *testing.T) {
 	}, nil)
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, failure, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepFailure, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -290,7 +291,7 @@ func TestCompleteCalloutWrongResponse(t *testing.T) {
 	}, nil)
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, failure, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepFailure, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -691,7 +692,7 @@ func TestCompleteCalloutSuccessLambdaCall(t *testing.T) {
 	req := MyEvent{ReportID: reportID, IsWaitTask: false, TaskToken: "taskToken", WorkflowID: workflowId, ARN: "lambda function arn", CallType: "lambda", Payload: map[string]interface{}{"key": "value"}}
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, success, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepSuccess, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -711,7 +712,7 @@ func TestCompleteCalloutFailureLambdaCall(t *testing.T) {
 	req := MyEvent{ReportID: reportID, IsWaitTask: false, TaskToken: "taskToken", WorkflowID: workflowId, ARN: "lambda function arn", CallType: "lambda", Payload: map[string]interface{}{"key": "value"}}
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, failure, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepFailure, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -744,6 +745,26 @@ func TestFailureLambdaCallunmarshalError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestCalloutSkippingStepRecord(t *testing.T) {
+	httpClient := new(mocks.MockHTTPClient)
+	dBClient := new(mocks.IDocDBClient)
+	slackClient := new(mocks.ISlackClient)
+	httpClient.Mock.On("Delete").Return(&http.Response{Status: "204 No Content", StatusCode: http.StatusNoContent, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil).Once()
+	httpClient.Mock.On("Delete").Return(&http.Response{Status: "404 Not Found", StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil).Once()
+	commonHandler.HttpClient = httpClient
+	commonHandler.DBClient = dBClient
+	commonHandler.SlackClient = slackClient
+	req := MyEvent{WorkflowID: "some-id", TaskName: "CancelCreateHipsterJobAndWaitForMeasurement", RequestMethod: "DELETE", URL: "http://hipster/v2/job/job-1", SkipStepRecord: true}
+
+	_, err := notifcationWrapper(context.Background(), req)
+	assert.NoError(t, err)
+	_, err = notifcationWrapper(context.Background(), req)
+	assert.Error(t, err)
+	// neither the step nor its failure is recorded, the caller reports it
+	dBClient.AssertExpectations(t)
+	slackClient.AssertExpectations(t)
+}
+
 func TestCompleteCalloutSuccessSQSCall(t *testing.T) {
 	awsClient := new(mocks.IAWSClient)
 	awsClient.Mock.On("PushMessageToSQS", mock.Anything, "Queue endpoint", mock.Anything).
@@ -756,7 +777,7 @@ func TestCompleteCalloutSuccessSQSCall(t *testing.T) {
 	req := MyEvent{ReportID: reportID, IsWaitTask: true, TaskToken: "taskToken", WorkflowID: workflowId, QueueUrl: "Queue endpoint", CallType: "sqs", Payload: map[string]interface{}{"key": "value"}}
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, success, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepSuccess, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -777,7 +798,7 @@ func TestCompleteCalloutFailureSQSCall(t *testing.T) {
 	req := MyEvent{ReportID: reportID, IsWaitTask: true, TaskToken: "taskToken", WorkflowID: workflowId, QueueUrl: "Queue endpoint", CallType: "sqs", Payload: map[string]interface{}{"key": "value"}}
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, failure, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepFailure, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -797,7 +818,7 @@ func TestCompleteCalloutSuccessSQSCallWithMeta(t *testing.T) {
 	req := MyEvent{ReportID: reportID, IsWaitTask: true, TaskToken: "taskToken", WorkflowID: workflowId, QueueUrl: "Queue endpoint", CallType: "sqs", Payload: map[string]interface{}{"key": "value", "meta": map[string]interface{}{"S3URI": ""}}}
 
 	dBClient.Mock.On("InsertStepExecutionData", mock.Anything, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, success, mock.Anything, req.IsWaitTask).Return("update")
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", mock.Anything, req.TaskName, mock.Anything, enums.StepSuccess, mock.Anything, req.IsWaitTask).Return("update")
 	dBClient.Mock.On("UpdateDocumentDB", mock.Anything, mock.Anything, "update", mock.Anything).Return(nil)
 	commonHandler.HttpClient = httpClient
 	commonHandler.AwsClient = awsClient
@@ -805,3 +826,34 @@ func TestCompleteCalloutSuccessSQSCallWithMeta(t *testing.T) {
 	_, err := HandleRequest(context.Background(), req)
 	assert.NoError(t, err)
 }
+
+func TestCompleteCalloutWritesDocumentsInMemory(t *testing.T) {
+	ctx := context.Background()
+	httpClient := new(mocks.MockHTTPClient)
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	workflowId := "some-id"
+	httpClient.Mock.On("Post").Return(&http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"jobId": "jobId"}`)),
+	}, nil)
+	assert.NoError(t, dBClient.InsertWorkflowExecutionData(ctx, documentDB_client.WorkflowExecutionDataBody{WorkflowId: workflowId, Status: enums.WorkflowInProgress, StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{}}))
+	commonHandler.HttpClient = httpClient
+	commonHandler.DBClient = dBClient
+
+	req := MyEvent{ReportID: "1241243", IsWaitTask: true, TaskToken: "taskToken", WorkflowID: workflowId, TaskName: "BuildingDetection", RequestMethod: "POST", URL: "http://google.com", Payload: map[string]interface{}{"key": "value"}}
+	_, err := HandleRequest(ctx, req)
+	assert.NoError(t, err)
+
+	workflow, err := dBClient.FetchWorkflowExecutionData(ctx, workflowId)
+	assert.NoError(t, err)
+	assert.Len(t, workflow.StepsPassedThrough, 1)
+	assert.Equal(t, enums.StepRunning, workflow.StepsPassedThrough[0].Status)
+	assert.Equal(t, string(enums.StepSubmitted), workflow.RunningState["BuildingDetection"])
+
+	step, err := dBClient.FetchStepExecutionData(ctx, workflow.StepsPassedThrough[0].StepId)
+	assert.NoError(t, err)
+	assert.Equal(t, enums.StepRunning, step.Status)
+	assert.Equal(t, "taskToken", step.TaskToken)
+	assert.Equal(t, "jobId", step.IntermediateOutput["jobId"])
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/eligibility_rules"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
@@ -18,10 +21,21 @@ const (
 )
 
 var (
-	commonHandler   common_handler.CommonHandler
-	validFacetCount = []int{1, 2, 4}
+	commonHandler common_handler.CommonHandler
+	rules         rulesSource = staticRules(eligibility_rules.Default())
 )
 
+// rulesSource returns the rules to evaluate an order with, eligibility_rules.Store refreshes them.
+type rulesSource interface {
+	Rules(ctx context.Context, now time.Time) eligibility_rules.RuleSet
+}
+
+type staticRules eligibility_rules.RuleSet
+
+func (ruleSet staticRules) Rules(context.Context, time.Time) eligibility_rules.RuleSet {
+	return eligibility_rules.RuleSet(ruleSet)
+}
+
 type pdwOutput struct {
 	Status      string `json:"status"`
 	MessageCode int    `json:"messageCode"`
@@ -39,7 +53,30 @@ type parcel struct {
 		Value *int `json:"value"`
 	} `json:"_detectedBuildingCount"`
 	Structures []structure `json:"structures"`
+
+	// every field of the parcel, as the rules may look at fields not decoded above
+	fields map[string]interface{}
+}
+
+func (p *parcel) UnmarshalJSON(data []byte) error {
+	type decoded parcel
+	if err := json.Unmarshal(data, (*decoded)(p)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &p.fields)
 }
+
+// document returns the fields of the parcel, built from the decoded ones when the parcel was not read from JSON.
+func (p parcel) document() map[string]interface{} {
+	if p.fields != nil {
+		return p.fields
+	}
+	document := map[string]interface{}{}
+	data, _ := json.Marshal(p)
+	json.Unmarshal(data, &document)
+	return document
+}
+
 type structure struct {
 	Type struct {
 		Value *string `json:"value"`
@@ -52,38 +89,36 @@ type structure struct {
 }
 
 func handler(ctx context.Context, input pdwOutput) error {
-	notMultiStructure := false
-	isValidFacetCount := false
 	status := "success"
 	bCount := 0
 	facetCount := 0
+	results := []eligibility_rules.Result{}
 
-	/*
-		case 1 : bc = 1, fC = [1, 2, 4] , true
-		case 2 : bc = 0, >2, fc = [1,2,4], false
-		case 3,  bc = 1, fc != [1,2,4] : false
-		case 4 : bc = 1, main structure not found, false
-		case 5 : bc = 0, >2, fc != [1,2,4], false
-	*/
-
-	if input.Status == "success" && len(input.Response.Data.Parcels) > 0 && input.Response.Data.Parcels[0].DetectedBuildingCount.Value != nil {
-		bCount = *input.Response.Data.Parcels[0].DetectedBuildingCount.Value
-		if *input.Response.Data.Parcels[0].DetectedBuildingCount.Value == 1 {
-			notMultiStructure = true
+	if input.Status == "success" && len(input.Response.Data.Parcels) > 0 {
+		p := input.Response.Data.Parcels[0]
+		if p.DetectedBuildingCount.Value != nil {
+			bCount = *p.DetectedBuildingCount.Value
 		}
-	}
-
-	if input.Status == "success" && len(input.Response.Data.Parcels) > 0 && len(input.Response.Data.Parcels[0].Structures) > 0 {
-		for _, s := range input.Response.Data.Parcels[0].Structures {
+		for _, s := range p.Structures {
 			if s.Type.Value != nil && *s.Type.Value == "main" {
 				if s.Roof.CountRoofFacets.Value != nil {
-					isValidFacetCount = findInIntArray(validFacetCount, *s.Roof.CountRoofFacets.Value)
 					facetCount = *s.Roof.CountRoofFacets.Value
 				}
 				break
 			}
 		}
+		now := time.Now()
+		results = rules.Rules(ctx, now).Evaluate(p.document(), now)
 	}
+	isHipsterCompatible := len(results) > 0
+	isValidFacetCount := false
+	for _, result := range results {
+		isHipsterCompatible = isHipsterCompatible && result.Passed
+		if result.Name == eligibility_rules.MainFacetCountRule {
+			isValidFacetCount = result.Passed
+		}
+	}
+	log.Infof(ctx, "Hipster eligibility rules: %+v", results)
 
 	if input.Status == "failure" {
 		status = "failure"
@@ -95,10 +130,11 @@ func handler(ctx context.Context, input pdwOutput) error {
 		"message":     input.Message,
 		"callbackId":  input.CallbackId,
 		"response": map[string]interface{}{
-			"isHipsterCompatible": notMultiStructure && isValidFacetCount,
+			"isHipsterCompatible": isHipsterCompatible,
 			"buildingCount":       bCount,
 			"facetCount":          facetCount,
 			"isValidFacetCount":   isValidFacetCount,
+			"rules":               results,
 		},
 	}
 	callBackLambdaArn := os.Getenv(callBackEnv)
@@ -112,15 +148,6 @@ func handler(ctx context.Context, input pdwOutput) error {
 	return nil
 }
 
-func findInIntArray(arr []int, val int) bool {
-	for _, v := range arr {
-		if v == val {
-			return true
-		}
-	}
-	return false
-}
-
 func notificationWrapper(ctx context.Context, req pdwOutput) error {
 	err := handler(ctx, req)
 	if err != nil {
@@ -134,6 +161,16 @@ func notificationWrapper(ctx context.Context, req pdwOutput) error {
 
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(true, false, false, true, false)
+	var err error
+	commonHandler, err = common_handler.New(true, false, false, true, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	rules, err = eligibility_rules.NewStore(context.Background(), commonHandler.AwsClient, time.Now())
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notificationWrapper)
 }
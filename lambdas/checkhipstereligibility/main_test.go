@@ -2,21 +2,42 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/eligibility_rules"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
 )
 
+// defaultRules is the breakdown of the default rules for a parcel, nil stands for a field missing from it.
+func defaultRules(buildingCount, facetCount interface{}) []eligibility_rules.Result {
+	return []eligibility_rules.Result{
+		ruleResult(eligibility_rules.SingleBuildingRule, eligibility_rules.BuildingCountField, eligibility_rules.OperatorEq, buildingCount, buildingCount == 1.0),
+		ruleResult(eligibility_rules.MainFacetCountRule, eligibility_rules.MainFacetCountField, eligibility_rules.OperatorIn, facetCount, facetCount == 1.0 || facetCount == 2.0 || facetCount == 4.0),
+	}
+}
+
+func ruleResult(name, field, operator string, value interface{}, passed bool) eligibility_rules.Result {
+	result := eligibility_rules.Result{Name: name, Passed: passed, Value: value}
+	if value == nil {
+		result.Reason = field + " is missing"
+	} else if !passed {
+		result.Reason = fmt.Sprintf("%s %v does not satisfy %s", field, value, operator)
+	}
+	return result
+}
+
 func TestIsHipsterCompatibleSIMfailed(t *testing.T) {
 	in := pdwOutput{
 		Status: "failure",
 	}
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 0, "isValidFacetCount": false}, "status": "failure"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 0, "isValidFacetCount": false, "rules": []eligibility_rules.Result{}}, "status": "failure"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -34,7 +55,7 @@ func TestIsHipsterEligibleInvokeFailed(t *testing.T) {
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
 	slackClient.On("SendErrorMessage", 4041, "", "", "checkHipsterEligibility", "checkHipsterEligibility", mock.Anything, mock.Anything).Return(nil)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 2, "isValidFacetCount": false}, "status": "success"}, false).Return(nil, errors.New("some error"))
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 2, "isValidFacetCount": false, "rules": defaultRules(2.0, nil)}, "status": "success"}, false).Return(nil, errors.New("some error"))
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -51,7 +72,7 @@ func TestCheckHipsterEligibilityBuildingCount(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 2, "isValidFacetCount": false}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 2, "isValidFacetCount": false, "rules": defaultRules(2.0, nil)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -69,7 +90,7 @@ func TestCheckHipsterEligibilityBuildingCount0(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 0, "isValidFacetCount": false}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 0, "isValidFacetCount": false, "rules": defaultRules(0.0, nil)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -101,7 +122,7 @@ func TestCheckHipsterEligibilityBuildingCount1FC1(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": true, "facetCount": 1, "buildingCount": 1, "isValidFacetCount": true}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": true, "facetCount": 1, "buildingCount": 1, "isValidFacetCount": true, "rules": defaultRules(1.0, 1.0)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -134,7 +155,7 @@ func TestCheckHipsterEligibilityBuildingCount1FC2(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": true, "facetCount": 2, "buildingCount": 1, "isValidFacetCount": true}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": true, "facetCount": 2, "buildingCount": 1, "isValidFacetCount": true, "rules": defaultRules(1.0, 2.0)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -167,7 +188,7 @@ func TestCheckHipsterEligibilityBuildingCount1FC4(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": true, "facetCount": 4, "buildingCount": 1, "isValidFacetCount": true}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": true, "facetCount": 4, "buildingCount": 1, "isValidFacetCount": true, "rules": defaultRules(1.0, 4.0)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -200,7 +221,7 @@ func TestCheckHipsterEligibilityBuildingCount1FC4NotMain(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 1, "isValidFacetCount": false}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 1, "isValidFacetCount": false, "rules": defaultRules(1.0, nil)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -233,7 +254,7 @@ func TestCheckHipsterEligibilityBuildingCount1FC5(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 5, "buildingCount": 1, "isValidFacetCount": false}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 5, "buildingCount": 1, "isValidFacetCount": false, "rules": defaultRules(1.0, 5.0)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
@@ -249,9 +270,51 @@ func TestCheckHipsterEligibilityBuildingCountNil(t *testing.T) {
 	in.Response.Data.Parcels = append(in.Response.Data.Parcels, pa)
 	awsClient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
-	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 0, "isValidFacetCount": false}, "status": "success"}, false).Return(nil, nil)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 0, "buildingCount": 0, "isValidFacetCount": false, "rules": defaultRules(nil, nil)}, "status": "success"}, false).Return(nil, nil)
 	commonHandler.SlackClient = slackClient
 	commonHandler.AwsClient = awsClient
 	err := notificationWrapper(context.Background(), in)
 	assert.NoError(t, err)
 }
+
+func useRules(t *testing.T, document string) {
+	t.Setenv(eligibility_rules.EligibilityRules, document)
+	loaded, err := eligibility_rules.Load(context.Background(), nil)
+	assert.NoError(t, err)
+	rules = staticRules(loaded)
+	t.Cleanup(func() { rules = staticRules(eligibility_rules.Default()) })
+}
+
+func TestCheckHipsterEligibilityConfiguredRules(t *testing.T) {
+	t.Setenv(eligibility_rules.KnownFields, "structures.roof._roofComplexity.value, _hasPool.value")
+	useRules(t, `[
+		{"name": "singleBuilding", "field": "_detectedBuildingCount.value", "operator": "eq", "value": 1},
+		{"name": "simpleRoof", "field": "structures[_type.value=main].roof._roofComplexity.value", "operator": "in", "values": ["simple", "normal"]},
+		{"name": "noPool", "field": "_hasPool.value", "operator": "ne", "value": true},
+		{"name": "freshDetection", "field": "_detectedBuildingCount.marker", "operator": "maxAgeDays", "value": 365000}
+	]`)
+	in := pdwOutput{}
+	err := json.Unmarshal([]byte(`{
+		"status": "success",
+		"response": {"data": {"parcels": [{
+			"_detectedBuildingCount": {"value": 1, "marker": "2021-08-01T00:00:00Z"},
+			"_hasPool": {"value": true},
+			"structures": [
+				{"_type": {"value": "garage"}, "roof": {"_roofComplexity": {"value": "simple"}}},
+				{"_type": {"value": "main"}, "roof": {"_roofComplexity": {"value": "complex"}, "_countRoofFacets": {"value": 4}}}
+			]
+		}]}}
+	}`), &in)
+	assert.NoError(t, err)
+	awsClient := new(mocks.IAWSClient)
+	awsClient.On("InvokeLambda", context.Background(), "", map[string]interface{}{"callbackId": "", "message": "", "messageCode": 0, "response": map[string]interface{}{"isHipsterCompatible": false, "facetCount": 4, "buildingCount": 1, "isValidFacetCount": false, "rules": []eligibility_rules.Result{
+		{Name: "singleBuilding", Passed: true, Value: 1.0},
+		{Name: "simpleRoof", Passed: false, Value: "complex", Reason: "structures[_type.value=main].roof._roofComplexity.value complex does not satisfy in"},
+		{Name: "noPool", Passed: false, Value: true, Reason: "_hasPool.value true does not satisfy ne"},
+		{Name: "freshDetection", Passed: true, Value: "2021-08-01T00:00:00Z"},
+	}}, "status": "success"}, false).Return(nil, nil)
+	commonHandler.AwsClient = awsClient
+	err = notificationWrapper(context.Background(), in)
+	assert.NoError(t, err)
+	awsClient.AssertExpectations(t)
+}
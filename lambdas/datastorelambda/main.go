@@ -1,32 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/execution_path"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var commonHandler common_handler.CommonHandler
 
 const (
-	Success    = "success"
-	Inprogress = "inprogress"
-	Finished   = "finished"
-	Timedout   = "timedout"
-	loglevel   = "info"
+	Success  = "success"
+	Timedout = "timedout"
+	loglevel = "info"
+
+	taskTimedOutMessage = "Task Timed Out"
+
+	envCalloutLambdaFunction = "envCalloutLambdaFunction"
+	cancelTaskPrefix         = "Cancel"
+	cancelled                = "cancelled"
+	cancelFailed             = "failed"
+	cancelSkipped            = "skipped"
+
+	// days a finished workflow and its steps are kept before the TTL index removes them, unset keeps them forever
+	envRetentionDays = "retentionDays"
+
+	envArchiveBucket        = "archiveBucket"
+	envArchivePrefix        = "archivePrefix"
+	envArchiveAfterDays     = "archiveAfterDays"
+	envArchiveBatchSize     = "archiveBatchSize"
+	defaultArchivePrefix    = "workflow-archive"
+	defaultArchiveAfterDays = 90
+	defaultArchiveBatchSize = 50
+	unknownSource           = "unknown"
 )
 
+// ArchivedWorkflow is the document written to S3 for each archived workflow, as gzipped canonical extended JSON.
+// The workflow and its steps are kept as stored so fields the typed bodies do not know survive the purge.
+type ArchivedWorkflow struct {
+	Workflow   bson.M   `bson:"workflow"`
+	Steps      []bson.M `bson:"steps"`
+	ArchivedAt int64    `bson:"archivedAt"`
+}
+
 type RequestBody struct {
 	Input             map[string]interface{}           `json:"input"`
 	OrderId           string                           `json:"orderId"`
@@ -35,6 +74,42 @@ type RequestBody struct {
 	FlowType          string                           `json:"flowType"`
 	StepID            string                           `json:"stepId"`
 	SfnSummaryFilters documentDB_client.SummaryFilters `json:"sfnSummaryFilters"`
+	MetricsWindow     documentDB_client.TimeRange      `json:"metricsWindow"`
+	ArchiveKey        string                           `json:"archiveKey"`
+	// MaxOutputBytes truncates the outputs returned by timeline, 0 returns them whole
+	MaxOutputBytes int `json:"maxOutputBytes"`
+}
+
+type WorkflowTimeline struct {
+	WorkflowId   string               `json:"workflowId"`
+	OrderId      string               `json:"orderId"`
+	FlowType     string               `json:"flowType"`
+	Status       enums.WorkflowStatus `json:"status"`
+	CreatedAt    int64                `json:"createdAt"`
+	FinishedAt   int64                `json:"finishedAt"`
+	Duration     int64                `json:"duration"`
+	TimedOutStep string               `json:"timedOutStep,omitempty"`
+	Steps        []TimelineStep       `json:"steps"`
+}
+
+// TimelineStep times are unix seconds, GapBefore is the idle time since the previous step ended
+// or since the workflow was created for the first step, overlapping steps have no gap.
+type TimelineStep struct {
+	StepId             string           `json:"stepId"`
+	TaskName           string           `json:"taskName"`
+	Status             enums.StepStatus `json:"status"`
+	StartTime          int64            `json:"startTime"`
+	EndTime            int64            `json:"endTime"`
+	Duration           int64            `json:"duration"`
+	GapBefore          int64            `json:"gapBefore"`
+	HasTaskToken       bool             `json:"hasTaskToken"`
+	IntermediateOutput interface{}      `json:"intermediateOutput,omitempty"`
+	Output             interface{}      `json:"output,omitempty"`
+	OutputTruncated    bool             `json:"outputTruncated,omitempty"`
+	ErrorMessage       string           `json:"errorMessage,omitempty"`
+	TimedOut           bool             `json:"timedOut,omitempty"`
+	// MissingStepData is set when the workflow lists the step but StepsData has no record of it
+	MissingStepData bool `json:"missingStepData,omitempty"`
 }
 
 const DBSecretARN = "DBSecretARN"
@@ -50,8 +125,15 @@ func Handler(ctx context.Context, Request RequestBody) (interface{}, error) {
 		data.CreatedAt = time.Now().Unix()
 		data.OrderId = Request.OrderId
 		data.WorkflowId = Request.WorkflowId
-		data.Status = Inprogress
+		data.Status = enums.WorkflowInProgress
 		data.InitialInput = Request.Input
+		priority, _ := Request.Input["priority"].(string)
+		data.Priority = enums.PriorityStandard
+		if p, ok := enums.ParsePriority(priority); ok {
+			data.Priority = p
+		} else {
+			log.Error(ctx, "unknown priority ", priority, ", recording the workflow as standard")
+		}
 		data.StepsPassedThrough = []documentDB_client.StepsPassedThroughBody{}
 		err = commonHandler.DBClient.InsertWorkflowExecutionData(ctx, data)
 		if err != nil {
@@ -59,24 +141,40 @@ func Handler(ctx context.Context, Request RequestBody) (interface{}, error) {
 			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorInsertingWorkflowDataInDB, err.Error())
 		}
 	case "update":
+		// the lane slot goes back first, the workflow stopped running even when its status can no longer change
+		laneErr := releasePriorityLane(ctx, Request.WorkflowId)
 		// handle timeout
 		err := handleTimeout(ctx, Request)
 		if err != nil {
 			log.Error(ctx, "error handling timeout, error: ", err.Error())
 			return map[string]interface{}{"status": "failed"}, err
 		}
-		update := bson.M{
-			"$set": bson.M{
-				"finishedAt": time.Now().Unix(),
-				"status":     Finished,
-			},
+		set := bson.M{
+			"finishedAt": time.Now().Unix(),
+			"status":     enums.WorkflowFinished,
 		}
-		query := bson.M{"_id": Request.WorkflowId}
-		err = commonHandler.DBClient.UpdateDocumentDB(ctx, query, update, documentDB_client.WorkflowDataCollection)
+		expireAt := retentionExpiry()
+		if expireAt != nil {
+			set[documentDB_client.ExpireAtField] = *expireAt
+		}
+		query := documentDB_client.WorkflowTransitionFilter(Request.WorkflowId, enums.WorkflowFinished)
+		err = commonHandler.DBClient.UpdateDocumentDB(ctx, query, bson.M{"$set": set}, documentDB_client.WorkflowDataCollection)
 		if err != nil {
 			log.Error(ctx, "Error while updating workflowExecutionData, error: ", err.Error())
 			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
 		}
+		if err = expireSteps(ctx, Request.WorkflowId, expireAt); err != nil {
+			return map[string]interface{}{"status": "failed"}, err
+		}
+		if laneErr != nil {
+			return map[string]interface{}{"status": "failed"}, laneErr
+		}
+	case "abort":
+		err := handleAbort(ctx, Request)
+		if err != nil {
+			log.Error(ctx, "error handling abort, error: ", err.Error())
+			return map[string]interface{}{"status": "failed"}, err
+		}
 	case "updateFlowType":
 		query := bson.M{"_id": Request.WorkflowId}
 		setrecord := bson.M{
@@ -89,27 +187,39 @@ func Handler(ctx context.Context, Request RequestBody) (interface{}, error) {
 			log.Errorf(ctx, "Unable to UpdateDocumentDB error = %s", err)
 			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
 		}
+		// a workflow falling back to the default path gives back the slot reserved by the throttle service
+		if Request.FlowType == execution_path.Paths().Default().Name {
+			if err = releaseHipsterSlot(ctx, Request.WorkflowId); err != nil {
+				return map[string]interface{}{"status": "failed"}, err
+			}
+		}
+	case "releaseHipsterSlot":
+		if err = releaseHipsterSlot(ctx, Request.WorkflowId); err != nil {
+			return map[string]interface{}{"status": "failed"}, err
+		}
 	case "sfnSummary":
 		log.Infof(ctx, "Filter: %+v", Request.SfnSummaryFilters)
-		response, err := commonHandler.DBClient.FetchWorkflowExecutionDataByListOfWorkflows(ctx, Request.SfnSummaryFilters, false)
+		page, err := commonHandler.DBClient.FetchWorkflowSummary(ctx, Request.SfnSummaryFilters)
 		if err != nil {
-			log.Errorf(ctx, "Unable to UpdateDocumentDB error = %s", err)
-			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
+			log.Errorf(ctx, "Unable to fetch workflow summary error = %s", err)
+			if errors.Is(err, documentDB_client.ErrInvalidSummaryFilters) {
+				return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.InvalidSummaryFilters, err.Error())
+			}
+			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
 		}
-		workflowSummary := []documentDB_client.WorkflowExecutionDataBody{}
-		for _, result := range response {
-			bye, _ := json.Marshal(result)
-			var temp documentDB_client.WorkflowExecutionDataBody
-			json.Unmarshal(bye, &temp)
-			workflowSummary = append(workflowSummary, temp)
+		log.Infof(ctx, "Response: %+v", len(page.Workflows))
+		if Request.SfnSummaryFilters.Paginated() {
+			return page, nil
 		}
-		log.Infof(ctx, "Response: %+v", len(workflowSummary))
-		return workflowSummary, nil
+		return page.Workflows, nil
 	case "sfnListOfWorkflowIDs":
 		log.Infof(ctx, "Filter: %+v", Request.SfnSummaryFilters)
 		response, err := commonHandler.DBClient.FetchWorkflowExecutionDataByListOfWorkflows(ctx, Request.SfnSummaryFilters, true)
 		if err != nil {
 			log.Errorf(ctx, "Unable to UpdateDocumentDB error = %s", err)
+			if errors.Is(err, documentDB_client.ErrInvalidSummaryFilters) {
+				return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.InvalidSummaryFilters, err.Error())
+			}
 			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
 		}
 		workflowIDs := []documentDB_client.WorkflowID{}
@@ -121,6 +231,33 @@ func Handler(ctx context.Context, Request RequestBody) (interface{}, error) {
 		}
 		log.Infof(ctx, "Response: %+v", workflowIDs)
 		return workflowIDs, nil
+	case "metrics":
+		log.Infof(ctx, "Metrics window: %+v", Request.MetricsWindow)
+		metrics, err := commonHandler.DBClient.FetchWorkflowMetrics(ctx, Request.MetricsWindow)
+		if err != nil {
+			log.Errorf(ctx, "Unable to fetch workflow metrics error = %s", err)
+			if errors.Is(err, documentDB_client.ErrInvalidMetricsWindow) {
+				return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.InvalidMetricsWindow, err.Error())
+			}
+			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowMetrics, err.Error())
+		}
+		return metrics, nil
+	case "timeline":
+		wfExecData, err := commonHandler.DBClient.FetchWorkflowExecutionData(ctx, Request.WorkflowId)
+		if err != nil {
+			log.Errorf(ctx, "Unable to fetch workflow error = %s", err)
+			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
+		}
+		steps, err := commonHandler.DBClient.FetchStepsByWorkflow(ctx, Request.WorkflowId)
+		if err != nil {
+			log.Errorf(ctx, "Unable to fetch steps error = %s", err)
+			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorFetchingStepExecutionDataFromDB, err.Error())
+		}
+		return buildTimeline(wfExecData, steps, Request.MaxOutputBytes), nil
+	case "archive":
+		return handleArchive(ctx)
+	case "restore":
+		return handleRestore(ctx, Request.ArchiveKey)
 	case "getOutputByStep":
 		response, err := commonHandler.DBClient.FetchStepExecutionData(ctx, Request.StepID)
 		if err != nil {
@@ -145,7 +282,16 @@ func notificationWrapper(ctx context.Context, req RequestBody) (interface{}, err
 
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(false, false, true, true, false)
+	var err error
+	commonHandler, err = common_handler.New(true, false, true, true, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	if _, err := execution_path.Load(); err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notificationWrapper)
 }
 
@@ -155,39 +301,576 @@ func handleTimeout(ctx context.Context, req RequestBody) error {
 		//running,
 		return error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
 	}
-	var timedOutStep *documentDB_client.StepsPassedThroughBody
+	runningSteps := getRunningSteps(wfExecData)
+	if len(runningSteps) == 0 {
+		return nil
+	}
+	timedOutStep := runningSteps[0]
+	log.Info(ctx, "task timed out: %s", timedOutStep.TaskName)
+
+	// every running step gets cancelled below, so none of them may stay running
+	for _, step := range runningSteps {
+		if err = markStepFailed(ctx, req.WorkflowId, step, stepFailureOutput(error_codes.StepFunctionTaskTimedOut, taskTimedOutMessage)); err != nil {
+			return err
+		}
+	}
+	commonHandler.SlackClient.SendErrorMessage(error_codes.StepFunctionTaskTimedOut, req.OrderId, req.WorkflowId, "datastore", timedOutStep.TaskName, taskTimedOutMessage, map[string]string{
+		"Task":   timedOutStep.TaskName,
+		"StepId": timedOutStep.StepId,
+	})
+	cancelRunningSteps(ctx, req, runningSteps)
+	return nil
+}
+
+// handleAbort is invoked when an execution is stopped, times out or fails outside of the state machine's own catch,
+// it fails every running step, cancels the vendor jobs they started and marks the workflow as aborted.
+func handleAbort(ctx context.Context, req RequestBody) error {
+	// the slots go back first, an execution failing before its workflow was recorded holds them too
+	releaseErr := releaseHipsterSlot(ctx, req.WorkflowId)
+	if err := releasePriorityLane(ctx, req.WorkflowId); err != nil && releaseErr == nil {
+		releaseErr = err
+	}
+	wfExecData, err := commonHandler.DBClient.FetchWorkflowExecutionData(ctx, req.WorkflowId)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		log.Info(ctx, "workflow ", req.WorkflowId, " was never recorded, nothing else to abort")
+		return releaseErr
+	}
+	if err != nil {
+		return error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
+	}
+	runningSteps := getRunningSteps(wfExecData)
+	for _, step := range runningSteps {
+		if err = markStepFailed(ctx, req.WorkflowId, step, stepFailureOutput(error_codes.WorkflowExecutionAborted, "Workflow aborted")); err != nil {
+			return err
+		}
+	}
+	cancelRunningSteps(ctx, req, runningSteps)
+
+	set := bson.M{
+		"finishedAt": time.Now().Unix(),
+		"status":     enums.WorkflowAborted,
+	}
+	expireAt := retentionExpiry()
+	if expireAt != nil {
+		set[documentDB_client.ExpireAtField] = *expireAt
+	}
+	err = commonHandler.DBClient.UpdateDocumentDB(ctx, documentDB_client.WorkflowTransitionFilter(req.WorkflowId, enums.WorkflowAborted), bson.M{"$set": set}, documentDB_client.WorkflowDataCollection)
+	if err != nil {
+		log.Error(ctx, "error updating db", err.Error())
+		return error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
+	}
+	if err = expireSteps(ctx, req.WorkflowId, expireAt); err != nil {
+		return err
+	}
+	return releaseErr
+}
+
+// releaseHipsterSlot frees the daily Hipster slot of a workflow that will not go through Hipster, workflows
+// without a slot are left alone.
+func releaseHipsterSlot(ctx context.Context, workflowId string) error {
+	released, err := commonHandler.DBClient.ReleaseHipsterSlot(ctx, workflowId)
+	if err != nil {
+		log.Error(ctx, "error releasing hipster slot, error: ", err.Error())
+		return error_handler.NewServiceError(error_codes.ErrorReleasingHipsterSlot, err.Error())
+	}
+	if released {
+		log.Info(ctx, "released hipster slot of workflow ", workflowId)
+	}
+	return nil
+}
+
+// releasePriorityLane gives back the slot invokesfn reserved in the priority lane of a workflow that stopped running,
+// workflows started without lanes hold none.
+func releasePriorityLane(ctx context.Context, workflowId string) error {
+	released, err := commonHandler.DBClient.ReleasePriorityLane(ctx, workflowId)
+	if err != nil {
+		log.Error(ctx, "error releasing priority lane slot, error: ", err.Error())
+		return error_handler.NewServiceError(error_codes.ErrorReleasingPriorityLane, err.Error())
+	}
+	if released {
+		log.Info(ctx, "released priority lane slot of workflow ", workflowId)
+	}
+	return nil
+}
+
+// retentionExpiry returns when a workflow finishing now should be removed by the TTL index, nil when retention is not configured.
+func retentionExpiry() *time.Time {
+	days, err := strconv.Atoi(os.Getenv(envRetentionDays))
+	if err != nil || days <= 0 {
+		return nil
+	}
+	expireAt := time.Now().AddDate(0, 0, days)
+	return &expireAt
+}
+
+func expireSteps(ctx context.Context, workflowID string, expireAt *time.Time) error {
+	if expireAt == nil {
+		return nil
+	}
+	update := bson.M{"$set": bson.M{documentDB_client.ExpireAtField: *expireAt}}
+	err := commonHandler.DBClient.UpdateDocumentDB(ctx, bson.M{"workflowId": workflowID}, update, documentDB_client.StepsDataCollection)
+	if err != nil {
+		log.Error(ctx, "error setting step expiry", err.Error())
+		return error_handler.NewServiceError(error_codes.ErrorUpdatingStepsDataInDB, err.Error())
+	}
+	return nil
+}
+
+func getRunningSteps(wfExecData documentDB_client.WorkflowExecutionDataBody) []documentDB_client.StepsPassedThroughBody {
+	runningSteps := []documentDB_client.StepsPassedThroughBody{}
 	for _, state := range wfExecData.StepsPassedThrough {
-		if state.Status == "running" {
-			timedOutStep = &state
+		if state.Status == enums.StepRunning {
+			runningSteps = append(runningSteps, state)
+		}
+	}
+	return runningSteps
+}
+
+// handleArchive moves up to batchSize workflows finished more than afterDays ago to S3, following the archival policy
+// stored by the schema bootstrap. A workflow restored within that window is left in place until it ages out again.
+func handleArchive(ctx context.Context) (interface{}, error) {
+	bucket := os.Getenv(envArchiveBucket)
+	if bucket == "" {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorArchivingWorkflow, envArchiveBucket+" is not configured")
+	}
+	policy, err := archivalPolicy(ctx)
+	if err != nil {
+		log.Error(ctx, "error loading the archival policy, ", err.Error())
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorArchivingWorkflow, err.Error())
+	}
+	batchSize := policy.BatchSize
+	cutoff := time.Now().AddDate(0, 0, -policy.AfterDays).Unix()
+	filters := documentDB_client.SummaryFilters{
+		Statuses:   []string{enums.WorkflowFinished.String(), enums.WorkflowAborted.String()},
+		FinishedAt: &documentDB_client.TimeRange{To: cutoff},
+		SortBy:     "finishedAt",
+		SortOrder:  documentDB_client.SortAscending,
+		PageSize:   int64(batchSize),
+	}
+
+	archived, failed := []string{}, 0
+	for len(archived)+failed < batchSize {
+		page, err := commonHandler.DBClient.FetchWorkflowSummary(ctx, filters)
+		if err != nil {
+			log.Error(ctx, "error selecting workflows to archive, ", err.Error())
+			return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
+		}
+		for _, workflow := range page.Workflows {
+			if workflow.RestoredAt > cutoff || len(archived)+failed >= batchSize {
+				continue
+			}
+			key, err := archiveWorkflow(ctx, bucket, workflow)
+			if err != nil {
+				failed++
+				log.Errorf(ctx, "error archiving workflow %s: %v", workflow.WorkflowId, err)
+				commonHandler.SlackClient.SendErrorMessage(error_codes.ErrorArchivingWorkflow, workflow.OrderId, workflow.WorkflowId, "datastore", "archive", err.Error(), nil)
+				continue
+			}
+			archived = append(archived, key)
+		}
+		if page.NextPageToken == "" {
 			break
 		}
+		filters.PageToken = page.NextPageToken
 	}
+	log.Infof(ctx, "archived %d workflows, %d failed", len(archived), failed)
+	return map[string]interface{}{
+		"status":   Success,
+		"archived": archived,
+		"failed":   failed,
+	}, nil
+}
 
-	if timedOutStep == nil {
-		return nil
+// archivalPolicy returns the policy stored by the schema bootstrap, archiveAfterDays and archiveBatchSize
+// until one is stored.
+func archivalPolicy(ctx context.Context) (documentDB_client.ArchivalPolicy, error) {
+	policy, err := commonHandler.DBClient.FetchArchivalPolicy(ctx)
+	if err == mongo.ErrNoDocuments {
+		return documentDB_client.ArchivalPolicy{
+			AfterDays: envInt(envArchiveAfterDays, defaultArchiveAfterDays),
+			BatchSize: envInt(envArchiveBatchSize, defaultArchiveBatchSize),
+		}, nil
 	}
-	log.Info(ctx, "task timed out: %s", timedOutStep.TaskName)
+	if err != nil {
+		return documentDB_client.ArchivalPolicy{}, err
+	}
+	return policy, policy.Validate()
+}
 
-	//update stepsPassedThrough
-	filter, update := commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateWorkflowExecutionSteps, "failure", req.WorkflowId, timedOutStep.StepId, timedOutStep.TaskName, nil)
-	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, update, documentDB_client.WorkflowDataCollection)
+// archiveWorkflow writes the workflow and its steps to S3, reads the object back to verify it
+// and only then deletes the documents from DocumentDB.
+func archiveWorkflow(ctx context.Context, bucket string, workflow documentDB_client.WorkflowExecutionDataBody) (string, error) {
+	documents, err := commonHandler.DBClient.FetchDocuments(ctx, bson.M{"_id": workflow.WorkflowId}, documentDB_client.WorkflowDataCollection)
+	if err != nil {
+		return "", err
+	}
+	if len(documents) != 1 {
+		return "", fmt.Errorf("workflow %s not found", workflow.WorkflowId)
+	}
+	steps, err := commonHandler.DBClient.FetchDocuments(ctx, bson.M{"workflowId": workflow.WorkflowId}, documentDB_client.StepsDataCollection)
+	if err != nil {
+		return "", err
+	}
+	// canonical extended JSON keeps the bson types, e.g. int32 and int64 fields are restored as they were
+	data, err := bson.MarshalExtJSON(ArchivedWorkflow{Workflow: documents[0], Steps: steps, ArchivedAt: time.Now().Unix()}, true, false)
+	if err != nil {
+		return "", err
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err = zw.Write(data); err != nil {
+		return "", err
+	}
+	if err = zw.Close(); err != nil {
+		return "", err
+	}
+
+	key := archiveKey(workflow)
+	if err = commonHandler.AwsClient.StoreDataToS3(ctx, bucket, key, compressed.Bytes()); err != nil {
+		return "", err
+	}
+	stored, err := commonHandler.AwsClient.GetDataFromS3(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(stored, compressed.Bytes()) {
+		return "", fmt.Errorf("archive %s does not match the data written", key)
+	}
+
+	if _, err = commonHandler.DBClient.DeleteDocuments(ctx, bson.M{"_id": workflow.WorkflowId}, documentDB_client.WorkflowDataCollection); err != nil {
+		return "", err
+	}
+	if _, err = commonHandler.DBClient.DeleteDocuments(ctx, bson.M{"workflowId": workflow.WorkflowId}, documentDB_client.StepsDataCollection); err != nil {
+		return "", fmt.Errorf("workflow archived to %s but its steps were not purged: %w", key, err)
+	}
+	return key, nil
+}
+
+// archiveKey partitions archives by the UTC day the workflow finished and its source.
+func archiveKey(workflow documentDB_client.WorkflowExecutionDataBody) string {
+	prefix := os.Getenv(envArchivePrefix)
+	if prefix == "" {
+		prefix = defaultArchivePrefix
+	}
+	source, _ := workflow.InitialInput["source"].(string)
+	if source == "" {
+		source = unknownSource
+	}
+	day := time.Unix(workflow.FinishedAt, 0).UTC().Format("2006-01-02")
+	return fmt.Sprintf("%s/dt=%s/source=%s/%s.json.gz", strings.TrimSuffix(prefix, "/"), day, source, workflow.WorkflowId)
+}
+
+// handleRestore inserts an archived workflow and its steps back into DocumentDB, marked with restoredAt.
+func handleRestore(ctx context.Context, key string) (interface{}, error) {
+	bucket := os.Getenv(envArchiveBucket)
+	if bucket == "" || key == "" {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorRestoringWorkflow, "archiveKey and "+envArchiveBucket+" are required")
+	}
+	data, err := commonHandler.AwsClient.GetDataFromS3(ctx, bucket, key)
 	if err != nil {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorFetchingDataFromS3, err.Error())
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err == nil {
+		data, err = ioutil.ReadAll(zr)
+	}
+	var archive ArchivedWorkflow
+	if err == nil {
+		err = bson.UnmarshalExtJSON(data, false, &archive)
+	}
+	if err != nil {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorRestoringWorkflow, err.Error())
+	}
+
+	if archive.Workflow == nil {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorRestoringWorkflow, key+" holds no workflow")
+	}
+	archive.Workflow["restoredAt"] = time.Now().Unix()
+	if err = commonHandler.DBClient.InsertDocuments(ctx, []bson.M{archive.Workflow}, documentDB_client.WorkflowDataCollection); err != nil {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorInsertingWorkflowDataInDB, err.Error())
+	}
+	if err = commonHandler.DBClient.InsertDocuments(ctx, archive.Steps, documentDB_client.StepsDataCollection); err != nil {
+		return map[string]interface{}{"status": "failed"}, error_handler.NewServiceError(error_codes.ErrorInsertingStepExecutionDataInDB, err.Error())
+	}
+	workflowId := fmt.Sprint(archive.Workflow["_id"])
+	log.Infof(ctx, "restored workflow %s with %d steps from %s", workflowId, len(archive.Steps), key)
+	return map[string]interface{}{
+		"status":     Success,
+		"workflowId": workflowId,
+		"steps":      len(archive.Steps),
+	}, nil
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// buildTimeline merges the steps the workflow passed through with their StepsData records ordered by start time.
+func buildTimeline(wfExecData documentDB_client.WorkflowExecutionDataBody, steps []documentDB_client.StepExecutionDataBody, maxOutputBytes int) WorkflowTimeline {
+	timeline := WorkflowTimeline{
+		WorkflowId: wfExecData.WorkflowId,
+		OrderId:    wfExecData.OrderId,
+		FlowType:   wfExecData.FlowType,
+		Status:     wfExecData.Status,
+		CreatedAt:  wfExecData.CreatedAt,
+		FinishedAt: wfExecData.FinishedAt,
+		Steps:      []TimelineStep{},
+	}
+	if wfExecData.FinishedAt > 0 {
+		timeline.Duration = wfExecData.FinishedAt - wfExecData.CreatedAt
+	}
+
+	stepData := make(map[string]documentDB_client.StepExecutionDataBody, len(steps))
+	for _, step := range steps {
+		stepData[step.StepId] = step
+	}
+	listed := make(map[string]bool, len(wfExecData.StepsPassedThrough))
+	for _, passed := range wfExecData.StepsPassedThrough {
+		listed[passed.StepId] = true
+		data, ok := stepData[passed.StepId]
+		if !ok {
+			timeline.Steps = append(timeline.Steps, TimelineStep{
+				StepId:          passed.StepId,
+				TaskName:        passed.TaskName,
+				Status:          passed.Status,
+				StartTime:       passed.StartTime,
+				MissingStepData: true,
+			})
+			continue
+		}
+		timeline.Steps = append(timeline.Steps, newTimelineStep(data, maxOutputBytes))
+	}
+	for _, step := range steps {
+		if !listed[step.StepId] {
+			timeline.Steps = append(timeline.Steps, newTimelineStep(step, maxOutputBytes))
+		}
+	}
+	sort.SliceStable(timeline.Steps, func(i, j int) bool {
+		return timeline.Steps[i].StartTime < timeline.Steps[j].StartTime
+	})
+
+	lastEnd := wfExecData.CreatedAt
+	for i := range timeline.Steps {
+		step := &timeline.Steps[i]
+		if lastEnd > 0 && step.StartTime > lastEnd {
+			step.GapBefore = step.StartTime - lastEnd
+		}
+		end := step.EndTime
+		if end == 0 {
+			end = step.StartTime
+		}
+		if end > lastEnd {
+			lastEnd = end
+		}
+		if step.TimedOut && timeline.TimedOutStep == "" {
+			timeline.TimedOutStep = step.StepId
+		}
+	}
+	return timeline
+}
+
+func newTimelineStep(data documentDB_client.StepExecutionDataBody, maxOutputBytes int) TimelineStep {
+	step := TimelineStep{
+		StepId:       data.StepId,
+		TaskName:     data.TaskName,
+		Status:       data.Status,
+		StartTime:    data.StartTime,
+		EndTime:      data.EndTime,
+		HasTaskToken: data.TaskToken != "",
+	}
+	if data.EndTime > 0 {
+		step.Duration = data.EndTime - data.StartTime
+	}
+	var truncated bool
+	step.IntermediateOutput, truncated = truncateOutput(data.IntermediateOutput, maxOutputBytes)
+	step.OutputTruncated = step.OutputTruncated || truncated
+	step.Output, truncated = truncateOutput(data.Output, maxOutputBytes)
+	step.OutputTruncated = step.OutputTruncated || truncated
+	if data.Status == enums.StepFailure {
+		if message, ok := data.Output["message"].(string); ok {
+			step.ErrorMessage = message
+		} else if message, ok := data.IntermediateOutput["message"].(string); ok {
+			step.ErrorMessage = message
+		}
+		step.TimedOut = fmt.Sprint(data.Output["messageCode"]) == strconv.Itoa(error_codes.StepFunctionTaskTimedOut)
+		// callbacks always record an output, a failed step without one was timed out before the timeout
+		// handler recorded its messageCode
+		if len(data.Output) == 0 {
+			step.TimedOut = true
+			if step.ErrorMessage == "" {
+				step.ErrorMessage = taskTimedOutMessage
+			}
+		}
+	}
+	return step
+}
+
+// truncateOutput returns output as is when it fits in maxBytes once serialised, otherwise its first maxBytes as a string
+// cut back to the start of a rune so it stays valid UTF-8.
+func truncateOutput(output map[string]interface{}, maxBytes int) (interface{}, bool) {
+	if len(output) == 0 {
+		return nil, false
+	}
+	if maxBytes <= 0 {
+		return output, false
+	}
+	b, err := json.Marshal(output)
+	if err != nil || len(b) <= maxBytes {
+		return output, false
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(b[end]) {
+		end--
+	}
+	return string(b[:end]), true
+}
+
+// stepFailureOutput is recorded as the output of a step failed on behalf of the state machine, in the shape of a callback response.
+func stepFailureOutput(messageCode int, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":      enums.StepFailure,
+		"messageCode": messageCode,
+		"message":     message,
+	}
+}
+
+func markStepFailed(ctx context.Context, workflowId string, step documentDB_client.StepsPassedThroughBody, output map[string]interface{}) error {
+	//update stepsPassedThrough
+	filter, update := commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateWorkflowExecutionSteps, enums.StepFailure, workflowId, step.StepId, step.TaskName, nil)
+	err := commonHandler.DBClient.UpdateDocumentDB(ctx, filter, update, documentDB_client.WorkflowDataCollection)
+	if err != nil && !alreadyFinished(ctx, step, err) {
 		log.Error(ctx, "error updating db", err.Error())
 		return error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
 	}
 
 	//update StepExecutionDataBody
-	filter, update = commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateStepExecution, "failure", req.WorkflowId, timedOutStep.StepId, timedOutStep.TaskName, nil)
+	filter, update = commonHandler.DBClient.BuildQueryForCallBack(ctx, documentDB_client.UpdateStepExecution, enums.StepFailure, workflowId, step.StepId, step.TaskName, output)
 	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, update, documentDB_client.StepsDataCollection)
-	if err != nil {
+	if err != nil && !alreadyFinished(ctx, step, err) {
 		log.Error(ctx, "error updating db", err.Error())
 		return error_handler.NewServiceError(error_codes.ErrorUpdatingStepsDataInDB, err.Error())
 	}
-	commonHandler.SlackClient.SendErrorMessage(error_codes.StepFunctionTaskTimedOut, req.OrderId, req.WorkflowId, "datastore", timedOutStep.TaskName, "Task Timed Out", map[string]string{
-		"Task":   timedOutStep.TaskName,
-		"StepId": timedOutStep.StepId,
-	})
 	return nil
 }
 
-// mongodb+srv://master:<password>@cluster0.qucxctq.mongodb.net/?retryWrites=true&w=majority
+// alreadyFinished reports whether err is the guarded update refusing to fail a step that finished in the meantime,
+// e.g. its callback arrived while the workflow was timing out.
+func alreadyFinished(ctx context.Context, step documentDB_client.StepsPassedThroughBody, err error) bool {
+	coded, ok := err.(error_handler.ICodedError)
+	if !ok || coded.GetErrorCode() != error_codes.IllegalStepStatusTransition {
+		return false
+	}
+	log.Info(ctx, fmt.Sprintf("step %s of %s already finished, not marking it failed", step.StepId, step.TaskName))
+	return true
+}
+
+// cancelRunningSteps calls the cancel endpoint registered by each step and records the outcome on the step,
+// a failed cancellation is reported to slack but does not fail the caller.
+func cancelRunningSteps(ctx context.Context, req RequestBody, runningSteps []documentDB_client.StepsPassedThroughBody) {
+	for _, step := range runningSteps {
+		stepData, err := commonHandler.DBClient.FetchStepExecutionData(ctx, step.StepId)
+		if err != nil {
+			log.Error(ctx, "error fetching step data for cancellation", err.Error())
+			continue
+		}
+		outcome := cancelStep(ctx, req, stepData)
+		log.Infof(ctx, "cancellation of %s: %+v", step.TaskName, outcome)
+		update := bson.M{
+			"$set": bson.M{
+				"cancellation": outcome,
+			},
+		}
+		err = commonHandler.DBClient.UpdateDocumentDB(ctx, bson.M{"_id": step.StepId}, update, documentDB_client.StepsDataCollection)
+		if err != nil {
+			log.Error(ctx, "error recording cancellation", err.Error())
+		}
+		if outcome.Status == cancelFailed {
+			commonHandler.SlackClient.SendErrorMessage(error_codes.ErrorCancellingVendorJob, req.OrderId, req.WorkflowId, "datastore", step.TaskName, outcome.Message, map[string]string{
+				"Task":   step.TaskName,
+				"StepId": step.StepId,
+			})
+		}
+	}
+}
+
+func cancelStep(ctx context.Context, req RequestBody, stepData documentDB_client.StepExecutionDataBody) documentDB_client.CancellationBody {
+	outcome := documentDB_client.CancellationBody{
+		Status:      cancelSkipped,
+		Message:     "no cancel endpoint registered",
+		AttemptedAt: time.Now().Unix(),
+	}
+	if len(stepData.CancelRequest) == 0 {
+		return outcome
+	}
+	payload := buildCancelPayload(stepData, req)
+	result, err := commonHandler.AwsClient.InvokeLambda(ctx, os.Getenv(envCalloutLambdaFunction), payload, false)
+	if err != nil {
+		outcome.Status, outcome.Message = cancelFailed, err.Error()
+		return outcome
+	}
+	var resp map[string]interface{}
+	if len(result.Payload) != 0 {
+		if err = json.Unmarshal(result.Payload, &resp); err != nil {
+			outcome.Status, outcome.Message = cancelFailed, err.Error()
+			return outcome
+		}
+	}
+	if errorType, ok := resp["errorType"]; ok {
+		outcome.Status, outcome.Message = cancelFailed, fmt.Sprintf("%v: %v", errorType, resp["errorMessage"])
+		return outcome
+	}
+	outcome.Status, outcome.Message = cancelled, "cancel endpoint called successfully"
+	return outcome
+}
+
+// buildCancelPayload turns the cancel request registered at callout time into a callout lambda event the callout
+// does not record as a step, {{key}} placeholders in its string values, nested ones included, are filled from the
+// step's intermediate output, e.g. {{jobId}}.
+func buildCancelPayload(stepData documentDB_client.StepExecutionDataBody, req RequestBody) map[string]interface{} {
+	payload := make(map[string]interface{}, len(stepData.CancelRequest)+6)
+	for key, val := range stepData.CancelRequest {
+		payload[key] = fillPlaceholders(val, stepData.IntermediateOutput)
+	}
+	payload["taskName"] = cancelTaskPrefix + stepData.TaskName
+	payload["workflowId"] = stepData.WorkflowId
+	payload["reportId"] = stepData.ReportId
+	payload["orderId"] = req.OrderId
+	payload["isWaitTask"] = false
+	payload["skipStepRecord"] = true
+	return payload
+}
+
+// fillPlaceholders returns a copy of value where every {{key}} of its strings, in maps and lists at any depth, is
+// replaced by the value of key in values.
+func fillPlaceholders(value interface{}, values map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		for key, val := range values {
+			v = strings.ReplaceAll(v, "{{"+key+"}}", fmt.Sprint(val))
+		}
+		return v
+	case map[string]interface{}:
+		filled := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			filled[key] = fillPlaceholders(val, values)
+		}
+		return filled
+	case bson.M:
+		return fillPlaceholders(map[string]interface{}(v), values)
+	case bson.D:
+		return fillPlaceholders(v.Map(), values)
+	case []interface{}:
+		filled := make([]interface{}, len(v))
+		for i, val := range v {
+			filled[i] = fillPlaceholders(val, values)
+		}
+		return filled
+	case bson.A:
+		return fillPlaceholders([]interface{}(v), values)
+	}
+	return value
+}
@@ -4,13 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var testContext = log_config.SetTraceIdInContext(context.Background(), "44825849", "9cabffdf-e980-0bbf-b481-0048f7a88bef")
@@ -87,12 +95,36 @@ func TestDatastoreLambdaupdate(t *testing.T) {
 
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, mock.Anything).Return(documentDB_client.WorkflowExecutionDataBody{}, nil)
+	dBClient.Mock.On("ReleasePriorityLane", testContext, mock.Anything).Return(true, nil)
 	commonHandler.DBClient = dBClient
 	resp, err := Handler(context.Background(), DataStoreRequestObj)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedResp, resp)
 
 }
+func TestDatastoreLambdaupdateSetsRetention(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	t.Setenv(envRetentionDays, "30")
+
+	DataStoreRequestObj := RequestBody{}
+	mydata := []byte(DataStoreRequest)
+	json.Unmarshal(mydata, &DataStoreRequestObj)
+	DataStoreRequestObj.Action = "update"
+
+	hasExpiry := mock.MatchedBy(func(update bson.M) bool {
+		_, ok := update["$set"].(bson.M)[documentDB_client.ExpireAtField]
+		return ok
+	})
+	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, mock.Anything).Return(documentDB_client.WorkflowExecutionDataBody{}, nil)
+	dBClient.Mock.On("ReleasePriorityLane", testContext, mock.Anything).Return(true, nil)
+	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, hasExpiry, documentDB_client.WorkflowDataCollection).Return(nil).Once()
+	dBClient.Mock.On("UpdateDocumentDB", testContext, bson.M{"workflowId": DataStoreRequestObj.WorkflowId}, hasExpiry, documentDB_client.StepsDataCollection).Return(nil).Once()
+	commonHandler.DBClient = dBClient
+	_, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	dBClient.AssertExpectations(t)
+}
+
 func TestDatastoreLambdaupdateerror(t *testing.T) {
 	dBClient := new(mocks.IDocDBClient)
 
@@ -104,11 +136,13 @@ func TestDatastoreLambdaupdateerror(t *testing.T) {
 
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("some error"))
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, mock.Anything).Return(documentDB_client.WorkflowExecutionDataBody{}, nil)
+	dBClient.Mock.On("ReleasePriorityLane", testContext, DataStoreRequestObj.WorkflowId).Return(true, nil)
 	commonHandler.DBClient = dBClient
 	resp, err := Handler(context.Background(), DataStoreRequestObj)
 	assert.Error(t, err)
 	assert.Equal(t, expectedResp, resp)
-
+	// the slot is given back even though the workflow could not be updated
+	dBClient.AssertCalled(t, "ReleasePriorityLane", testContext, DataStoreRequestObj.WorkflowId)
 }
 
 func TestDatastoreLambdaupdateStepTimeOut(t *testing.T) {
@@ -128,8 +162,10 @@ func TestDatastoreLambdaupdateStepTimeOut(t *testing.T) {
 		},
 	}
 
-	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil).Times(3)
+	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil).Times(4)
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, mock.Anything).Return(stepData, nil)
+	dBClient.Mock.On("ReleasePriorityLane", testContext, mock.Anything).Return(true, nil)
+	dBClient.Mock.On("FetchStepExecutionData", testContext, "1234").Return(documentDB_client.StepExecutionDataBody{StepId: "1234"}, nil)
 	dBClient.Mock.On("BuildQueryForCallBack", testContext, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
 	slackClient.Mock.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	commonHandler.DBClient = dBClient
@@ -139,3 +175,494 @@ func TestDatastoreLambdaupdateStepTimeOut(t *testing.T) {
 	assert.Equal(t, expectedResp, resp)
 
 }
+
+func TestDatastoreLambdaupdateStepTimeOutFailsEveryCancelledStep(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	awsClient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	DataStoreRequestObj := RequestBody{}
+	mydata := []byte(DataStoreRequest)
+	json.Unmarshal(mydata, &DataStoreRequestObj)
+	DataStoreRequestObj.Action = "update"
+	wfData := documentDB_client.WorkflowExecutionDataBody{
+		StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{
+			{Status: "running", StepId: "1234", TaskName: "CreateHipsterJobAndWaitForMeasurement"},
+			{Status: "running", StepId: "5678", TaskName: "3DModellingService"},
+		},
+	}
+	cancelRequest := map[string]interface{}{"url": "https://vendor/jobs/{{jobId}}", "requestMethod": "DELETE"}
+
+	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, mock.Anything).Return(wfData, nil)
+	dBClient.Mock.On("ReleasePriorityLane", testContext, mock.Anything).Return(true, nil)
+	dBClient.Mock.On("BuildQueryForCallBack", testContext, mock.Anything, enums.StepFailure, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("FetchStepExecutionData", testContext, "1234").Return(documentDB_client.StepExecutionDataBody{StepId: "1234", TaskName: "CreateHipsterJobAndWaitForMeasurement", CancelRequest: cancelRequest}, nil)
+	dBClient.Mock.On("FetchStepExecutionData", testContext, "5678").Return(documentDB_client.StepExecutionDataBody{StepId: "5678", TaskName: "3DModellingService", CancelRequest: cancelRequest}, nil)
+	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	awsClient.Mock.On("InvokeLambda", testContext, mock.Anything, mock.Anything, false).Return(&lambda.InvokeOutput{Payload: []byte(`{"status":"success"}`)}, nil)
+	slackClient.Mock.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = awsClient
+	commonHandler.SlackClient = slackClient
+	_, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	for _, stepId := range []string{"1234", "5678"} {
+		dBClient.AssertCalled(t, "BuildQueryForCallBack", testContext, mock.Anything, enums.StepFailure, mock.Anything, stepId, mock.Anything, mock.Anything)
+	}
+	awsClient.AssertNumberOfCalls(t, "InvokeLambda", 2)
+}
+
+func TestDatastoreLambdaabortCancelsRunningSteps(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	awsClient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	DataStoreRequestObj := RequestBody{}
+	mydata := []byte(DataStoreRequest)
+	json.Unmarshal(mydata, &DataStoreRequestObj)
+	DataStoreRequestObj.Action = "abort"
+	expectedResp := map[string]interface{}{"status": "success"}
+	wfData := documentDB_client.WorkflowExecutionDataBody{
+		StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{
+			{Status: "success", StepId: "1233", TaskName: "ThrottleService"},
+			{Status: "running", StepId: "1234", TaskName: "CreateHipsterJobAndWaitForMeasurement"},
+		},
+	}
+	stepData := documentDB_client.StepExecutionDataBody{
+		StepId:             "1234",
+		TaskName:           "CreateHipsterJobAndWaitForMeasurement",
+		WorkflowId:         DataStoreRequestObj.WorkflowId,
+		IntermediateOutput: map[string]interface{}{"jobId": "job-1"},
+		CancelRequest: map[string]interface{}{
+			"url":           "https://hipster/v2/job/{{jobId}}",
+			"requestMethod": "DELETE",
+		},
+	}
+	expectedPayload := map[string]interface{}{
+		"url":            "https://hipster/v2/job/job-1",
+		"requestMethod":  "DELETE",
+		"taskName":       "CancelCreateHipsterJobAndWaitForMeasurement",
+		"workflowId":     DataStoreRequestObj.WorkflowId,
+		"reportId":       "",
+		"orderId":        DataStoreRequestObj.OrderId,
+		"isWaitTask":     false,
+		"skipStepRecord": true,
+	}
+
+	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, DataStoreRequestObj.WorkflowId).Return(wfData, nil)
+	dBClient.Mock.On("ReleasePriorityLane", testContext, mock.Anything).Return(true, nil)
+	dBClient.Mock.On("BuildQueryForCallBack", testContext, mock.Anything, enums.StepFailure, mock.Anything, "1234", mock.Anything, mock.Anything).Return("filter", "query")
+	dBClient.Mock.On("FetchStepExecutionData", testContext, "1234").Return(stepData, nil)
+	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	dBClient.Mock.On("ReleaseHipsterSlot", testContext, DataStoreRequestObj.WorkflowId).Return(true, nil)
+	awsClient.Mock.On("InvokeLambda", testContext, mock.Anything, expectedPayload, false).Return(&lambda.InvokeOutput{Payload: []byte(`{"status":"success"}`)}, nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = awsClient
+	commonHandler.SlackClient = slackClient
+	resp, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedResp, resp)
+	awsClient.AssertExpectations(t)
+	dBClient.AssertCalled(t, "ReleasePriorityLane", testContext, DataStoreRequestObj.WorkflowId)
+	dBClient.AssertCalled(t, "UpdateDocumentDB", testContext, bson.M{"_id": "1234"}, mock.MatchedBy(func(update bson.M) bool {
+		return update["$set"].(bson.M)["cancellation"].(documentDB_client.CancellationBody).Status == cancelled
+	}), documentDB_client.StepsDataCollection)
+}
+
+func TestBuildCancelPayloadFillsNestedPlaceholders(t *testing.T) {
+	stepData := documentDB_client.StepExecutionDataBody{
+		TaskName:           "CreateJob",
+		IntermediateOutput: map[string]interface{}{"jobId": "job-1", "attempt": 2.0},
+		CancelRequest: map[string]interface{}{
+			"url":         "https://vendor/job/{{jobId}}",
+			"requestData": bson.M{"job": map[string]interface{}{"id": "{{jobId}}", "tags": bson.A{"attempt-{{attempt}}", 3.0}}},
+		},
+	}
+	payload := buildCancelPayload(stepData, RequestBody{})
+	assert.Equal(t, "https://vendor/job/job-1", payload["url"])
+	assert.Equal(t, map[string]interface{}{"job": map[string]interface{}{"id": "job-1", "tags": []interface{}{"attempt-2", 3.0}}}, payload["requestData"])
+	assert.Equal(t, true, payload["skipStepRecord"])
+}
+
+func TestDatastoreLambdasfnSummaryReturnsWorkflows(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	filters := documentDB_client.SummaryFilters{Source: "SIM", MaxCount: 10}
+	workflows := []documentDB_client.WorkflowExecutionDataBody{{WorkflowId: "wf-1"}, {WorkflowId: "wf-2"}}
+	dBClient.On("FetchWorkflowSummary", mock.Anything, filters).Return(documentDB_client.WorkflowSummaryPage{Workflows: workflows}, nil)
+	commonHandler.DBClient = dBClient
+
+	resp, err := Handler(context.Background(), RequestBody{Action: "sfnSummary", SfnSummaryFilters: filters})
+	assert.NoError(t, err)
+	assert.Equal(t, workflows, resp)
+}
+
+func TestDatastoreLambdasfnSummaryPaginated(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	filters := documentDB_client.SummaryFilters{Source: "SIM", PageSize: 1, Fields: []string{"status"}}
+	page := documentDB_client.WorkflowSummaryPage{
+		Workflows:     []documentDB_client.WorkflowExecutionDataBody{{WorkflowId: "wf-1", Status: enums.WorkflowFinished}},
+		NextPageToken: "token",
+	}
+	dBClient.On("FetchWorkflowSummary", mock.Anything, filters).Return(page, nil)
+	commonHandler.DBClient = dBClient
+
+	resp, err := Handler(context.Background(), RequestBody{Action: "sfnSummary", SfnSummaryFilters: filters})
+	assert.NoError(t, err)
+	assert.Equal(t, page, resp)
+}
+
+func TestDatastoreLambdasfnSummaryInvalidFilters(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	filters := documentDB_client.SummaryFilters{PageSize: 10, SortBy: "orderId"}
+	dBClient.On("FetchWorkflowSummary", mock.Anything, filters).Return(documentDB_client.WorkflowSummaryPage{}, fmt.Errorf("%w: cannot sort on orderId", documentDB_client.ErrInvalidSummaryFilters))
+	commonHandler.DBClient = dBClient
+
+	_, err := Handler(context.Background(), RequestBody{Action: "sfnSummary", SfnSummaryFilters: filters})
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.InvalidSummaryFilters, err.(error_handler.ICodedError).GetErrorCode())
+}
+
+func TestDatastoreLambdametrics(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	window := documentDB_client.TimeRange{From: 1650000000, To: 1650086400}
+	metrics := documentDB_client.WorkflowMetrics{
+		Window:    window,
+		Workflows: []documentDB_client.WorkflowCount{{Day: "2022-04-15", Source: "SIM", FlowType: "Hipster", Status: "finished", Count: 3}},
+		Tasks:     []documentDB_client.TaskMetrics{{TaskName: "3DModellingService", Total: 4, Completed: 4, Failed: 1, FailureRate: 0.25, P50Duration: 120, P95Duration: 300}},
+	}
+	dBClient.On("FetchWorkflowMetrics", mock.Anything, window).Return(metrics, nil)
+	commonHandler.DBClient = dBClient
+
+	resp, err := Handler(context.Background(), RequestBody{Action: "metrics", MetricsWindow: window})
+	assert.NoError(t, err)
+	assert.Equal(t, metrics, resp)
+}
+
+func TestDatastoreLambdametricsInvalidWindow(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	window := documentDB_client.TimeRange{To: 1650086400}
+	dBClient.On("FetchWorkflowMetrics", mock.Anything, window).Return(documentDB_client.WorkflowMetrics{}, fmt.Errorf("%w: from is required", documentDB_client.ErrInvalidMetricsWindow))
+	commonHandler.DBClient = dBClient
+
+	_, err := Handler(context.Background(), RequestBody{Action: "metrics", MetricsWindow: window})
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.InvalidMetricsWindow, err.(error_handler.ICodedError).GetErrorCode())
+}
+
+func TestDatastoreLambdatimeline(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	wfExecData := documentDB_client.WorkflowExecutionDataBody{
+		WorkflowId: "wf-1",
+		OrderId:    "44825849",
+		Status:     enums.WorkflowFinished,
+		CreatedAt:  1000,
+		FinishedAt: 1500,
+		StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{
+			{TaskName: "BuildingDetection", StepId: "s1", StartTime: 1010, Status: enums.StepSuccess},
+			{TaskName: "3DModellingService", StepId: "s2", StartTime: 1100, Status: enums.StepFailure},
+			{TaskName: "ConvertPropertyModelToEVJson", StepId: "s3", StartTime: 1050, Status: enums.StepRunning},
+		},
+	}
+	steps := []documentDB_client.StepExecutionDataBody{
+		{StepId: "s1", TaskName: "BuildingDetection", StartTime: 1010, EndTime: 1040, Status: enums.StepSuccess, Output: map[string]interface{}{"orthoImagePath": "s3://bucket/some/long/path.png"}},
+		{StepId: "s2", TaskName: "3DModellingService", StartTime: 1100, EndTime: 1490, Status: enums.StepFailure, TaskToken: "token",
+			IntermediateOutput: map[string]interface{}{"jobId": "j1"},
+			Output:             map[string]interface{}{"status": "failure", "messageCode": 4024, "message": "Task Timed Out"}},
+	}
+	dBClient.On("FetchWorkflowExecutionData", mock.Anything, "wf-1").Return(wfExecData, nil)
+	dBClient.On("FetchStepsByWorkflow", mock.Anything, "wf-1").Return(steps, nil)
+	commonHandler.DBClient = dBClient
+
+	resp, err := Handler(context.Background(), RequestBody{Action: "timeline", WorkflowId: "wf-1", MaxOutputBytes: 20})
+	assert.NoError(t, err)
+	timeline := resp.(WorkflowTimeline)
+	assert.Equal(t, int64(500), timeline.Duration)
+	assert.Equal(t, "s2", timeline.TimedOutStep)
+	assert.Len(t, timeline.Steps, 3)
+
+	assert.Equal(t, "s1", timeline.Steps[0].StepId)
+	assert.Equal(t, int64(10), timeline.Steps[0].GapBefore)
+	assert.Equal(t, int64(30), timeline.Steps[0].Duration)
+	assert.True(t, timeline.Steps[0].OutputTruncated)
+	assert.Equal(t, `{"orthoImagePath":"s`, timeline.Steps[0].Output)
+
+	assert.Equal(t, "s3", timeline.Steps[1].StepId)
+	assert.True(t, timeline.Steps[1].MissingStepData)
+	assert.Equal(t, int64(10), timeline.Steps[1].GapBefore)
+
+	assert.Equal(t, "s2", timeline.Steps[2].StepId)
+	assert.Equal(t, int64(50), timeline.Steps[2].GapBefore)
+	assert.True(t, timeline.Steps[2].TimedOut)
+	assert.True(t, timeline.Steps[2].HasTaskToken)
+	assert.Equal(t, "Task Timed Out", timeline.Steps[2].ErrorMessage)
+}
+
+func TestDatastoreLambdatimelineClassifiesLegacyTimeout(t *testing.T) {
+	step := newTimelineStep(documentDB_client.StepExecutionDataBody{StepId: "s1", Status: enums.StepFailure, StartTime: 10, EndTime: 20}, 0)
+	assert.True(t, step.TimedOut)
+	assert.Equal(t, taskTimedOutMessage, step.ErrorMessage)
+
+	step = newTimelineStep(documentDB_client.StepExecutionDataBody{StepId: "s1", Status: enums.StepFailure, Output: map[string]interface{}{"isReworkRequired": false, "message": "roof not visible"}}, 0)
+	assert.False(t, step.TimedOut)
+	assert.Equal(t, "roof not visible", step.ErrorMessage)
+}
+
+func TestTruncateOutputKeepsRunes(t *testing.T) {
+	output := map[string]interface{}{"a": "日本"}
+	// {"a":" is 6 bytes, each rune 3 bytes
+	for maxBytes, want := range map[int]string{6: `{"a":"`, 7: `{"a":"`, 8: `{"a":"`, 9: `{"a":"日`, 10: `{"a":"日`} {
+		truncated, ok := truncateOutput(output, maxBytes)
+		assert.True(t, ok)
+		assert.Equal(t, want, truncated, "maxBytes %d", maxBytes)
+		assert.True(t, utf8.ValidString(truncated.(string)))
+	}
+	kept, ok := truncateOutput(output, 100)
+	assert.False(t, ok)
+	assert.Equal(t, output, kept)
+}
+
+func TestDatastoreLambdaarchiveAndRestore(t *testing.T) {
+	t.Setenv(envArchiveBucket, "archive-bucket")
+	ctx := context.Background()
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	awsClient := new(mocks.IAWSClient)
+	// vendorRef is not part of the typed bodies and must survive the round trip
+	workflow := bson.M{
+		"_id":          "wf-1",
+		"status":       string(enums.WorkflowFinished),
+		"createdAt":    int64(1650000000),
+		"finishedAt":   int64(1650000600),
+		"initialInput": bson.M{"source": "SIM"},
+		"vendorRef":    bson.M{"batch": int32(7)},
+	}
+	step := bson.M{"_id": "s1", "workflowId": "wf-1", "taskName": "BuildingDetection", "status": string(enums.StepSuccess), "vendorRef": "v-1"}
+	assert.NoError(t, dBClient.InsertDocuments(ctx, []bson.M{workflow}, documentDB_client.WorkflowDataCollection))
+	assert.NoError(t, dBClient.InsertDocuments(ctx, []bson.M{step}, documentDB_client.StepsDataCollection))
+	key := "workflow-archive/dt=2022-04-15/source=SIM/wf-1.json.gz"
+
+	var stored []byte
+	awsClient.On("StoreDataToS3", mock.Anything, "archive-bucket", key, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(3).([]byte)
+	}).Return(nil)
+	awsClient.On("GetDataFromS3", mock.Anything, "archive-bucket", key).Return(func(context.Context, string, string) []byte { return stored }, nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = awsClient
+
+	resp, err := Handler(ctx, RequestBody{Action: "archive"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": Success, "archived": []string{key}, "failed": 0}, resp)
+	remaining, err := dBClient.FetchDocuments(ctx, bson.M{}, documentDB_client.WorkflowDataCollection)
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+
+	resp, err = Handler(ctx, RequestBody{Action: "restore", ArchiveKey: key})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": Success, "workflowId": "wf-1", "steps": 1}, resp)
+
+	restored, err := dBClient.FetchDocuments(ctx, bson.M{"_id": "wf-1"}, documentDB_client.WorkflowDataCollection)
+	assert.NoError(t, err)
+	assert.Len(t, restored, 1)
+	assert.Equal(t, bson.M{"batch": int32(7)}, restored[0]["vendorRef"])
+	assert.Equal(t, int64(1650000600), restored[0]["finishedAt"])
+	assert.NotNil(t, restored[0]["restoredAt"])
+	restoredSteps, err := dBClient.FetchDocuments(ctx, bson.M{"workflowId": "wf-1"}, documentDB_client.StepsDataCollection)
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{step}, restoredSteps)
+}
+
+func TestDatastoreLambdaarchiveKeepsDocumentsWhenVerificationFails(t *testing.T) {
+	t.Setenv(envArchiveBucket, "archive-bucket")
+	dBClient := new(mocks.IDocDBClient)
+	awsClient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	workflow := documentDB_client.WorkflowExecutionDataBody{WorkflowId: "wf-1", Status: enums.WorkflowAborted, FinishedAt: 1650000600}
+
+	dBClient.On("FetchArchivalPolicy", mock.Anything).Return(documentDB_client.ArchivalPolicy{AfterDays: 30, BatchSize: 5}, nil)
+	dBClient.On("FetchWorkflowSummary", mock.Anything, mock.MatchedBy(func(f documentDB_client.SummaryFilters) bool {
+		return f.PageSize == 5 && f.FinishedAt.To < time.Now().AddDate(0, 0, -29).Unix()
+	})).Return(documentDB_client.WorkflowSummaryPage{Workflows: []documentDB_client.WorkflowExecutionDataBody{workflow}}, nil)
+	dBClient.On("FetchDocuments", mock.Anything, bson.M{"_id": "wf-1"}, documentDB_client.WorkflowDataCollection).Return([]bson.M{{"_id": "wf-1"}}, nil)
+	dBClient.On("FetchDocuments", mock.Anything, bson.M{"workflowId": "wf-1"}, documentDB_client.StepsDataCollection).Return([]bson.M{}, nil)
+	awsClient.On("StoreDataToS3", mock.Anything, "archive-bucket", mock.Anything, mock.Anything).Return(nil)
+	awsClient.On("GetDataFromS3", mock.Anything, "archive-bucket", mock.Anything).Return([]byte("truncated"), nil)
+	slackClient.On("SendErrorMessage", error_codes.ErrorArchivingWorkflow, mock.Anything, "wf-1", "datastore", "archive", mock.Anything, mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.AwsClient = awsClient
+	commonHandler.SlackClient = slackClient
+
+	resp, err := Handler(context.Background(), RequestBody{Action: "archive"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": Success, "archived": []string{}, "failed": 1}, resp)
+	dBClient.AssertNotCalled(t, "DeleteDocuments", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDatastoreLambdaarchiveRejectsInvalidPolicy(t *testing.T) {
+	t.Setenv(envArchiveBucket, "archive-bucket")
+	dBClient := new(mocks.IDocDBClient)
+	dBClient.On("FetchArchivalPolicy", mock.Anything).Return(documentDB_client.ArchivalPolicy{AfterDays: 0, BatchSize: 5}, nil)
+	commonHandler.DBClient = dBClient
+
+	_, err := Handler(context.Background(), RequestBody{Action: "archive"})
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.ErrorArchivingWorkflow, err.(error_handler.ICodedError).GetErrorCode())
+	dBClient.AssertNotCalled(t, "FetchWorkflowSummary", mock.Anything, mock.Anything)
+}
+
+// TestDatastoreLambdaWorkflowLifecycle runs the documents through the writes of datastore insert, callout, callback
+// and datastore update against the in-memory DocumentDB client and checks the resulting workflow and steps.
+func TestDatastoreLambdaWorkflowLifecycle(t *testing.T) {
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	slackClient := new(mocks.ISlackClient)
+	slackClient.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.SlackClient = slackClient
+
+	DataStoreRequestObj := RequestBody{}
+	json.Unmarshal([]byte(DataStoreRequest), &DataStoreRequestObj)
+	workflowId := DataStoreRequestObj.WorkflowId
+	_, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+
+	// callout of two wait tasks
+	callout := func(stepId, taskName string, startTime int64) {
+		err := dBClient.InsertStepExecutionData(testContext, documentDB_client.StepExecutionDataBody{
+			StepId: stepId, WorkflowId: workflowId, TaskName: taskName, StartTime: startTime, TaskToken: "token", Status: enums.StepRunning,
+		})
+		assert.NoError(t, err)
+		update := dBClient.BuildQueryForUpdateWorkflowDataCallout(testContext, taskName, stepId, enums.StepSuccess, startTime, true)
+		assert.NoError(t, dBClient.UpdateDocumentDB(testContext, bson.M{"_id": workflowId}, update, documentDB_client.WorkflowDataCollection))
+	}
+	callout("s1", "BuildingDetection", 1000)
+	callout("s2", "3DModellingService", 1100)
+
+	// callback closing the first task
+	for _, event := range []struct{ name, collection string }{
+		{documentDB_client.UpdateStepExecution, documentDB_client.StepsDataCollection},
+		{documentDB_client.UpdateWorkflowExecutionSteps, documentDB_client.WorkflowDataCollection},
+		{documentDB_client.UpdateWorkflowExecutionStatus, documentDB_client.WorkflowDataCollection},
+	} {
+		filter, query := dBClient.BuildQueryForCallBack(testContext, event.name, enums.StepSuccess, workflowId, "s1", "BuildingDetection", map[string]interface{}{"orthoImagePath": "s3://bucket/ortho.png"})
+		assert.NoError(t, dBClient.UpdateDocumentDB(testContext, filter, query, event.collection))
+	}
+
+	// the state machine ends while the second task is still running
+	DataStoreRequestObj.Action = "update"
+	_, err = Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+
+	workflow, err := dBClient.FetchWorkflowExecutionData(testContext, workflowId)
+	assert.NoError(t, err)
+	assert.Equal(t, enums.WorkflowFinished, workflow.Status)
+	assert.NotZero(t, workflow.FinishedAt)
+	assert.Equal(t, []documentDB_client.StepsPassedThroughBody{
+		{TaskName: "BuildingDetection", StepId: "s1", StartTime: 1000, Status: enums.StepSuccess},
+		{TaskName: "3DModellingService", StepId: "s2", StartTime: 1100, Status: enums.StepFailure},
+	}, workflow.StepsPassedThrough)
+
+	steps, err := dBClient.FetchStepsByWorkflow(testContext, workflowId)
+	assert.NoError(t, err)
+	assert.Len(t, steps, 2)
+	assert.Equal(t, enums.StepSuccess, steps[0].Status)
+	assert.Equal(t, "s3://bucket/ortho.png", steps[0].Output["orthoImagePath"])
+	assert.Equal(t, enums.StepFailure, steps[1].Status)
+	assert.Equal(t, "Task Timed Out", steps[1].Output["message"])
+
+	// a late callback for the timed out task is rejected by the guarded update
+	filter, query := dBClient.BuildQueryForCallBack(testContext, documentDB_client.UpdateStepExecution, enums.StepSuccess, workflowId, "s2", "3DModellingService", map[string]interface{}{})
+	err = dBClient.UpdateDocumentDB(testContext, filter, query, documentDB_client.StepsDataCollection)
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.IllegalStepStatusTransition, err.(error_handler.ICodedError).GetErrorCode())
+	step, err := dBClient.FetchStepExecutionData(testContext, "s2")
+	assert.NoError(t, err)
+	assert.Equal(t, enums.StepFailure, step.Status)
+}
+
+func TestDatastoreLambdainsertRecordsPriority(t *testing.T) {
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = dBClient
+	for workflowId, priority := range map[string]interface{}{"rush-order": "rush", "plain-order": nil, "odd-order": "urgent"} {
+		DataStoreRequestObj := RequestBody{}
+		json.Unmarshal([]byte(DataStoreRequest), &DataStoreRequestObj)
+		DataStoreRequestObj.WorkflowId = workflowId
+		if priority != nil {
+			DataStoreRequestObj.Input["priority"] = priority
+		}
+		_, err := Handler(context.Background(), DataStoreRequestObj)
+		assert.NoError(t, err)
+	}
+	for workflowId, priority := range map[string]enums.Priority{"rush-order": enums.PriorityRush, "plain-order": enums.PriorityStandard, "odd-order": enums.PriorityStandard} {
+		workflow, err := dBClient.FetchWorkflowExecutionData(testContext, workflowId)
+		assert.NoError(t, err)
+		assert.Equal(t, priority, workflow.Priority)
+	}
+}
+
+func TestDatastoreLambdaFinishReleasesPriorityLane(t *testing.T) {
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = dBClient
+
+	DataStoreRequestObj := RequestBody{}
+	json.Unmarshal([]byte(DataStoreRequest), &DataStoreRequestObj)
+	_, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	limits := documentDB_client.LaneLimits{MaxRunning: 1}
+	reserved, err := dBClient.ReservePriorityLane(testContext, DataStoreRequestObj.WorkflowId, enums.PriorityStandard, limits)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	DataStoreRequestObj.Action = "update"
+	_, err = Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	// the slot is free again for the next workflow
+	reserved, err = dBClient.ReservePriorityLane(testContext, "next-workflow", enums.PriorityStandard, limits)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func TestDatastoreLambdaAbortReleasesPriorityLaneOfUnrecordedWorkflow(t *testing.T) {
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = dBClient
+	limits := documentDB_client.LaneLimits{MaxRunning: 1}
+	reserved, err := dBClient.ReservePriorityLane(testContext, "failed-before-insert", enums.PriorityStandard, limits)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	// the execution failed before it recorded its workflow
+	_, err = Handler(context.Background(), RequestBody{Action: "abort", WorkflowId: "failed-before-insert"})
+	assert.NoError(t, err)
+	reserved, err = dBClient.ReservePriorityLane(testContext, "next-workflow", enums.PriorityStandard, limits)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func TestDatastoreLambdaTwisterFallbackReleasesHipsterSlot(t *testing.T) {
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = dBClient
+
+	DataStoreRequestObj := RequestBody{}
+	json.Unmarshal([]byte(DataStoreRequest), &DataStoreRequestObj)
+	_, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	reservation, err := dBClient.ReserveHipsterSlot(testContext, "daily/2022-05-10T00:00", DataStoreRequestObj.WorkflowId, 1, time.Time{})
+	assert.NoError(t, err)
+	assert.True(t, reservation.Reserved)
+	reservation, err = dBClient.ReserveHipsterSlot(testContext, "daily/2022-05-10T00:00", "other-workflow", 1, time.Time{})
+	assert.NoError(t, err)
+	assert.False(t, reservation.Reserved)
+
+	DataStoreRequestObj.Action = "updateFlowType"
+	DataStoreRequestObj.FlowType = "Twister"
+	_, err = Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+
+	workflow, err := dBClient.FetchWorkflowExecutionData(testContext, DataStoreRequestObj.WorkflowId)
+	assert.NoError(t, err)
+	assert.Equal(t, "Twister", workflow.FlowType)
+	reservation, err = dBClient.ReserveHipsterSlot(testContext, "daily/2022-05-10T00:00", "other-workflow", 1, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, documentDB_client.HipsterReservation{Quota: "daily/2022-05-10T00:00", Slot: 2, Count: 1, Reserved: true}, reservation)
+
+	// releasing a workflow without a slot is a no-op
+	DataStoreRequestObj.Action = "releaseHipsterSlot"
+	resp, err := Handler(context.Background(), DataStoreRequestObj)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": Success}, resp)
+}
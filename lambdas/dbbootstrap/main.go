@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.eagleview.com/engineering/assess-platform-library/log"
+	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/log_config"
+)
+
+const (
+	loglevel   = "info"
+	lambdaName = "dbBootstrap"
+	// set by the lambda runtime, when missing the bootstrap runs once from the command line
+	lambdaRuntimeEnv = "AWS_LAMBDA_RUNTIME_API"
+)
+
+var commonHandler common_handler.CommonHandler
+
+func Handler(ctx context.Context, config documentDB_client.SchemaConfig) (map[string]interface{}, error) {
+	created, err := commonHandler.DBClient.BootstrapSchema(ctx, config)
+	if err != nil {
+		log.Error(ctx, "error bootstrapping db schema, ", err)
+		return nil, error_handler.NewServiceError(error_codes.ErrorBootstrappingDBSchema, err.Error())
+	}
+	log.Infof(ctx, "db schema bootstrapped, created %d indexes", len(created))
+	return map[string]interface{}{
+		"status":  "success",
+		"created": created,
+	}, nil
+}
+
+func notificationWrapper(ctx context.Context, config documentDB_client.SchemaConfig) (map[string]interface{}, error) {
+	resp, err := Handler(ctx, config)
+	if err != nil {
+		errT := err.(error_handler.ICodedError)
+		commonHandler.SlackClient.SendErrorMessage(errT.GetErrorCode(), "", "", lambdaName, lambdaName, err.Error(), map[string]string{})
+	}
+	return resp, err
+}
+
+func main() {
+	log_config.InitLogging(loglevel)
+	var err error
+	if os.Getenv(lambdaRuntimeEnv) != "" {
+		commonHandler, err = common_handler.New(false, false, true, true, false)
+		if err != nil {
+			log.Error(context.Background(), err)
+			panic(err)
+		}
+		lambda.Start(notificationWrapper)
+		return
+	}
+
+	enableTTL := flag.Bool("ttl", false, "create TTL indexes on expireAt")
+	archiveAfterDays := flag.Int("archive-after-days", 0, "store an archival policy moving workflows finished this many days ago to S3")
+	archiveBatchSize := flag.Int("archive-batch-size", 50, "workflows archived per run of the archival policy")
+	flag.Parse()
+	config := documentDB_client.SchemaConfig{EnableTTL: *enableTTL}
+	if *archiveAfterDays > 0 {
+		config.Archival = &documentDB_client.ArchivalPolicy{AfterDays: *archiveAfterDays, BatchSize: *archiveBatchSize}
+	}
+	commonHandler, err = common_handler.New(false, false, true, false, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		os.Exit(1)
+	}
+	if _, err = Handler(context.Background(), config); err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/mocks"
+)
+
+func TestBootstrapCreatesIndexes(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	config := documentDB_client.SchemaConfig{EnableTTL: true}
+	dBClient.On("BootstrapSchema", context.Background(), config).Return([]string{"WorkflowData.orderId_1"}, nil)
+	commonHandler.DBClient = dBClient
+
+	resp, err := notificationWrapper(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"status": "success", "created": []string{"WorkflowData.orderId_1"}}, resp)
+}
+
+func TestBootstrapFailsOnConflictingIndex(t *testing.T) {
+	dBClient := new(mocks.IDocDBClient)
+	slackClient := new(mocks.ISlackClient)
+	dBClient.On("BootstrapSchema", context.Background(), documentDB_client.SchemaConfig{}).Return([]string{}, errors.New("conflicting index orderId_1 on WorkflowData"))
+	slackClient.On("SendErrorMessage", error_codes.ErrorBootstrappingDBSchema, "", "", lambdaName, lambdaName, mock.Anything, mock.Anything).Return(nil)
+	commonHandler.DBClient = dBClient
+	commonHandler.SlackClient = slackClient
+
+	_, err := notificationWrapper(context.Background(), documentDB_client.SchemaConfig{})
+	assert.Error(t, err)
+	slackClient.AssertExpectations(t)
+}
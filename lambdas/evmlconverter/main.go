@@ -3,8 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
@@ -13,8 +11,10 @@ import (
 	ctxlog "github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/execution_path"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 	"github.eagleview.com/engineering/symphony-service/lambdas/legacyupdate/status"
 	"go.mongodb.org/mongo-driver/bson"
@@ -52,15 +52,12 @@ type eventData struct {
 func handler(ctx context.Context, eventData eventData) (map[string]interface{}, error) {
 	ctx = log_config.SetTraceIdInContext(ctx, eventData.ReportID, eventData.WorkflowID)
 	ctxlog.Info(ctx, "EVMLConverter Lambda Reached")
-	tasksWithPMFOutputString := os.Getenv("tasksWithPMFOutput")
-	tasksWithPMFOutputArray := strings.Split(tasksWithPMFOutputString, ",")
 	var (
 		err                 error
 		ok                  bool
 		finalTaskStepID     string
 		taskOutput          interface{}
 		propertyModelS3Path string
-		legacyStatus        string = "QCCompleted"
 	)
 
 	starttime := time.Now().Unix()
@@ -76,47 +73,58 @@ func handler(ctx context.Context, eventData eventData) (map[string]interface{},
 	workflowData, err := commonHandler.DBClient.FetchWorkflowExecutionData(ctx, eventData.WorkflowID)
 	if err != nil {
 		ctxlog.Error(ctx, "Error in fetching workflow data from DocumentDb: ", err.Error())
-		return updateDocumentDbAndGetResponse(ctx, failure, "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
+		return updateDocumentDbAndGetResponse(ctx, failure, "", "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.ErrorFetchingWorkflowExecutionDataFromDB, err.Error())
 	}
 
 	ctxlog.Info(ctx, "Workflow Data Fetched from DocumentDb...")
 	stepscount := len(workflowData.StepsPassedThrough)
 	var lastCompletedTask documentDB_client.StepsPassedThroughBody
-	var isQCTaskCompleted, isHipsterTaskCompleted bool
 	ctxlog.Info(ctx, "WorkflowID: %s and Flow type: %s", eventData.WorkflowID, workflowData.FlowType)
 	ctxlog.Infof(ctx, "Workflow tasks list: %+v", workflowData.StepsPassedThrough)
+	paths := execution_path.Paths()
+	failedTaskStatusMap := status.FailedTaskStatusMap()
+	reached := map[string]bool{}
+	failedStatus := map[string]string{}
+	var producedBy execution_path.Path
 	//iterate in reverse over list of tasks
-out:
 	for i := stepscount - 1; i >= 0; i-- {
-		for _, task := range tasksWithPMFOutputArray {
-			//check if workflow reached both hipster measure and qc in case of faliure in between.
-			switch workflowData.StepsPassedThrough[i].TaskName {
-			case "UpdateHipsterJobAndWaitForQC":
-				isQCTaskCompleted = true
-			case "CreateHipsterJobAndWaitForMeasurement":
-				isHipsterTaskCompleted = true
-			}
-			//finding first task from set of tasks with PMF output
-			if workflowData.StepsPassedThrough[i].TaskName == task {
-				//if status==success, return PMF from this task
-				if workflowData.StepsPassedThrough[i].Status == success {
-					lastCompletedTask = workflowData.StepsPassedThrough[i]
-					if workflowData.FlowType == "Twister" {
-						ctxlog.Info(ctx, "Job being pushed to Twister...")
-						legacyStatus = "MACompleted"
-					}
-					break out
-					//if status == failure, get status to update back to legacy
-				} else if workflowData.StepsPassedThrough[i].Status == failure {
-					legacyStatus = status.FailedTaskStatusMap[task].StatusKey
-				}
-			}
+		step := workflowData.StepsPassedThrough[i]
+		//remember the tasks reached after the last PMF in case of faliure in between.
+		reached[step.TaskName] = true
+		//finding first task from set of tasks with PMF output
+		owner, ok := paths.PMFTaskOwner(step.TaskName)
+		if !ok {
+			continue
+		}
+		//if status==success, return PMF from this task
+		if step.Status == success {
+			lastCompletedTask = step
+			producedBy = owner
+			break
+			//if status == failure, get status to update back to legacy
+		} else if step.Status == failure {
+			failedStatus[owner.Name] = failedTaskStatusMap[step.TaskName].StatusKey
 		}
 	}
 
-	//check if Hipster Measure is completed which Hipster QC hasn't been reached
-	if !isQCTaskCompleted && isHipsterTaskCompleted {
-		legacyStatus = "MeasurementFailed"
+	// the flowType names the path taken, older workflows without one use the path of the PMF
+	path, ok := paths.Get(workflowData.FlowType)
+	if !ok {
+		path = producedBy
+	}
+	ctxlog.Infof(ctx, "Job being pushed to %s...", path.Name)
+	legacyStatus := path.LegacyStatus.Completed
+	if failed, ok := failedStatus[path.Name]; ok {
+		legacyStatus = failed
+	}
+	//check if the path started producing its PMF without reaching its last PMF task
+	if len(path.PMFTasks) > 1 && reached[path.PMFTasks[0]] && !reached[path.PMFTasks[len(path.PMFTasks)-1]] {
+		legacyStatus = path.LegacyStatus.Incomplete
+	}
+	//a path that did not complete falls back to the measurement of the default path
+	deliveredBy := paths.Default().Name
+	if legacyStatus == path.LegacyStatus.Completed {
+		deliveredBy = path.Name
 	}
 
 	ctxlog.Info(ctx, fmt.Sprintf("Last executed taskwith PMF Output: %s, status: %s", lastCompletedTask.TaskName, lastCompletedTask.Status))
@@ -125,34 +133,31 @@ out:
 	taskData, err := commonHandler.DBClient.FetchStepExecutionData(ctx, finalTaskStepID)
 	if err != nil {
 		ctxlog.Error(ctx, "Error in fetching steo data from DocumentDb: ", err.Error())
-		return updateDocumentDbAndGetResponse(ctx, failure, "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.ErrorFetchingStepExecutionDataFromDB, err.Error())
+		return updateDocumentDbAndGetResponse(ctx, failure, "", "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.ErrorFetchingStepExecutionDataFromDB, err.Error())
 	}
 	if taskOutput, ok = taskData.Output["propertyModelLocation"]; !ok {
-		return updateDocumentDbAndGetResponse(ctx, failure, "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.PropertyModelLocationMissingInTaskOutput, "propertyModelLocation missing from task output")
+		return updateDocumentDbAndGetResponse(ctx, failure, "", "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.PropertyModelLocationMissingInTaskOutput, "propertyModelLocation missing from task output")
 	}
 	if propertyModelS3Path, ok = taskOutput.(string); !ok {
-		return updateDocumentDbAndGetResponse(ctx, failure, "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.InvalidTypeForPropertyModelLocation, "propertyModelLocation should be a string")
+		return updateDocumentDbAndGetResponse(ctx, failure, "", "", "", eventData.WorkflowID, StepExecutionData), error_handler.NewServiceError(error_codes.InvalidTypeForPropertyModelLocation, "propertyModelLocation should be a string")
 	}
-	lambdaResp := updateDocumentDbAndGetResponse(ctx, success, legacyStatus, propertyModelS3Path, eventData.WorkflowID, StepExecutionData)
+	lambdaResp := updateDocumentDbAndGetResponse(ctx, success, legacyStatus, deliveredBy, propertyModelS3Path, eventData.WorkflowID, StepExecutionData)
 	return lambdaResp, nil
 }
 
-func updateDocumentDbAndGetResponse(ctx context.Context, status, legacyStatus, propertyModelS3Path, workflowId string, stepExecutionData documentDB_client.StepExecutionDataBody) map[string]interface{} {
+func updateDocumentDbAndGetResponse(ctx context.Context, status, legacyStatus, path, propertyModelS3Path, workflowId string, stepExecutionData documentDB_client.StepExecutionDataBody) map[string]interface{} {
 	stepExecutionData.EndTime = time.Now().Unix()
 	response := map[string]interface{}{
 		"status": status,
 	}
 	if status == failure {
-		stepExecutionData.Status = failure
+		stepExecutionData.Status = enums.StepFailure
 		stepExecutionData.Output = response
 	} else {
 		response["legacyStatus"] = legacyStatus
 		response["propertyModelS3Path"] = propertyModelS3Path
-		response["path"] = "Twister"
-		if legacyStatus == "QCCompleted" {
-			response["path"] = "Hipster"
-		}
-		stepExecutionData.Status = success
+		response["path"] = path
+		stepExecutionData.Status = enums.StepSuccess
 		stepExecutionData.Output = response
 	}
 
@@ -161,7 +166,7 @@ func updateDocumentDbAndGetResponse(ctx context.Context, status, legacyStatus, p
 		ctxlog.Error(ctx, "Unable to insert Step Data in DocumentDB")
 	}
 	filter := bson.M{"_id": workflowId}
-	update := commonHandler.DBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, taskName, stepExecutionData.StepId, status, stepExecutionData.StartTime, false)
+	update := commonHandler.DBClient.BuildQueryForUpdateWorkflowDataCallout(ctx, taskName, stepExecutionData.StepId, enums.StepStatus(status), stepExecutionData.StartTime, false)
 	err = commonHandler.DBClient.UpdateDocumentDB(ctx, filter, update, documentDB_client.WorkflowDataCollection)
 	if err != nil {
 		ctxlog.Error(ctx, "Unable to update DocumentDb")
@@ -180,6 +185,15 @@ func notificationWrapper(ctx context.Context, req eventData) (map[string]interfa
 
 func main() {
 	log_config.InitLogging(logLevel)
-	commonHandler = common_handler.New(true, true, true, true, false)
+	var err error
+	commonHandler, err = common_handler.New(true, true, true, true, false)
+	if err != nil {
+		ctxlog.Error(context.Background(), err)
+		panic(err)
+	}
+	if _, err = execution_path.Load(); err != nil {
+		ctxlog.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notificationWrapper)
 }
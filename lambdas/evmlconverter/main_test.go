@@ -4,20 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"github.eagleview.com/engineering/symphony-service/commons/execution_path"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
 )
 
-func init() {
-	os.Setenv("tasksWithPMFOutput", "3DModellingService,CreateHipsterJobAndWaitForMeasurement,UpdateHipsterJobAndWaitForQC")
-}
-
 var testContext = log_config.SetTraceIdInContext(context.Background(), "", "")
 
 var mockWorkflowDetails = []byte(`{
@@ -152,7 +149,7 @@ func TestHandler(t *testing.T) {
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, eventDataObj.WorkflowID).Return(workflowData, nil)
 	dBClient.Mock.On("FetchStepExecutionData", testContext, "03caaccc-cca9-4f7a-9dee-2d72d6a6a944").Return(taskdata, nil)
 	dBClient.Mock.On("InsertStepExecutionData", testContext, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, success, mock.Anything, false).Return(nil)
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, enums.StepSuccess, mock.Anything, false).Return(nil)
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, nil, mock.Anything).Return(nil)
 
 	commonHandler.AwsClient = awsClient
@@ -194,7 +191,7 @@ func TestHandlerTwisterFlow(t *testing.T) {
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, eventDataObj.WorkflowID).Return(workflowData, nil)
 	dBClient.Mock.On("FetchStepExecutionData", testContext, "03caaccc-cca9-4f7a-9dee-2d72d6a6a944").Return(taskdata, nil)
 	dBClient.Mock.On("InsertStepExecutionData", testContext, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, success, mock.Anything, false).Return(nil)
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, enums.StepSuccess, mock.Anything, false).Return(nil)
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, nil, mock.Anything).Return(nil)
 
 	commonHandler.AwsClient = awsClient
@@ -240,7 +237,7 @@ func TestHandlerFailureCase(t *testing.T) {
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, eventDataObj.WorkflowID).Return(workflowData, nil)
 	dBClient.Mock.On("FetchStepExecutionData", testContext, "03caaccc-cca9-4f7a-9dee-2d72d6a6a944").Return(taskdata, nil)
 	dBClient.Mock.On("InsertStepExecutionData", testContext, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, success, mock.Anything, false).Return(nil)
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, enums.StepSuccess, mock.Anything, false).Return(nil)
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, nil, mock.Anything).Return(nil)
 
 	commonHandler.AwsClient = awsClient
@@ -269,7 +266,7 @@ func TestHandlerDocDbWorkflowDataError(t *testing.T) {
 
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, eventDataObj.WorkflowID).Return(workflowData, errors.New("error here"))
 	dBClient.Mock.On("InsertStepExecutionData", testContext, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, failure, mock.Anything, false).Return(nil)
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, enums.StepFailure, mock.Anything, false).Return(nil)
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, nil, mock.Anything).Return(nil)
 
 	commonHandler.AwsClient = awsClient
@@ -307,7 +304,7 @@ func TestHandlerFetchStepExecutionDataError(t *testing.T) {
 	dBClient.Mock.On("FetchWorkflowExecutionData", testContext, eventDataObj.WorkflowID).Return(workflowData, nil)
 	dBClient.Mock.On("FetchStepExecutionData", testContext, "03caaccc-cca9-4f7a-9dee-2d72d6a6a944").Return(taskdata, errors.New("error"))
 	dBClient.Mock.On("InsertStepExecutionData", testContext, mock.Anything).Return(nil)
-	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, failure, mock.Anything, false).Return(nil)
+	dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, enums.StepFailure, mock.Anything, false).Return(nil)
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, nil, mock.Anything).Return(nil)
 
 	commonHandler.AwsClient = awsClient
@@ -319,3 +316,65 @@ func TestHandlerFetchStepExecutionDataError(t *testing.T) {
 	// assert.Equal(t, "error", err.Error())
 	assert.Equal(t, expectedResp, resp)
 }
+
+func useVendorPath(t *testing.T) {
+	vendor := execution_path.Path{
+		Name:         "Vendor",
+		LegacyStatus: execution_path.LegacyStatus{Completed: "QCCompleted", Incomplete: "MeasurementFailed"},
+		PMFTasks:     []string{"CreateVendorJobAndWaitForMeasurement", "UpdateVendorJobAndWaitForQC"},
+		FailedTasks: map[string]execution_path.FailedTask{
+			"UpdateVendorJobAndWaitForQC": {StatusKey: "QCFailed", FallbackTaskName: "CreateVendorJobAndWaitForMeasurement"},
+		},
+	}
+	execution_path.Use(append(execution_path.DefaultRegistry(), vendor))
+	t.Cleanup(func() { execution_path.Use(execution_path.DefaultRegistry()) })
+}
+
+func vendorWorkflow(qcStatus enums.StepStatus) documentDB_client.WorkflowExecutionDataBody {
+	return documentDB_client.WorkflowExecutionDataBody{
+		FlowType: "Vendor",
+		StepsPassedThrough: []documentDB_client.StepsPassedThroughBody{
+			{TaskName: "3DModellingService", StepId: "modelling-step", Status: enums.StepSuccess},
+			{TaskName: "CreateVendorJobAndWaitForMeasurement", StepId: "measurement-step", Status: enums.StepSuccess},
+			{TaskName: "UpdateVendorJobAndWaitForQC", StepId: "qc-step", Status: qcStatus},
+		},
+	}
+}
+
+func TestHandlerRegisteredPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		qcStatus     enums.StepStatus
+		pmfStep      string
+		legacyStatus string
+		path         string
+	}{
+		{name: "completed", qcStatus: enums.StepSuccess, pmfStep: "qc-step", legacyStatus: "QCCompleted", path: "Vendor"},
+		{name: "qc failed", qcStatus: enums.StepFailure, pmfStep: "measurement-step", legacyStatus: "QCFailed", path: "Twister"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useVendorPath(t)
+			dBClient := new(mocks.IDocDBClient)
+			taskdata := documentDB_client.StepExecutionDataBody{
+				StepId: test.pmfStep,
+				Output: map[string]interface{}{"propertyModelLocation": "s3Location"},
+			}
+			dBClient.Mock.On("FetchWorkflowExecutionData", testContext, "").Return(vendorWorkflow(test.qcStatus), nil)
+			dBClient.Mock.On("FetchStepExecutionData", testContext, test.pmfStep).Return(taskdata, nil)
+			dBClient.Mock.On("InsertStepExecutionData", testContext, mock.Anything).Return(nil)
+			dBClient.Mock.On("BuildQueryForUpdateWorkflowDataCallout", testContext, taskName, mock.Anything, enums.StepSuccess, mock.Anything, false).Return(nil)
+			dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, nil, mock.Anything).Return(nil)
+			commonHandler.DBClient = dBClient
+
+			resp, err := handler(context.Background(), eventData{})
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{
+				"status":              success,
+				"legacyStatus":        test.legacyStatus,
+				"propertyModelS3Path": "s3Location",
+				"path":                test.path,
+			}, resp)
+		})
+	}
+}
@@ -3,15 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sfn"
 	"github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
 	"github.eagleview.com/engineering/symphony-service/commons/enums"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
@@ -19,37 +28,33 @@ import (
 	"github.eagleview.com/engineering/symphony-service/commons/validator"
 )
 
-type sfnInput struct {
-	Address struct {
-		City      string  `json:"city" validate:"required"`
-		Country   string  `json:"country" validate:"required"`
-		Longitude float64 `json:"longitude" validate:"required"`
-		Latitude  float64 `json:"latitude" validate:"required"`
-		State     string  `json:"state" validate:"required"`
-		Street    string  `json:"street" validate:"required"`
-		Zip       string  `json:"zip" validate:"required"`
-	}
-	OrderID    string        `json:"orderId"`
-	ReportID   string        `json:"reportId" validate:"required"`
-	WorkflowId string        `json:"workflowId"`
-	Source     enums.Sources `json:"source" validate:"source"`
+// SourceRoute describes how the orders of a source start their state machine. ExecutionName is a template where
+// {field} placeholders, dotted for nested fields, are replaced with values from the input, and TraceIDField names
+// the input field used as report id in logs and slack. OnFinishedDuplicate decides what happens to a different
+// request reusing the execution name of a finished execution, it is rejected unless set to rerun.
+type SourceRoute struct {
+	StateMachineARN     string                `json:"stateMachineArn"`
+	InputSchema         *validator.JSONSchema `json:"inputSchema"`
+	ExecutionName       string                `json:"executionName"`
+	TraceIDField        string                `json:"traceIdField"`
+	OnFinishedDuplicate string                `json:"onFinishedDuplicate"`
 }
 
-type Address struct {
-	ParcelAddress string  `json:"parcelAddress"`
-	Lat           float64 `json:"lat"`
-	Long          float64 `json:"long"`
-}
+// RoutingTable maps the source of an order to its route.
+type RoutingTable map[string]SourceRoute
 
-type sfnSIMInput struct {
-	Address Address       `json:"address"`
-	Meta    *Meta         `json:"meta" validate:"required"`
-	Vintage time.Time     `json:"vintage"`
-	Source  enums.Sources `json:"source" validate:"source"`
+// PriorityLane caps the running executions of a priority. MaxRunning is a hard cap and Weight the share of the
+// capacity the lane is guaranteed when every lane competes for it, zero values leave the lane unbounded.
+type PriorityLane struct {
+	Weight     int64 `json:"weight"`
+	MaxRunning int64 `json:"maxRunning"`
 }
-type Meta struct {
-	CallbackID  string `json:"callbackId" validate:"required"`
-	CallbackURL string `json:"callbackUrl" validate:"required"`
+
+// PriorityLanes shares Capacity running executions between the priorities. A lane may use the capacity left idle
+// by the others, but once all of it is in use only lanes below their weighted share start new executions.
+type PriorityLanes struct {
+	Capacity int64                           `json:"capacity"`
+	Lanes    map[enums.Priority]PriorityLane `json:"lanes"`
 }
 
 type NotifyRequest struct {
@@ -65,8 +70,13 @@ type NotifyRequestErrorMessage struct {
 }
 
 var (
-	commonHandler        common_handler.CommonHandler
-	reportId, workflowId string
+	commonHandler common_handler.CommonHandler
+	routes        RoutingTable
+	lanes         *PriorityLanes
+	errThrottled  = errors.New("priority lane is full")
+
+	routingTableSource  = config_loader.Source{Name: "routing table", Env: SourceRoutes, S3Env: SourceRoutesS3Path, Code: error_codes.ErrorLoadingSourceRoutes}
+	priorityLanesSource = config_loader.Source{Name: "priority lanes", Env: PriorityLanesConfig, Code: error_codes.ErrorLoadingPriorityLanes}
 )
 
 const (
@@ -74,119 +84,565 @@ const (
 	AISStateMachineARN   = "AISStateMachineARN"
 	SIMStateMachineARN   = "SIMStateMachineARN"
 	SFNNotifierLambdaARN = "SFNNotifierLambdaARN"
+	SourceRoutes         = "SourceRoutes"
+	SourceRoutesS3Path   = "SourceRoutesS3Path"
+	PriorityLanesConfig  = "PriorityLanes"
+	DeadLetterQueueURL   = "DeadLetterQueueURL"
+	priorityQueueInfix   = "-receiveOrder-"
+	minThrottleBackoff   = 30
+	maxThrottleBackoff   = 900
 	loglevel             = "info"
+	maxExecutionName     = 80
+	DuplicateReject      = "reject"
+	DuplicateRerun       = "rerun"
+	maxReruns            = 5
 )
 
+var placeholder = regexp.MustCompile(`\{([A-Za-z0-9_.]+)\}`)
+
+// executionNameRejected matches the characters Step Functions does not accept in an execution name.
+var executionNameRejected = regexp.MustCompile("[\\s<>{}\\[\\]?*\"#%\\\\^|~`$&,;:/\\x00-\\x1f\\x7f-\\x9f]")
+
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(true, false, false, true, false)
+	var err error
+	// lane slots are only reserved when priority lanes are configured
+	commonHandler, err = common_handler.New(true, false, os.Getenv(PriorityLanesConfig) != "", true, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	routes, err = LoadRoutingTable(context.Background())
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	lanes, err = LoadPriorityLanes(context.Background())
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notificationWrapper)
 }
 
-func notificationWrapper(ctx context.Context, sqsEvent events.SQSEvent) {
-	req, err := Handler(ctx, sqsEvent)
-	if err != nil {
-		cerr := err.(error_handler.ICodedError)
-		commonHandler.SlackClient.SendErrorMessage(cerr.GetErrorCode(), reportId, workflowId, "", "invokesfn", err.Error(), map[string]string{
-			"request": strings.Join(req, " : "),
-		})
-	}
+// notificationWrapper never fails the invocation, SQS retries only the records listed in BatchItemFailures.
+func notificationWrapper(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	return Handler(ctx, sqsEvent), nil
 }
 
-func Handler(ctx context.Context, sqsEvent events.SQSEvent) (req []string, err error) {
+// Handler starts a state machine per record, a failing record is reported to slack and returned for retry
+// without affecting the other records of the batch. Records no retry can start are not returned: duplicate
+// conflicts are dropped once the caller is notified, undecodable, unrouted and invalid ones go to the dead letter queue.
+func Handler(ctx context.Context, sqsEvent events.SQSEvent) events.SQSEventResponse {
 	log.Infof(ctx, "Invokesfn Lambda reached...")
-
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
 	for _, message := range sqsEvent.Records {
-		log.Info(ctx, "SQS Message: %+v", message)
-		req = append(req, message.Body)
-
 		var sfnreq map[string]interface{}
 		err := json.Unmarshal([]byte(message.Body), &sfnreq)
+		source, _ := sfnreq["source"].(string)
+		route, known := routes[source]
+		reportId, workflowId := route.traceID(sfnreq), stringField(sfnreq, "workflowId")
+		recordCtx := log_config.SetTraceIdInContext(ctx, reportId, workflowId)
 		if err != nil {
-			log.Error(ctx, err)
-			return req, error_handler.NewServiceError(error_codes.ErrorDecodingInvokeSFNInput, err.Error())
+			err = error_handler.NewServiceError(error_codes.ErrorDecodingInvokeSFNInput, err.Error())
+		} else if !known {
+			err = error_handler.NewServiceError(error_codes.ErrorUnknownSource, fmt.Sprintf("Unknown Source %q", source))
+		} else {
+			err = startExecution(recordCtx, message, route, sfnreq)
 		}
-		src, ok := sfnreq["source"]
-		if !ok {
-			return req, error_handler.NewServiceError(error_codes.ErrorUnknownSource, "Unknown Source")
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errThrottled) {
+			// left on the queue until its lane has room, this is not an error worth reporting
+			log.Info(recordCtx, "message ", message.MessageId, " postponed: ", err)
+			postpone(recordCtx, message)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+			continue
 		}
-		err, SFNStateMachineARN, sfnName := GetSfnDataBySource(ctx, message.Body, src.(string))
+		log.Error(recordCtx, "failed processing message ", message.MessageId, ": ", err)
+		errorCode := error_codes.ErrorInvokingStepFunction
+		if cerr, ok := err.(error_handler.ICodedError); ok {
+			errorCode = cerr.GetErrorCode()
+		}
+		commonHandler.SlackClient.SendErrorMessage(errorCode, reportId, workflowId, "", "invokesfn", err.Error(), map[string]string{
+			"messageId": message.MessageId,
+			"request":   message.Body,
+		})
+		switch {
+		case errorCode == error_codes.DuplicateExecutionConflict:
+			// the caller was notified, a redelivery would only conflict and notify again
+			continue
+		case rejectedCodes[errorCode]:
+			if err = deadLetter(recordCtx, message); err == nil {
+				continue
+			}
+			log.Error(recordCtx, "failed moving message ", message.MessageId, " to the dead letter queue: ", err)
+		}
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+	}
+	log.Infof(ctx, "Invokesfn Lambda processed %d messages, %d failed", len(sqsEvent.Records), len(response.BatchItemFailures))
+	return response
+}
+
+func startExecution(ctx context.Context, message events.SQSMessage, route SourceRoute, sfnreq map[string]interface{}) error {
+	log.Info(ctx, "SQS Message: %+v", message)
+	if err := route.InputSchema.Validate(sfnreq); err != nil {
+		log.Error(ctx, "error in validation: ", err)
+		return error_handler.NewServiceError(error_codes.ErrorValidatingInvokeSFNInput, err.Error())
+	}
+	sfnName, err := route.executionName(sfnreq)
+	if err != nil {
+		return error_handler.NewServiceError(error_codes.ErrorValidatingInvokeSFNInput, err.Error())
+	}
+	priority, err := messagePriority(message, sfnreq)
+	if err != nil {
+		return error_handler.NewServiceError(error_codes.ErrorValidatingInvokeSFNInput, err.Error())
+	}
+	input := message.Body
+	if _, fromQueue := queuePriority(message.EventSourceARN); fromQueue && stringField(sfnreq, "priority") == "" {
+		// the workflow records the priority of its input, give it the lane of the queue
+		sfnreq["priority"] = priority
+		data, err := json.Marshal(sfnreq)
 		if err != nil {
+			return error_handler.NewServiceError(error_codes.ErrorDecodingInvokeSFNInput, err.Error())
+		}
+		input = string(data)
+	}
+	err = invokeExecution(ctx, input, route, sfnName, priority)
+	if cerr, ok := err.(error_handler.ICodedError); ok && cerr.GetErrorCode() == error_codes.DuplicateExecutionConflict {
+		notifyCallback(ctx, sfnreq, err)
+	}
+	return err
+}
+
+// invokeExecution starts the state machine under name once its priority lane has room. When an execution with that
+// name already exists it is described: the same input means the message was redelivered and is a success, a
+// different input is a conflict unless the existing execution has finished and the route reruns it under a suffixed
+// name. The lane slot is kept by a running execution of that name and released when none is left running.
+func invokeExecution(ctx context.Context, input string, route SourceRoute, name string, priority enums.Priority) error {
+	SFNStateMachineARN := route.StateMachineARN
+	for attempt := 1; ; attempt++ {
+		sfnName := rerunName(name, attempt)
+		if err := admit(ctx, sfnName, priority); err != nil {
+			return err
+		}
+		ExecutionArn, err := commonHandler.AwsClient.InvokeSFN(&input, &SFNStateMachineARN, &sfnName)
+		if err == nil {
+			log.Infof(ctx, "executionARN of Step function:  %s", ExecutionArn)
+			return nil
+		}
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != sfn.ErrCodeExecutionAlreadyExists {
 			log.Error(ctx, err)
-			return req, err
+			releaseLane(ctx, sfnName)
+			return error_handler.NewServiceError(error_codes.ErrorInvokingStepFunction, err.Error())
+		}
+		existingArn, err := executionArn(SFNStateMachineARN, sfnName)
+		if err != nil {
+			return error_handler.NewServiceError(error_codes.ErrorInvokingStepFunction, err.Error())
+		}
+		existing, err := commonHandler.AwsClient.DescribeExecution(ctx, existingArn)
+		if err != nil {
+			return error_handler.NewServiceError(error_codes.ErrorInvokingStepFunction, err.Error())
+		}
+		status := aws.StringValue(existing.Status)
+		if status != sfn.ExecutionStatusRunning {
+			// a finished execution gave its slot back, the one just reserved is not used
+			releaseLane(ctx, sfnName)
 		}
+		if sameInput(input, aws.StringValue(existing.Input)) {
+			log.Infof(ctx, "execution %s already started for this request", existingArn)
+			return nil
+		}
+		if status == sfn.ExecutionStatusRunning || route.OnFinishedDuplicate != DuplicateRerun || attempt > maxReruns {
+			return error_handler.NewServiceError(error_codes.DuplicateExecutionConflict, fmt.Sprintf("execution %s is %s with a different input", sfnName, status))
+		}
+		log.Infof(ctx, "execution %s is %s with a different input, rerunning", sfnName, status)
+	}
+}
 
-		ExecutionArn, err := commonHandler.AwsClient.InvokeSFN(&message.Body, &SFNStateMachineARN, &sfnName)
-		log.Infof(ctx, "executionARN of Step function:  %s", ExecutionArn)
+// rerunName suffixes the reruns of name with their attempt, keeping the name within the execution name limit.
+func rerunName(name string, attempt int) string {
+	if attempt == 1 {
+		return name
+	}
+	suffix := fmt.Sprintf("-r%d", attempt)
+	if len(name)+len(suffix) > maxExecutionName {
+		name = name[:maxExecutionName-len(suffix)]
+	}
+	return name + suffix
+}
 
-		if err != nil {
-			log.Error(ctx, err)
-			// NOTIFY Lambda
-			notifyError := NotifyRequestErrorMessage{
-				Error: err.Error(),
-				Cause: fmt.Sprintf("Unable to trigger workflow as callback Id %s is not unique", sfnreq["meta"].(map[string]interface{})["callbackId"].(string)),
-			}
+// executionArn derives the ARN of an execution from its state machine ARN and name.
+func executionArn(stateMachineArn, name string) (string, error) {
+	const marker = ":stateMachine:"
+	if !strings.Contains(stateMachineArn, marker) {
+		return "", fmt.Errorf("%s is not a state machine ARN", stateMachineArn)
+	}
+	return strings.Replace(stateMachineArn, marker, ":execution:", 1) + ":" + name, nil
+}
 
-			payload := map[string]interface{}{
-				"CallbackID":   sfnreq["meta"].(map[string]interface{})["callbackId"].(string),
-				"CallbackURL":  sfnreq["meta"].(map[string]interface{})["callbackUrl"].(string),
-				"ErrorMessage": notifyError,
-			}
+// sameInput compares two JSON documents ignoring formatting and key order.
+func sameInput(a, b string) bool {
+	var left, right interface{}
+	if json.Unmarshal([]byte(a), &left) != nil || json.Unmarshal([]byte(b), &right) != nil {
+		return a == b
+	}
+	return reflect.DeepEqual(left, right)
+}
 
-			sfnnotifierlambdaarn := os.Getenv("SFNNotifierLambdaARN")
-			_, invokeErr := commonHandler.AwsClient.InvokeLambda(ctx, sfnnotifierlambdaarn, payload, false)
-			log.Error(ctx, invokeErr)
-			return req, error_handler.NewServiceError(error_codes.ErrorInvokingStepFunction, err.Error())
-		}
+// rejectedCodes are the failures of the message itself, retrying it can only fail the same way.
+var rejectedCodes = map[int]bool{
+	error_codes.ErrorDecodingInvokeSFNInput:   true,
+	error_codes.ErrorUnknownSource:            true,
+	error_codes.ErrorValidatingInvokeSFNInput: true,
+}
+
+// deadLetter moves a rejected message to the DeadLetterQueueURL queue, where it is kept for inspection.
+func deadLetter(ctx context.Context, message events.SQSMessage) error {
+	queueURL := os.Getenv(DeadLetterQueueURL)
+	if queueURL == "" {
+		return fmt.Errorf("%s is not set", DeadLetterQueueURL)
+	}
+	return commonHandler.AwsClient.PushMessageToSQS(ctx, queueURL, message.Body)
+}
 
+// notifyCallback tells the caller of a request carrying a callback that its workflow could not be started.
+func notifyCallback(ctx context.Context, sfnreq map[string]interface{}, err error) {
+	meta, _ := sfnreq["meta"].(map[string]interface{})
+	callbackID, _ := meta["callbackId"].(string)
+	callbackURL, _ := meta["callbackUrl"].(string)
+	if callbackID == "" {
+		return
+	}
+	notifyError := NotifyRequestErrorMessage{
+		Error: err.Error(),
+		Cause: fmt.Sprintf("Unable to trigger workflow as callback Id %s is not unique", callbackID),
+	}
+	payload := map[string]interface{}{
+		"CallbackID":   callbackID,
+		"CallbackURL":  callbackURL,
+		"ErrorMessage": notifyError,
+	}
+	_, invokeErr := commonHandler.AwsClient.InvokeLambda(ctx, os.Getenv(SFNNotifierLambdaARN), payload, false)
+	if invokeErr != nil {
+		log.Error(ctx, invokeErr)
 	}
-	log.Infof(ctx, "Invokesfn Lambda successful...")
-	return req, nil
 }
 
-func GetSfnDataBySource(ctx context.Context, input string, source string) (error, string, string) {
-	log.Info(ctx, "input body:", input)
+// LoadPriorityLanes reads the lanes from the PriorityLanes JSON, without it executions start regardless of priority.
+func LoadPriorityLanes(ctx context.Context) (*PriorityLanes, error) {
+	config := &PriorityLanes{}
+	found, err := priorityLanesSource.Decode(ctx, commonHandler.AwsClient, config)
+	if err != nil || !found {
+		return nil, err
+	}
+	return config, nil
+}
 
-	switch source {
-	case enums.AutoImageSelection, enums.MeasurementAutomation:
-		var SFNStateMachineARN string
-		sfnreq := sfnInput{}
-		err := json.Unmarshal([]byte(input), &sfnreq)
-		if err != nil {
-			log.Error(ctx, err)
-			return error_handler.NewServiceError(error_codes.ErrorDecodingInvokeSFNInput, err.Error()), "", ""
+// Validate reports every problem of the lanes.
+func (config *PriorityLanes) Validate() error {
+	problems := config_loader.Problems{}
+	if config.Capacity < 0 {
+		problems.Add("capacity should not be negative")
+	}
+	for priority, lane := range config.Lanes {
+		if _, ok := enums.ParsePriority(string(priority)); !ok || priority == "" {
+			problems.Add("%q is not a priority", priority)
 		}
-		if err := validator.ValidateInvokeSfnRequest(ctx, sfnreq); err != nil {
-			log.Error(ctx, "error in validation: ", err)
-			return error_handler.NewServiceError(error_codes.ErrorValidatingCallOutLambdaRequest, err.Error()), "", ""
+		if lane.Weight < 0 || lane.MaxRunning < 0 {
+			problems.Add("%s should not have a negative weight or maxRunning", priority)
 		}
-		if source == enums.AutoImageSelection {
-			SFNStateMachineARN = os.Getenv(AISStateMachineARN)
-		} else {
-			SFNStateMachineARN = os.Getenv(StateMachineARN)
+	}
+	sort.Strings(problems)
+	return problems.Err("priority lanes")
+}
+
+// admit reserves a slot of the priority lane for the execution name, or returns errThrottled when the lane has no
+// room left. The slots are counted in DocumentDB so concurrent invocations cannot overshoot a cap. A full lane is
+// first reconciled with WorkflowData, slots of workflows that already stopped are released and the reservation
+// tried again.
+func admit(ctx context.Context, name string, priority enums.Priority) error {
+	if lanes == nil {
+		return nil
+	}
+	reserved, err := commonHandler.DBClient.ReservePriorityLane(ctx, name, priority, lanes.limits(priority))
+	if err == nil && !reserved {
+		released, reconcileErr := documentDB_client.ReconcilePriorityLanes(ctx, commonHandler.DBClient)
+		if reconcileErr != nil {
+			log.Error(ctx, "error reconciling the priority lanes ", reconcileErr)
+		}
+		if len(released) > 0 {
+			log.Info(ctx, "released the priority lane slots of stopped workflows ", released)
+			reserved, err = commonHandler.DBClient.ReservePriorityLane(ctx, name, priority, lanes.limits(priority))
 		}
-		sfnName := fmt.Sprintf("%s-%s-%s", sfnreq.ReportID, sfnreq.WorkflowId, sfnreq.Source)
-		log_config.SetTraceIdInContext(ctx, sfnreq.ReportID, "")
-		return nil, SFNStateMachineARN, sfnName
+	}
+	if err != nil {
+		log.Error(ctx, "error reserving a priority lane slot ", err)
+		return error_handler.NewServiceError(error_codes.ErrorReservingPriorityLane, err.Error())
+	}
+	if !reserved {
+		return fmt.Errorf("%w: no %s slot left within maxRunning %d, capacity %d and share %d", errThrottled, priority, lanes.Lanes[priority].MaxRunning, lanes.Capacity, lanes.fairShare(priority))
+	}
+	return nil
+}
 
-	case enums.SIM:
-		sfnsimreq := sfnSIMInput{}
-		err := json.Unmarshal([]byte(input), &sfnsimreq)
-		if err != nil {
-			log.Error(ctx, err)
-			return error_handler.NewServiceError(error_codes.ErrorDecodingInvokeSFNInput, err.Error()), "", ""
+// releaseLane gives back the slot of an execution that did not start, a failure only leaves the slot taken
+// until the message is retried under the same name.
+func releaseLane(ctx context.Context, name string) {
+	if lanes == nil {
+		return
+	}
+	if _, err := commonHandler.DBClient.ReleasePriorityLane(ctx, name); err != nil {
+		log.Error(ctx, "error releasing the priority lane slot of ", name, ": ", err)
+	}
+}
+
+func (config *PriorityLanes) limits(priority enums.Priority) documentDB_client.LaneLimits {
+	return documentDB_client.LaneLimits{
+		MaxRunning: config.Lanes[priority].MaxRunning,
+		Capacity:   config.Capacity,
+		Share:      config.fairShare(priority),
+	}
+}
+
+// fairShare is the part of the capacity guaranteed to priority, proportional to its weight.
+func (config *PriorityLanes) fairShare(priority enums.Priority) int64 {
+	var weights int64
+	for _, lane := range config.Lanes {
+		weights += lane.Weight
+	}
+	weight := config.Lanes[priority].Weight
+	if weights == 0 || weight == 0 {
+		return 0
+	}
+	share := config.Capacity * weight / weights
+	if share == 0 {
+		share = 1
+	}
+	return share
+}
+
+// messagePriority returns the lane of the message. The rush and bulk queues decide the lane of their messages,
+// a priority field naming another lane is rejected. Messages of the other queues are in the lane of their field.
+func messagePriority(message events.SQSMessage, sfnreq map[string]interface{}) (enums.Priority, error) {
+	field := stringField(sfnreq, "priority")
+	priority, ok := enums.ParsePriority(field)
+	if !ok {
+		return "", fmt.Errorf("priority should be one of %v", enums.PriorityList())
+	}
+	lane, ok := queuePriority(message.EventSourceARN)
+	if !ok {
+		return priority, nil
+	}
+	if field != "" && priority != lane {
+		return "", fmt.Errorf("priority %s was sent to the %s queue", field, lane)
+	}
+	return lane, nil
+}
+
+// queuePriority returns the priority of a receiveOrder-<priority> queue.
+func queuePriority(queueArn string) (enums.Priority, bool) {
+	name := queueArn[strings.LastIndex(queueArn, ":")+1:]
+	index := strings.LastIndex(name, priorityQueueInfix)
+	if index < 0 {
+		return "", false
+	}
+	suffix := name[index+len(priorityQueueInfix):]
+	priority, ok := enums.ParsePriority(suffix)
+	return priority, ok && suffix != ""
+}
+
+// postpone hides a throttled message for a backoff doubling with each receive, so it comes back once its lane may
+// have room instead of right away. The message stays visible again on the usual timeout when this fails.
+func postpone(ctx context.Context, message events.SQSMessage) {
+	queueURL, err := queueURL(message.EventSourceARN)
+	if err != nil {
+		log.Error(ctx, "cannot postpone message ", message.MessageId, ": ", err)
+		return
+	}
+	receives, _ := strconv.Atoi(message.Attributes["ApproximateReceiveCount"])
+	if err = commonHandler.AwsClient.ChangeMessageVisibility(ctx, queueURL, message.ReceiptHandle, throttleBackoff(receives)); err != nil {
+		log.Error(ctx, "cannot postpone message ", message.MessageId, ": ", err)
+	}
+}
+
+// throttleBackoff is the visibility timeout of a message throttled on its receives-th receive.
+func throttleBackoff(receives int) int64 {
+	backoff := int64(minThrottleBackoff)
+	for i := 1; i < receives && backoff < maxThrottleBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxThrottleBackoff {
+		backoff = maxThrottleBackoff
+	}
+	return backoff
+}
+
+// queueURL derives the URL of a queue from its ARN, arn:aws:sqs:<region>:<account>:<name>.
+func queueURL(queueArn string) (string, error) {
+	parts := strings.Split(queueArn, ":")
+	if len(parts) != 6 || parts[2] != "sqs" {
+		return "", fmt.Errorf("%q is not a queue ARN", queueArn)
+	}
+	return fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", parts[3], parts[4], parts[5]), nil
+}
+
+// LoadRoutingTable reads the routes from the SourceRoutes JSON, or from the S3 object at SourceRoutesS3Path, and
+// falls back to the built-in routes when neither is set. Every route is checked before the table is used.
+func LoadRoutingTable(ctx context.Context) (RoutingTable, error) {
+	table := RoutingTable{}
+	found, err := routingTableSource.Decode(ctx, commonHandler.AwsClient, &table)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		table = DefaultRoutingTable()
+		if err = routingTableSource.Validate(table); err != nil {
+			return nil, err
 		}
-		if err := validator.ValidateInvokeSfnRequest(ctx, sfnsimreq); err != nil {
-			log.Error(ctx, "error in validation: ", err)
-			return error_handler.NewServiceError(error_codes.ErrorValidatingCallOutLambdaRequest, err.Error()), "", ""
+	}
+	return table, nil
+}
+
+// DefaultRoutingTable routes the MA, AIS and SIM orders to the state machines set in the environment.
+func DefaultRoutingTable() RoutingTable {
+	ofType := func(t validator.FieldType) *validator.JSONSchema { return &validator.JSONSchema{Type: t} }
+	orderSchema := &validator.JSONSchema{
+		Type:     validator.FieldTypeObject,
+		Required: []string{"address", "reportId"},
+		Properties: map[string]*validator.JSONSchema{
+			"address": {
+				Type:     validator.FieldTypeObject,
+				Required: []string{"city", "country", "longitude", "latitude", "state", "street", "zip"},
+				Properties: map[string]*validator.JSONSchema{
+					"city":      ofType(validator.FieldTypeString),
+					"country":   ofType(validator.FieldTypeString),
+					"longitude": ofType(validator.FieldTypeNumber),
+					"latitude":  ofType(validator.FieldTypeNumber),
+					"state":     ofType(validator.FieldTypeString),
+					"street":    ofType(validator.FieldTypeString),
+					"zip":       ofType(validator.FieldTypeString),
+				},
+			},
+			"reportId":   ofType(validator.FieldTypeString),
+			"orderId":    ofType(validator.FieldTypeString),
+			"workflowId": ofType(validator.FieldTypeString),
+		},
+	}
+	simSchema := &validator.JSONSchema{
+		Type:     validator.FieldTypeObject,
+		Required: []string{"meta"},
+		Properties: map[string]*validator.JSONSchema{
+			"address": {
+				Type: validator.FieldTypeObject,
+				Properties: map[string]*validator.JSONSchema{
+					"parcelAddress": ofType(validator.FieldTypeString),
+					"lat":           ofType(validator.FieldTypeNumber),
+					"long":          ofType(validator.FieldTypeNumber),
+				},
+			},
+			"meta": {
+				Type:     validator.FieldTypeObject,
+				Required: []string{"callbackId", "callbackUrl"},
+				Properties: map[string]*validator.JSONSchema{
+					"callbackId":  ofType(validator.FieldTypeString),
+					"callbackUrl": ofType(validator.FieldTypeString),
+				},
+			},
+			"vintage": {Type: validator.FieldTypeString, Format: validator.FormatDateTime},
+		},
+	}
+	return RoutingTable{
+		enums.MeasurementAutomation: {
+			StateMachineARN: os.Getenv(StateMachineARN),
+			InputSchema:     orderSchema,
+			ExecutionName:   "{reportId}-{workflowId}-{source}",
+			TraceIDField:    "reportId",
+		},
+		enums.AutoImageSelection: {
+			StateMachineARN: os.Getenv(AISStateMachineARN),
+			InputSchema:     orderSchema,
+			ExecutionName:   "{reportId}-{workflowId}-{source}",
+			TraceIDField:    "reportId",
+		},
+		enums.SIM: {
+			StateMachineARN: os.Getenv(SIMStateMachineARN),
+			InputSchema:     simSchema,
+			ExecutionName:   "{meta.callbackId}-{source}",
+			TraceIDField:    "meta.callbackId",
+		},
+	}
+}
+
+// Validate reports every route missing a state machine or an execution name, or with an invalid input schema.
+func (table RoutingTable) Validate() error {
+	if len(table) == 0 {
+		return errors.New("routing table has no routes")
+	}
+	sources := make([]string, 0, len(table))
+	for source := range table {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	problems := config_loader.Problems{}
+	for _, source := range sources {
+		route := table[source]
+		if route.StateMachineARN == "" {
+			problems.Add("%s has no stateMachineArn", source)
+		}
+		if route.ExecutionName == "" {
+			problems.Add("%s has no executionName", source)
+		} else if executionNameRejected.MatchString(placeholder.ReplaceAllString(route.ExecutionName, "")) {
+			problems.Add("%s has characters Step Functions rejects in its executionName", source)
 		}
-		SFNStateMachineARN := os.Getenv(SIMStateMachineARN)
-		sfnName := fmt.Sprintf("%s-%s", sfnsimreq.Meta.CallbackID, sfnsimreq.Source)
-		log_config.SetTraceIdInContext(ctx, sfnsimreq.Meta.CallbackID, "")
-		return nil, SFNStateMachineARN, sfnName
+		if route.OnFinishedDuplicate != "" && route.OnFinishedDuplicate != DuplicateReject && route.OnFinishedDuplicate != DuplicateRerun {
+			problems.Add("%s has unsupported onFinishedDuplicate %s", source, route.OnFinishedDuplicate)
+		}
+		if route.InputSchema == nil {
+			problems.Add("%s has no inputSchema", source)
+		} else if err := route.InputSchema.Compile(); err != nil {
+			problems.Add("%s has an invalid inputSchema: %v", source, err)
+		}
+	}
+	return problems.Err("routing table")
+}
 
-	default:
-		return error_handler.NewServiceError(error_codes.ErrorUnknownSource, "Unknown Source"), "", ""
+// executionName fills the template of the route, a missing field renders as empty like the former fixed formats.
+// Characters Step Functions rejects in the filled values are replaced by "_".
+func (route SourceRoute) executionName(input map[string]interface{}) (string, error) {
+	name := placeholder.ReplaceAllStringFunc(route.ExecutionName, func(match string) string {
+		return executionNameRejected.ReplaceAllString(stringField(input, match[1:len(match)-1]), "_")
+	})
+	if len(name) > maxExecutionName {
+		return "", fmt.Errorf("execution name %s is longer than %d characters", name, maxExecutionName)
 	}
+	return name, nil
+}
+
+func (route SourceRoute) traceID(input map[string]interface{}) string {
+	if route.TraceIDField == "" {
+		return stringField(input, "reportId")
+	}
+	return stringField(input, route.TraceIDField)
+}
 
+// stringField returns the value at a dotted path of input, or an empty string when it is missing. JSON numbers are
+// rendered without exponent, so a numeric reportId keeps its digits.
+func stringField(input map[string]interface{}, path string) string {
+	var value interface{} = input
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
 }
@@ -2,19 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sfn"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/enums"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
 )
 
 var InvokeSFNRequest string = "{ \"address\": { \"city\": \"Gilroy\", \"country\": \"UnitedStates\", \"latitude\": 37.024966, \"longitude\": -121.583003, \"state\": \"CA\", \"street\": \"270 Ronan Ave\", \"zip\": \"95020\" }, \"reportId\": \"44825849\", \"orderId\": \"44825849\", \"customerNotes\": \"\", \"measurementInstructions\": {}, \"orderType\": \"\", \"source\": \"AIS\" }"
 
 func TestInvokeSFN(t *testing.T) {
+	useDefaultRoutes(t)
 	awsclient := new(mocks.IAWSClient)
 	commonHandler.AwsClient = awsclient
 	InvokeSFNRequestObj := events.SQSEvent{}
@@ -26,6 +35,7 @@ func TestInvokeSFN(t *testing.T) {
 var InvokeSFNSIMRequest string = "{\"address\": { \"parcelAddress\":\"23 HAVENSHIRE RD, ROCHESTER, NY, 14625\",        \"lat\":  43.172988,        \"long\":  -77.501957    },    \"meta\":{        \"callbackId\":\"callback-test-00001\",        \"callbackUrl\":\"callback\"    },  \"source\":\"SIM\" ,   \"vintage\":\"2017-08-16T09:19:47.051096+00:00\"  }"
 
 func TestInvokeSFNSIM(t *testing.T) {
+	useDefaultRoutes(t)
 	awsclient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
 	slackClient.On("SendErrorMessage", mock.Anything, mock.Anything, "", mock.Anything, "invokesfn", mock.Anything, mock.Anything).Return(nil)
@@ -37,6 +47,7 @@ func TestInvokeSFNSIM(t *testing.T) {
 	notificationWrapper(context.Background(), InvokeSFNSIMRequestObj)
 }
 func TestInvokeSFNerrorNoBody(t *testing.T) {
+	useDefaultRoutes(t)
 	awsclient := new(mocks.IAWSClient)
 	slackClient := new(mocks.ISlackClient)
 	slackClient.On("SendErrorMessage", mock.Anything, mock.Anything, "", mock.Anything, "invokesfn", mock.Anything, mock.Anything).Return(nil)
@@ -44,28 +55,392 @@ func TestInvokeSFNerrorNoBody(t *testing.T) {
 	commonHandler.SlackClient = slackClient
 	InvokeSFNRequestObj := events.SQSEvent{}
 	InvokeSFNRequestObj.Records = []events.SQSMessage{events.SQSMessage{Body: ""}}
-	_, err := Handler(context.Background(), InvokeSFNRequestObj)
-	assert.Error(t, err)
+	t.Setenv(DeadLetterQueueURL, "https://sqs/dlq")
+	awsclient.Mock.On("PushMessageToSQS", mock.Anything, "https://sqs/dlq", "").Return(nil).Once()
+	resp := Handler(context.Background(), InvokeSFNRequestObj)
+	assert.Empty(t, resp.BatchItemFailures)
+	awsclient.AssertExpectations(t)
 }
 func TestInvokeSFNerror(t *testing.T) {
+	useDefaultRoutes(t)
 	awsclient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	slackClient.On("SendErrorMessage", mock.Anything, "callback-test-00001", "", mock.Anything, "invokesfn", mock.Anything, mock.Anything).Return(nil)
 	commonHandler.AwsClient = awsclient
+	commonHandler.SlackClient = slackClient
 	InvokeSFNRequestObj := events.SQSEvent{}
 	InvokeSFNRequestObj.Records = []events.SQSMessage{events.SQSMessage{Body: InvokeSFNSIMRequest}}
 	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.Anything).Return("ExecutionARN", errors.New("some error"))
 	awsclient.Mock.On("InvokeLambda", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&lambda.InvokeOutput{Payload: []byte("")}, nil)
-	_, err := Handler(context.Background(), InvokeSFNRequestObj)
-	assert.Error(t, err)
+	resp := Handler(context.Background(), InvokeSFNRequestObj)
+	assert.Len(t, resp.BatchItemFailures, 1)
+	slackClient.AssertExpectations(t)
 }
 
 var InvokeSFNRequestaddressmissing string = "{ \"address\": { \"country\": \"UnitedStates\", \"latitude\": 37.024966, \"longitude\": -121.583003, \"state\": \"CA\", \"street\": \"270 Ronan Ave\", \"zip\": \"95020\" }, \"reportId\": \"44825849\", \"orderId\": \"44825849\", \"customerNotes\": \"\", \"measurementInstructions\": {}, \"orderType\": \"\" }"
 
 func TestInvokeSFNerrorValidation(t *testing.T) {
+	useDefaultRoutes(t)
 	awsclient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	slackClient.On("SendErrorMessage", mock.Anything, "44825849", "", mock.Anything, "invokesfn", mock.Anything, mock.Anything).Return(nil)
 	commonHandler.AwsClient = awsclient
+	commonHandler.SlackClient = slackClient
 	InvokeSFNRequestObj := events.SQSEvent{}
 	InvokeSFNRequestObj.Records = []events.SQSMessage{events.SQSMessage{Body: InvokeSFNRequestaddressmissing}}
-	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.Anything).Return("ExecutionARN", nil)
-	_, err := Handler(context.Background(), InvokeSFNRequestObj)
+	t.Setenv(DeadLetterQueueURL, "https://sqs/dlq")
+	// kept on the queue when it cannot be moved to the dead letter queue
+	awsclient.Mock.On("PushMessageToSQS", mock.Anything, "https://sqs/dlq", InvokeSFNRequestaddressmissing).Return(errors.New("throttled")).Once()
+	resp := Handler(context.Background(), InvokeSFNRequestObj)
+	assert.Len(t, resp.BatchItemFailures, 1)
+	awsclient.AssertExpectations(t)
+}
+
+func TestInvokeSFNPartialBatchFailure(t *testing.T) {
+	useDefaultRoutes(t)
+	awsclient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	slackClient.On("SendErrorMessage", mock.Anything, "44825849", "", mock.Anything, "invokesfn", mock.Anything, map[string]string{"messageId": "bad", "request": InvokeSFNRequestaddressmissing}).Return(nil).Once()
+	commonHandler.AwsClient = awsclient
+	commonHandler.SlackClient = slackClient
+	InvokeSFNRequestObj := events.SQSEvent{}
+	InvokeSFNRequestObj.Records = []events.SQSMessage{
+		{MessageId: "first", Body: InvokeSFNRequest},
+		{MessageId: "bad", Body: InvokeSFNRequestaddressmissing},
+		{MessageId: "last", Body: InvokeSFNSIMRequest},
+	}
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.Anything).Return("ExecutionARN", nil).Twice()
+	resp, err := notificationWrapper(context.Background(), InvokeSFNRequestObj)
+	assert.NoError(t, err)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "bad"}}, resp.BatchItemFailures)
+	awsclient.AssertExpectations(t)
+	slackClient.AssertExpectations(t)
+}
+
+func useDefaultRoutes(t *testing.T) {
+	t.Setenv(StateMachineARN, "arn:ma")
+	t.Setenv(AISStateMachineARN, "arn:ais")
+	t.Setenv(SIMStateMachineARN, "arn:sim")
+	var err error
+	routes, err = LoadRoutingTable(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestInvokeSFNDefaultRoutes(t *testing.T) {
+	useDefaultRoutes(t)
+	awsclient := new(mocks.IAWSClient)
+	commonHandler.AwsClient = awsclient
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.MatchedBy(func(arn *string) bool { return *arn == "arn:ais" }), mock.MatchedBy(func(name *string) bool { return *name == "44825849--AIS" })).Return("ExecutionARN", nil).Once()
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.MatchedBy(func(arn *string) bool { return *arn == "arn:sim" }), mock.MatchedBy(func(name *string) bool { return *name == "callback-test-00001-SIM" })).Return("ExecutionARN", nil).Once()
+	resp := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{Body: InvokeSFNRequest}, {Body: InvokeSFNSIMRequest}}})
+	assert.Empty(t, resp.BatchItemFailures)
+	awsclient.AssertExpectations(t)
+}
+
+var SourceRoutesConfig = `{
+	"ROOF": {
+		"stateMachineArn": "arn:roof",
+		"executionName": "{order.id}-{source}",
+		"traceIdField": "order.id",
+		"inputSchema": {
+			"type": "object",
+			"required": ["order"],
+			"properties": {
+				"order": {
+					"type": "object",
+					"required": ["id", "pitch"],
+					"properties": {
+						"id": {"type": "string", "pattern": "^[0-9]+$"},
+						"pitch": {"type": "number", "minimum": 0, "maximum": 24},
+						"priority": {"type": "string", "enum": ["low", "high"]}
+					}
+				}
+			}
+		}
+	}
+}`
+
+func TestInvokeSFNConfiguredRoutes(t *testing.T) {
+	t.Setenv(SourceRoutes, SourceRoutesConfig)
+	table, err := LoadRoutingTable(context.Background())
+	assert.NoError(t, err)
+	routes = table
+
+	awsclient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	commonHandler.AwsClient = awsclient
+	commonHandler.SlackClient = slackClient
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.MatchedBy(func(arn *string) bool { return *arn == "arn:roof" }), mock.MatchedBy(func(name *string) bool { return *name == "42-ROOF" })).Return("ExecutionARN", nil).Once()
+	slackClient.On("SendErrorMessage", error_codes.ErrorValidatingInvokeSFNInput, "4x", "", "", "invokesfn", "{\"message\":\"order.id should match ^[0-9]+$,order.pitch should be at most 24,order.priority should be one of [low high]\",\"messageCode\":4035}", mock.Anything).Return(nil).Once()
+	slackClient.On("SendErrorMessage", error_codes.ErrorUnknownSource, "44825849", "", "", "invokesfn", mock.Anything, mock.Anything).Return(nil).Once()
+	t.Setenv(DeadLetterQueueURL, "https://sqs/dlq")
+	invalid := `{"source": "ROOF", "order": {"id": "4x", "pitch": 30, "priority": "urgent"}}`
+	awsclient.Mock.On("PushMessageToSQS", mock.Anything, "https://sqs/dlq", invalid).Return(nil).Once()
+	awsclient.Mock.On("PushMessageToSQS", mock.Anything, "https://sqs/dlq", InvokeSFNRequest).Return(nil).Once()
+
+	resp := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "valid", Body: `{"source": "ROOF", "order": {"id": "42", "pitch": 6}}`},
+		{MessageId: "invalid", Body: invalid},
+		{MessageId: "unrouted", Body: InvokeSFNRequest},
+	}})
+	assert.Empty(t, resp.BatchItemFailures)
+	awsclient.AssertExpectations(t)
+	slackClient.AssertExpectations(t)
+}
+
+func TestLoadRoutingTableFromS3(t *testing.T) {
+	t.Setenv(SourceRoutesS3Path, "s3://config-bucket/invokesfn/routes.json")
+	awsclient := new(mocks.IAWSClient)
+	commonHandler.AwsClient = awsclient
+	awsclient.Mock.On("FetchS3BucketPath", "s3://config-bucket/invokesfn/routes.json").Return("config-bucket", "invokesfn/routes.json", nil)
+	awsclient.Mock.On("GetDataFromS3", mock.Anything, "config-bucket", "invokesfn/routes.json").Return([]byte(SourceRoutesConfig), nil)
+	table, err := LoadRoutingTable(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "arn:roof", table["ROOF"].StateMachineARN)
+}
+
+func TestLoadRoutingTableInvalid(t *testing.T) {
+	t.Setenv(SourceRoutes, `{"ROOF": {"executionName": "{id}/roof", "inputSchema": {"type": "object", "properties": {"id": {"type": "text", "pattern": "("}}}}, "WALL": {"stateMachineArn": "arn:wall"}}`)
+	_, err := LoadRoutingTable(context.Background())
+	assert.Error(t, err)
+	for _, problem := range []string{"ROOF has no stateMachineArn", "ROOF has characters Step Functions rejects in its executionName", "id has unsupported type text", "id has invalid pattern", "WALL has no executionName", "WALL has no inputSchema"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestExecutionName(t *testing.T) {
+	route := SourceRoute{ExecutionName: "{reportId}-{order.ref}-{source}", TraceIDField: "reportId"}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"strings", `{"reportId": "44825849", "order": {"ref": "a1"}, "source": "AIS"}`, "44825849-a1-AIS"},
+		{"numbers keep their digits", `{"reportId": 44825849, "order": {"ref": 1.5}, "source": "AIS"}`, "44825849-1.5-AIS"},
+		{"missing fields render empty", `{"reportId": "1"}`, "1--"},
+		{"rejected characters", `{"reportId": "1 2", "order": {"ref": "a/b:c*"}, "source": "A{I}S"}`, "1_2-a_b_c_-A_I_S"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var input map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(test.input), &input))
+			name, err := route.executionName(input)
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, name)
+		})
+	}
+
+	var input map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"reportId": 44825849}`), &input))
+	assert.Equal(t, "44825849", route.traceID(input))
+}
+
+func duplicateRoutes(policy string) RoutingTable {
+	table := DefaultRoutingTable()
+	route := table[enums.SIM]
+	route.StateMachineARN = "arn:aws:states:us-east-2:123456789012:stateMachine:sim"
+	route.OnFinishedDuplicate = policy
+	table[enums.SIM] = route
+	return table
+}
+
+func TestInvokeSFNDuplicateExecution(t *testing.T) {
+	executionArn := "arn:aws:states:us-east-2:123456789012:execution:sim:callback-test-00001-SIM"
+	alreadyExists := awserr.New(sfn.ErrCodeExecutionAlreadyExists, "Execution Already Exists", nil)
+	named := func(name string) interface{} {
+		return mock.MatchedBy(func(n *string) bool { return *n == name })
+	}
+	tests := []struct {
+		name         string
+		policy       string
+		existing     sfn.DescribeExecutionOutput
+		rerun        bool
+		failed       bool
+		notifyCaller bool
+	}{
+		{name: "redelivered while running", existing: sfn.DescribeExecutionOutput{Status: aws.String(sfn.ExecutionStatusRunning), Input: aws.String(InvokeSFNSIMRequest)}},
+		{name: "redelivered after finishing", existing: sfn.DescribeExecutionOutput{Status: aws.String(sfn.ExecutionStatusSucceeded), Input: aws.String(`{"source":"SIM","meta":{"callbackUrl":"callback","callbackId":"callback-test-00001"},"vintage":"2017-08-16T09:19:47.051096+00:00","address":{"long":-77.501957,"lat":43.172988,"parcelAddress":"23 HAVENSHIRE RD, ROCHESTER, NY, 14625"}}`)}},
+		{name: "conflicting running execution", policy: DuplicateRerun, existing: sfn.DescribeExecutionOutput{Status: aws.String(sfn.ExecutionStatusRunning), Input: aws.String(`{"source":"SIM"}`)}, failed: true, notifyCaller: true},
+		{name: "finished execution rejected", existing: sfn.DescribeExecutionOutput{Status: aws.String(sfn.ExecutionStatusFailed), Input: aws.String(`{"source":"SIM"}`)}, failed: true, notifyCaller: true},
+		{name: "finished execution rerun", policy: DuplicateRerun, existing: sfn.DescribeExecutionOutput{Status: aws.String(sfn.ExecutionStatusFailed), Input: aws.String(`{"source":"SIM"}`)}, rerun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes = duplicateRoutes(tt.policy)
+			awsclient := new(mocks.IAWSClient)
+			slackClient := new(mocks.ISlackClient)
+			commonHandler.AwsClient = awsclient
+			commonHandler.SlackClient = slackClient
+			awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, named("callback-test-00001-SIM")).Return("", alreadyExists).Once()
+			awsclient.Mock.On("DescribeExecution", mock.Anything, executionArn).Return(&tt.existing, nil).Once()
+			if tt.rerun {
+				awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, named("callback-test-00001-SIM-r2")).Return("ExecutionARN", nil).Once()
+			}
+			if tt.notifyCaller {
+				awsclient.Mock.On("InvokeLambda", mock.Anything, mock.Anything, mock.MatchedBy(func(payload map[string]interface{}) bool { return payload["CallbackID"] == "callback-test-00001" }), false).Return(&lambda.InvokeOutput{}, nil).Once()
+			}
+			if tt.failed {
+				slackClient.On("SendErrorMessage", error_codes.DuplicateExecutionConflict, "callback-test-00001", "", "", "invokesfn", mock.Anything, mock.Anything).Return(nil).Once()
+			}
+
+			// a conflict is reported but not retried, a redelivery would conflict again
+			resp := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "sim", Body: InvokeSFNSIMRequest}}})
+			assert.Empty(t, resp.BatchItemFailures)
+			awsclient.AssertExpectations(t)
+			slackClient.AssertExpectations(t)
+		})
+	}
+}
+
+const (
+	legacyQueueArn = "arn:aws:sqs:us-east-2:123456789012:sbox-sqs-receiveLegacyOrder"
+	bulkQueueArn   = "arn:aws:sqs:us-east-2:123456789012:sbox-sqs-receiveOrder-bulk"
+)
+
+func TestInvokeSFNPriorityLanes(t *testing.T) {
+	useDefaultRoutes(t)
+	t.Setenv(PriorityLanesConfig, `{"capacity": 4, "lanes": {"rush": {"weight": 3}, "standard": {"weight": 1}, "bulk": {"maxRunning": 2}}}`)
+	var err error
+	lanes, err = LoadPriorityLanes(context.Background())
+	assert.NoError(t, err)
+	defer func() { lanes = nil }()
+
+	order := func(reportId, priority string) string {
+		body := strings.Replace(InvokeSFNRequest, `"reportId": "44825849"`, `"reportId": "`+reportId+`"`, 1)
+		if priority == "" {
+			return body
+		}
+		return strings.Replace(body, `"source": "AIS"`, `"source": "AIS", "priority": "`+priority+`"`, 1)
+	}
+	awsclient := new(mocks.IAWSClient)
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	slackClient := new(mocks.ISlackClient)
+	commonHandler.AwsClient = awsclient
+	commonHandler.DBClient = dBClient
+	commonHandler.SlackClient = slackClient
+	// one standard and two bulk executions are already running
+	for name, priority := range map[string]enums.Priority{"running-standard": enums.PriorityStandard, "running-bulk-1": enums.PriorityBulk, "running-bulk-2": enums.PriorityBulk} {
+		reserved, err := dBClient.ReservePriorityLane(context.Background(), name, priority, documentDB_client.LaneLimits{})
+		assert.NoError(t, err)
+		assert.True(t, reserved)
+	}
+	started := []string{}
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.Anything).Return("ExecutionARN", nil).Run(func(args mock.Arguments) {
+		started = append(started, *args.Get(2).(*string))
+	}).Times(3)
+	awsclient.Mock.On("ChangeMessageVisibility", mock.Anything, "https://sqs.us-east-2.amazonaws.com/123456789012/sbox-sqs-receiveOrder-bulk", "bulk-receipt", int64(30)).Return(nil).Once()
+	awsclient.Mock.On("ChangeMessageVisibility", mock.Anything, "https://sqs.us-east-2.amazonaws.com/123456789012/sbox-sqs-receiveLegacyOrder", "standard-receipt", int64(120)).Return(nil).Once()
+	slackClient.On("SendErrorMessage", error_codes.ErrorValidatingInvokeSFNInput, "6", "", "", "invokesfn", mock.Anything, mock.Anything).Return(nil).Once()
+	slackClient.On("SendErrorMessage", error_codes.ErrorValidatingInvokeSFNInput, "7", "", "", "invokesfn", mock.Anything, mock.Anything).Return(nil).Once()
+	t.Setenv(DeadLetterQueueURL, "https://sqs/dlq")
+	awsclient.Mock.On("PushMessageToSQS", mock.Anything, "https://sqs/dlq", order("6", "urgent")).Return(nil).Once()
+	awsclient.Mock.On("PushMessageToSQS", mock.Anything, "https://sqs/dlq", order("7", "rush")).Return(nil).Once()
+
+	resp := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "bulk", Body: order("1", ""), EventSourceARN: bulkQueueArn, ReceiptHandle: "bulk-receipt", Attributes: map[string]string{"ApproximateReceiveCount": "1"}},
+		{MessageId: "standard", Body: order("2", ""), EventSourceARN: legacyQueueArn},
+		{MessageId: "rush-1", Body: order("3", "rush"), EventSourceARN: legacyQueueArn},
+		{MessageId: "standard-over-share", Body: order("4", "standard"), EventSourceARN: legacyQueueArn, ReceiptHandle: "standard-receipt", Attributes: map[string]string{"ApproximateReceiveCount": "3"}},
+		{MessageId: "rush-2", Body: order("5", "rush"), EventSourceARN: legacyQueueArn},
+		{MessageId: "unknown", Body: order("6", "urgent"), EventSourceARN: legacyQueueArn},
+		{MessageId: "rush-on-bulk-queue", Body: order("7", "rush"), EventSourceARN: bulkQueueArn},
+	}})
+	// bulk is at its cap, the capacity is used up after rush-1 and standard is then above its share of 1
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "bulk"}, {ItemIdentifier: "standard-over-share"}}, resp.BatchItemFailures)
+	assert.Equal(t, []string{"2--AIS", "3--AIS", "5--AIS"}, started)
+	awsclient.AssertExpectations(t)
+	slackClient.AssertExpectations(t)
+
+	// finished executions give their slots back to the lanes and the shared capacity
+	for _, name := range []string{"running-bulk-1", "running-standard", "3--AIS"} {
+		released, err := dBClient.ReleasePriorityLane(context.Background(), name)
+		assert.NoError(t, err)
+		assert.True(t, released, name)
+	}
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.MatchedBy(func(name *string) bool { return *name == "1--AIS" })).Return("ExecutionARN", nil).Once()
+	resp = Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "bulk", Body: order("1", ""), EventSourceARN: bulkQueueArn}}})
+	assert.Empty(t, resp.BatchItemFailures)
+	// the queue gave the order its priority
+	input := awsclient.Calls[len(awsclient.Calls)-1].Arguments.Get(0).(*string)
+	assert.Contains(t, *input, `"priority":"bulk"`)
+}
+
+func TestInvokeSFNReleasesLaneWhenNotStarted(t *testing.T) {
+	useDefaultRoutes(t)
+	t.Setenv(PriorityLanesConfig, `{"lanes": {"standard": {"maxRunning": 1}}}`)
+	var err error
+	lanes, err = LoadPriorityLanes(context.Background())
+	assert.NoError(t, err)
+	defer func() { lanes = nil }()
+	awsclient := new(mocks.IAWSClient)
+	slackClient := new(mocks.ISlackClient)
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.AwsClient = awsclient
+	commonHandler.DBClient = dBClient
+	commonHandler.SlackClient = slackClient
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.Anything).Return("", errors.New("sfn unavailable")).Once()
+	slackClient.On("SendErrorMessage", error_codes.ErrorInvokingStepFunction, "44825849", "", "", "invokesfn", mock.Anything, mock.Anything).Return(nil).Once()
+
+	resp := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "standard", Body: InvokeSFNRequest}}})
+	assert.Len(t, resp.BatchItemFailures, 1)
+	reserved, err := dBClient.ReservePriorityLane(context.Background(), "other", enums.PriorityStandard, lanes.limits(enums.PriorityStandard))
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func TestInvokeSFNReconcilesFullLane(t *testing.T) {
+	useDefaultRoutes(t)
+	t.Setenv(PriorityLanesConfig, `{"lanes": {"standard": {"maxRunning": 3}}}`)
+	var err error
+	lanes, err = LoadPriorityLanes(context.Background())
+	assert.NoError(t, err)
+	defer func() { lanes = nil }()
+	awsclient := new(mocks.IAWSClient)
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.AwsClient = awsclient
+	commonHandler.DBClient = dBClient
+	// the release of the finished workflow was missed, the running one and the one not recorded yet keep their slot
+	for name, status := range map[string]enums.WorkflowStatus{"finished": enums.WorkflowFinished, "running": enums.WorkflowInProgress, "starting": ""} {
+		reserved, err := dBClient.ReservePriorityLane(context.Background(), name, enums.PriorityStandard, documentDB_client.LaneLimits{})
+		assert.NoError(t, err)
+		assert.True(t, reserved)
+		if status != "" {
+			assert.NoError(t, dBClient.InsertWorkflowExecutionData(context.Background(), documentDB_client.WorkflowExecutionDataBody{WorkflowId: name, Status: status}))
+		}
+	}
+	awsclient.Mock.On("InvokeSFN", mock.Anything, mock.Anything, mock.Anything).Return("ExecutionARN", nil).Once()
+
+	resp := Handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "standard", Body: InvokeSFNRequest}}})
+	assert.Empty(t, resp.BatchItemFailures)
+	awsclient.AssertExpectations(t)
+	for name, released := range map[string]bool{"finished": false, "running": true, "starting": true} {
+		ok, err := dBClient.ReleasePriorityLane(context.Background(), name)
+		assert.NoError(t, err)
+		assert.Equal(t, released, ok, name)
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	for receives, want := range map[int]int64{0: 30, 1: 30, 2: 60, 3: 120, 5: 480, 6: 900, 40: 900} {
+		assert.Equal(t, want, throttleBackoff(receives), "receive %d", receives)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	priority, ok := queuePriority(bulkQueueArn)
+	assert.True(t, ok)
+	assert.Equal(t, enums.PriorityBulk, priority)
+	for _, arn := range []string{legacyQueueArn, "arn:aws:sqs:us-east-2:123456789012:sbox-sqs-receiveOrder-dlq", "arn:aws:sqs:us-east-2:123456789012:sbox-sqs-receiveOrder-", ""} {
+		_, ok = queuePriority(arn)
+		assert.False(t, ok, arn)
+	}
+}
+
+func TestLoadPriorityLanesInvalid(t *testing.T) {
+	t.Setenv(PriorityLanesConfig, `{"capacity": -1, "lanes": {"urgent": {"weight": 1}, "bulk": {"maxRunning": -2}}}`)
+	_, err := LoadPriorityLanes(context.Background())
 	assert.Error(t, err)
+	for _, problem := range []string{"capacity should not be negative", `\"urgent\" is not a priority`, "bulk should not have a negative weight or maxRunning"} {
+		assert.Contains(t, err.Error(), problem)
+	}
 }
@@ -1,5 +1,7 @@
 package status
 
+import "github.eagleview.com/engineering/symphony-service/commons/execution_path"
+
 type status struct {
 	Status    string
 	SubStatus string
@@ -65,25 +67,11 @@ var StatusMap = map[string]status{
 	},
 }
 
-var FailedTaskStatusMap = map[string]failedTaskMetaData{
-	"CreateHipsterJobAndWaitForMeasurement": {
-		StatusKey:        "MeasurementFailed",
-		FallbackTaskName: "3DModellingService",
-	},
-	"UpdateHipsterJobAndWaitForQC": {
-		StatusKey:        "QCFailed",
-		FallbackTaskName: "CreateHipsterJobAndWaitForMeasurement",
-	},
-	"UpdateHipsterJobAndWaitForMeasurement": {
-		StatusKey:        "MeasurementFailed",
-		FallbackTaskName: "3DModellingService",
-	},
-	"UpdateHipsterMeasurementCompleteInLegacy": {
-		StatusKey:        "MeasurementFailed",
-		FallbackTaskName: "3DModellingService",
-	},
-	"CheckIsMultiStructure": {
-		StatusKey:        "MACompleted",
-		FallbackTaskName: "3DModellingService",
-	},
+// FailedTaskStatusMap maps the tasks of every registered execution path to the legacy status reported when they fail.
+func FailedTaskStatusMap() map[string]failedTaskMetaData {
+	failed := map[string]failedTaskMetaData{}
+	for task, status := range execution_path.Paths().FailedTasks() {
+		failed[task] = failedTaskMetaData{StatusKey: status.StatusKey, FallbackTaskName: status.FallbackTaskName}
+	}
+	return failed
 }
@@ -3,21 +3,31 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.eagleview.com/engineering/assess-platform-library/httpservice"
 	"github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/field_path"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 	"github.eagleview.com/engineering/symphony-service/commons/utils"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type eventData struct {
@@ -32,29 +42,98 @@ type eventData struct {
 	CallbackURL string `json:"callbackUrl"`
 	ParcelID    string `json:"parcelId"`
 	WorkflowID  string `json:"workflowId"`
+	// Items switches to batch mode, every item is a parcel id, an address or a point
+	Items []batchItem `json:"items"`
 }
 
 type pdwValidationResponse struct {
 	Data struct {
-		Parcels []struct {
-			ID                    string `json:"id"`
-			DetectedBuildingCount struct {
-				Marker string      `json:"marker"`
-				Value  interface{} `json:"value"`
-			} `json:"_detectedBuildingCount"`
-			Structures []struct {
-				ID   string                 `json:"id"`
-				Roof map[string]interface{} `json:"roof"`
-			} `json:"structures"`
-			GeoCoder struct {
-				Lat float64 `json:"lat"`
-				Lon float64 `json:"lon"`
-			} `json:"geocoder"`
-			Input string `json:"_input"`
-		} `json:"parcels"`
+		Parcels []pdwParcel `json:"parcels"`
 	} `json:"data"`
 }
 
+type pdwParcel struct {
+	ID                    string `json:"id"`
+	DetectedBuildingCount struct {
+		Marker string      `json:"marker"`
+		Value  interface{} `json:"value"`
+	} `json:"_detectedBuildingCount"`
+	Structures []struct {
+		ID   string                 `json:"id"`
+		Roof map[string]interface{} `json:"roof"`
+	} `json:"structures"`
+	GeoCoder struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"geocoder"`
+	Input string `json:"_input"`
+
+	// every field of the parcel, the freshness checks read the attributes they are configured with from it
+	fields map[string]interface{}
+}
+
+func (p *pdwParcel) UnmarshalJSON(data []byte) error {
+	type decoded pdwParcel
+	if err := json.Unmarshal(data, (*decoded)(p)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &p.fields)
+}
+
+// FreshAttribute is an attribute the parcel needs, with a value and a marker not older than the vintage. Field
+// is written in the dotted attribute format of the queries, each structure of a list has to hold the attribute.
+type FreshAttribute struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+}
+
+// FreshAttributes are the attributes a parcel needs to be valid.
+type FreshAttributes []FreshAttribute
+
+// freshnessResult tells whether the parcel holds fresh values for every attribute, and which ones are missing or
+// have a marker older than the vintage.
+type freshnessResult struct {
+	Valid   bool     `json:"valid"`
+	Missing []string `json:"missing"`
+	Stale   []string `json:"stale"`
+}
+
+type batchItem struct {
+	ParcelID string  `json:"parcelId,omitempty"`
+	Address  string  `json:"address,omitempty"`
+	Lat      float64 `json:"lat,omitempty"`
+	Long     float64 `json:"long,omitempty"`
+}
+
+// empty tells an item that names no parcel id, address or point, which would otherwise be looked up at 0,0.
+func (item batchItem) empty() bool {
+	return item.ParcelID == "" && item.Address == "" && item.Lat == 0 && item.Long == 0
+}
+
+// batchItemResult is the outcome of one batch item, ParcelID is the parcel PDW found for it.
+type batchItemResult struct {
+	batchItem
+	Found      bool             `json:"found"`
+	Valid      bool             `json:"valid"`
+	TriggerSIM bool             `json:"triggerSIM"`
+	Message    string           `json:"message"`
+	Validation *freshnessResult `json:"validation,omitempty"`
+}
+
+// batchSummary counts the batch outcomes, TriggerSIM lists the positions of the items SIM has to run for.
+type batchSummary struct {
+	Total      int   `json:"total"`
+	Valid      int   `json:"valid"`
+	NotFound   int   `json:"notFound"`
+	TriggerSIM []int `json:"triggerSIM"`
+}
+
+// batchGroup is one parcels list of the batch query, Items are the positions of the items it looks up in order.
+type batchGroup struct {
+	Alias string
+	Items []int
+}
+
 type eventResponse struct {
 	Address    string  `json:"address,omitempty"`
 	Latitude   float64 `json:"latitude,omitempty"`
@@ -62,15 +141,24 @@ type eventResponse struct {
 	ParcelID   string  `json:"parcelId,omitempty"`
 	TriggerSIM bool    `json:"triggerSIM"`
 	Message    string  `json:"message,omitempty"`
-}
 
-type geocoderResponse struct {
-	Address  string `json:"address"`
-	ParcelId string `json:"parcelID"`
+	Validation *freshnessResult `json:"validation,omitempty"`
+	Geocode    *GeocodeResult   `json:"geocode,omitempty"`
+
+	Items   []batchItemResult `json:"items,omitempty"`
+	Summary *batchSummary     `json:"summary,omitempty"`
 }
 
 var commonHandler common_handler.CommonHandler
+var freshAttributes = DefaultFreshAttributes()
+var coordinatePattern = regexp.MustCompile(`-?[0-9]+(\.[0-9]+)?`)
+var markerLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+var dateLayouts = []string{"2006-01-02", "2006/01/02", "20060102"}
 var auth_client utils.AuthTokenInterface = &utils.AuthTokenUtil{}
+var geocodeCache = &geocodeCacheDB{}
+var geocodersSource = config_loader.Source{Name: "geocoder providers", Env: GeocoderProvidersConfig, Code: error_codes.ErrorLoadingGeocoders}
+var freshAttributesSource = config_loader.Source{Name: "fresh attributes", Env: FreshAttributesConfig, Code: error_codes.ErrorLoadingFreshAttributes}
+var geocoder = NewGeocoder(DefaultGeocoderProviders(), defaultGeocodePrecision, defaultGeocodeCacheDays*24*time.Hour)
 
 const (
 	queryfilepath           = "query.gql"
@@ -86,6 +174,23 @@ const (
 	NoStructureMessage      = "Structures does not exist in the graph response"
 	StructurePresentMessage = "Structures exist in the graph response"
 	appCode                 = "O2"
+	maxBatchItems           = 100
+	pointTolerance          = 1e-6
+	byParcelID              = "byParcelId"
+	byAddress               = "byAddress"
+	byPoint                 = "byPoint"
+	FreshAttributesConfig   = "FreshAttributes"
+	GeoCoderUrl             = "GeoCoderUrl"
+	GeocoderProvidersConfig = "GeocoderProviders"
+	GeocodeCachePrecision   = "GeocodeCachePrecision"
+	GeocodeCacheDays        = "GeocodeCacheDays"
+
+	geocoderAuthEagleView   = "eagleview"
+	geocoderAuthAPIKey      = "apiKey"
+	geocoderAuthNone        = "none"
+	defaultGeocodePrecision = 5
+	maxGeocodePrecision     = 8
+	defaultGeocodeCacheDays = 30
 )
 
 func handler(ctx context.Context, eventData eventData) (eventResponse, error) {
@@ -93,18 +198,33 @@ func handler(ctx context.Context, eventData eventData) (eventResponse, error) {
 
 	log.Info(ctx, "querypdw reached...", eventData)
 
+	minDate, err := parseVintage(eventData.Vintage)
+	if err != nil {
+		log.Error(ctx, "invalid vintage, error: ", err.Error())
+		return eventResponse{}, err
+	}
+	if len(eventData.Items) > 0 {
+		return handleBatch(ctx, eventData, minDate)
+	}
+
+	var geocode *GeocodeResult
 	if eventData.Address.ParcelAddress == "" && eventData.ParcelID == "" {
 		log.Info(ctx, "calling geocoder service")
-		address, parcelId, err := getAddressFromLatLong(ctx, eventData.Address.Lat, eventData.Address.Long)
+		result, err := geocoder.ReverseGeocode(ctx, eventData.Address.Lat, eventData.Address.Long)
 		if err != nil {
 			return eventResponse{}, err
 		}
-		eventData.Address.ParcelAddress = address
-		eventData.ParcelID = parcelId
+		log.Infof(ctx, "geocoded by %s, cached: %t", result.Provider, result.Cached)
+		eventData.Address.ParcelAddress = result.Address
+		eventData.ParcelID = result.ParcelID
+		geocode = &result
 	}
 
 	// build the validation graph query
-	query := generateValidationQuery(eventData)
+	query, err := generateValidationQuery(eventData)
+	if err != nil {
+		return eventResponse{}, err
+	}
 	log.Info(ctx, "validation query generated...")
 	// fetch the validation graph response
 	response, err := fetchDataFromPDW(ctx, query)
@@ -121,12 +241,13 @@ func handler(ctx context.Context, eventData eventData) (eventResponse, error) {
 	if len(validationgraphResponse.Data.Parcels) == 0 || validationgraphResponse.Data.Parcels[0].ID == "" {
 		log.Info(ctx, NoParcelMessage)
 		err = makeCallBack(ctx, failure, NoParcelMessage, eventData.CallbackID, eventData.CallbackURL, error_codes.ParcelIDDoesnotExist, nil)
-		return eventResponse{Message: NoParcelMessage}, err
+		return eventResponse{Message: NoParcelMessage, Geocode: geocode}, err
 	}
 	parcelid := validationgraphResponse.Data.Parcels[0].ID
-	isValid := isValidPDWResponse(validationgraphResponse, eventData.Vintage)
+	validation := isValidPDWResponse(validationgraphResponse, minDate)
+	log.Infof(ctx, "parcel validation: %+v", validation)
 	// if structures doesnot exist
-	if !isValid {
+	if !validation.Valid {
 		// make callback if structures doesn't exist after ingestion
 		if eventData.Action == querydata {
 			err = error_handler.NewServiceError(error_codes.ErrorQueryingPDWAfterIngestion, "unable to query data after ingestion")
@@ -142,16 +263,15 @@ func handler(ctx context.Context, eventData eventData) (eventResponse, error) {
 			TriggerSIM: true,
 			Address:    eventData.Address.ParcelAddress,
 			Message:    NoStructureMessage,
+			Validation: &validation,
+			Geocode:    geocode,
 		}
 		return triggerSIMResponse, nil
 	} else {
-		gqlbytearray, err := ioutil.ReadFile(queryfilepath)
+		graphquery, err := readParcelDataQuery(ctx, []string{parcelid})
 		if err != nil {
-			log.Error(ctx, "Unable to read query file: ", err)
-			return eventResponse{}, error_handler.NewServiceError(error_codes.ErrorReadingQueryFile, err.Error())
+			return eventResponse{}, err
 		}
-		graphquery := string(gqlbytearray)
-		graphquery = fmt.Sprintf(graphquery, parcelid)
 		response, err = fetchDataFromPDW(ctx, graphquery)
 		if err != nil {
 			return eventResponse{}, err
@@ -163,16 +283,220 @@ func handler(ctx context.Context, eventData eventData) (eventResponse, error) {
 			return eventResponse{}, error_handler.NewServiceError(error_codes.ErrorDecodingServiceResponse, err.Error())
 		}
 		err = makeCallBack(ctx, success, "", eventData.CallbackID, eventData.CallbackURL, error_codes.Success, graphResponse["data"].(map[string]interface{}))
-		return eventResponse{Message: StructurePresentMessage}, err
+		return eventResponse{Message: StructurePresentMessage, Geocode: geocode}, err
 	}
 }
 
-func generateValidationQuery(eventData eventData) string {
+func generateValidationQuery(eventData eventData) (GraphQLQuery, error) {
+	return GenerateGQL(validationAttributes(), eventData.Address.Lat, eventData.Address.Long, eventData.ParcelID, eventData.Address.ParcelAddress, "")
+}
+
+// validationAttributes selects the marker and value of every fresh attribute along with the parcel location.
+func validationAttributes() []string {
 	commonattributelist := []string{"geocoder.lat", "geocoder.lon", "_input", "id"}
-	validationattributelist := []string{"_detectedBuildingCount.marker", "_detectedBuildingCount.value", `structures(type: "main").roof._countRoofFacets.marker`, `structures(type: "main").roof._countRoofFacets.value`}
-	validationattributelist = append(validationattributelist, commonattributelist...)
-	query := GenerateGQL(validationattributelist, eventData.Address.Lat, eventData.Address.Long, eventData.ParcelID, eventData.Address.ParcelAddress, "")
-	return query
+	validationattributelist := []string{}
+	for _, attribute := range freshAttributes {
+		validationattributelist = append(validationattributelist, attribute.Field+".marker", attribute.Field+".value")
+	}
+	return append(validationattributelist, commonattributelist...)
+}
+
+// handleBatch validates every item in one round trip, with a parcels list per kind of item, and sends a single
+// callback with the full data of the valid parcels.
+func handleBatch(ctx context.Context, eventData eventData, minDate markerDate) (eventResponse, error) {
+	if len(eventData.Items) > maxBatchItems {
+		return eventResponse{}, error_handler.NewServiceError(error_codes.InvalidPDWBatch, fmt.Sprintf("a batch holds at most %d items, got %d", maxBatchItems, len(eventData.Items)))
+	}
+	for i, item := range eventData.Items {
+		if item.empty() {
+			return eventResponse{}, error_handler.NewServiceError(error_codes.InvalidPDWBatch, fmt.Sprintf("batch item %d has no parcel id, address or point", i))
+		}
+	}
+	query, groups, err := generateBatchValidationQuery(eventData.Items)
+	if err != nil {
+		return eventResponse{}, err
+	}
+	log.Infof(ctx, "batch validation query generated for %d items...", len(eventData.Items))
+	response, err := fetchDataFromPDW(ctx, query)
+	if err != nil {
+		return eventResponse{}, err
+	}
+	var graphResponse struct {
+		Data map[string][]pdwParcel `json:"data"`
+	}
+	if err = json.Unmarshal(response, &graphResponse); err != nil {
+		log.Error(ctx, "Error while unmarshalling graphresponse, error: ", err.Error())
+		return eventResponse{}, error_handler.NewServiceError(error_codes.ErrorDecodingServiceResponse, err.Error())
+	}
+	results, summary := evaluateBatch(eventData.Items, groups, graphResponse.Data, minDate)
+	log.Infof(ctx, "batch validated, %d valid, %d not found, %d need SIM", summary.Valid, summary.NotFound, len(summary.TriggerSIM))
+
+	validIds := []string{}
+	seen := map[string]bool{}
+	for _, result := range results {
+		if result.Valid && !seen[result.ParcelID] {
+			seen[result.ParcelID] = true
+			validIds = append(validIds, result.ParcelID)
+		}
+	}
+	// structures still missing after ingestion fail the batch as they do a single lookup
+	if eventData.Action == querydata && len(summary.TriggerSIM) > 0 {
+		return eventResponse{}, error_handler.NewServiceError(error_codes.ErrorQueryingPDWAfterIngestion, "unable to query data after ingestion")
+	}
+	if len(validIds) > 0 && eventData.CallbackURL != "" {
+		graphquery, err := readParcelDataQuery(ctx, validIds)
+		if err != nil {
+			return eventResponse{}, err
+		}
+		response, err = fetchDataFromPDW(ctx, graphquery)
+		if err != nil {
+			return eventResponse{}, err
+		}
+		var dataResponse map[string]interface{}
+		if err = json.Unmarshal(response, &dataResponse); err != nil {
+			log.Error(ctx, "Error while unmarshalling graphresponse, error: ", err.Error())
+			return eventResponse{}, error_handler.NewServiceError(error_codes.ErrorDecodingServiceResponse, err.Error())
+		}
+		data, _ := dataResponse["data"].(map[string]interface{})
+		if err = makeCallBack(ctx, success, "", eventData.CallbackID, eventData.CallbackURL, error_codes.Success, data); err != nil {
+			return eventResponse{}, err
+		}
+	}
+	// nothing valid and nothing for SIM to ingest, fail the callback as a single lookup does
+	if len(validIds) == 0 && len(summary.TriggerSIM) == 0 && eventData.CallbackURL != "" {
+		log.Info(ctx, NoParcelMessage)
+		if err = makeCallBack(ctx, failure, NoParcelMessage, eventData.CallbackID, eventData.CallbackURL, error_codes.ParcelIDDoesnotExist, nil); err != nil {
+			return eventResponse{}, err
+		}
+	}
+	return eventResponse{TriggerSIM: len(summary.TriggerSIM) > 0, Items: results, Summary: &summary}, nil
+}
+
+// generateBatchValidationQuery looks the items up with one aliased parcels list per kind, parcel ids first, then
+// addresses and points.
+func generateBatchValidationQuery(items []batchItem) (GraphQLQuery, []batchGroup, error) {
+	builder := NewQueryBuilder("ValidateParcels")
+	ids, addresses, points := []string{}, []string{}, []string{}
+	groups := map[string]*batchGroup{byParcelID: {Alias: byParcelID}, byAddress: {Alias: byAddress}, byPoint: {Alias: byPoint}}
+	for i, item := range items {
+		switch {
+		case item.ParcelID != "":
+			ids = append(ids, item.ParcelID)
+			groups[byParcelID].Items = append(groups[byParcelID].Items, i)
+		case item.Address != "":
+			addresses = append(addresses, item.Address)
+			groups[byAddress].Items = append(groups[byAddress].Items, i)
+		default:
+			n := len(groups[byPoint].Items)
+			lat := builder.Variable(fmt.Sprintf("lat%d", n), coordinateType, item.Lat)
+			lon := builder.Variable(fmt.Sprintf("lon%d", n), coordinateType, item.Long)
+			points = append(points, fmt.Sprintf("{lat: %s, lon: %s}", lat, lon))
+			groups[byPoint].Items = append(groups[byPoint].Items, i)
+		}
+	}
+	lists := []QueryField{}
+	if len(ids) > 0 {
+		lists = append(lists, QueryField{Alias: byParcelID, Name: "parcels", Arguments: []QueryArgument{{Name: "ids", Value: builder.Variable("parcelIds", "["+parcelIdType+"]!", ids)}}})
+	}
+	if len(addresses) > 0 {
+		lists = append(lists, QueryField{Alias: byAddress, Name: "parcels", Arguments: []QueryArgument{{Name: "addresses", Value: builder.Variable("addresses", "["+addressType+"]!", addresses)}}})
+	}
+	if len(points) > 0 {
+		lists = append(lists, QueryField{Alias: byPoint, Name: "parcels", Arguments: []QueryArgument{{Name: "points", Value: "[" + strings.Join(points, ", ") + "]"}}})
+	}
+	ordered := []batchGroup{}
+	for _, list := range lists {
+		for _, attribute := range validationAttributes() {
+			if err := builder.AddAttribute(attribute, list); err != nil {
+				return GraphQLQuery{}, nil, error_handler.NewServiceError(error_codes.ErrorBuildingGraphQuery, err.Error())
+			}
+		}
+		ordered = append(ordered, *groups[list.Alias])
+	}
+	return builder.Build(), ordered, nil
+}
+
+// evaluateBatch pairs the parcels of each list with its items, by id for parcel ids and by the _input PDW echoes
+// otherwise, as PDW leaves out the inputs it finds no parcel for. Each parcel is checked with isValidPDWResponse.
+func evaluateBatch(items []batchItem, groups []batchGroup, lists map[string][]pdwParcel, minDate markerDate) ([]batchItemResult, batchSummary) {
+	results := make([]batchItemResult, len(items))
+	summary := batchSummary{Total: len(items), TriggerSIM: []int{}}
+	for _, group := range groups {
+		parcels := lists[group.Alias]
+		for _, i := range group.Items {
+			result := batchItemResult{batchItem: items[i], Message: NoParcelMessage}
+			var found *pdwParcel
+			if group.Alias == byParcelID {
+				for j := range parcels {
+					if parcels[j].ID == items[i].ParcelID {
+						found = &parcels[j]
+						break
+					}
+				}
+			} else {
+				for j := range parcels {
+					if parcels[j].ID != "" && items[i].matchesInput(parcels[j].Input) {
+						found = &parcels[j]
+						break
+					}
+				}
+			}
+			if found != nil {
+				var single pdwValidationResponse
+				single.Data.Parcels = []pdwParcel{*found}
+				result.Found = true
+				result.ParcelID = found.ID
+				validation := isValidPDWResponse(single, minDate)
+				result.Valid = validation.Valid
+				result.Validation = &validation
+				result.TriggerSIM = !result.Valid
+				result.Message = StructurePresentMessage
+				if !result.Valid {
+					result.Message = NoStructureMessage
+					if result.Lat == 0 && result.Long == 0 {
+						result.Lat, result.Long = found.GeoCoder.Lat, found.GeoCoder.Lon
+					}
+				}
+			}
+			results[i] = result
+		}
+	}
+	for i, result := range results {
+		switch {
+		case !result.Found:
+			summary.NotFound++
+		case result.Valid:
+			summary.Valid++
+		default:
+			summary.TriggerSIM = append(summary.TriggerSIM, i)
+		}
+	}
+	return results, summary
+}
+
+// matchesInput tells whether input, the _input of a parcel, is the address or the point of the item. Addresses are
+// compared ignoring case and spacing, points by their two coordinates in any notation.
+func (item batchItem) matchesInput(input string) bool {
+	if item.Address != "" {
+		return strings.EqualFold(strings.Join(strings.Fields(input), " "), strings.Join(strings.Fields(item.Address), " "))
+	}
+	coordinates := coordinatePattern.FindAllString(input, -1)
+	if len(coordinates) != 2 {
+		return false
+	}
+	lat, latErr := strconv.ParseFloat(coordinates[0], 64)
+	long, longErr := strconv.ParseFloat(coordinates[1], 64)
+	return latErr == nil && longErr == nil && math.Abs(lat-item.Lat) < pointTolerance && math.Abs(long-item.Long) < pointTolerance
+}
+
+// readParcelDataQuery reads the query file, which looks the parcels up from the $parcelIds variable.
+func readParcelDataQuery(ctx context.Context, parcelIds []string) (GraphQLQuery, error) {
+	gqlbytearray, err := ioutil.ReadFile(queryfilepath)
+	if err != nil {
+		log.Error(ctx, "Unable to read query file: ", err)
+		return GraphQLQuery{}, error_handler.NewServiceError(error_codes.ErrorReadingQueryFile, err.Error())
+	}
+	return GraphQLQuery{Text: string(gqlbytearray), Variables: map[string]interface{}{"parcelIds": parcelIds}}, nil
 }
 
 func populateData(ctx context.Context, req eventData, pdwResp pdwValidationResponse) eventData {
@@ -183,41 +507,364 @@ func populateData(ctx context.Context, req eventData, pdwResp pdwValidationRespo
 	return req
 }
 
-func getAddressFromLatLong(ctx context.Context, lat, long float64) (string, string, error) {
-	headers := make(map[string]string)
-	secretMap := commonHandler.Secrets
-	log.Info(ctx, "fetched secrets from secrets manager...")
-	clientID := secretMap["ClientID"].(string)
-	clientSecret := secretMap["ClientSecret"].(string)
-	err := auth_client.AddAuthorizationTokenHeader(ctx, commonHandler.HttpClient, headers, appCode, clientID, clientSecret)
+// Geocoder finds the address and parcel at a point.
+type Geocoder interface {
+	Name() string
+	ReverseGeocode(ctx context.Context, lat, long float64) (GeocodeResult, error)
+}
+
+// GeocodeResult is the address and parcel found at a point, Provider is the geocoder that answered and Cached
+// tells the result was read from the GeocodeCache collection instead of asked to it.
+type GeocodeResult struct {
+	Address  string `json:"address"`
+	ParcelID string `json:"parcelId"`
+	Provider string `json:"provider"`
+	Cached   bool   `json:"cached"`
+}
+
+// GeocoderProvider configures one reverse geocoding service of the chain. The URL is read from the URLEnv variable
+// when it is set. Auth is eagleview for a token of the auth service, apiKey for the APIKeySecret secret sent in the
+// APIKeyHeader header or, without it, in the APIKeyParam query parameter, and none. AddressField and ParcelIDField
+// are dotted paths into the JSON response, numeric segments index arrays.
+type GeocoderProvider struct {
+	Name          string            `json:"name"`
+	URL           string            `json:"url"`
+	URLEnv        string            `json:"urlEnv"`
+	Auth          string            `json:"auth"`
+	APIKeySecret  string            `json:"apiKeySecret"`
+	APIKeyHeader  string            `json:"apiKeyHeader"`
+	APIKeyParam   string            `json:"apiKeyParam"`
+	LatParam      string            `json:"latParam"`
+	LonParam      string            `json:"lonParam"`
+	Params        map[string]string `json:"params"`
+	AddressField  string            `json:"addressField"`
+	ParcelIDField string            `json:"parcelIdField"`
+}
+
+// httpGeocoder asks the service configured by provider.
+type httpGeocoder struct {
+	provider GeocoderProvider
+}
+
+// geocoderChain asks its geocoders in order until one finds the point.
+type geocoderChain []Geocoder
+
+// cachedGeocoder answers from the GeocodeCache collection, keyed by the coordinates rounded to precision decimals,
+// and caches what next answers for ttl, forever when ttl is 0.
+type cachedGeocoder struct {
+	next      Geocoder
+	precision int
+	ttl       time.Duration
+}
+
+// DefaultGeocoderProviders returns the EagleView geocoding service read from GeoCoderUrl.
+func DefaultGeocoderProviders() []GeocoderProvider {
+	return []GeocoderProvider{{
+		Name:          "EGS",
+		URLEnv:        GeoCoderUrl,
+		Auth:          geocoderAuthEagleView,
+		Params:        map[string]string{"parcelID": "true"},
+		AddressField:  "address",
+		ParcelIDField: "parcelID",
+	}}
+}
+
+// NewGeocoder chains providers in order behind the DocumentDB cache.
+func NewGeocoder(providers []GeocoderProvider, precision int, ttl time.Duration) Geocoder {
+	chain := geocoderChain{}
+	for _, provider := range providers {
+		chain = append(chain, httpGeocoder{provider: provider})
+	}
+	return cachedGeocoder{next: chain, precision: precision, ttl: ttl}
+}
+
+// LoadGeocoder builds the geocoder from the GeocoderProviders JSON list, or from the default providers without it.
+// GeocodeCachePrecision and GeocodeCacheDays override the rounding of the cache key and how long results are kept.
+func LoadGeocoder() (Geocoder, error) {
+	providers := DefaultGeocoderProviders()
+	data, found, err := geocodersSource.Read(context.Background(), nil)
 	if err != nil {
-		log.Error(ctx, "Error while adding token to header, error: ", err.Error())
-		return "", "", err
+		return nil, err
 	}
-	geoCoderUrl := os.Getenv("GeoCoderUrl")
-	url := fmt.Sprintf("%s?lat=%v&lon=%v&parcelID=true", geoCoderUrl, lat, long)
-	resp, err := commonHandler.HttpClient.Get(ctx, url, headers)
+	if found {
+		providers = []GeocoderProvider{}
+		if err = json.Unmarshal(data, &providers); err != nil {
+			return nil, error_handler.NewServiceError(geocodersSource.Code, "invalid geocoder providers: "+err.Error())
+		}
+	}
+	problems := validateGeocoderProviders(providers)
+	precision, err := intFromEnv(GeocodeCachePrecision, defaultGeocodePrecision)
+	if err != nil || precision < 0 || precision > maxGeocodePrecision {
+		problems.Add("%s should be a number of decimals between 0 and %d", GeocodeCachePrecision, maxGeocodePrecision)
+	}
+	days, err := intFromEnv(GeocodeCacheDays, defaultGeocodeCacheDays)
+	if err != nil || days < 0 {
+		problems.Add("%s should be a positive number of days, or 0 to keep results forever", GeocodeCacheDays)
+	}
+	if err = problems.Err("geocoder providers"); err != nil {
+		return nil, error_handler.NewServiceError(geocodersSource.Code, err.Error())
+	}
+	return NewGeocoder(providers, precision, time.Duration(days)*24*time.Hour), nil
+}
+
+func validateGeocoderProviders(providers []GeocoderProvider) config_loader.Problems {
+	problems := config_loader.Problems{}
+	if len(providers) == 0 {
+		problems.Add("no provider is configured")
+	}
+	names := map[string]bool{}
+	for i, provider := range providers {
+		name := provider.Name
+		if name == "" {
+			name = fmt.Sprintf("provider %d", i+1)
+			problems.Add("%s has no name", name)
+		} else if names[name] {
+			problems.Add("%s is listed several times", name)
+		}
+		names[name] = true
+		if provider.URL == "" && provider.URLEnv == "" {
+			problems.Add("%s has no url", name)
+		}
+		switch provider.Auth {
+		case geocoderAuthEagleView, geocoderAuthNone:
+		case geocoderAuthAPIKey:
+			if provider.APIKeySecret == "" {
+				problems.Add("%s has no api key secret", name)
+			}
+		default:
+			problems.Add("%s has unsupported auth %s", name, provider.Auth)
+		}
+		if provider.AddressField == "" {
+			problems.Add("%s has no address field", name)
+		}
+		for _, field := range []string{provider.AddressField, provider.ParcelIDField} {
+			if field != "" && strings.Contains("."+field+".", "..") {
+				problems.Add("%s has malformed field %s", name, field)
+			}
+		}
+	}
+	return problems
+}
+
+func intFromEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func (geocoder httpGeocoder) Name() string {
+	return geocoder.provider.Name
+}
+
+// ReverseGeocode calls the provider. A 500 or 503 response is retriable, any other non 2xx response is not.
+func (geocoder httpGeocoder) ReverseGeocode(ctx context.Context, lat, long float64) (GeocodeResult, error) {
+	provider := geocoder.provider
+	headers := make(map[string]string)
+	query := url.Values{}
+	for name, value := range provider.Params {
+		query.Set(name, value)
+	}
+	query.Set(withDefault(provider.LatParam, "lat"), fmt.Sprint(lat))
+	query.Set(withDefault(provider.LonParam, "lon"), fmt.Sprint(long))
+	switch provider.Auth {
+	case geocoderAuthEagleView:
+		secretMap := commonHandler.Secrets
+		clientID, _ := secretMap["ClientID"].(string)
+		clientSecret, _ := secretMap["ClientSecret"].(string)
+		err := auth_client.AddAuthorizationTokenHeader(ctx, commonHandler.HttpClient, headers, appCode, clientID, clientSecret)
+		if err != nil {
+			log.Error(ctx, "Error while adding token to header, error: ", err.Error())
+			return GeocodeResult{}, err
+		}
+	case geocoderAuthAPIKey:
+		apiKey, _ := commonHandler.Secrets[provider.APIKeySecret].(string)
+		if apiKey == "" {
+			return GeocodeResult{}, error_handler.NewServiceError(error_codes.ErrorFetchingSecretsFromSecretManager, "missing secret "+provider.APIKeySecret+" of "+provider.Name)
+		}
+		if provider.APIKeyHeader != "" {
+			headers[provider.APIKeyHeader] = apiKey
+		} else {
+			query.Set(withDefault(provider.APIKeyParam, "key"), apiKey)
+		}
+	}
+	endpoint := provider.URL
+	if provider.URLEnv != "" {
+		endpoint = os.Getenv(provider.URLEnv)
+	}
+	resp, err := commonHandler.HttpClient.Get(ctx, endpoint+"?"+query.Encode(), headers)
 	if err != nil {
 		log.Error(ctx, "error in http get call", err.Error())
-		return "", "", error_handler.NewServiceError(error_codes.ErrorMakingGetCall, "error calling EGS : "+err.Error())
+		return GeocodeResult{}, error_handler.NewServiceError(error_codes.ErrorMakingGetCall, "error calling "+provider.Name+" : "+err.Error())
 	}
 	if resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == http.StatusServiceUnavailable {
-		return "", "", error_handler.NewRetriableError(error_codes.ReceivedInternalServerError, fmt.Sprintf("%d status code received", resp.StatusCode))
+		return GeocodeResult{}, error_handler.NewRetriableError(error_codes.ReceivedInternalServerError, fmt.Sprintf("%d status code received", resp.StatusCode))
 	}
 	if !strings.HasPrefix(strconv.Itoa(resp.StatusCode), "20") {
 		log.Error(ctx, "invalid http status code received, statusCode: ", resp.StatusCode)
-		return "", "", error_handler.NewServiceError(error_codes.ReceivedInvalidHTTPStatusCode, "received invalid http status code: "+strconv.Itoa(resp.StatusCode))
+		return GeocodeResult{}, error_handler.NewServiceError(error_codes.ReceivedInvalidHTTPStatusCode, "received invalid http status code: "+strconv.Itoa(resp.StatusCode))
 	}
-	respBody := geocoderResponse{}
+	var respBody interface{}
 	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err = decoder.Decode(&respBody); err != nil {
+		return GeocodeResult{}, error_handler.NewServiceError(error_codes.ErrorDecodingServiceResponse, "geocoding error "+err.Error())
+	}
+	return GeocodeResult{
+		Address:  responseField(respBody, provider.AddressField),
+		ParcelID: responseField(respBody, provider.ParcelIDField),
+		Provider: provider.Name,
+	}, nil
+}
+
+// responseField reads the value at the dotted path of a decoded JSON response, an empty string when it is missing.
+func responseField(document interface{}, path string) string {
+	value, _ := field_path.Lookup(document, path)
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case json.Number:
+		return typed.String()
+	case bool:
+		return strconv.FormatBool(typed)
+	}
+	return ""
+}
+
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func (chain geocoderChain) Name() string {
+	names := []string{}
+	for _, geocoder := range chain {
+		names = append(names, geocoder.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// ReverseGeocode returns the first result with an address or a parcel. When every geocoder fails the error of the
+// last one is returned, unless one of them failed with a retriable error so the task gets retried.
+func (chain geocoderChain) ReverseGeocode(ctx context.Context, lat, long float64) (GeocodeResult, error) {
+	var lastErr, retriableErr error
+	for _, geocoder := range chain {
+		result, err := geocoder.ReverseGeocode(ctx, lat, long)
+		if err != nil {
+			log.Errorf(ctx, "geocoder %s failed: %v", geocoder.Name(), err)
+			if _, ok := err.(*error_handler.RetriableError); ok && retriableErr == nil {
+				retriableErr = err
+			}
+			lastErr = err
+			continue
+		}
+		if result.Address != "" || result.ParcelID != "" {
+			return result, nil
+		}
+		log.Infof(ctx, "geocoder %s found nothing at %v,%v", geocoder.Name(), lat, long)
+	}
+	if retriableErr != nil {
+		return GeocodeResult{}, retriableErr
+	}
+	if lastErr != nil {
+		return GeocodeResult{}, lastErr
+	}
+	return GeocodeResult{}, nil
+}
+
+func (cache cachedGeocoder) Name() string {
+	return cache.next.Name()
+}
+
+// geocodeCacheDB connects to DocumentDB the first time the cache is used. A failed connection is logged and leaves
+// the cache off until the next cold start, the geocoders are then asked directly.
+type geocodeCacheDB struct {
+	once    sync.Once
+	connect func(ctx context.Context) (documentDB_client.IDocDBClient, error)
+}
+
+// client returns the DocumentDB client of the common handler, connected on first use, or nil without one.
+func (db *geocodeCacheDB) client(ctx context.Context) documentDB_client.IDocDBClient {
+	db.once.Do(func() {
+		if commonHandler.DBClient != nil || db.connect == nil {
+			return
+		}
+		client, err := db.connect(ctx)
+		if err != nil {
+			log.Errorf(ctx, "Failed to connect to the geocode cache, geocoding without it: %v", err)
+			return
+		}
+		commonHandler.DBClient = client
+	})
+	return commonHandler.DBClient
+}
+
+// connectDocumentDB connects with the DB settings of the secrets and the environment.
+func connectDocumentDB(ctx context.Context) (documentDB_client.IDocDBClient, error) {
+	config, err := documentDB_client.LoadDBConfig(commonHandler.Secrets)
 	if err != nil {
-		return "", "", error_handler.NewServiceError(error_codes.ErrorDecodingServiceResponse, "geocoding error "+err.Error())
+		return nil, err
 	}
-	return respBody.Address, respBody.ParcelId, nil
+	client, err := documentDB_client.NewDBClientService(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, config.ConnectTimeout)
+	defer cancel()
+	if err = client.CheckConnection(checkCtx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// ReverseGeocode looks the point up in the cache before asking the next geocoder. The cache is skipped without a
+// DocumentDB client and its failures are only logged, so they never fail the workflow.
+func (cache cachedGeocoder) ReverseGeocode(ctx context.Context, lat, long float64) (GeocodeResult, error) {
+	db := geocodeCache.client(ctx)
+	if db == nil {
+		return cache.next.ReverseGeocode(ctx, lat, long)
+	}
+	location := geocodeLocation(lat, long, cache.precision)
+	cached, err := db.FetchGeocode(ctx, location)
+	if err == nil {
+		log.Infof(ctx, "geocode of %s found in cache", location)
+		return GeocodeResult{Address: cached.Address, ParcelID: cached.ParcelId, Provider: cached.Provider, Cached: true}, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Errorf(ctx, "Failed to read the geocode cache: %v", err)
+	}
+	result, err := cache.next.ReverseGeocode(ctx, lat, long)
+	if err != nil || (result.Address == "" && result.ParcelID == "") {
+		return result, err
+	}
+	now := time.Now()
+	entry := documentDB_client.GeocodeCacheBody{
+		Location:  location,
+		Address:   result.Address,
+		ParcelId:  result.ParcelID,
+		Provider:  result.Provider,
+		CreatedAt: now.Unix(),
+	}
+	if cache.ttl > 0 {
+		expireAt := now.Add(cache.ttl)
+		entry.ExpireAt = &expireAt
+	}
+	if err := db.SaveGeocode(ctx, entry); err != nil {
+		log.Errorf(ctx, "Failed to cache the geocode of %s: %v", location, err)
+	}
+	return result, nil
+}
+
+// geocodeLocation is the cache key of a point, 5 decimals group points about a meter apart.
+func geocodeLocation(lat, long float64, precision int) string {
+	return strconv.FormatFloat(lat, 'f', precision, 64) + "," + strconv.FormatFloat(long, 'f', precision, 64)
 }
 
-func fetchDataFromPDW(ctx context.Context, query string) ([]byte, error) {
+func fetchDataFromPDW(ctx context.Context, query GraphQLQuery) ([]byte, error) {
 	headers := make(map[string]string)
 	headers["Content-Type"] = "application/json"
 	secretMap := commonHandler.Secrets
@@ -231,7 +878,8 @@ func fetchDataFromPDW(ctx context.Context, query string) ([]byte, error) {
 	}
 	log.Info(ctx, "added authtoken to headers...")
 	graphrequest := map[string]interface{}{
-		"query": query,
+		"query":     query.Text,
+		"variables": query.Variables,
 	}
 	bytearray, err := json.Marshal(graphrequest)
 	if err != nil {
@@ -295,89 +943,163 @@ func makeCallBack(ctx context.Context, status, message, callbackId, callbackUrl
 	return nil
 }
 
-func isValidPDWResponse(pdwResponse pdwValidationResponse, minDate string) bool {
-	if pdwResponse.Data.Parcels[0].DetectedBuildingCount.Value == nil {
-		return false
+// isValidPDWResponse checks that the parcel holds every fresh attribute with a marker not older than minDate, a
+// zero minDate only requires the markers to be set.
+func isValidPDWResponse(pdwResponse pdwValidationResponse, minDate markerDate) freshnessResult {
+	result := freshnessResult{Missing: []string{}, Stale: []string{}}
+	document := pdwResponse.Data.Parcels[0].fields
+	for _, attribute := range freshAttributes {
+		values := attributeValues(document, attribute.Field)
+		if len(values) == 0 {
+			result.Missing = append(result.Missing, attribute.Name)
+			continue
+		}
+		missing, stale := false, false
+		for _, value := range values {
+			object, ok := value.(map[string]interface{})
+			if !ok || object["value"] == nil {
+				missing = true
+				continue
+			}
+			marker, ok := parseMarker(object["marker"])
+			stale = stale || !ok || marker.before(minDate)
+		}
+		if missing {
+			result.Missing = append(result.Missing, attribute.Name)
+		} else if stale {
+			result.Stale = append(result.Stale, attribute.Name)
+		}
 	}
-	marker := pdwResponse.Data.Parcels[0].DetectedBuildingCount.Marker
-	if marker == "" || (minDate != "" && marker < minDate) {
-		return false
+	result.Valid = len(result.Missing) == 0 && len(result.Stale) == 0
+	return result
+}
+
+// attributeValues returns the objects found at field, one per element of the lists met on the way. A segment is
+// read from the response under its alias when it has one.
+func attributeValues(document map[string]interface{}, field string) []interface{} {
+	keys := []string{}
+	for _, segment := range splitOutside(field, '.') {
+		queryField, err := parseQueryField(segment)
+		if err != nil {
+			return nil
+		}
+		key := queryField.Name
+		if queryField.Alias != "" {
+			key = queryField.Alias
+		}
+		keys = append(keys, key)
+	}
+	values := []interface{}{}
+	for _, value := range field_path.Keys(keys...).Values(document) {
+		if list, ok := value.([]interface{}); ok {
+			values = append(values, list...)
+		} else {
+			values = append(values, value)
+		}
+	}
+	found := []interface{}{}
+	for _, value := range values {
+		if value != nil {
+			found = append(found, value)
+		}
 	}
+	return found
+}
+
+// markerDate is a parsed marker or vintage, DateOnly when it was written without a time of day.
+type markerDate struct {
+	time.Time
+	DateOnly bool
+}
 
-	if len(pdwResponse.Data.Parcels[0].Structures) == 0 {
+// before tells whether the marker is older than minDate, on the day when either of them is a date only so a
+// timestamp later on the day of a date is not older than it. A zero minDate is older than any marker.
+func (marker markerDate) before(minDate markerDate) bool {
+	if minDate.IsZero() {
 		return false
 	}
+	if marker.DateOnly || minDate.DateOnly {
+		return day(marker.Time).Before(day(minDate.Time))
+	}
+	return marker.Before(minDate.Time)
+}
 
-	countRoofFacetsObj := pdwResponse.Data.Parcels[0].Structures[0].Roof["_countRoofFacets"]
-	if countRoofFacetsObj == nil {
-		return false
+func day(date time.Time) time.Time {
+	year, month, dayOfMonth := date.Date()
+	return time.Date(year, month, dayOfMonth, 0, 0, 0, 0, time.UTC)
+}
+
+// parseMarker reads a marker written as a date or a timestamp, in any of the layouts PDW sources use.
+func parseMarker(marker interface{}) (markerDate, bool) {
+	text, ok := marker.(string)
+	if !ok || text == "" {
+		return markerDate{}, false
 	}
-	if countRoofFacetsObj.(map[string]interface{})["value"] == nil {
-		return false
+	for _, layout := range markerLayouts {
+		if date, err := time.Parse(layout, text); err == nil {
+			return markerDate{Time: date}, true
+		}
 	}
-	facetCountmarker := countRoofFacetsObj.(map[string]interface{})["marker"].(string)
-	if facetCountmarker == "" || (minDate != "" && facetCountmarker < minDate) {
-		return false
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, text); err == nil {
+			return markerDate{Time: date, DateOnly: true}, true
+		}
 	}
-	return true
+	return markerDate{}, false
 }
 
-func GenerateGQL(attributes []string, lat, long float64, parcelID, address, structureType string) string {
-	topnode := ""
-	if parcelID != "" {
-		topnode = fmt.Sprintf(`parcels(ids: ["%s"])`, parcelID)
-	} else if address != "" {
-		topnode = fmt.Sprintf(`parcels(addresses: ["%s"])`, address)
-	} else {
-		topnode = fmt.Sprintf(`parcels(points:[{lat:%f,lon:%f}])`, lat, long)
-	}
-	parentChildAttributesMap := make(map[string][]string)
-	for _, attr := range attributes {
-		allattr := strings.Split(attr, ".")
-		l := len(allattr)
-		parentChildAttributesMap = inserttomap(parentChildAttributesMap, topnode, allattr[0])
-		for i := range allattr {
-			if i == l-1 {
-				continue
-			}
-			parentChildAttributesMap = inserttomap(parentChildAttributesMap, allattr[i], allattr[i+1])
-		}
+// parseVintage reads the minimum date of the markers, no vintage requires none. A vintage that is not a date is
+// rejected rather than checking the markers without a minimum date.
+func parseVintage(vintage string) (markerDate, error) {
+	if vintage == "" {
+		return markerDate{}, nil
 	}
-	query := "{ " + generatequery(parentChildAttributesMap, topnode) + " }"
-	return query
+	minDate, ok := parseMarker(vintage)
+	if !ok {
+		return markerDate{}, error_handler.NewServiceError(error_codes.InvalidVintage, "vintage "+vintage+" is not a date")
+	}
+	return minDate, nil
 }
 
-func generatequery(parentChildAttributesMap map[string][]string, node string) string {
-	var graphql string
-	if len(parentChildAttributesMap[node]) == 0 {
-		graphql = node
-	} else {
-		for i := range parentChildAttributesMap[node] {
-			graphql = graphql + "\n" + generatequery(parentChildAttributesMap, parentChildAttributesMap[node][i])
-		}
-		graphql = node + "{ " + graphql + " }"
+// DefaultFreshAttributes requires the building count and the roof facet count of the main structure.
+func DefaultFreshAttributes() FreshAttributes {
+	return FreshAttributes{
+		{Name: "buildingCount", Field: "_detectedBuildingCount"},
+		{Name: "roofFacets", Field: `structures(type: "main").roof._countRoofFacets`},
 	}
-	return graphql
 }
 
-func inserttomap(parentChildAttributesMap map[string][]string, key, value string) map[string][]string {
-	if _, ok := parentChildAttributesMap[key]; ok {
-		if !contains(parentChildAttributesMap[key], value) {
-			parentChildAttributesMap[key] = append(parentChildAttributesMap[key], value)
-		}
-	} else {
-		parentChildAttributesMap[key] = []string{value}
+// LoadFreshAttributes reads the FreshAttributes JSON list, or returns the default attributes without it.
+func LoadFreshAttributes() (FreshAttributes, error) {
+	loaded := FreshAttributes{}
+	found, err := freshAttributesSource.Decode(context.Background(), nil, &loaded)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return DefaultFreshAttributes(), nil
 	}
-	return parentChildAttributesMap
+	return loaded, nil
 }
 
-func contains(myarray []string, checkval string) bool {
-	for _, value := range myarray {
-		if value == checkval {
-			return true
+// Validate reports every problem of the attributes.
+func (attributes FreshAttributes) Validate() error {
+	problems := config_loader.Problems{}
+	names := map[string]bool{}
+	for i, attribute := range attributes {
+		name := attribute.Name
+		if name == "" {
+			name = fmt.Sprintf("attribute %d", i+1)
+			problems.Add("%s has no name", name)
+		} else if names[name] {
+			problems.Add("%s is listed several times", name)
+		}
+		names[name] = true
+		if err := NewQueryBuilder("Check").AddAttribute(attribute.Field + ".marker"); err != nil {
+			problems.Add("%s has %v", name, err)
 		}
 	}
-	return false
+	return problems.Err("fresh attributes")
 }
 
 func notificationWrapper(ctx context.Context, req eventData) (eventResponse, error) {
@@ -391,7 +1113,23 @@ func notificationWrapper(ctx context.Context, req eventData) (eventResponse, err
 
 func main() {
 	log_config.InitLogging("info")
-	commonHandler = common_handler.New(true, true, false, true, true)
+	var err error
+	commonHandler, err = common_handler.New(true, true, false, true, true)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	geocodeCache.connect = connectDocumentDB
+	freshAttributes, err = LoadFreshAttributes()
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	geocoder, err = LoadGeocoder()
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	httpservice.ConfigureHTTPClient(&httpservice.HTTPClientConfiguration{
 		// APITimeout: 90,
 	})
@@ -5,12 +5,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
@@ -42,6 +46,10 @@ var (
 	  }`)
 )
 
+func validation(missing, stale []string) *freshnessResult {
+	return &freshnessResult{Valid: len(missing) == 0 && len(stale) == 0, Missing: missing, Stale: stale}
+}
+
 func TestHandlerTriggerSIM(t *testing.T) {
 
 	var eventDataReq eventData
@@ -98,6 +106,7 @@ func TestHandlerTriggerSIM(t *testing.T) {
 		TriggerSIM: true,
 		ParcelID:   "9a3a3f3b-8ba1-468b-8102-3b3e6ee5d8c1",
 		Message:    NoStructureMessage,
+		Validation: validation([]string{"roofFacets"}, []string{"buildingCount"}),
 	}
 	resp, err := notificationWrapper(context.Background(), eventDataReq)
 	assert.NoError(t, err)
@@ -154,6 +163,7 @@ func TestHandlerTriggerSIM3NoStructures(t *testing.T) {
 		TriggerSIM: true,
 		ParcelID:   "9a3a3f3b-8ba1-468b-8102-3b3e6ee5d8c1",
 		Message:    NoStructureMessage,
+		Validation: validation([]string{"roofFacets"}, []string{}),
 	}
 	resp, err := notificationWrapper(context.Background(), eventDataReq)
 	assert.NoError(t, err)
@@ -295,6 +305,12 @@ func TestHandlerTriggerSIM2(t *testing.T) {
 		TriggerSIM: true,
 		ParcelID:   "9a3a3f3b-8ba1-468b-8102-3b3e6ee5d8c1",
 		Message:    NoStructureMessage,
+		Validation: validation([]string{"roofFacets"}, []string{"buildingCount"}),
+		Geocode: &GeocodeResult{
+			Address:  "31 Havenshire Rd, Rochester, NY 14625, United States",
+			ParcelID: "c7a80489-1693-427e-b1df-869cf985e063",
+			Provider: "EGS",
+		},
 	}
 	resp, err := notificationWrapper(context.Background(), eventDataReq)
 	assert.NoError(t, err)
@@ -586,7 +602,7 @@ func TestHandlerStructureExists(t *testing.T) {
 	commonHandler.Secrets = map[string]interface{}{
 		"ClientID":     "id",
 		"ClientSecret": "secret"}
-	expectedResp := eventResponse{Address: "23 HAVENSHIRE RD, ROCHESTER, NY, 14625", Latitude: 43.172988, Longitude: -77.501957, ParcelID: "9a3a3f3b-8ba1-468b-8102-3b3e6ee5d8c1", TriggerSIM: true, Message: "Structures does not exist in the graph response"}
+	expectedResp := eventResponse{Address: "23 HAVENSHIRE RD, ROCHESTER, NY, 14625", Latitude: 43.172988, Longitude: -77.501957, ParcelID: "9a3a3f3b-8ba1-468b-8102-3b3e6ee5d8c1", TriggerSIM: true, Message: "Structures does not exist in the graph response", Validation: validation([]string{"roofFacets"}, []string{})}
 	resp, err := notificationWrapper(context.Background(), eventDataReq)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedResp, resp)
@@ -714,7 +730,7 @@ func TestFetchPDWDataError(t *testing.T) {
 	mock_auth_client := new(mocks.AuthTokenInterface)
 	mock_auth_client.Mock.On("AddAuthorizationTokenHeader", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	auth_client = mock_auth_client
-	_, err := fetchDataFromPDW(context.Background(), "")
+	_, err := fetchDataFromPDW(context.Background(), GraphQLQuery{})
 	assert.Error(t, err)
 }
 
@@ -735,6 +751,428 @@ func TestFetchPDWDataErrorAddingTokenToHeaders(t *testing.T) {
 	mock_auth_client := new(mocks.AuthTokenInterface)
 	mock_auth_client.Mock.On("AddAuthorizationTokenHeader", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("some error"))
 	auth_client = mock_auth_client
-	_, err := fetchDataFromPDW(context.Background(), "")
+	_, err := fetchDataFromPDW(context.Background(), GraphQLQuery{})
 	assert.Error(t, err)
 }
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the GraphQL queries")
+
+// assertGolden compares the query with testdata/<name>.golden, the query text followed by its variables.
+func assertGolden(t *testing.T, name string, query GraphQLQuery) {
+	variables, err := json.MarshalIndent(query.Variables, "", "  ")
+	assert.NoError(t, err)
+	actual := query.Text + "\nvariables: " + string(variables) + "\n"
+	golden := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		assert.NoError(t, ioutil.WriteFile(golden, []byte(actual), 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), actual)
+}
+
+func TestGenerateValidationQueryGolden(t *testing.T) {
+	tests := map[string]eventData{
+		"validation_by_parcel_id": {ParcelID: "9a3a3f3b-8ba1-468b-8102-3b3e6ee5d8c1"},
+		"validation_by_address": {Address: struct {
+			ParcelAddress string  `json:"parcelAddress"`
+			Lat           float64 `json:"lat"`
+			Long          float64 `json:"long"`
+		}{ParcelAddress: `23 "HAVENSHIRE" RD"]) { id } }, ROCHESTER, NY \ 14625`}},
+		"validation_by_point": {Address: struct {
+			ParcelAddress string  `json:"parcelAddress"`
+			Lat           float64 `json:"lat"`
+			Long          float64 `json:"long"`
+		}{Lat: 43.172988, Long: -77.501957}},
+	}
+	for name, event := range tests {
+		t.Run(name, func(t *testing.T) {
+			query, err := generateValidationQuery(event)
+			assert.NoError(t, err)
+			assertGolden(t, name, query)
+		})
+	}
+}
+
+func TestQueryBuilderAliasesAndNestedArgumentsGolden(t *testing.T) {
+	builder := NewQueryBuilder("StructureDetails")
+	parcels := QueryField{Name: "parcels", Arguments: []QueryArgument{{Name: "ids", Value: builder.Variable("ids", "[ID!]!", []string{"p-1", "p-2"})}}}
+	garageType := builder.Variable("garageType", "String!", "garage")
+	for _, attribute := range []string{
+		`id`,
+		`main:structures(type: "main").roof._countRoofFacets.value`,
+		`main:structures(type: "main").roof._countRoofFacets.marker`,
+		`garages:structures(type: ` + garageType + `, first: 2).id`,
+		`pools(filter: {covered: false, kinds: ["inground", "above"]})._outline.value`,
+	} {
+		assert.NoError(t, builder.AddAttribute(attribute, parcels))
+	}
+	builder.AddPath(parcels, QueryField{Alias: "outlines", Name: "structures", Arguments: []QueryArgument{{Name: "since", Value: builder.Variable("since", "Date", "2020-12-13")}}}, QueryField{Name: "_outline"}, QueryField{Name: "marker"})
+	assertGolden(t, "builder_aliases_and_arguments", builder.Build())
+}
+
+func TestGenerateGQLRejectsMalformedAttributes(t *testing.T) {
+	for _, attribute := range []string{`structures(type: "main".roof`, `roof..value`, `main:2structures.id`, `structures(type).id`} {
+		_, err := GenerateGQL([]string{attribute}, 0, 0, "p-1", "", "")
+		assert.Error(t, err, attribute)
+		assert.Equal(t, error_codes.ErrorBuildingGraphQuery, err.(error_handler.ICodedError).GetErrorCode(), attribute)
+	}
+}
+
+var batchItems = []batchItem{
+	{ParcelID: "p-1"},
+	{Address: `1 "MAIN" ST`},
+	{Lat: 43.1, Long: -77.5},
+	{ParcelID: "p-missing"},
+}
+
+func TestGenerateBatchValidationQueryGolden(t *testing.T) {
+	query, groups, err := generateBatchValidationQuery(batchItems)
+	assert.NoError(t, err)
+	assert.Equal(t, []batchGroup{{Alias: byParcelID, Items: []int{0, 3}}, {Alias: byAddress, Items: []int{1}}, {Alias: byPoint, Items: []int{2}}}, groups)
+	assertGolden(t, "batch_validation", query)
+}
+
+func TestHandlerBatch(t *testing.T) {
+	aws_Client := new(mocks.IAWSClient)
+	http_Client := new(mocks.MockHTTPClient)
+	mock_auth_client := new(mocks.AuthTokenInterface)
+	mock_auth_client.Mock.On("AddAuthorizationTokenHeader", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	auth_client = mock_auth_client
+	http_Client.Mock.On("Post").Return(&http.Response{
+		Body: ioutil.NopCloser(bytes.NewBufferString(`{
+			"data": {
+				"byParcelId": [{
+					"id": "p-1",
+					"_detectedBuildingCount": {"marker": "2021-08-29", "value": 1},
+					"structures": [{"id": "s-1", "roof": {"_countRoofFacets": {"marker": "2021-08-29", "value": 4}}}]
+				}],
+				"byAddress": [{
+					"id": "p-2",
+					"_input": "1 \"MAIN\" ST",
+					"_detectedBuildingCount": {"marker": "2021-08-29", "value": 1},
+					"structures": [],
+					"geocoder": {"lat": 43.2, "lon": -77.6}
+				}],
+				"byPoint": []
+			}
+		}`)),
+		StatusCode: http.StatusOK,
+	}, nil).Once()
+	http_Client.Mock.On("Post").Return(&http.Response{
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"data": {"parcels": [{"id": "p-1"}]}}`)),
+		StatusCode: http.StatusOK,
+	}, nil).Once()
+	aws_Client.On("InvokeLambda", mock.Anything, "arn:callback", map[string]interface{}{
+		"callbackId":  "batch",
+		"status":      success,
+		"message":     "",
+		"messageCode": error_codes.Success,
+		"response":    map[string]interface{}{"data": map[string]interface{}{"parcels": []interface{}{map[string]interface{}{"id": "p-1"}}}},
+	}, false).Return(nil, nil)
+	commonHandler.AwsClient = aws_Client
+	commonHandler.HttpClient = http_Client
+	commonHandler.Secrets = map[string]interface{}{
+		"ClientID":     "id",
+		"ClientSecret": "secret"}
+
+	resp, err := notificationWrapper(context.Background(), eventData{Vintage: "2020-12-13", Action: validatedata, CallbackID: "batch", CallbackURL: "arn:callback", Items: batchItems})
+	assert.NoError(t, err)
+	assert.True(t, resp.TriggerSIM)
+	assert.Equal(t, []batchItemResult{
+		{batchItem: batchItem{ParcelID: "p-1"}, Found: true, Valid: true, Message: StructurePresentMessage, Validation: validation([]string{}, []string{})},
+		{batchItem: batchItem{ParcelID: "p-2", Address: `1 "MAIN" ST`, Lat: 43.2, Long: -77.6}, Found: true, TriggerSIM: true, Message: NoStructureMessage, Validation: validation([]string{"roofFacets"}, []string{})},
+		{batchItem: batchItem{Lat: 43.1, Long: -77.5}, Message: NoParcelMessage},
+		{batchItem: batchItem{ParcelID: "p-missing"}, Message: NoParcelMessage},
+	}, resp.Items)
+	assert.Equal(t, &batchSummary{Total: 4, Valid: 1, NotFound: 2, TriggerSIM: []int{1}}, resp.Summary)
+	aws_Client.AssertExpectations(t)
+}
+
+func TestEvaluateBatchMatchesItemsOnInput(t *testing.T) {
+	items := []batchItem{
+		{Address: "1 MAIN ST"},
+		{Address: "2 UNKNOWN RD"},
+		{Address: "3 Elm  St"},
+		{Lat: 43.1, Long: -77.5},
+		{Lat: 10, Long: 10},
+		{Lat: 43.2, Long: -77.6},
+	}
+	groups := []batchGroup{{Alias: byAddress, Items: []int{0, 1, 2}}, {Alias: byPoint, Items: []int{3, 4, 5}}}
+	parcel := func(id, input string) pdwParcel {
+		found := pdwParcel{ID: id, Input: input}
+		found.GeoCoder.Lat, found.GeoCoder.Lon = 1, 2
+		return found
+	}
+	lists := map[string][]pdwParcel{
+		byAddress: {parcel("p-3", "3 ELM ST"), parcel("p-1", "1 Main St")},
+		byPoint:   {parcel("p-6", "43.2,-77.6"), parcel("p-4", "{lat: 43.1, lon: -77.5}")},
+	}
+
+	results, summary := evaluateBatch(items, groups, lists, markerDate{})
+	parcelIDs := []string{}
+	for _, result := range results {
+		parcelIDs = append(parcelIDs, result.ParcelID)
+	}
+	assert.Equal(t, []string{"p-1", "", "p-3", "p-4", "", "p-6"}, parcelIDs)
+	assert.Equal(t, 2, summary.NotFound)
+	assert.Equal(t, NoParcelMessage, results[1].Message)
+	assert.Equal(t, batchItem{Lat: 10, Long: 10}, results[4].batchItem)
+}
+
+func TestHandlerBatchTooLarge(t *testing.T) {
+	slackClient := new(mocks.ISlackClient)
+	slackClient.On("SendErrorMessage", error_codes.InvalidPDWBatch, "", "", "querypdw", "querypdw", mock.Anything, mock.Anything).Return(nil)
+	commonHandler.SlackClient = slackClient
+	_, err := notificationWrapper(context.Background(), eventData{Items: make([]batchItem, maxBatchItems+1)})
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.InvalidPDWBatch, err.(error_handler.ICodedError).GetErrorCode())
+}
+
+func TestHandlerBatchEmptyItem(t *testing.T) {
+	slackClient := new(mocks.ISlackClient)
+	slackClient.On("SendErrorMessage", error_codes.InvalidPDWBatch, "", "", "querypdw", "querypdw", mock.Anything, mock.Anything).Return(nil)
+	commonHandler.SlackClient = slackClient
+	http_Client := new(mocks.MockHTTPClient)
+	commonHandler.HttpClient = http_Client
+	_, err := notificationWrapper(context.Background(), eventData{Items: []batchItem{{ParcelID: "p-1"}, {}}})
+	assert.Equal(t, error_codes.InvalidPDWBatch, err.(error_handler.ICodedError).GetErrorCode())
+	assert.Contains(t, err.Error(), "batch item 1 has no parcel id, address or point")
+	http_Client.AssertNotCalled(t, "Post")
+}
+
+func TestHandlerBatchNothingFound(t *testing.T) {
+	aws_Client := new(mocks.IAWSClient)
+	http_Client := new(mocks.MockHTTPClient)
+	mock_auth_client := new(mocks.AuthTokenInterface)
+	mock_auth_client.Mock.On("AddAuthorizationTokenHeader", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	auth_client = mock_auth_client
+	http_Client.Mock.On("Post").Return(&http.Response{
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"data": {"byParcelId": [], "byAddress": []}}`)),
+		StatusCode: http.StatusOK,
+	}, nil).Once()
+	aws_Client.On("InvokeLambda", mock.Anything, "arn:callback", map[string]interface{}{
+		"callbackId":  "batch",
+		"status":      failure,
+		"message":     NoParcelMessage,
+		"messageCode": error_codes.ParcelIDDoesnotExist,
+	}, false).Return(nil, nil)
+	commonHandler.AwsClient = aws_Client
+	commonHandler.HttpClient = http_Client
+	commonHandler.Secrets = map[string]interface{}{
+		"ClientID":     "id",
+		"ClientSecret": "secret"}
+
+	resp, err := notificationWrapper(context.Background(), eventData{Vintage: "2020-12-13", Action: validatedata, CallbackID: "batch", CallbackURL: "arn:callback", Items: []batchItem{{ParcelID: "p-missing"}, {Address: "2 UNKNOWN RD"}}})
+	assert.NoError(t, err)
+	assert.False(t, resp.TriggerSIM)
+	assert.Equal(t, &batchSummary{Total: 2, NotFound: 2, TriggerSIM: []int{}}, resp.Summary)
+	aws_Client.AssertExpectations(t)
+}
+
+func TestIsValidPDWResponseComparesMarkersAsDates(t *testing.T) {
+	minDate, err := parseVintage("2020-12-13")
+	assert.NoError(t, err)
+	parcel := func(buildingMarker, facetMarker string) pdwValidationResponse {
+		var response pdwValidationResponse
+		assert.NoError(t, json.Unmarshal([]byte(`{"data": {"parcels": [{
+			"id": "p-1",
+			"_detectedBuildingCount": {"marker": "`+buildingMarker+`", "value": 1},
+			"structures": [{"roof": {"_countRoofFacets": {"marker": "`+facetMarker+`", "value": 4}}}]
+		}]}}`), &response))
+		return response
+	}
+	// a timestamp later on the day of the vintage is fresh although it sorts before it as a string
+	assert.Equal(t, *validation([]string{}, []string{}), isValidPDWResponse(parcel("2020-12-13T08:30:00Z", "2020/12/14"), minDate))
+	assert.Equal(t, *validation([]string{}, []string{"buildingCount", "roofFacets"}), isValidPDWResponse(parcel("2020-12-12T23:59:59Z", "2019/08/29"), minDate))
+	assert.Equal(t, *validation([]string{}, []string{"roofFacets"}), isValidPDWResponse(parcel("2021-01-01", "not a date"), minDate))
+	assert.Equal(t, *validation([]string{}, []string{}), isValidPDWResponse(parcel("20210101", "2021-01-01 10:00:00"), markerDate{}))
+	// US and European day orders cannot be told apart, so neither is read
+	assert.Equal(t, *validation([]string{}, []string{"roofFacets"}), isValidPDWResponse(parcel("2021-01-01", "12/14/2020"), minDate))
+
+	// a date only marker is fresh on the day of a timestamp vintage, a timestamp is compared to the second
+	timestampVintage, err := parseVintage("2020-12-13T09:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, *validation([]string{}, []string{}), isValidPDWResponse(parcel("2020-12-13", "2020-12-13T09:00:00Z"), timestampVintage))
+	assert.Equal(t, *validation([]string{}, []string{"buildingCount", "roofFacets"}), isValidPDWResponse(parcel("2020-12-12", "2020-12-13T08:59:59Z"), timestampVintage))
+
+	// an unreadable vintage is rejected instead of skipping the freshness check
+	_, err = parseVintage("last winter")
+	assert.Equal(t, error_codes.InvalidVintage, err.(error_handler.ICodedError).GetErrorCode())
+	_, err = handler(context.Background(), eventData{Vintage: "last winter", ParcelID: "p-1"})
+	assert.Equal(t, error_codes.InvalidVintage, err.(error_handler.ICodedError).GetErrorCode())
+}
+
+func TestIsValidPDWResponseConfiguredAttributes(t *testing.T) {
+	t.Setenv(FreshAttributesConfig, `[
+		{"name": "buildingCount", "field": "_detectedBuildingCount"},
+		{"name": "pools", "field": "pools._outline"},
+		{"name": "trampolines", "field": "trampolines._outline"},
+		{"name": "outlines", "field": "structures._outline"}
+	]`)
+	loaded, err := LoadFreshAttributes()
+	assert.NoError(t, err)
+	freshAttributes = loaded
+	t.Cleanup(func() { freshAttributes = DefaultFreshAttributes() })
+
+	var response pdwValidationResponse
+	assert.NoError(t, json.Unmarshal([]byte(`{"data": {"parcels": [{
+		"id": "p-1",
+		"_detectedBuildingCount": {"marker": "2021-08-29", "value": 2},
+		"pools": [{"_outline": {"marker": "2021-08-29", "value": {"type": "Polygon"}}}],
+		"structures": [
+			{"_outline": {"marker": "2021-08-29T10:00:00Z", "value": {"type": "Polygon"}}},
+			{"_outline": {"marker": "2019-01-01", "value": {"type": "Polygon"}}}
+		]
+	}]}}`), &response))
+	minDate, err := parseVintage("2020-12-13")
+	assert.NoError(t, err)
+	assert.Equal(t, *validation([]string{"trampolines"}, []string{"outlines"}), isValidPDWResponse(response, minDate))
+
+	query, err := generateValidationQuery(eventData{ParcelID: "p-1"})
+	assert.NoError(t, err)
+	assert.Contains(t, query.Text, "trampolines {\n      _outline {\n        marker\n        value\n")
+}
+
+func TestLoadFreshAttributesReportsEveryProblem(t *testing.T) {
+	t.Setenv(FreshAttributesConfig, `[{"name": "pools", "field": "pools(covered: ._outline"}, {"name": "pools", "field": "pools._outline"}, {"field": "trampolines"}]`)
+	_, err := LoadFreshAttributes()
+	assert.Equal(t, error_codes.ErrorLoadingFreshAttributes, err.(error_handler.ICodedError).GetErrorCode())
+	for _, problem := range []string{"pools has invalid attribute", "pools is listed several times", "attribute 3 has no name"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func geocoderResponse(body string) *http.Response {
+	return &http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(body)), StatusCode: http.StatusOK}
+}
+
+func TestGeocoderChainFallsBackToNextProvider(t *testing.T) {
+	http_Client := new(mocks.MockHTTPClient)
+	mock_auth_client := new(mocks.AuthTokenInterface)
+	mock_auth_client.Mock.On("AddAuthorizationTokenHeader", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	auth_client = mock_auth_client
+	http_Client.On("Get").Return(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil).Once()
+	http_Client.On("Get").Return(geocoderResponse(`{"results": [{"formatted": "31 Havenshire Rd", "parcel": {"id": 12345678901234}}]}`), nil).Once()
+	commonHandler.HttpClient = http_Client
+	commonHandler.Secrets = map[string]interface{}{
+		"ClientID":     "id",
+		"ClientSecret": "secret",
+		"BackupKey":    "key"}
+	providers := append(DefaultGeocoderProviders(), GeocoderProvider{
+		Name:          "backup",
+		URL:           "https://backup.example.com/reverse",
+		Auth:          geocoderAuthAPIKey,
+		APIKeySecret:  "BackupKey",
+		APIKeyHeader:  "X-Api-Key",
+		AddressField:  "results.0.formatted",
+		ParcelIDField: "results.0.parcel.id",
+	})
+
+	result, err := NewGeocoder(providers, defaultGeocodePrecision, 0).ReverseGeocode(context.Background(), 43.172733, -77.501619)
+	assert.NoError(t, err)
+	assert.Equal(t, GeocodeResult{Address: "31 Havenshire Rd", ParcelID: "12345678901234", Provider: "backup"}, result)
+	http_Client.AssertNumberOfCalls(t, "Get", 2)
+}
+
+func TestGeocoderChainReturnsRetriableErrorWhenEveryProviderFails(t *testing.T) {
+	http_Client := new(mocks.MockHTTPClient)
+	http_Client.On("Get").Return(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil).Once()
+	http_Client.On("Get").Return(&http.Response{StatusCode: http.StatusBadRequest}, nil).Once()
+	commonHandler.HttpClient = http_Client
+	providers := []GeocoderProvider{
+		{Name: "first", URL: "https://first.example.com", Auth: geocoderAuthNone, AddressField: "address"},
+		{Name: "second", URL: "https://second.example.com", Auth: geocoderAuthNone, AddressField: "address"},
+	}
+
+	_, err := NewGeocoder(providers, defaultGeocodePrecision, 0).ReverseGeocode(context.Background(), 43.172733, -77.501619)
+	assert.IsType(t, &error_handler.RetriableError{}, err)
+	assert.Equal(t, error_codes.ReceivedInternalServerError, err.(error_handler.ICodedError).GetErrorCode())
+}
+
+func TestGeocoderCachesByRoundedLocation(t *testing.T) {
+	db := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = db
+	t.Cleanup(func() { commonHandler.DBClient = nil })
+	http_Client := new(mocks.MockHTTPClient)
+	mock_auth_client := new(mocks.AuthTokenInterface)
+	mock_auth_client.Mock.On("AddAuthorizationTokenHeader", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	auth_client = mock_auth_client
+	http_Client.On("Get").Return(geocoderResponse(`{"address": "31 Havenshire Rd", "parcelID": "c7a80489"}`), nil).Once()
+	commonHandler.HttpClient = http_Client
+	commonHandler.Secrets = map[string]interface{}{
+		"ClientID":     "id",
+		"ClientSecret": "secret"}
+	geocoder := NewGeocoder(DefaultGeocoderProviders(), defaultGeocodePrecision, 24*time.Hour)
+
+	result, err := geocoder.ReverseGeocode(context.Background(), 43.172733, -77.501619)
+	assert.NoError(t, err)
+	assert.Equal(t, GeocodeResult{Address: "31 Havenshire Rd", ParcelID: "c7a80489", Provider: "EGS"}, result)
+
+	result, err = geocoder.ReverseGeocode(context.Background(), 43.1727331, -77.5016192)
+	assert.NoError(t, err)
+	assert.Equal(t, GeocodeResult{Address: "31 Havenshire Rd", ParcelID: "c7a80489", Provider: "EGS", Cached: true}, result)
+	http_Client.AssertNumberOfCalls(t, "Get", 1)
+
+	cached, err := db.FetchGeocode(context.Background(), "43.17273,-77.50162")
+	assert.NoError(t, err)
+	assert.Equal(t, "EGS", cached.Provider)
+	assert.NotNil(t, cached.ExpireAt)
+}
+
+// fixedGeocoder answers every point with result.
+type fixedGeocoder struct {
+	result GeocodeResult
+	calls  *int
+}
+
+func (geocoder fixedGeocoder) Name() string {
+	return geocoder.result.Provider
+}
+
+func (geocoder fixedGeocoder) ReverseGeocode(ctx context.Context, lat, long float64) (GeocodeResult, error) {
+	*geocoder.calls++
+	return geocoder.result, nil
+}
+
+func TestGeocoderConnectsToTheCacheOnFirstUse(t *testing.T) {
+	defer func(previous *geocodeCacheDB) { geocodeCache = previous }(geocodeCache)
+	t.Cleanup(func() { commonHandler.DBClient = nil })
+	calls, connections := 0, 0
+	cache := cachedGeocoder{next: fixedGeocoder{result: GeocodeResult{Address: "31 Havenshire Rd", Provider: "EGS"}, calls: &calls}, precision: defaultGeocodePrecision}
+
+	geocodeCache = &geocodeCacheDB{connect: func(context.Context) (documentDB_client.IDocDBClient, error) {
+		connections++
+		return nil, errors.New("no route to DocumentDB")
+	}}
+	for i := 0; i < 2; i++ {
+		result, err := cache.ReverseGeocode(context.Background(), 43.172733, -77.501619)
+		assert.NoError(t, err)
+		assert.False(t, result.Cached)
+	}
+	assert.Equal(t, 1, connections, "a failed connection is not retried before the next cold start")
+	assert.Nil(t, commonHandler.DBClient)
+
+	geocodeCache = &geocodeCacheDB{connect: func(context.Context) (documentDB_client.IDocDBClient, error) {
+		connections++
+		return documentDB_client.NewInMemoryDocDBClient(), nil
+	}}
+	_, err := cache.ReverseGeocode(context.Background(), 43.172733, -77.501619)
+	assert.NoError(t, err)
+	result, err := cache.ReverseGeocode(context.Background(), 43.172733, -77.501619)
+	assert.NoError(t, err)
+	assert.True(t, result.Cached)
+	assert.Equal(t, 2, connections)
+	assert.Equal(t, 3, calls)
+}
+
+func TestLoadGeocoderReportsEveryProblem(t *testing.T) {
+	t.Setenv(GeocoderProvidersConfig, `[{"name": "google", "auth": "apiKey", "addressField": "results..formatted"}, {"name": "google", "url": "https://example.com", "auth": "oauth"}]`)
+	t.Setenv(GeocodeCachePrecision, "12")
+	_, err := LoadGeocoder()
+	assert.Equal(t, error_codes.ErrorLoadingGeocoders, err.(error_handler.ICodedError).GetErrorCode())
+	for _, problem := range []string{"google has no url", "google has no api key secret", "google has malformed field results..formatted",
+		"google is listed several times", "google has unsupported auth oauth", "google has no address field", GeocodeCachePrecision + " should be"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
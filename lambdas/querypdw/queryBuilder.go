@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+)
+
+// types of the PDW parcels arguments, testdata/pdw_schema.json is the schema the queries are checked against
+const (
+	validationOperation = "ValidateParcel"
+	parcelIdType        = "ID!"
+	addressType         = "String!"
+	coordinateType      = "Float!"
+)
+
+// GraphQLQuery is a parameterized query, Variables hold the values the query text refers to as $name.
+type GraphQLQuery struct {
+	Text      string
+	Variables map[string]interface{}
+}
+
+// QueryField is one field of a query path, Arguments are written as given so their values are either variable
+// references returned by QueryBuilder.Variable or literals.
+type QueryField struct {
+	Alias     string
+	Name      string
+	Arguments []QueryArgument
+}
+
+type QueryArgument struct {
+	Name  string
+	Value string
+}
+
+// QueryBuilder assembles a GraphQL query whose input values travel in the variables object rather than in the
+// query text, so an address with quotes can neither break nor change the query.
+type QueryBuilder struct {
+	operation string
+	variables []queryVariable
+	values    map[string]interface{}
+	root      queryNode
+}
+
+type queryVariable struct {
+	name    string
+	gqlType string
+}
+
+type queryNode struct {
+	field    QueryField
+	children []*queryNode
+}
+
+func NewQueryBuilder(operation string) *QueryBuilder {
+	return &QueryBuilder{operation: operation, values: map[string]interface{}{}}
+}
+
+// Variable declares the variable name of type gqlType holding value and returns the reference to use in arguments.
+func (builder *QueryBuilder) Variable(name, gqlType string, value interface{}) string {
+	if _, ok := builder.values[name]; !ok {
+		builder.variables = append(builder.variables, queryVariable{name: name, gqlType: gqlType})
+	}
+	builder.values[name] = value
+	return "$" + name
+}
+
+// AddPath selects the fields of path, each one nested in the previous one. Fields already selected with the same
+// alias, name and arguments are shared.
+func (builder *QueryBuilder) AddPath(path ...QueryField) *QueryBuilder {
+	node := &builder.root
+	for _, field := range path {
+		node = node.child(field)
+	}
+	return builder
+}
+
+// AddAttribute selects a dotted attribute such as structures(type: "main").roof._countRoofFacets.value below
+// parents, a segment may carry an alias written as alias:name.
+func (builder *QueryBuilder) AddAttribute(attribute string, parents ...QueryField) error {
+	path := append([]QueryField{}, parents...)
+	for _, segment := range splitOutside(attribute, '.') {
+		field, err := parseQueryField(segment)
+		if err != nil {
+			return fmt.Errorf("invalid attribute %s: %v", attribute, err)
+		}
+		path = append(path, field)
+	}
+	builder.AddPath(path...)
+	return nil
+}
+
+// Build writes the query text, fields keep the order they were first selected in.
+func (builder *QueryBuilder) Build() GraphQLQuery {
+	var text strings.Builder
+	text.WriteString("query " + builder.operation)
+	if len(builder.variables) > 0 {
+		definitions := []string{}
+		for _, variable := range builder.variables {
+			definitions = append(definitions, "$"+variable.name+": "+variable.gqlType)
+		}
+		text.WriteString("(" + strings.Join(definitions, ", ") + ")")
+	}
+	text.WriteString(" {\n")
+	for _, child := range builder.root.children {
+		child.write(&text, 1)
+	}
+	text.WriteString("}\n")
+	variables := map[string]interface{}{}
+	for name, value := range builder.values {
+		variables[name] = value
+	}
+	return GraphQLQuery{Text: text.String(), Variables: variables}
+}
+
+func (node *queryNode) child(field QueryField) *queryNode {
+	for _, child := range node.children {
+		if child.field.String() == field.String() {
+			return child
+		}
+	}
+	child := &queryNode{field: field}
+	node.children = append(node.children, child)
+	return child
+}
+
+func (node *queryNode) write(text *strings.Builder, depth int) {
+	indent := strings.Repeat("  ", depth)
+	text.WriteString(indent + node.field.String())
+	if len(node.children) == 0 {
+		text.WriteString("\n")
+		return
+	}
+	text.WriteString(" {\n")
+	for _, child := range node.children {
+		child.write(text, depth+1)
+	}
+	text.WriteString(indent + "}\n")
+}
+
+func (field QueryField) String() string {
+	text := field.Name
+	if field.Alias != "" {
+		text = field.Alias + ": " + text
+	}
+	if len(field.Arguments) > 0 {
+		arguments := []string{}
+		for _, argument := range field.Arguments {
+			arguments = append(arguments, argument.Name+": "+argument.Value)
+		}
+		text += "(" + strings.Join(arguments, ", ") + ")"
+	}
+	return text
+}
+
+func parseQueryField(segment string) (QueryField, error) {
+	field := QueryField{}
+	head := strings.TrimSpace(segment)
+	if open := strings.Index(head, "("); open >= 0 {
+		if !strings.HasSuffix(head, ")") {
+			return field, fmt.Errorf("arguments of %s are not closed", segment)
+		}
+		for _, argument := range splitOutside(head[open+1:len(head)-1], ',') {
+			colon := strings.Index(argument, ":")
+			if colon < 0 || !isGraphQLName(strings.TrimSpace(argument[:colon])) || strings.TrimSpace(argument[colon+1:]) == "" {
+				return field, fmt.Errorf("argument %s should be written as name: value", strings.TrimSpace(argument))
+			}
+			field.Arguments = append(field.Arguments, QueryArgument{Name: strings.TrimSpace(argument[:colon]), Value: strings.TrimSpace(argument[colon+1:])})
+		}
+		head = strings.TrimSpace(head[:open])
+	}
+	if colon := strings.Index(head, ":"); colon >= 0 {
+		field.Alias = strings.TrimSpace(head[:colon])
+		if !isGraphQLName(field.Alias) {
+			return field, fmt.Errorf("alias %s is not a GraphQL name", field.Alias)
+		}
+		head = strings.TrimSpace(head[colon+1:])
+	}
+	field.Name = head
+	if !isGraphQLName(field.Name) {
+		return field, fmt.Errorf("field %s is not a GraphQL name", field.Name)
+	}
+	return field, nil
+}
+
+// splitOutside splits text on separator when it is outside quotes, parentheses, brackets and braces.
+func splitOutside(text string, separator rune) []string {
+	parts := []string{}
+	depth, quoted, escaped, start := 0, false, false, 0
+	for i, c := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == separator && depth == 0:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(text[start:]) != "" || len(parts) > 0 {
+		parts = append(parts, text[start:])
+	}
+	return parts
+}
+
+func isGraphQLName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parcelsField selects the parcel by id, by address or by point, the value travelling as a variable.
+func parcelsField(builder *QueryBuilder, lat, long float64, parcelID, address string) QueryField {
+	if parcelID != "" {
+		return QueryField{Name: "parcels", Arguments: []QueryArgument{{Name: "ids", Value: "[" + builder.Variable("parcelId", parcelIdType, parcelID) + "]"}}}
+	} else if address != "" {
+		return QueryField{Name: "parcels", Arguments: []QueryArgument{{Name: "addresses", Value: "[" + builder.Variable("address", addressType, address) + "]"}}}
+	}
+	point := fmt.Sprintf("[{lat: %s, lon: %s}]", builder.Variable("lat", coordinateType, lat), builder.Variable("lon", coordinateType, long))
+	return QueryField{Name: "parcels", Arguments: []QueryArgument{{Name: "points", Value: point}}}
+}
+
+// GenerateGQL builds the query selecting the dotted attributes of the parcel found by id, address or point.
+func GenerateGQL(attributes []string, lat, long float64, parcelID, address, structureType string) (GraphQLQuery, error) {
+	builder := NewQueryBuilder(validationOperation)
+	parcels := parcelsField(builder, lat, long, parcelID, address)
+	for _, attribute := range attributes {
+		if err := builder.AddAttribute(attribute, parcels); err != nil {
+			return GraphQLQuery{}, error_handler.NewServiceError(error_codes.ErrorBuildingGraphQuery, err.Error())
+		}
+	}
+	return builder.Build(), nil
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pdwSchemaFile holds the result of the standard introspection query against the PDW graph. Save the data of a
+// new introspection response there when PDW changes its schema, the tests check every query we send against it.
+var pdwSchemaFile = filepath.Join("testdata", "pdw_schema.json")
+
+type schemaTypeRef struct {
+	Kind   string         `json:"kind"`
+	Name   string         `json:"name"`
+	OfType *schemaTypeRef `json:"ofType"`
+}
+
+// String writes the reference the way GraphQL does, [ID!]!.
+func (ref schemaTypeRef) String() string {
+	switch ref.Kind {
+	case "NON_NULL":
+		return ref.OfType.String() + "!"
+	case "LIST":
+		return "[" + ref.OfType.String() + "]"
+	}
+	return ref.Name
+}
+
+func (ref schemaTypeRef) named() string {
+	if ref.OfType != nil {
+		return ref.OfType.named()
+	}
+	return ref.Name
+}
+
+type schemaInputValue struct {
+	Name string        `json:"name"`
+	Type schemaTypeRef `json:"type"`
+}
+
+type schemaField struct {
+	Name string             `json:"name"`
+	Args []schemaInputValue `json:"args"`
+	Type schemaTypeRef      `json:"type"`
+}
+
+type schemaType struct {
+	Kind        string             `json:"kind"`
+	Name        string             `json:"name"`
+	Fields      []schemaField      `json:"fields"`
+	InputFields []schemaInputValue `json:"inputFields"`
+}
+
+type pdwSchema struct {
+	queryType string
+	types     map[string]schemaType
+}
+
+func loadPDWSchema(t *testing.T) pdwSchema {
+	data, err := ioutil.ReadFile(pdwSchemaFile)
+	assert.NoError(t, err)
+	introspection := struct {
+		Data struct {
+			Schema struct {
+				QueryType struct {
+					Name string `json:"name"`
+				} `json:"queryType"`
+				Types []schemaType `json:"types"`
+			} `json:"__schema"`
+		} `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(data, &introspection))
+	schema := pdwSchema{queryType: introspection.Data.Schema.QueryType.Name, types: map[string]schemaType{}}
+	for _, schemaType := range introspection.Data.Schema.Types {
+		schema.types[schemaType.Name] = schemaType
+	}
+	return schema
+}
+
+// gqlValue is an argument value of a parsed query, a variable, a list, an input object or a literal.
+type gqlValue struct {
+	variable string
+	list     []gqlValue
+	object   map[string]gqlValue
+	isList   bool
+	literal  string
+}
+
+type gqlSelection struct {
+	name      string
+	arguments map[string]gqlValue
+	children  []gqlSelection
+}
+
+// gqlParser reads the subset of GraphQL the queries are written in: one query operation with variable
+// definitions, aliases, arguments and nested selections.
+type gqlParser struct {
+	tokens []string
+	next   int
+}
+
+func parseGraphQL(text string) (map[string]string, []gqlSelection, error) {
+	parser := &gqlParser{tokens: tokenizeGraphQL(text)}
+	if parser.take() != "query" {
+		return nil, nil, fmt.Errorf("query should start with the query keyword")
+	}
+	if parser.peek() != "(" && parser.peek() != "{" {
+		parser.take()
+	}
+	variables := map[string]string{}
+	if parser.peek() == "(" {
+		parser.take()
+		for parser.peek() != ")" && parser.peek() != "" {
+			name := strings.TrimPrefix(parser.take(), "$")
+			if parser.take() != ":" {
+				return nil, nil, fmt.Errorf("variable %s has no type", name)
+			}
+			variables[name] = parser.typeRef()
+		}
+		parser.take()
+	}
+	selections, err := parser.selections()
+	return variables, selections, err
+}
+
+func tokenizeGraphQL(text string) []string {
+	tokens := []string{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c) || c == ',':
+		case c == '"':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			tokens = append(tokens, string(runes[i:j+1]))
+			i = j
+		case strings.ContainsRune("{}()[]:!", c):
+			tokens = append(tokens, string(c))
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && !strings.ContainsRune("{}()[]:!,\"", runes[j]) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j - 1
+		}
+	}
+	return tokens
+}
+
+func (parser *gqlParser) peek() string {
+	if parser.next < len(parser.tokens) {
+		return parser.tokens[parser.next]
+	}
+	return ""
+}
+
+func (parser *gqlParser) take() string {
+	token := parser.peek()
+	parser.next++
+	return token
+}
+
+func (parser *gqlParser) typeRef() string {
+	ref := ""
+	if parser.peek() == "[" {
+		parser.take()
+		ref = "[" + parser.typeRef() + "]"
+		parser.take()
+	} else {
+		ref = parser.take()
+	}
+	if parser.peek() == "!" {
+		ref += parser.take()
+	}
+	return ref
+}
+
+func (parser *gqlParser) selections() ([]gqlSelection, error) {
+	if parser.take() != "{" {
+		return nil, fmt.Errorf("selection set expected at token %d", parser.next)
+	}
+	selections := []gqlSelection{}
+	for parser.peek() != "}" {
+		if parser.peek() == "" {
+			return nil, fmt.Errorf("unterminated selection set")
+		}
+		selection := gqlSelection{name: parser.take(), arguments: map[string]gqlValue{}}
+		if parser.peek() == ":" {
+			parser.take()
+			selection.name = parser.take()
+		}
+		if parser.peek() == "(" {
+			parser.take()
+			for parser.peek() != ")" && parser.peek() != "" {
+				name := parser.take()
+				parser.take()
+				selection.arguments[name] = parser.value()
+			}
+			parser.take()
+		}
+		if parser.peek() == "{" {
+			children, err := parser.selections()
+			if err != nil {
+				return nil, err
+			}
+			selection.children = children
+		}
+		selections = append(selections, selection)
+	}
+	parser.take()
+	return selections, nil
+}
+
+func (parser *gqlParser) value() gqlValue {
+	token := parser.take()
+	switch {
+	case strings.HasPrefix(token, "$"):
+		return gqlValue{variable: token[1:]}
+	case token == "[":
+		value := gqlValue{isList: true}
+		for parser.peek() != "]" && parser.peek() != "" {
+			value.list = append(value.list, parser.value())
+		}
+		parser.take()
+		return value
+	case token == "{":
+		value := gqlValue{object: map[string]gqlValue{}}
+		for parser.peek() != "}" && parser.peek() != "" {
+			name := parser.take()
+			parser.take()
+			value.object[name] = parser.value()
+		}
+		parser.take()
+		return value
+	}
+	return gqlValue{literal: token}
+}
+
+// schemaValidator collects every way a query does not match the schema.
+type schemaValidator struct {
+	schema    pdwSchema
+	variables map[string]string
+	used      map[string]bool
+	problems  []string
+}
+
+// validateQuery checks the fields, the arguments and the variable types of the query against the schema, and
+// that every declared variable is used and has a value.
+func validateQuery(schema pdwSchema, query GraphQLQuery) []string {
+	variables, selections, err := parseGraphQL(query.Text)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	validator := &schemaValidator{schema: schema, variables: variables, used: map[string]bool{}}
+	validator.selections(schema.queryType, selections, "")
+	for name := range variables {
+		if !validator.used[name] {
+			validator.problems = append(validator.problems, fmt.Sprintf("$%s is declared but not used", name))
+		}
+		if _, ok := query.Variables[name]; !ok {
+			validator.problems = append(validator.problems, fmt.Sprintf("$%s has no value", name))
+		}
+	}
+	sort.Strings(validator.problems)
+	return validator.problems
+}
+
+func (validator *schemaValidator) selections(typeName string, selections []gqlSelection, path string) {
+	fields := map[string]schemaField{}
+	for _, field := range validator.schema.types[typeName].Fields {
+		fields[field.Name] = field
+	}
+	for _, selection := range selections {
+		at := strings.TrimPrefix(path+"."+selection.name, ".")
+		field, ok := fields[selection.name]
+		if !ok {
+			validator.problems = append(validator.problems, fmt.Sprintf("%s is not a field of %s", at, typeName))
+			continue
+		}
+		args := map[string]schemaTypeRef{}
+		for _, arg := range field.Args {
+			args[arg.Name] = arg.Type
+		}
+		for name, value := range selection.arguments {
+			argType, ok := args[name]
+			if !ok {
+				validator.problems = append(validator.problems, fmt.Sprintf("%s has no argument %s", at, name))
+				continue
+			}
+			validator.value(value, argType, at+"("+name+")")
+		}
+		fieldType := validator.schema.types[field.Type.named()]
+		switch {
+		case fieldType.Kind == "OBJECT" && len(selection.children) == 0:
+			validator.problems = append(validator.problems, fmt.Sprintf("%s needs a selection of the fields of %s", at, fieldType.Name))
+		case fieldType.Kind != "OBJECT" && len(selection.children) > 0:
+			validator.problems = append(validator.problems, fmt.Sprintf("%s is a %s and has no fields", at, field.Type))
+		case fieldType.Kind == "OBJECT":
+			validator.selections(fieldType.Name, selection.children, at)
+		}
+	}
+}
+
+// value checks a value used where expected is, a variable of a non null type may be used where null is allowed.
+func (validator *schemaValidator) value(value gqlValue, expected schemaTypeRef, at string) {
+	nullable := expected
+	if expected.Kind == "NON_NULL" {
+		nullable = *expected.OfType
+	}
+	switch {
+	case value.variable != "":
+		validator.used[value.variable] = true
+		declared, ok := validator.variables[value.variable]
+		if !ok {
+			validator.problems = append(validator.problems, fmt.Sprintf("%s uses undeclared $%s", at, value.variable))
+		} else if declared != expected.String() && declared != nullable.String()+"!" {
+			validator.problems = append(validator.problems, fmt.Sprintf("%s expects %s but $%s is %s", at, expected, value.variable, declared))
+		}
+	case value.isList:
+		if nullable.Kind != "LIST" {
+			validator.problems = append(validator.problems, fmt.Sprintf("%s expects %s, not a list", at, expected))
+			return
+		}
+		for i, element := range value.list {
+			validator.value(element, *nullable.OfType, fmt.Sprintf("%s[%d]", at, i))
+		}
+	case value.object != nil:
+		inputType := validator.schema.types[nullable.Name]
+		if nullable.Kind != "INPUT_OBJECT" {
+			validator.problems = append(validator.problems, fmt.Sprintf("%s expects %s, not an object", at, expected))
+			return
+		}
+		for _, field := range inputType.InputFields {
+			fieldValue, ok := value.object[field.Name]
+			if !ok {
+				if field.Type.Kind == "NON_NULL" {
+					validator.problems = append(validator.problems, fmt.Sprintf("%s misses %s", at, field.Name))
+				}
+				continue
+			}
+			validator.value(fieldValue, field.Type, at+"."+field.Name)
+		}
+		for name := range value.object {
+			found := false
+			for _, field := range inputType.InputFields {
+				found = found || field.Name == name
+			}
+			if !found {
+				validator.problems = append(validator.problems, fmt.Sprintf("%s has no field %s in %s", at, name, inputType.Name))
+			}
+		}
+	case strings.HasPrefix(value.literal, `"`):
+		if named := nullable.named(); nullable.Kind == "LIST" || (named != "String" && named != "ID") {
+			validator.problems = append(validator.problems, fmt.Sprintf("%s expects %s, not a string", at, expected))
+		}
+	}
+}
+
+func TestQueriesMatchPDWSchema(t *testing.T) {
+	schema := loadPDWSchema(t)
+	queries := map[string]GraphQLQuery{}
+	for name, event := range map[string]eventData{
+		"by parcel id": {ParcelID: "p-1"},
+		"by address": {Address: struct {
+			ParcelAddress string  `json:"parcelAddress"`
+			Lat           float64 `json:"lat"`
+			Long          float64 `json:"long"`
+		}{ParcelAddress: "1 MAIN ST"}},
+		"by point": {Address: struct {
+			ParcelAddress string  `json:"parcelAddress"`
+			Lat           float64 `json:"lat"`
+			Long          float64 `json:"long"`
+		}{Lat: 43.1, Long: -77.5}},
+	} {
+		query, err := generateValidationQuery(event)
+		assert.NoError(t, err)
+		queries[name] = query
+	}
+	batch, _, err := generateBatchValidationQuery([]batchItem{{ParcelID: "p-1"}, {Address: "1 MAIN ST"}, {Lat: 43.1, Long: -77.5}, {Lat: 43.2, Long: -77.6}})
+	assert.NoError(t, err)
+	queries["batch"] = batch
+	parcelData, err := readParcelDataQuery(context.Background(), []string{"p-1"})
+	assert.NoError(t, err)
+	queries["parcel data"] = parcelData
+
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			assert.Empty(t, validateQuery(schema, query))
+		})
+	}
+}
+
+func TestValidateQueryReportsSchemaMismatches(t *testing.T) {
+	schema := loadPDWSchema(t)
+	query := GraphQLQuery{
+		Text: `query Check($id: String!, $lat: String!, $unused: Int) {
+  parcels(ids: [$id], points: [{lat: $lat}], radius: 5) {
+    _detectedBuildingCount
+    structures(type: "main") {
+      roof {
+        pitch
+      }
+    }
+    id {
+      value
+    }
+  }
+}
+`,
+		Variables: map[string]interface{}{"id": "p-1", "lat": "43.1"},
+	}
+	assert.Equal(t, []string{
+		"$unused has no value",
+		"$unused is declared but not used",
+		"parcels has no argument radius",
+		"parcels(ids)[0] expects ID! but $id is String!",
+		"parcels(points)[0] misses lon",
+		"parcels(points)[0].lat expects Float! but $lat is String!",
+		"parcels._detectedBuildingCount needs a selection of the fields of Attribute",
+		"parcels.id is a ID! and has no fields",
+		"parcels.structures.roof.pitch is not a field of Roof",
+	}, validateQuery(schema, query))
+}
@@ -134,7 +134,12 @@ func notificationWrapper(ctx context.Context, req eventData) error {
 }
 func main() {
 	log_config.InitLogging("info")
-	commonHandler = common_handler.New(true, true, true, true, true)
+	var err error
+	commonHandler, err = common_handler.New(true, true, true, true, true)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	httpservice.ConfigureHTTPClient(&httpservice.HTTPClientConfiguration{
 		// APITimeout: 90,
 	})
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"math"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
@@ -18,10 +21,35 @@ import (
 const (
 	loglevel    = "info"
 	envS3Bucket = "PDO_BUCKET"
+
+	pdwPayloadFile    = "pdw_payload.json"
+	geoJSONFile       = "detections.geojson"
+	imageFootprintTag = "imageFootprint"
+
+	GeometryPolicy      = "GeometryPolicy"
+	dropInvalidGeometry = "drop"
+	flagInvalidGeometry = "flag"
+
+	// a closed ring needs 3 distinct vertices, and an area above about a square centimeter
+	minRingVertices = 3
+	minRingArea     = 1e-14
+
+	issueUnsupportedType    = "unsupportedType"
+	issueMissingCoordinates = "missingCoordinates"
+	issueOutOfBounds        = "outOfBounds"
+	issueTooFewVertices     = "tooFewVertices"
+	issueDegenerate         = "degenerate"
+	issueSelfIntersection   = "selfIntersection"
+	issueUnclosedRing       = "unclosedRing"
+	issueRepeatedVertices   = "repeatedVertices"
+	issueWrongOrientation   = "wrongOrientation"
 )
 
 var (
-	commonHandler common_handler.CommonHandler
+	commonHandler  common_handler.CommonHandler
+	geometryPolicy = dropInvalidGeometry
+
+	geometryPolicySource = config_loader.Source{Name: "geometry policy", Env: GeometryPolicy, Code: error_codes.ErrorLoadingGeometryPolicy}
 
 	crs4326 = map[string]interface{}{
 		"properties": map[string]string{
@@ -77,6 +105,11 @@ type structure struct {
 	Geometry   geometry               `json:"geometry"`
 	Primary    bool                   `json:"primary"`
 	Details    map[string]interface{} `json:"details"`
+
+	// GeometryIssues are the problems of a geometry that could not be repaired, GeometryDropped is set when the
+	// drop policy removed it
+	GeometryIssues  []string `json:"-"`
+	GeometryDropped bool     `json:"-"`
 }
 
 type point struct {
@@ -139,6 +172,26 @@ type pdwAttributes2 struct {
 	Meta       map[string]interface{} `json:"meta,omitempty"`
 }
 
+// FeatureCollection is the RFC 7946 GeoJSON of the SIM detections, positions are longitude, latitude pairs in
+// WGS84 so no crs member is written.
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+// Feature is one structure detected by SIM, or the footprint of the image it was detected on. Geometry is null
+// when SIM gave no coordinates.
+type Feature struct {
+	Type       string                 `json:"type"`
+	Geometry   *featureGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type featureGeometry struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
 func handler(ctx context.Context, eventData sim2pdwInput) (map[string]interface{}, error) {
 	resp := make(map[string]interface{})
 	resp["status"] = "failure"
@@ -161,6 +214,8 @@ func handler(ctx context.Context, eventData sim2pdwInput) (map[string]interface{
 	if err != nil {
 		return resp, error_handler.NewServiceError(error_codes.ErrorUnmarshallingSimOutput, err.Error())
 	}
+	report := validateGeometries(ctx, &output, geometryPolicy)
+	log.Infof(ctx, "geometry validation: %+v", report)
 
 	pdwPayload, err := sim2Pdw(ctx, &output, eventData.ParcelId, eventData.Address)
 	if err != nil {
@@ -173,14 +228,28 @@ func handler(ctx context.Context, eventData sim2pdwInput) (map[string]interface{
 	}
 
 	s3Bucket := os.Getenv("PDO_S3_BUCKET")
-	err = commonHandler.AwsClient.StoreDataToS3(ctx, s3Bucket, "/sim-pipeline/"+eventData.WorkflowId+"/sim2pdw/pdw_payload.json", data)
+	s3Prefix := "/sim-pipeline/" + eventData.WorkflowId + "/sim2pdw/"
+	err = commonHandler.AwsClient.StoreDataToS3(ctx, s3Bucket, s3Prefix+pdwPayloadFile, data)
 	if err != nil {
 		return resp, error_handler.NewServiceError(error_codes.ErrorStoringDataToS3, err.Error())
 	}
 	log.Info(context.Background(), " upload successfull")
-	s3Key := "s3://" + s3Bucket + "/sim-pipeline/" + eventData.WorkflowId + "/sim2pdw/pdw_payload.json"
-	// Upload to s3
-	return map[string]interface{}{"pdwPayload": s3Key, "status": "success"}, nil
+
+	s3Key := "s3://" + s3Bucket + s3Prefix
+	resp = map[string]interface{}{"pdwPayload": s3Key + pdwPayloadFile, "geometry": report, "status": "success"}
+
+	// the GeoJSON is a side output for the GIS team, failing to store it does not fail the PDW pipeline
+	data, err = json.Marshal(sim2GeoJSON(ctx, &output))
+	if err == nil {
+		err = commonHandler.AwsClient.StoreDataToS3(ctx, s3Bucket, s3Prefix+geoJSONFile, data)
+	}
+	if err != nil {
+		log.Error(ctx, "error storing the detections geojson, continuing without it", err)
+		return resp, nil
+	}
+	log.Info(ctx, "geojson upload successfull")
+	resp["geoJson"] = s3Key + geoJSONFile
+	return resp, nil
 }
 
 func sim2Pdw(ctx context.Context, simOutput *SimOutput, parcelId, address string) ([]PDWPayload, error) {
@@ -306,9 +375,73 @@ func sim2Pdw(ctx context.Context, simOutput *SimOutput, parcelId, address string
 	return resp, nil
 }
 
+// sim2GeoJSON writes every SIM detection as a Feature, whatever its type, followed by the image footprint.
+func sim2GeoJSON(ctx context.Context, simOutput *SimOutput) FeatureCollection {
+	collection := FeatureCollection{Type: "FeatureCollection", Features: []Feature{}}
+	for _, v := range simOutput.Structure {
+		feature := Feature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"type":       v.Type,
+				"subType":    v.SubType,
+				"confidence": v.Confidence,
+				"primary":    v.Primary,
+			},
+		}
+		if len(v.Geometry.Coordinates) > 0 {
+			feature.Geometry = &featureGeometry{Type: v.Geometry.Type, Coordinates: v.Geometry.Coordinates}
+		}
+		if len(v.GeometryIssues) > 0 {
+			feature.Properties["geometryIssues"] = v.GeometryIssues
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+
+	footprint, ok := imageFootprint(simOutput.Image)
+	if !ok {
+		log.Info(ctx, "image has no UL/RL corners, footprint not written")
+		return collection
+	}
+	collection.Features = append(collection.Features, Feature{
+		Type:     "Feature",
+		Geometry: footprint,
+		Properties: map[string]interface{}{
+			"type":         imageFootprintTag,
+			"imageUrn":     simOutput.Image.ImageURN,
+			"imageSetUrn":  simOutput.Image.ImageSetURN,
+			"shotDateTime": simOutput.Image.ShotDateTime,
+			"source":       simOutput.Image.Source,
+			"gsd":          simOutput.Image.GSD,
+		},
+	})
+	return collection
+}
+
+// imageFootprint is the rectangle between the upper left and lower right corners of the image, given as latitude,
+// longitude pairs. The ring runs counterclockwise as RFC 7946 wants for exterior rings.
+func imageFootprint(image imageSource) (*featureGeometry, bool) {
+	if len(image.UL) != 2 || len(image.RL) != 2 {
+		return nil, false
+	}
+	north, west := image.UL[0], image.UL[1]
+	south, east := image.RL[0], image.RL[1]
+	return &featureGeometry{
+		Type: "Polygon",
+		Coordinates: [][][]float64{{
+			{west, north},
+			{west, south},
+			{east, south},
+			{east, north},
+			{west, north},
+		}},
+	}, true
+}
+
 func getRoofPayload(ctx context.Context, payload PDWPayload, v structure, facetCount int) PDWPayload {
 	payload.Asset.Type = "Roof"
-	payload.Attributes["outline"].Attributes["outlineType"] = outlineTypeBuildingFP
+	if outline, ok := payload.Attributes["outline"]; ok {
+		outline.Attributes["outlineType"] = outlineTypeBuildingFP
+	}
 	payload.Attributes["countRoofFacets"] = pdwAttributes{
 		Value: getFacetCount(ctx, v),
 	}
@@ -339,8 +472,12 @@ func setPayloadAttributes(ctx context.Context, simOutput SimOutput, v structure,
 		DateCreated: dateCreated,
 	}
 
-	v.Geometry.CRS = crs4326
 	payload.Attributes = make(map[string]pdwAttributes)
+	// the detection still counts without its dropped outline
+	if v.GeometryDropped {
+		return payload
+	}
+	v.Geometry.CRS = crs4326
 	payload.Attributes["outline"] = pdwAttributes{
 		Value: v.Geometry,
 		Attributes: map[string]pdwAttributes2{
@@ -350,9 +487,226 @@ func setPayloadAttributes(ctx context.Context, simOutput SimOutput, v structure,
 			"confidence-exist": v.Confidence,
 		},
 	}
+	if len(v.GeometryIssues) > 0 {
+		payload.Attributes["outline"].Meta["geometryIssues"] = v.GeometryIssues
+	}
 	return payload
 }
 
+// GeometryReport counts the outcome of the geometry checks, Issues counts every issue found whether it was
+// repaired or not.
+type GeometryReport struct {
+	Checked  int            `json:"checked"`
+	Valid    int            `json:"valid"`
+	Repaired int            `json:"repaired"`
+	Dropped  int            `json:"dropped"`
+	Flagged  int            `json:"flagged"`
+	Issues   map[string]int `json:"issues"`
+}
+
+// LoadGeometryPolicy reads what GeometryPolicy tells to do with structures whose geometry cannot be repaired, drop
+// them without it.
+func LoadGeometryPolicy() (string, error) {
+	data, found, err := geometryPolicySource.Read(context.Background(), nil)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return dropInvalidGeometry, nil
+	}
+	policy := geometryPolicyName(data)
+	if err = geometryPolicySource.Validate(policy); err != nil {
+		return "", err
+	}
+	return string(policy), nil
+}
+
+// geometryPolicyName is the value of GeometryPolicy.
+type geometryPolicyName string
+
+func (policy geometryPolicyName) Validate() error {
+	if policy != dropInvalidGeometry && policy != flagInvalidGeometry {
+		return fmt.Errorf("unsupported geometry policy %s, expected %s or %s", policy, dropInvalidGeometry, flagInvalidGeometry)
+	}
+	return nil
+}
+
+// validateGeometries repairs the geometry of every structure when it safely can. A structure it cannot repair is
+// kept, so it is still counted as a detection, and its GeometryIssues recorded. The drop policy removes its geometry
+// and the flag policy keeps it.
+func validateGeometries(ctx context.Context, simOutput *SimOutput, policy string) GeometryReport {
+	report := GeometryReport{Issues: map[string]int{}}
+	kept := []structure{}
+	for _, v := range simOutput.Structure {
+		report.Checked++
+		repaired, repairs, problems := checkGeometry(v.Geometry)
+		for _, issue := range append(repairs, problems...) {
+			report.Issues[issue]++
+		}
+		switch {
+		case len(problems) == 0 && len(repairs) == 0:
+			report.Valid++
+		case len(problems) == 0:
+			report.Repaired++
+			v.Geometry = repaired
+		case policy == flagInvalidGeometry:
+			report.Flagged++
+			log.Infof(ctx, "flagging %s %s geometry: %v", v.Type, v.SubType, problems)
+			v.GeometryIssues = problems
+		default:
+			report.Dropped++
+			log.Infof(ctx, "dropping %s %s geometry: %v", v.Type, v.SubType, problems)
+			v.Geometry = geometry{}
+			v.GeometryIssues = problems
+			v.GeometryDropped = true
+		}
+		kept = append(kept, v)
+	}
+	simOutput.Structure = kept
+	return report
+}
+
+// checkGeometry returns the repaired copy of a polygon with the repairs it made, problems are the issues it could
+// not repair. The exterior ring has to run counterclockwise and holes clockwise, as RFC 7946 wants.
+func checkGeometry(g geometry) (geometry, []string, []string) {
+	if g.Type != "Polygon" {
+		return g, nil, []string{issueUnsupportedType}
+	}
+	if len(g.Coordinates) == 0 {
+		return g, nil, []string{issueMissingCoordinates}
+	}
+	repaired := g
+	repaired.Coordinates = [][][]float64{}
+	repairs, problems := []string{}, []string{}
+	for i, ring := range g.Coordinates {
+		fixed, ringRepairs, problem := checkRing(ring, i == 0)
+		repairs = appendIssues(repairs, ringRepairs...)
+		if problem != "" {
+			problems = appendIssues(problems, problem)
+		}
+		repaired.Coordinates = append(repaired.Coordinates, fixed)
+	}
+	return repaired, repairs, problems
+}
+
+// checkRing closes ring, drops its repeated vertices and fixes its orientation. problem is the first issue it
+// cannot repair: a position out of bounds, less than 3 distinct vertices, crossing edges or no area.
+func checkRing(ring [][]float64, exterior bool) ([][]float64, []string, string) {
+	repairs := []string{}
+	for _, position := range ring {
+		if len(position) < 2 || !validLongitude(position[0]) || !validLatitude(position[1]) {
+			return ring, repairs, issueOutOfBounds
+		}
+	}
+	open := ring
+	if len(open) > 1 && samePosition(open[0], open[len(open)-1]) {
+		open = open[:len(open)-1]
+	} else if len(open) > 0 {
+		repairs = append(repairs, issueUnclosedRing)
+	}
+	vertices := [][]float64{}
+	for _, position := range open {
+		if len(vertices) == 0 || !samePosition(vertices[len(vertices)-1], position) {
+			vertices = append(vertices, position)
+		}
+	}
+	for len(vertices) > 1 && samePosition(vertices[0], vertices[len(vertices)-1]) {
+		vertices = vertices[:len(vertices)-1]
+	}
+	if len(vertices) < len(open) {
+		repairs = append(repairs, issueRepeatedVertices)
+	}
+	if len(vertices) < minRingVertices {
+		return ring, repairs, issueTooFewVertices
+	}
+	// crossing edges are looked for first, the halves of a bowtie cancel out in the signed area
+	if selfIntersects(vertices) {
+		return ring, repairs, issueSelfIntersection
+	}
+	area := signedArea(vertices)
+	if math.Abs(area) < minRingArea {
+		return ring, repairs, issueDegenerate
+	}
+	if (area > 0) != exterior {
+		for i, j := 0, len(vertices)-1; i < j; i, j = i+1, j-1 {
+			vertices[i], vertices[j] = vertices[j], vertices[i]
+		}
+		repairs = append(repairs, issueWrongOrientation)
+	}
+	return append(vertices, vertices[0]), repairs, ""
+}
+
+func appendIssues(issues []string, added ...string) []string {
+	for _, issue := range added {
+		found := false
+		for _, existing := range issues {
+			found = found || existing == issue
+		}
+		if !found {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+func validLongitude(lon float64) bool {
+	return lon >= -180 && lon <= 180
+}
+
+func validLatitude(lat float64) bool {
+	return lat >= -90 && lat <= 90
+}
+
+func samePosition(a, b []float64) bool {
+	return a[0] == b[0] && a[1] == b[1]
+}
+
+// signedArea is the shoelace area of the open ring vertices, positive when they run counterclockwise.
+func signedArea(vertices [][]float64) float64 {
+	area := 0.0
+	for i := range vertices {
+		next := vertices[(i+1)%len(vertices)]
+		area += vertices[i][0]*next[1] - next[0]*vertices[i][1]
+	}
+	return area / 2
+}
+
+// selfIntersects tells whether two edges of the open ring vertices that do not follow each other touch.
+func selfIntersects(vertices [][]float64) bool {
+	n := len(vertices)
+	for i := 0; i < n; i++ {
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				continue
+			}
+			if segmentsIntersect(vertices[i], vertices[(i+1)%n], vertices[j], vertices[(j+1)%n]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func segmentsIntersect(a, b, c, d []float64) bool {
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(c, d, a)) || (d2 == 0 && onSegment(c, d, b)) ||
+		(d3 == 0 && onSegment(a, b, c)) || (d4 == 0 && onSegment(a, b, d))
+}
+
+func orientation(a, b, c []float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// onSegment tells whether p, known to be collinear with a and b, lies between them.
+func onSegment(a, b, p []float64) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
 func getFacetCount(ctx context.Context, strucs structure) int {
 	facets := strucs.Details["facets"]
 	facetsList, _ := facets.([]interface{})
@@ -370,6 +724,16 @@ func notificationWrapper(ctx context.Context, req sim2pdwInput) (map[string]inte
 
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(true, false, false, true, false)
+	var err error
+	commonHandler, err = common_handler.New(true, false, false, true, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	geometryPolicy, err = LoadGeometryPolicy()
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notificationWrapper)
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -865,12 +867,72 @@ func TestSim2Pdw(t *testing.T) {
 	awsClient.On("FetchS3BucketPath", "s3path").Return("bucket", "path", nil)
 	awsClient.On("GetDataFromS3", context.Background(), "bucket", "path").Return([]byte(sampleSimOutput), nil)
 	awsClient.On("StoreDataToS3", context.Background(), "", "/sim-pipeline/1/sim2pdw/pdw_payload.json", mock.Anything).Return(nil)
+	awsClient.On("StoreDataToS3", context.Background(), "", "/sim-pipeline/1/sim2pdw/detections.geojson", mock.Anything).Return(nil)
 	commonHandler.AwsClient = awsClient
 
 	resp, err := notificationWrapper(context.Background(), sim2pdwInput{SimOutput: "s3path", WorkflowId: "1", Address: "some address", ParcelId: "some id"})
 	assert.NoError(t, err)
 	assert.Equal(t, "success", resp["status"])
 	assert.Equal(t, "s3:///sim-pipeline/1/sim2pdw/pdw_payload.json", resp["pdwPayload"])
+	assert.Equal(t, "s3:///sim-pipeline/1/sim2pdw/detections.geojson", resp["geoJson"])
+	report := resp["geometry"].(GeometryReport)
+	assert.Equal(t, 5, report.Checked)
+	assert.Equal(t, 0, report.Dropped)
+}
+
+func TestSim2PdwWithoutGeoJSON(t *testing.T) {
+	awsClient := new(mocks.IAWSClient)
+	awsClient.On("FetchS3BucketPath", "s3path").Return("bucket", "path", nil)
+	awsClient.On("GetDataFromS3", context.Background(), "bucket", "path").Return([]byte(sampleSimOutput), nil)
+	awsClient.On("StoreDataToS3", context.Background(), "", "/sim-pipeline/1/sim2pdw/pdw_payload.json", mock.Anything).Return(nil)
+	awsClient.On("StoreDataToS3", context.Background(), "", "/sim-pipeline/1/sim2pdw/detections.geojson", mock.Anything).Return(errors.New("access denied"))
+	commonHandler.AwsClient = awsClient
+
+	resp, err := notificationWrapper(context.Background(), sim2pdwInput{SimOutput: "s3path", WorkflowId: "1", Address: "some address", ParcelId: "some id"})
+	assert.NoError(t, err)
+	assert.Equal(t, "success", resp["status"])
+	assert.Equal(t, "s3:///sim-pipeline/1/sim2pdw/pdw_payload.json", resp["pdwPayload"])
+	assert.NotContains(t, resp, "geoJson")
+}
+
+func TestSim2GeoJSON(t *testing.T) {
+	output := SimOutput{}
+	assert.NoError(t, json.Unmarshal([]byte(sampleSimOutput), &output))
+
+	collection := sim2GeoJSON(context.Background(), &output)
+	assert.Equal(t, "FeatureCollection", collection.Type)
+	assert.Len(t, collection.Features, len(output.Structure)+1)
+	primary := collection.Features[0]
+	assert.Equal(t, "Feature", primary.Type)
+	assert.Equal(t, map[string]interface{}{"type": "building", "subType": "building", "confidence": 0.595, "primary": true}, primary.Properties)
+	assert.Equal(t, "Polygon", primary.Geometry.Type)
+	assert.Equal(t, []float64{-74.1445128, 40.619855}, primary.Geometry.Coordinates[0][0])
+
+	footprint := collection.Features[len(collection.Features)-1]
+	assert.Equal(t, imageFootprintTag, footprint.Properties["type"])
+	assert.Equal(t, [][][]float64{{
+		{-74.144615, 40.619918},
+		{-74.144615, 40.619664},
+		{-74.144216, 40.619664},
+		{-74.144216, 40.619918},
+		{-74.144615, 40.619918},
+	}}, footprint.Geometry.Coordinates)
+
+	data, err := json.Marshal(collection)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), `"crs"`)
+}
+
+func TestSim2GeoJSONWithoutImageCorners(t *testing.T) {
+	output := SimOutput{Structure: []structure{{Type: "trampoline", SubType: "trampoline"}}}
+
+	collection := sim2GeoJSON(context.Background(), &output)
+	assert.Len(t, collection.Features, 1)
+	assert.Nil(t, collection.Features[0].Geometry)
+
+	data, err := json.Marshal(collection)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"geometry":null`)
 }
 
 func TestSim2PdwWrongData(t *testing.T) {
@@ -896,3 +958,111 @@ func TestSim2PdwWrongInput(t *testing.T) {
 	assert.Equal(t, error_codes.ErrorValidatingSim2PDWRequest, err2.GetErrorCode())
 	assert.Equal(t, "failure", resp["status"])
 }
+
+func square(positions ...[]float64) geometry {
+	return geometry{Type: "Polygon", Coordinates: [][][]float64{positions}}
+}
+
+func TestCheckGeometryRepairsRing(t *testing.T) {
+	// clockwise, open and with a repeated vertex
+	g := square([]float64{-74.1, 40.6}, []float64{-74.1, 40.7}, []float64{-74.1, 40.7}, []float64{-74.0, 40.7}, []float64{-74.0, 40.6})
+
+	repaired, repairs, problems := checkGeometry(g)
+	assert.Empty(t, problems)
+	assert.Equal(t, []string{issueUnclosedRing, issueRepeatedVertices, issueWrongOrientation}, repairs)
+	assert.Equal(t, [][][]float64{{{-74.0, 40.6}, {-74.0, 40.7}, {-74.1, 40.7}, {-74.1, 40.6}, {-74.0, 40.6}}}, repaired.Coordinates)
+	assert.Greater(t, signedArea(repaired.Coordinates[0][:4]), 0.0)
+}
+
+func TestCheckGeometryHoleRunsClockwise(t *testing.T) {
+	g := square([]float64{0, 0}, []float64{4, 0}, []float64{4, 4}, []float64{0, 4}, []float64{0, 0})
+	g.Coordinates = append(g.Coordinates, [][]float64{{1, 1}, {2, 1}, {2, 2}, {1, 2}, {1, 1}})
+
+	repaired, repairs, problems := checkGeometry(g)
+	assert.Empty(t, problems)
+	assert.Equal(t, []string{issueWrongOrientation}, repairs)
+	assert.Equal(t, [][]float64{{1, 2}, {2, 2}, {2, 1}, {1, 1}, {1, 2}}, repaired.Coordinates[1])
+}
+
+func TestCheckGeometryProblems(t *testing.T) {
+	tests := map[string]struct {
+		geometry geometry
+		problem  string
+	}{
+		"unsupported type":    {geometry{Type: "MultiPolygon"}, issueUnsupportedType},
+		"missing coordinates": {geometry{Type: "Polygon"}, issueMissingCoordinates},
+		"out of bounds":       {square([]float64{40.6, -74.1}, []float64{40.7, -74.1}, []float64{40.7, -200}, []float64{40.6, -74.1}), issueOutOfBounds},
+		"too few vertices":    {square([]float64{0, 0}, []float64{1, 0}, []float64{0, 0}), issueTooFewVertices},
+		"degenerate":          {square([]float64{0, 0}, []float64{1, 1}, []float64{2, 2}, []float64{0, 0}), issueDegenerate},
+		"self intersection":   {square([]float64{0, 0}, []float64{1, 1}, []float64{1, 0}, []float64{0, 1}, []float64{0, 0}), issueSelfIntersection},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, problems := checkGeometry(test.geometry)
+			assert.Equal(t, []string{test.problem}, problems)
+		})
+	}
+}
+
+func TestValidateGeometriesPolicies(t *testing.T) {
+	valid := square([]float64{0, 0}, []float64{1, 0}, []float64{1, 1}, []float64{0, 1}, []float64{0, 0})
+	open := square([]float64{0, 0}, []float64{1, 0}, []float64{1, 1}, []float64{0, 1})
+	bowtie := square([]float64{0, 0}, []float64{1, 1}, []float64{1, 0}, []float64{0, 1}, []float64{0, 0})
+	simOutput := func() *SimOutput {
+		return &SimOutput{Structure: []structure{
+			{Type: "building", Geometry: valid},
+			{Type: "swimming pool", Geometry: open},
+			{Type: "trampoline", Geometry: bowtie},
+		}}
+	}
+
+	dropped := simOutput()
+	report := validateGeometries(context.Background(), dropped, dropInvalidGeometry)
+	assert.Equal(t, GeometryReport{Checked: 3, Valid: 1, Repaired: 1, Dropped: 1,
+		Issues: map[string]int{issueUnclosedRing: 1, issueSelfIntersection: 1}}, report)
+	assert.Len(t, dropped.Structure, 3)
+	assert.Equal(t, valid.Coordinates, dropped.Structure[1].Geometry.Coordinates)
+	assert.True(t, dropped.Structure[2].GeometryDropped)
+	payload := setPayloadAttributes(context.Background(), *dropped, dropped.Structure[2], nil, "", "", "")
+	assert.NotContains(t, payload.Attributes, "outline")
+	assert.Nil(t, sim2GeoJSON(context.Background(), dropped).Features[2].Geometry)
+
+	flagged := simOutput()
+	report = validateGeometries(context.Background(), flagged, flagInvalidGeometry)
+	assert.Equal(t, 1, report.Flagged)
+	assert.Equal(t, 0, report.Dropped)
+	assert.Len(t, flagged.Structure, 3)
+	payload = setPayloadAttributes(context.Background(), *flagged, flagged.Structure[2], nil, "", "", "")
+	assert.Equal(t, []string{issueSelfIntersection}, payload.Attributes["outline"].Meta["geometryIssues"])
+	assert.Equal(t, []string{issueSelfIntersection}, sim2GeoJSON(context.Background(), flagged).Features[2].Properties["geometryIssues"])
+}
+
+func TestDroppedGeometryKeepsDetectedCounts(t *testing.T) {
+	valid := square([]float64{0, 0}, []float64{1, 0}, []float64{1, 1}, []float64{0, 1}, []float64{0, 0})
+	bowtie := square([]float64{0, 0}, []float64{1, 1}, []float64{1, 0}, []float64{0, 1}, []float64{0, 0})
+	simOutput := &SimOutput{Structure: []structure{
+		{Type: "building", Primary: true, Geometry: bowtie, Details: map[string]interface{}{}},
+		{Type: "building", Geometry: valid},
+	}}
+	report := validateGeometries(context.Background(), simOutput, dropInvalidGeometry)
+	assert.Equal(t, 1, report.Dropped)
+
+	payloads, err := sim2Pdw(context.Background(), simOutput, "parcel", "address")
+	assert.NoError(t, err)
+	parcel := payloads[len(payloads)-1]
+	assert.Equal(t, 2, parcel.Attributes["detectedBuildingCount"].Value)
+	roof := payloads[len(payloads)-2]
+	assert.Equal(t, "Roof", roof.Asset.Type)
+	assert.Contains(t, roof.Attributes, "countRoofFacets")
+	assert.NotContains(t, roof.Attributes, "outline")
+}
+
+func TestLoadGeometryPolicy(t *testing.T) {
+	policy, err := LoadGeometryPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, dropInvalidGeometry, policy)
+
+	t.Setenv(GeometryPolicy, "repair")
+	_, err = LoadGeometryPolicy()
+	assert.Equal(t, error_codes.ErrorLoadingGeometryPolicy, err.(error_handler.ICodedError).GetErrorCode())
+}
@@ -2,100 +2,463 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.eagleview.com/engineering/assess-platform-library/log"
 	"github.eagleview.com/engineering/symphony-service/commons/common_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/config_loader"
 	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
-	"github.eagleview.com/engineering/symphony-service/commons/enums"
 	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
 	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/execution_path"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-var commonHandler common_handler.CommonHandler
+var (
+	commonHandler common_handler.CommonHandler
+	policy        *ThrottlePolicy
+
+	throttlePolicySource = config_loader.Source{Name: "throttle policy", Env: ThrottlePolicyConfig, S3Env: ThrottlePolicyS3Path, Code: error_codes.ErrorLoadingThrottlePolicy}
+)
 
 const (
 	Success  = "success"
 	loglevel = "info"
 	failed   = "failed"
-	hipster  = "Hipster"
-	twister  = "Twister"
+
+	WindowDay  = execution_path.WindowDay
+	WindowHour = execution_path.WindowHour
+
+	defaultTimeZone  = documentDB_client.PSTTimeZone
+	defaultResetTime = "00:00"
+	quotaRetention   = 7 * 24 * time.Hour
+	eligibilityRule  = "eligibility"
+	noRule           = "default"
+	customerField    = "customerId"
+	sourceField      = "source"
+	hipsterFlag      = "isHipsterEnabled"
 )
 
 type eventData struct {
-	ReportID         string `json:"reportId"`
-	OrderID          string `json:"orderId"`
-	WorkflowID       string `json:"workflowId"`
-	OrderType        string `json:"orderType"`
-	IsPenetration    bool   `json:"isPenetration"`
-	IsHipsterEnabled bool   `json:"isHipsterEnabled"`
+	ReportID         string                 `json:"reportId"`
+	OrderID          string                 `json:"orderId"`
+	WorkflowID       string                 `json:"workflowId"`
+	OrderType        string                 `json:"orderType"`
+	IsPenetration    bool                   `json:"isPenetration"`
+	IsHipsterEnabled bool                   `json:"isHipsterEnabled"`
+	Input            map[string]interface{} `json:"input"`
+}
+
+const (
+	AllowedHipsterCount  = "AllowedHipsterCount"
+	ThrottlePolicyConfig = "ThrottlePolicy"
+	ThrottlePolicyS3Path = "ThrottlePolicyS3Path"
+)
+
+// ThrottleScope restricts a rule to some orders, an empty list matches every order.
+type ThrottleScope struct {
+	ProductTypes []string `json:"productTypes"`
+	Customers    []string `json:"customers"`
+	Sources      []string `json:"sources"`
+}
+
+// ThrottleRule sends the orders of its scope to Path, one of the registered execution paths. A rule with a Limit
+// only lets Limit workflows of its scope take Path per Window, the orders over the limit look for another path.
+type ThrottleRule struct {
+	Name   string        `json:"name"`
+	Scope  ThrottleScope `json:"scope"`
+	Window string        `json:"window"`
+	Limit  *int64        `json:"limit"`
+	Path   string        `json:"path"`
+}
+
+// ThrottlePolicy holds the rules evaluated in order for every order eligible for a path besides the default one. Day windows start at
+// ResetTime, written as 15:04, in TimeZone and hour windows start at the same minute of every hour.
+type ThrottlePolicy struct {
+	TimeZone  string         `json:"timeZone"`
+	ResetTime string         `json:"resetTime"`
+	Rules     []ThrottleRule `json:"rules"`
+
+	location    *time.Location
+	resetHour   int
+	resetMinute int
+}
+
+// RuleOutcome explains what a matching rule did with the order, Slot and Count are only set for limited rules.
+type RuleOutcome struct {
+	Rule    string `json:"rule"`
+	Path    string `json:"path"`
+	Quota   string `json:"quota,omitempty"`
+	Limit   int64  `json:"limit,omitempty"`
+	Slot    int64  `json:"slot,omitempty"`
+	Count   int64  `json:"count,omitempty"`
+	Outcome string `json:"outcome"`
 }
 
-const AllowedHipsterCount = "AllowedHipsterCount"
+// PathDecision is the path chosen for an order, the rule that decided it and the outcome of every matching rule.
+type PathDecision struct {
+	Path   string        `json:"path"`
+	Rule   string        `json:"rule"`
+	Reason string        `json:"reason"`
+	Rules  []RuleOutcome `json:"rules"`
+}
+
+const (
+	outcomeMatched = "matched"
+	outcomeGranted = "granted"
+	outcomeFull    = "full"
+)
+
+// executionPath is the outcome of the throttle, Slot is the slot reserved for the workflow or 0 on a path taken
+// without a limit. TodayCount and Threshold describe the limited rule that decided the path.
+type executionPath struct {
+	Path             string
+	TodayCount       int64
+	Threshold        int64
+	Slot             int64
+	IsHipsterAllowed bool
+	EligiblePaths    []string
+	Decision         PathDecision
+}
 
 func handler(ctx context.Context, eventData *eventData) (map[string]interface{}, error) {
 
 	log.Infof(ctx, "Reached throttle logic handler")
 	ctx = log_config.SetTraceIdInContext(ctx, eventData.ReportID, eventData.WorkflowID)
 
-	// set the execution to twister or hipster
-	Path, todayCount, thresholdVal, isHipsterAllowed, err := getWorkflowExecutionPath(ctx, eventData)
+	// set the execution to one of the registered paths
+	execution, err := getWorkflowExecutionPath(ctx, eventData, time.Now())
 	if err != nil {
 		return map[string]interface{}{"status": failed}, err
 	}
 
-	if Path == "Twister" {
-		query := bson.M{"_id": eventData.WorkflowID}
-		setrecord := bson.M{
-			"$set": bson.M{
-				"flowType": Path,
-			}}
+	// the flowType is written right away so the workflow counts on its path as soon as it holds a slot
+	query := bson.M{"_id": eventData.WorkflowID}
+	setrecord := bson.M{
+		"$set": bson.M{
+			"flowType": execution.Path,
+		}}
 
-		err = commonHandler.DBClient.UpdateDocumentDB(ctx, query, setrecord, documentDB_client.WorkflowDataCollection)
+	err = commonHandler.DBClient.UpdateDocumentDB(ctx, query, setrecord, documentDB_client.WorkflowDataCollection)
+	if err != nil {
+		log.Errorf(ctx, "Unable to UpdateDocumentDB error = %s", err)
+		if execution.Slot > 0 {
+			releaseHipsterSlot(ctx, eventData.WorkflowID)
+		}
+		return map[string]interface{}{"status": failed}, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
+	}
+	path, _ := execution_path.Paths().Get(execution.Path)
+	return map[string]interface{}{"Path": execution.Path, "Route": path.Route, "status": Success, "TodayHipsterCountBeforeCurrentOrder": execution.TodayCount, "HipsterThresholdValue": execution.Threshold, "isHipsterAllowed": execution.IsHipsterAllowed, "HipsterSlot": execution.Slot, "EligiblePaths": execution.EligiblePaths, "Decision": execution.Decision}, nil
+}
+
+func getWorkflowExecutionPath(ctx context.Context, eventData *eventData, now time.Time) (executionPath, error) {
+	paths := execution_path.Paths()
+	fallback := paths.Default().Name
+	eligible := eligiblePaths(ctx, eventData)
+	execution := executionPath{Path: fallback, EligiblePaths: eligible.Names()}
+	_, execution.IsHipsterAllowed = eligible.Get(execution_path.Hipster)
+	if len(eligible) == 0 || (len(eligible) == 1 && eligible[0].Default) {
+		execution.Decision = PathDecision{Path: fallback, Rule: eligibilityRule, Reason: "order is only eligible for " + fallback, Rules: []RuleOutcome{}}
+		// the count is only reported for orders that cannot go to hipster, it does not take a slot
+		if limit := policy.hipsterDailyLimit(); limit != nil {
+			count, err := commonHandler.DBClient.GetHipsterCountPerDay(ctx)
+			if err != nil {
+				log.Errorf(ctx, "Unable to Fetch from DocumentDb error = %s", err)
+				return execution, error_handler.NewServiceError(error_codes.ErrorFetchingHipsterCountFromDB, err.Error())
+			}
+			execution.TodayCount, execution.Threshold = count, *limit
+		}
+		log.Infof(ctx, "Path is set as %s", fallback)
+		return execution, nil
+	}
+
+	decision, err := policy.Evaluate(ctx, eventData, eligible, now)
+	if err != nil {
+		log.Errorf(ctx, "Unable to reserve a slot error = %s", err)
+		releaseHipsterSlot(ctx, eventData.WorkflowID)
+		return execution, error_handler.NewServiceError(error_codes.ErrorReservingHipsterSlot, err.Error())
+	}
+	execution.Path = decision.Path
+	execution.Decision = decision
+	for _, outcome := range decision.Rules {
+		if outcome.Rule == decision.Rule && outcome.Quota != "" {
+			execution.Threshold = outcome.Limit
+			execution.TodayCount = outcome.Count
+			// slots are numbered in the order they were handed out in the window, released ones included
+			if outcome.Outcome == outcomeGranted {
+				execution.Slot = outcome.Slot
+				execution.TodayCount = outcome.Slot - 1
+			}
+		}
+	}
+	log.Infof(ctx, "Path is set as %s by rule %s: %s", decision.Path, decision.Rule, decision.Reason)
+	return execution, nil
+}
+
+// Evaluate runs the rules of the eligible paths in order. The first matching rule without a limit decides the
+// path. A limited rule with a free slot makes its path the candidate and lets the next rules of that path add
+// their own limits, a full one rules its path out and gives back the slots already taken. The order goes to the
+// candidate left at the end, or to the default path.
+func (policy *ThrottlePolicy) Evaluate(ctx context.Context, eventData *eventData, eligible execution_path.Registry, now time.Time) (PathDecision, error) {
+	fallback := execution_path.Paths().Default().Name
+	outcomes := []RuleOutcome{}
+	candidate := ""
+	granted := []string{}
+	ruledOut := map[string]bool{}
+	var full *PathDecision
+	for _, rule := range policy.Rules {
+		if _, ok := eligible.Get(rule.Path); !ok || ruledOut[rule.Path] || !rule.Scope.matches(eventData) {
+			continue
+		}
+		if rule.Limit == nil {
+			outcomes = append(outcomes, RuleOutcome{Rule: rule.Name, Path: rule.Path, Outcome: outcomeMatched})
+			if candidate != "" && candidate != rule.Path {
+				if _, err := commonHandler.DBClient.ReleaseHipsterSlot(ctx, eventData.WorkflowID); err != nil {
+					return PathDecision{}, err
+				}
+			}
+			return PathDecision{Path: rule.Path, Rule: rule.Name, Reason: fmt.Sprintf("rule %s sends its orders to %s", rule.Name, rule.Path), Rules: outcomes}, nil
+		}
+		if candidate != "" && candidate != rule.Path {
+			continue
+		}
+		quota := policy.quota(rule, now)
+		reservation, err := commonHandler.DBClient.ReserveHipsterSlot(ctx, quota, eventData.WorkflowID, *rule.Limit, policy.quotaExpiry(rule, now))
 		if err != nil {
-			log.Errorf(ctx, "Unable to UpdateDocumentDB error = %s", err)
-			return map[string]interface{}{"status": failed}, error_handler.NewServiceError(error_codes.ErrorUpdatingWorkflowDataInDB, err.Error())
+			return PathDecision{}, err
+		}
+		outcome := RuleOutcome{Rule: rule.Name, Path: rule.Path, Quota: quota, Limit: *rule.Limit, Slot: reservation.Slot, Count: reservation.Count}
+		if !reservation.Reserved {
+			outcome.Path = fallback
+			outcome.Outcome = outcomeFull
+			outcomes = append(outcomes, outcome)
+			ruledOut[rule.Path] = true
+			if candidate != "" {
+				if _, err = commonHandler.DBClient.ReleaseHipsterSlot(ctx, eventData.WorkflowID); err != nil {
+					return PathDecision{}, err
+				}
+				candidate, granted = "", []string{}
+			}
+			full = &PathDecision{Rule: rule.Name, Reason: fmt.Sprintf("all %d slots of rule %s are taken for the %s", *rule.Limit, rule.Name, rule.Window)}
+			continue
+		}
+		outcome.Outcome = outcomeGranted
+		outcomes = append(outcomes, outcome)
+		candidate = rule.Path
+		granted = append(granted, rule.Name)
+	}
+	if candidate != "" {
+		decidedBy := granted[len(granted)-1]
+		return PathDecision{Path: candidate, Rule: decidedBy, Reason: "order is within the limits of rules " + strings.Join(granted, ", "), Rules: outcomes}, nil
+	}
+	if full != nil {
+		return PathDecision{Path: fallback, Rule: full.Rule, Reason: full.Reason, Rules: outcomes}, nil
+	}
+	return PathDecision{Path: fallback, Rule: noRule, Reason: "no rule matches the order", Rules: outcomes}, nil
+}
+
+func (scope ThrottleScope) matches(eventData *eventData) bool {
+	return matchesAny(scope.ProductTypes, eventData.OrderType) &&
+		matchesAny(scope.Customers, inputField(eventData.Input, customerField)) &&
+		matchesAny(scope.Sources, inputField(eventData.Input, sourceField))
+}
+
+func matchesAny(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if v == value {
+			return true
 		}
 	}
-	return map[string]interface{}{"Path": Path, "status": Success, "TodayHipsterCountBeforeCurrentOrder": todayCount, "HipsterThresholdValue": thresholdVal, "isHipsterAllowed":  isHipsterAllowed}, nil
+	return false
 }
 
-func getWorkflowExecutionPath(ctx context.Context, eventData *eventData) (string, int64, int64, bool, error) {
-	var threshold, count int64
-	isHipsterAllowed :=  hipsterAllowed(ctx, eventData)
-	threshold, err := strconv.ParseInt(os.Getenv(AllowedHipsterCount), 10, 64)
+func inputField(input map[string]interface{}, field string) string {
+	if value, ok := input[field]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// quota names the counter of rule for the window containing now, after the rule and the start of the window.
+// The default Hipster rule keeps counting on the PST date quotas were stored under before throttle policies, so the
+// day of a deploy does not start again from 0.
+func (policy *ThrottlePolicy) quota(rule ThrottleRule, now time.Time) string {
+	start := policy.windowStart(rule.Window, now)
+	if policy.countsLegacyDailyQuota(rule) {
+		return start.Format("2006-01-02")
+	}
+	return rule.Name + "/" + start.Format("2006-01-02T15:04")
+}
+
+func (policy *ThrottlePolicy) countsLegacyDailyQuota(rule ThrottleRule) bool {
+	hipster, ok := execution_path.Paths().Get(execution_path.Hipster)
+	return ok && hipster.Quota != nil && rule.Name == defaultRuleName(hipster) && rule.Path == hipster.Name && rule.Window == WindowDay &&
+		policy.TimeZone == defaultTimeZone && policy.resetHour == 0 && policy.resetMinute == 0
+}
+
+// quotaExpiry keeps the quota of rule for quotaRetention after the end of the window containing now.
+func (policy *ThrottlePolicy) quotaExpiry(rule ThrottleRule, now time.Time) time.Time {
+	start := policy.windowStart(rule.Window, now)
+	if rule.Window == WindowHour {
+		return start.Add(time.Hour + quotaRetention)
+	}
+	return start.AddDate(0, 0, 1).Add(quotaRetention)
+}
+
+// hipsterDailyLimit is the limit of the first daily rule sending orders to Hipster, nil when no rule limits it.
+func (policy *ThrottlePolicy) hipsterDailyLimit() *int64 {
+	for _, rule := range policy.Rules {
+		if rule.Path == execution_path.Hipster && rule.Window == WindowDay && rule.Limit != nil {
+			return rule.Limit
+		}
+	}
+	return nil
+}
+
+func (policy *ThrottlePolicy) windowStart(window string, now time.Time) time.Time {
+	local := now.In(policy.location)
+	y, m, d := local.Date()
+	start := time.Date(y, m, d, policy.resetHour, policy.resetMinute, 0, 0, policy.location)
+	if start.After(local) {
+		start = time.Date(y, m, d-1, policy.resetHour, policy.resetMinute, 0, 0, policy.location)
+	}
+	if window == WindowHour {
+		start = start.Add(local.Sub(start).Truncate(time.Hour))
+	}
+	return start
+}
+
+// LoadThrottlePolicy reads the policy from the ThrottlePolicy JSON, or from the S3 object at ThrottlePolicyS3Path.
+// Without either the policy is built from the quotas of the registered paths.
+func LoadThrottlePolicy(ctx context.Context) (*ThrottlePolicy, error) {
+	loaded := &ThrottlePolicy{}
+	found, err := throttlePolicySource.Decode(ctx, commonHandler.AwsClient, loaded)
 	if err != nil {
-		log.Errorf(ctx, "Unable to convert string to int64 error = %s", err)
-		return "", count, threshold, isHipsterAllowed, error_handler.NewServiceError(error_codes.ErrorConvertingAllowedHipsterCountToInteger, err.Error())
+		return nil, err
+	}
+	if !found {
+		return DefaultThrottlePolicy()
+	}
+	return loaded, nil
+}
+
+// DefaultThrottlePolicy has one rule per registered path with a quota, letting the number of workflows read from
+// the quota LimitEnv take the path per PST day or hour.
+func DefaultThrottlePolicy() (*ThrottlePolicy, error) {
+	defaults := &ThrottlePolicy{Rules: []ThrottleRule{}}
+	for _, path := range execution_path.Paths() {
+		if path.Quota == nil {
+			continue
+		}
+		threshold, err := strconv.ParseInt(os.Getenv(path.Quota.LimitEnv), 10, 64)
+		if err != nil {
+			return nil, error_handler.NewServiceError(error_codes.ErrorConvertingAllowedHipsterCountToInteger, err.Error())
+		}
+		defaults.Rules = append(defaults.Rules, ThrottleRule{Name: defaultRuleName(path), Window: path.Quota.Window, Limit: &threshold, Path: path.Name})
+	}
+	if err := throttlePolicySource.Validate(defaults); err != nil {
+		return nil, err
 	}
+	return defaults, nil
+}
+
+func defaultRuleName(path execution_path.Path) string {
+	if path.Quota.Window == WindowHour {
+		return strings.ToLower(path.Name) + "-hourly"
+	}
+	return strings.ToLower(path.Name) + "-daily"
+}
 
-	// Get the count of data from documnetDB for last 24 hours UTC
-	count, err = commonHandler.DBClient.GetHipsterCountPerDay(ctx)
+// Validate reports every problem of the policy and prepares its time zone and reset time, it has to succeed
+// before the policy is evaluated.
+func (policy *ThrottlePolicy) Validate() error {
+	problems := config_loader.Problems{}
+	if policy.TimeZone == "" {
+		policy.TimeZone = defaultTimeZone
+	}
+	location, err := time.LoadLocation(policy.TimeZone)
 	if err != nil {
-		log.Errorf(ctx, "Unable to Fetch from DocumentDb error = %s", err)
-		return "", count, threshold, isHipsterAllowed, error_handler.NewServiceError(error_codes.ErrorFetchingHipsterCountFromDB, err.Error())
+		problems.Add("time zone %s is unknown", policy.TimeZone)
+	}
+	policy.location = location
+	if policy.ResetTime == "" {
+		policy.ResetTime = defaultResetTime
 	}
+	reset, err := time.Parse("15:04", policy.ResetTime)
+	if err != nil {
+		problems.Add("reset time %s should be written as HH:MM", policy.ResetTime)
+	}
+	policy.resetHour, policy.resetMinute = reset.Hour(), reset.Minute()
 
-	// Move to hipster only when count is less than threshold and product matches
-	
-	if (count < threshold) && isHipsterAllowed {
-		log.Infof(ctx, "Path is set as hipster", err)
-		return hipster, count, threshold, isHipsterAllowed, nil
+	names := map[string]bool{}
+	for i, rule := range policy.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+			problems.Add("%s has no name", name)
+		} else if strings.Contains(name, "/") {
+			problems.Add("%s should not contain /", name)
+		} else if names[name] {
+			problems.Add("%s is used by several rules", name)
+		}
+		names[name] = true
+		path, registered := execution_path.Paths().Get(rule.Path)
+		if !registered {
+			problems.Add("%s has unsupported path %s", name, rule.Path)
+		}
+		for _, productType := range rule.Scope.ProductTypes {
+			if !path.Accepts(execution_path.Order{ProductType: productType, Flags: map[string]bool{path.Eligibility.EnabledFlag: true}}) {
+				problems.Add("%s has product type %s not accepted by path %s", name, productType, rule.Path)
+			}
+		}
+		if rule.Limit == nil {
+			if rule.Window != "" {
+				problems.Add("%s has a window but no limit", name)
+			}
+			continue
+		}
+		if path.Default {
+			problems.Add("%s cannot limit the default path %s", name, rule.Path)
+		}
+		if *rule.Limit < 0 {
+			problems.Add("%s should not have a negative limit", name)
+		}
+		if rule.Window != WindowDay && rule.Window != WindowHour {
+			problems.Add("%s has unsupported window %s", name, rule.Window)
+		}
+	}
+	return problems.Err("throttle policy")
+}
+
+// releaseHipsterSlot gives the slot back when the workflow could not be recorded as Hipster, a failure is only
+// logged since the datastore releases the slot again if the workflow later fails or falls back to Twister.
+func releaseHipsterSlot(ctx context.Context, workflowId string) {
+	if _, err := commonHandler.DBClient.ReleaseHipsterSlot(ctx, workflowId); err != nil {
+		log.Errorf(ctx, "Unable to release the hipster slot error = %s", err)
 	}
-	log.Infof(ctx, "Path is set as twister", err)
-	return twister, count, threshold, isHipsterAllowed, nil
 }
 
-func hipsterAllowed(ctx context.Context, eventData *eventData) bool {
-	log.Infof(ctx, "Checking Hipster is allowed or not")
-	if eventData.IsPenetration || !enums.IsHipsterCompatible(eventData.OrderType) || !eventData.IsHipsterEnabled {
-		return false
+// eligiblePaths returns the registered paths the order may take, the boolean execution input fields are the flags
+// enabling a path.
+func eligiblePaths(ctx context.Context, eventData *eventData) execution_path.Registry {
+	log.Infof(ctx, "Checking the paths allowed for the order")
+	flags := map[string]bool{hipsterFlag: eventData.IsHipsterEnabled}
+	for field, value := range eventData.Input {
+		if enabled, ok := value.(bool); ok && field != hipsterFlag {
+			flags[field] = enabled
+		}
 	}
-	return true
+	order := execution_path.Order{ProductType: eventData.OrderType, IsPenetration: eventData.IsPenetration, Flags: flags}
+	return execution_path.Paths().Eligible(order)
 }
 
 func notifcationWrapper(ctx context.Context, eventData *eventData) (map[string]interface{}, error) {
@@ -109,7 +472,22 @@ func notifcationWrapper(ctx context.Context, eventData *eventData) (map[string]i
 
 func main() {
 	log_config.InitLogging(loglevel)
-	commonHandler = common_handler.New(false, false, true, false, false)
+	var err error
+	commonHandler, err = common_handler.New(os.Getenv(ThrottlePolicyS3Path) != "", false, true, false, false)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	_, err = execution_path.Load()
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
+	policy, err = LoadThrottlePolicy(context.Background())
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	lambda.Start(notifcationWrapper)
 
 }
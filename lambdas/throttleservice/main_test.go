@@ -4,10 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.eagleview.com/engineering/symphony-service/commons/documentDB_client"
+	"github.eagleview.com/engineering/symphony-service/commons/error_codes"
+	"github.eagleview.com/engineering/symphony-service/commons/error_handler"
+	"github.eagleview.com/engineering/symphony-service/commons/execution_path"
 	"github.eagleview.com/engineering/symphony-service/commons/log_config"
 	"github.eagleview.com/engineering/symphony-service/commons/mocks"
 )
@@ -23,70 +31,75 @@ var eventTestData string = `{
 
 var testContext = log_config.SetTraceIdInContext(context.Background(), "44825849", "9cabffdf-e980-0bbf-b481-0048f7a88bef")
 
+var testNow = time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+
+func useDefaultPolicy(t *testing.T, allowed string) {
+	t.Setenv(AllowedHipsterCount, allowed)
+	var err error
+	policy, err = LoadThrottlePolicy(context.Background())
+	assert.NoError(t, err)
+}
+
+func usePolicy(t *testing.T, document string) {
+	t.Setenv(ThrottlePolicyConfig, document)
+	var err error
+	policy, err = LoadThrottlePolicy(context.Background())
+	assert.NoError(t, err)
+}
+
 func TestThrottleLambdaTwisterFlow(t *testing.T) {
+	useDefaultPolicy(t, "50")
 	dBClient := new(mocks.IDocDBClient)
 
 	eventDataRequestObj := &eventData{}
 	mydata := []byte(eventTestData)
 	json.Unmarshal(mydata, &eventDataRequestObj)
 
-	var count int64 = 52
-	var AllowedHipsterCount int64= 50
-	expectedResp := map[string]interface{}{"Path": "Twister", "status": Success, "TodayHipsterCountBeforeCurrentOrder": count, "HipsterThresholdValue": AllowedHipsterCount, "isHipsterAllowed": false }
+	decision := PathDecision{Path: "Twister", Rule: "eligibility", Reason: "order is only eligible for Twister", Rules: []RuleOutcome{}}
+	expectedResp := map[string]interface{}{"Path": "Twister", "Route": "default", "status": Success, "TodayHipsterCountBeforeCurrentOrder": int64(12), "HipsterThresholdValue": int64(50), "isHipsterAllowed": false, "HipsterSlot": int64(0), "EligiblePaths": []string{"Twister"}, "Decision": decision}
 	commonHandler.DBClient = dBClient
-	
-	t.Setenv("AllowedHipsterCount", "50")
-	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(count, nil)
+
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(int64(12), nil)
 
 	resp, err := notifcationWrapper(context.Background(), eventDataRequestObj)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedResp, resp)
+	dBClient.AssertNotCalled(t, "ReserveHipsterSlot", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
 
 }
 
-func TestThrottleLambdaGetHipsterCountPerDayError(t *testing.T) {
+func TestThrottleLambdaReserveHipsterSlotError(t *testing.T) {
+	useDefaultPolicy(t, "50")
 	dBClient := new(mocks.IDocDBClient)
 	slackclient := new(mocks.ISlackClient)
 	eventDataRequestObj := &eventData{}
 	mydata := []byte(eventTestData)
 	json.Unmarshal(mydata, &eventDataRequestObj)
+	eventDataRequestObj.IsPenetration = false
 
 	expectedResp := map[string]interface{}{"status": failed}
 	commonHandler.DBClient = dBClient
 	commonHandler.SlackClient = slackclient
-	var count int64 = 52
-	t.Setenv("AllowedHipsterCount", "50")
-	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(count, errors.New("some error"))
-	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(nil)
-	slackclient.Mock.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	dBClient.Mock.On("ReserveHipsterSlot", testContext, mock.Anything, eventDataRequestObj.WorkflowID, int64(50), mock.Anything).Return(documentDB_client.HipsterReservation{}, errors.New("some error"))
+	dBClient.Mock.On("ReleaseHipsterSlot", testContext, eventDataRequestObj.WorkflowID).Return(false, nil)
+	slackclient.Mock.On("SendErrorMessage", error_codes.ErrorReservingHipsterSlot, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	resp, err := notifcationWrapper(context.Background(), eventDataRequestObj)
 	assert.Error(t, err)
 	assert.Equal(t, expectedResp, resp)
+	slackclient.AssertExpectations(t)
 
 }
 func TestThrottleLambdaErrorStringParse(t *testing.T) {
-	dBClient := new(mocks.IDocDBClient)
-	slackclient := new(mocks.ISlackClient)
-	eventDataRequestObj := &eventData{}
-	mydata := []byte(eventTestData)
-	json.Unmarshal(mydata, &eventDataRequestObj)
-
-	expectedResp := map[string]interface{}{"status": failed}
-	commonHandler.DBClient = dBClient
-	commonHandler.SlackClient = slackclient
-	var count int64 = 52
 	t.Setenv("AllowedHipsterCount", "abc")
-	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(count, nil)
-	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("some error"))
-	slackclient.Mock.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
-	resp, err := notifcationWrapper(context.Background(), eventDataRequestObj)
+	_, err := LoadThrottlePolicy(context.Background())
 	assert.Error(t, err)
-	assert.Equal(t, expectedResp, resp)
+	assert.Equal(t, error_codes.ErrorConvertingAllowedHipsterCountToInteger, err.(error_handler.ICodedError).GetErrorCode())
 
 }
 
 func TestThrottleLambdaUpdateDocumentDBError(t *testing.T) {
+	useDefaultPolicy(t, "50")
 	dBClient := new(mocks.IDocDBClient)
 	slackclient := new(mocks.ISlackClient)
 	eventDataRequestObj := &eventData{}
@@ -96,10 +109,8 @@ func TestThrottleLambdaUpdateDocumentDBError(t *testing.T) {
 	expectedResp := map[string]interface{}{"status": failed}
 	commonHandler.DBClient = dBClient
 	commonHandler.SlackClient = slackclient
-	var count int64 = 52
-	t.Setenv("AllowedHipsterCount", "50")
-	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(count, nil)
 	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("some error"))
+	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(int64(0), nil)
 	slackclient.Mock.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
 	resp, err := notifcationWrapper(context.Background(), eventDataRequestObj)
 	assert.Error(t, err)
@@ -108,27 +119,84 @@ func TestThrottleLambdaUpdateDocumentDBError(t *testing.T) {
 }
 
 func TestGetWorkflowExecutionPathHipster(t *testing.T) {
+	useDefaultPolicy(t, "50")
 	dBClient := new(mocks.IDocDBClient)
 	slackclient := new(mocks.ISlackClient)
 	eventDataRequestObj := eventData{}
 	mydata := []byte(eventTestData)
 	json.Unmarshal(mydata, &eventDataRequestObj)
 
-	expectedResp := "Hipster"
 	commonHandler.DBClient = dBClient
 	commonHandler.SlackClient = slackclient
-	var count int64 = 20
-	t.Setenv("AllowedHipsterCount", "50")
-	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(count, nil)
+	dBClient.Mock.On("ReserveHipsterSlot", testContext, "2022-05-10", eventDataRequestObj.WorkflowID, int64(50), mock.Anything).Return(documentDB_client.HipsterReservation{Quota: "2022-05-10", Slot: 21, Count: 21, Reserved: true}, nil)
 
 	eventDataRequestObj.IsPenetration = false
-	resp, _, _, _, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj)
+	resp, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj, testNow)
 	assert.NoError(t, err)
-	assert.Equal(t, expectedResp, resp)
+	assert.Equal(t, "Hipster", resp.Path)
+	assert.Equal(t, int64(20), resp.TodayCount)
+	assert.Equal(t, int64(50), resp.Threshold)
+	assert.Equal(t, int64(21), resp.Slot)
+	assert.Equal(t, PathDecision{Path: "Hipster", Rule: "hipster-daily", Reason: "order is within the limits of rules hipster-daily", Rules: []RuleOutcome{
+		{Rule: "hipster-daily", Path: "Hipster", Quota: "2022-05-10", Limit: 50, Slot: 21, Count: 21, Outcome: "granted"},
+	}}, resp.Decision)
+}
+
+func TestThrottlePolicyQuota(t *testing.T) {
+	useDefaultPolicy(t, "50")
+	daily := policy.Rules[0]
+	assert.Equal(t, "hipster-daily", daily.Name)
+	// the default rule counts on the bare PST date of the quotas stored before throttle policies
+	assert.Equal(t, "2022-05-10", policy.quota(daily, testNow))
+	assert.True(t, time.Date(2022, 5, 18, 7, 0, 0, 0, time.UTC).Equal(policy.quotaExpiry(daily, testNow)))
 
+	hourly := ThrottleRule{Name: "hipster-hourly", Window: WindowHour, Limit: daily.Limit, Path: "Hipster"}
+	assert.Equal(t, "hipster-hourly/2022-05-10T05:00", policy.quota(hourly, testNow))
+	assert.True(t, time.Date(2022, 5, 17, 13, 0, 0, 0, time.UTC).Equal(policy.quotaExpiry(hourly, testNow)))
+
+	// a moved reset time starts other windows than the dates of the old quotas
+	policy.ResetTime = "06:00"
+	assert.NoError(t, policy.Validate())
+	assert.Equal(t, "hipster-daily/2022-05-09T06:00", policy.quota(daily, testNow))
+}
+
+func TestGetWorkflowExecutionPathHipsterQuotaFull(t *testing.T) {
+	useDefaultPolicy(t, "50")
+	dBClient := new(mocks.IDocDBClient)
+	eventDataRequestObj := eventData{}
+	json.Unmarshal([]byte(eventTestData), &eventDataRequestObj)
+
+	commonHandler.DBClient = dBClient
+	dBClient.Mock.On("ReserveHipsterSlot", testContext, "2022-05-10", eventDataRequestObj.WorkflowID, int64(50), mock.Anything).Return(documentDB_client.HipsterReservation{Quota: "2022-05-10", Count: 50}, nil)
+
+	eventDataRequestObj.IsPenetration = false
+	resp, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj, testNow)
+	assert.NoError(t, err)
+	assert.Equal(t, "Twister", resp.Path)
+	assert.Equal(t, int64(50), resp.TodayCount)
+	assert.Equal(t, int64(0), resp.Slot)
+	assert.Equal(t, "hipster-daily", resp.Decision.Rule)
+	assert.Equal(t, "all 50 slots of rule hipster-daily are taken for the day", resp.Decision.Reason)
+}
+
+func TestGetWorkflowExecutionPathReserveError(t *testing.T) {
+	useDefaultPolicy(t, "50")
+	dBClient := new(mocks.IDocDBClient)
+	eventDataRequestObj := eventData{}
+	json.Unmarshal([]byte(eventTestData), &eventDataRequestObj)
+
+	commonHandler.DBClient = dBClient
+	dBClient.Mock.On("ReserveHipsterSlot", testContext, mock.Anything, eventDataRequestObj.WorkflowID, int64(50), mock.Anything).Return(documentDB_client.HipsterReservation{}, errors.New("some error"))
+	dBClient.Mock.On("ReleaseHipsterSlot", testContext, eventDataRequestObj.WorkflowID).Return(false, nil)
+
+	eventDataRequestObj.IsPenetration = false
+	_, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj, testNow)
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.ErrorReservingHipsterSlot, err.(error_handler.ICodedError).GetErrorCode())
 }
 
 func TestGetWorkflowExecutionPathHTwister(t *testing.T) {
+	useDefaultPolicy(t, "50")
 	dBClient := new(mocks.IDocDBClient)
 	slackclient := new(mocks.ISlackClient)
 	eventDataRequestObj := eventData{}
@@ -138,10 +206,225 @@ func TestGetWorkflowExecutionPathHTwister(t *testing.T) {
 	expectedResp := "Twister"
 	commonHandler.DBClient = dBClient
 	commonHandler.SlackClient = slackclient
-	var count int64 = 20
-	t.Setenv("AllowedHipsterCount", "50")
-	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(count, nil)
-	resp, _, _, _, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj)
+	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(int64(0), errors.New("some error")).Once()
+	_, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj, testNow)
+	assert.Equal(t, error_codes.ErrorFetchingHipsterCountFromDB, err.(error_handler.ICodedError).GetErrorCode())
+	dBClient.Mock.On("GetHipsterCountPerDay", testContext).Return(int64(7), nil)
+	resp, err := getWorkflowExecutionPath(testContext, &eventDataRequestObj, testNow)
 	assert.NoError(t, err)
-	assert.Equal(t, expectedResp, resp)
+	assert.Equal(t, expectedResp, resp.Path)
+	assert.Equal(t, int64(7), resp.TodayCount)
+	dBClient.AssertNotCalled(t, "ReserveHipsterSlot", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestThrottleLambdaReleasesSlotWhenFlowTypeUpdateFails(t *testing.T) {
+	useDefaultPolicy(t, "50")
+	dBClient := new(mocks.IDocDBClient)
+	slackclient := new(mocks.ISlackClient)
+	eventDataRequestObj := &eventData{}
+	json.Unmarshal([]byte(eventTestData), &eventDataRequestObj)
+	eventDataRequestObj.IsPenetration = false
+
+	commonHandler.DBClient = dBClient
+	commonHandler.SlackClient = slackclient
+	dBClient.Mock.On("ReserveHipsterSlot", testContext, mock.Anything, eventDataRequestObj.WorkflowID, int64(50), mock.Anything).Return(documentDB_client.HipsterReservation{Slot: 3, Count: 3, Reserved: true}, nil)
+	dBClient.Mock.On("UpdateDocumentDB", testContext, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("some error"))
+	dBClient.Mock.On("ReleaseHipsterSlot", testContext, eventDataRequestObj.WorkflowID).Return(true, nil)
+	slackclient.Mock.On("SendErrorMessage", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	resp, err := notifcationWrapper(context.Background(), eventDataRequestObj)
+	assert.Error(t, err)
+	assert.Equal(t, map[string]interface{}{"status": failed}, resp)
+	dBClient.AssertCalled(t, "ReleaseHipsterSlot", testContext, eventDataRequestObj.WorkflowID)
+}
+
+func TestThrottleLambdaConcurrentWorkflowsStayWithinQuota(t *testing.T) {
+	useDefaultPolicy(t, "5")
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = dBClient
+
+	var wg sync.WaitGroup
+	results := make([]map[string]interface{}, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			event := &eventData{WorkflowID: fmt.Sprintf("workflow-%d", i), OrderType: "PremiumResidential", IsHipsterEnabled: true}
+			resp, err := handler(context.Background(), event)
+			assert.NoError(t, err)
+			results[i] = resp
+		}(i)
+	}
+	wg.Wait()
+
+	slots := map[int64]bool{}
+	for _, resp := range results {
+		if resp["Path"] == "Hipster" {
+			slots[resp["HipsterSlot"].(int64)] = true
+		}
+	}
+	assert.Equal(t, map[int64]bool{1: true, 2: true, 3: true, 4: true, 5: true}, slots)
+
+	// a retried throttle task gets its slot back instead of taking another one
+	var holder string
+	for i, resp := range results {
+		if resp["HipsterSlot"] == int64(2) {
+			holder = fmt.Sprintf("workflow-%d", i)
+		}
+	}
+	resp, err := handler(context.Background(), &eventData{WorkflowID: holder, OrderType: "PremiumResidential", IsHipsterEnabled: true})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), resp["HipsterSlot"])
+}
+
+func TestThrottlePolicyRulesInOrder(t *testing.T) {
+	usePolicy(t, `{
+		"timeZone": "UTC",
+		"resetTime": "06:00",
+		"rules": [
+			{"name": "excluded-customer", "scope": {"customers": ["acme"]}, "path": "Twister"},
+			{"name": "global-daily", "window": "day", "limit": 2, "path": "Hipster"},
+			{"name": "premium-hourly", "scope": {"productTypes": ["PremiumResidential"], "sources": ["MA"]}, "window": "hour", "limit": 1, "path": "Hipster"}
+		]
+	}`)
+	dBClient := documentDB_client.NewInMemoryDocDBClient()
+	commonHandler.DBClient = dBClient
+	order := func(workflowId, productType, customer string) *eventData {
+		return &eventData{WorkflowID: workflowId, OrderType: productType, IsHipsterEnabled: true, Input: map[string]interface{}{"customerId": customer, "source": "MA"}}
+	}
+	at := func(hour, minute int) time.Time { return time.Date(2022, 5, 10, hour, minute, 0, 0, time.UTC) }
+	held := func(quota string) int64 {
+		reservation, err := dBClient.ReserveHipsterSlot(testContext, quota, "probe", 0, time.Time{})
+		assert.NoError(t, err)
+		return reservation.Count
+	}
+
+	resp, err := getWorkflowExecutionPath(testContext, order("wf-acme", "PremiumResidential", "acme"), at(7, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, PathDecision{Path: "Twister", Rule: "excluded-customer", Reason: "rule excluded-customer sends its orders to Twister", Rules: []RuleOutcome{
+		{Rule: "excluded-customer", Path: "Twister", Outcome: "matched"},
+	}}, resp.Decision)
+
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-1", "PremiumResidential", "globex"), at(7, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, PathDecision{Path: "Hipster", Rule: "premium-hourly", Reason: "order is within the limits of rules global-daily, premium-hourly", Rules: []RuleOutcome{
+		{Rule: "global-daily", Path: "Hipster", Quota: "global-daily/2022-05-10T06:00", Limit: 2, Slot: 1, Count: 1, Outcome: "granted"},
+		{Rule: "premium-hourly", Path: "Hipster", Quota: "premium-hourly/2022-05-10T07:00", Limit: 1, Slot: 1, Count: 1, Outcome: "granted"},
+	}}, resp.Decision)
+
+	// the hourly limit sends the order to Twister and gives its daily slot back
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-2", "PremiumResidential", "globex"), at(7, 40))
+	assert.NoError(t, err)
+	assert.Equal(t, "Twister", resp.Path)
+	assert.Equal(t, "premium-hourly", resp.Decision.Rule)
+	assert.Equal(t, "all 1 slots of rule premium-hourly are taken for the hour", resp.Decision.Reason)
+	assert.Equal(t, int64(1), held("global-daily/2022-05-10T06:00"))
+
+	// other products only count against the daily limit, the slot given back to wf-2 keeps its number
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-3", "ClaimsReadyResidential", "globex"), at(7, 45))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hipster", resp.Path)
+	assert.Equal(t, int64(3), resp.Slot)
+	assert.Equal(t, int64(2), held("global-daily/2022-05-10T06:00"))
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-4", "ClaimsReadyResidential", "globex"), at(8, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "Twister", resp.Path)
+	assert.Equal(t, "global-daily", resp.Decision.Rule)
+
+	// the day resets at 06:00 UTC
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-5", "ClaimsReadyResidential", "globex"), at(29, 59))
+	assert.NoError(t, err)
+	assert.Equal(t, "Twister", resp.Path)
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-6", "ClaimsReadyResidential", "globex"), at(30, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hipster", resp.Path)
+	assert.Equal(t, "global-daily/2022-05-11T06:00", resp.Decision.Rules[0].Quota)
+}
+
+func TestThrottlePolicyRegisteredPaths(t *testing.T) {
+	vendor := execution_path.Path{
+		Name:         "Vendor",
+		Eligibility:  execution_path.Eligibility{ProductTypes: []string{"PremiumResidential"}, EnabledFlag: "isVendorEnabled"},
+		Quota:        &execution_path.Quota{LimitEnv: "AllowedVendorCount", Window: execution_path.WindowHour},
+		LegacyStatus: execution_path.LegacyStatus{Completed: "QCCompleted"},
+		PMFTasks:     []string{"CreateVendorJobAndWaitForMeasurement"},
+	}
+	execution_path.Use(append(execution_path.DefaultRegistry(), vendor))
+	t.Cleanup(func() { execution_path.Use(execution_path.DefaultRegistry()) })
+	t.Setenv("AllowedVendorCount", "1")
+	useDefaultPolicy(t, "1")
+	assert.Equal(t, []string{"hipster-daily", "vendor-hourly"}, []string{policy.Rules[0].Name, policy.Rules[1].Name})
+	commonHandler.DBClient = documentDB_client.NewInMemoryDocDBClient()
+	order := func(workflowId string, hipsterEnabled bool) *eventData {
+		return &eventData{WorkflowID: workflowId, OrderType: "PremiumResidential", IsHipsterEnabled: hipsterEnabled, Input: map[string]interface{}{"isVendorEnabled": true}}
+	}
+
+	resp, err := getWorkflowExecutionPath(testContext, order("wf-1", true), testNow)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hipster", resp.Path)
+	assert.Equal(t, []string{"Hipster", "Twister", "Vendor"}, resp.EligiblePaths)
+
+	// a full Hipster quota moves the order on to the next path with room
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-2", true), testNow)
+	assert.NoError(t, err)
+	assert.Equal(t, "Vendor", resp.Path)
+	assert.Equal(t, "vendor-hourly", resp.Decision.Rule)
+	assert.Equal(t, int64(1), resp.Slot)
+
+	// orders not enabled for Hipster skip its rules
+	resp, err = getWorkflowExecutionPath(testContext, order("wf-3", false), testNow)
+	assert.NoError(t, err)
+	assert.Equal(t, "Twister", resp.Path)
+	assert.False(t, resp.IsHipsterAllowed)
+	assert.Equal(t, "all 1 slots of rule vendor-hourly are taken for the hour", resp.Decision.Reason)
+}
+
+func TestThrottlePolicyWindowsFollowTheTimeZone(t *testing.T) {
+	usePolicy(t, `{"rules": [{"name": "daily", "window": "day", "limit": 1, "path": "Hipster"}, {"name": "hourly", "window": "hour", "limit": 1, "path": "Hipster"}]}`)
+	// 06:30 UTC is still the previous day in Los Angeles
+	now := time.Date(2022, 5, 10, 6, 30, 0, 0, time.UTC)
+	assert.Equal(t, "daily/2022-05-09T00:00", policy.quota(policy.Rules[0], now))
+	assert.Equal(t, "hourly/2022-05-09T23:00", policy.quota(policy.Rules[1], now))
+}
+
+func TestLoadThrottlePolicyReportsEveryProblem(t *testing.T) {
+	t.Setenv(ThrottlePolicyConfig, `{
+		"timeZone": "Mars/Olympus",
+		"resetTime": "6am",
+		"rules": [
+			{"name": "daily", "window": "week", "limit": 5, "path": "Hipster"},
+			{"name": "daily", "path": "Walk"},
+			{"name": "capped-twister", "window": "day", "limit": 5, "path": "Twister"},
+			{"scope": {"productTypes": ["Bungalow"]}, "path": "Hipster"}
+		]
+	}`)
+	_, err := LoadThrottlePolicy(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, error_codes.ErrorLoadingThrottlePolicy, err.(error_handler.ICodedError).GetErrorCode())
+	for _, problem := range []string{
+		"time zone Mars/Olympus is unknown",
+		"reset time 6am should be written as HH:MM",
+		"daily has unsupported window week",
+		"daily is used by several rules",
+		"daily has unsupported path Walk",
+		"capped-twister cannot limit the default path Twister",
+		"rule 4 has no name",
+		"rule 4 has product type Bungalow not accepted by path Hipster",
+	} {
+		assert.True(t, strings.Contains(err.Error(), problem), problem)
+	}
+}
+
+func TestLoadThrottlePolicyFromS3(t *testing.T) {
+	awsClient := new(mocks.IAWSClient)
+	commonHandler.AwsClient = awsClient
+	t.Setenv(ThrottlePolicyS3Path, "s3://config/throttle.json")
+	awsClient.On("FetchS3BucketPath", "s3://config/throttle.json").Return("config", "/throttle.json", nil)
+	awsClient.On("GetDataFromS3", mock.Anything, "config", "/throttle.json").Return([]byte(`{"rules": [{"name": "off", "path": "Twister"}]}`), nil)
+
+	loaded, err := LoadThrottlePolicy(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "America/Los_Angeles", loaded.TimeZone)
+	assert.Equal(t, "00:00", loaded.ResetTime)
+	assert.Equal(t, []ThrottleRule{{Name: "off", Path: "Twister"}}, loaded.Rules)
 }
@@ -250,7 +250,12 @@ func UploadData(ctx context.Context, reportId string, location string, url strin
 
 func main() {
 	log_config.InitLogging(logLevel)
-	commonHandler = common_handler.New(true, true, true, true, true)
+	var err error
+	commonHandler, err = common_handler.New(true, true, true, true, true)
+	if err != nil {
+		log.Error(context.Background(), err)
+		panic(err)
+	}
 	httpservice.ConfigureHTTPClient(&httpservice.HTTPClientConfiguration{
 		// APITimeout: 90,
 	})
@@ -17,4 +17,26 @@ locals {
   // In sandox, password is clear text, to avoid depending on an onboarding secret
   clear_text_db_password = try(module.config.document_db_config_map.master_password, null)
   document_db_password   = local.clear_text_db_password == null ? jsondecode(data.aws_secretsmanager_secret_version.secret[0].secret_string)["password"] : local.clear_text_db_password
+
+  legacy_order_queue = module.config.sqs_config_map[module.config.environment_config_map.receive_legacy_order_queue_name]
+  // rush is polled in full batches as soon as orders arrive, bulk in small batches gathered over a minute
+  priority_order_queues = {
+    rush = { batch_size = 10, maximum_batching_window_in_seconds = 0, max_receive_count = 100 }
+    bulk = { batch_size = 2, maximum_batching_window_in_seconds = 60, max_receive_count = 100 }
+  }
+
+  datastore_archive_env = {
+    archiveBucket = "${local.resource_name_prefix}-s3-workflow-archive"
+  }
+
+  // the routes the Hipster/Twister Choice state of the workflow state machine matches, an execution path may only
+  // take one of them or the Default of the Choice
+  workflow_state_machine = jsondecode(file("${path.module}/../../stepfunctions/symphony-workfow/state-machine.json"))
+  execution_routes_env = {
+    ExecutionRoutes = join(",", [for choice in local.workflow_state_machine.States["Hipster/Twister"].Choices : choice.StringEquals])
+  }
+
+  invokesfn_dlq_env = {
+    DeadLetterQueueURL = aws_sqs_queue.order_dead_letter.url
+  }
 }
@@ -16,11 +16,13 @@ module "lambda" {
   image_uri             = try(each.value.image_uri, null)
   package_type          = try(each.value.package_type, "Image")
   vpc_id                = each.value.vpc_id
-  environment_variables = try(each.value.environment_variables, null)
+  // datastore lambda archives to the workflow archive bucket, see local.datastore_archive_env, and every lambda
+  // loading the execution paths gets the routes of the state machine, see local.execution_routes_env
+  environment_variables = merge(try(each.value.environment_variables, {}), local.execution_routes_env, each.key == module.config.environment_config_map.datastore_lambda_name ? local.datastore_archive_env : {})
   lambda_name           = each.key
   lambda_handler        = each.value.lambda_handler
   lambda_description    = each.value.lambda_description
-  managed_policy_arns   = each.value.managed_policy_arns
+  managed_policy_arns   = each.key == module.config.environment_config_map.datastore_lambda_name ? concat(each.value.managed_policy_arns, [aws_iam_policy.workflow_archive_access.arn]) : each.value.managed_policy_arns
   lambda_inline_policy  = try(each.value.lambda_inline_policy, null)
   schedule_time_trigger = try(each.value.schedule_time_trigger, null)
   aws_lambda_permission = try(each.value.aws_lambda_permission, [])
@@ -43,11 +45,12 @@ module "invokesfn_lambda" {
   image_uri                 = try(each.value.image_uri, null)
   package_type              = try(each.value.package_type, "Image")
   vpc_id                    = each.value.vpc_id
-  environment_variables     = try(each.value.environment_variables, null)
+  // invokesfn moves the orders it rejects to the order dead letter queue, see local.invokesfn_dlq_env
+  environment_variables     = each.key == module.config.environment_config_map.invokesfn_lambda_name ? merge(try(each.value.environment_variables, {}), local.invokesfn_dlq_env) : try(each.value.environment_variables, null)
   lambda_name               = each.key
   lambda_handler            = each.value.lambda_handler
   lambda_description        = each.value.lambda_description
-  managed_policy_arns       = each.value.managed_policy_arns
+  managed_policy_arns       = each.key == module.config.environment_config_map.invokesfn_lambda_name ? concat(each.value.managed_policy_arns, [aws_iam_policy.invokesfn_order_access.arn]) : each.value.managed_policy_arns
   lambda_inline_policy      = try(each.value.lambda_inline_policy, null)
   lambda_assume_role_policy = try(each.value.lambda_assume_role_policy, null)
   schedule_time_trigger     = try(each.value.schedule_time_trigger, null)
@@ -129,16 +132,88 @@ resource "aws_sqs_queue" "sqs" {
 
 // Name of the legacy order queue
 resource "aws_lambda_event_source_mapping" "event_trigger_sqs" {
-  event_source_arn = "arn:aws:sqs:${local.region}:${local.account_id}:${local.resource_name_prefix}-sqs-${module.config.environment_config_map.receive_legacy_order_queue_name}"
-  function_name    = "arn:aws:lambda:${local.region}:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.invokesfn_lambda_name}" //module.invokesfn_lambda[0].arn
-  depends_on       = [module.invokesfn_lambda]
+  event_source_arn        = "arn:aws:sqs:${local.region}:${local.account_id}:${local.resource_name_prefix}-sqs-${module.config.environment_config_map.receive_legacy_order_queue_name}"
+  function_name           = "arn:aws:lambda:${local.region}:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.invokesfn_lambda_name}" //module.invokesfn_lambda[0].arn
+  function_response_types = ["ReportBatchItemFailures"]
+  depends_on              = [module.invokesfn_lambda]
 }
 //
 
 resource "aws_lambda_event_source_mapping" "event_trigger_sqssim" {
-  event_source_arn = "arn:aws:sqs:${local.region}:${local.account_id}:${local.resource_name_prefix}-sqs-${module.config.environment_config_map.receive_sim_order_queue_name}"
-  function_name    = "arn:aws:lambda:${local.region}:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.invokesfn_lambda_name}" //module.invokesfn_lambda[0].arn
-  depends_on       = [module.invokesfn_lambda]
+  event_source_arn        = "arn:aws:sqs:${local.region}:${local.account_id}:${local.resource_name_prefix}-sqs-${module.config.environment_config_map.receive_sim_order_queue_name}"
+  function_name           = "arn:aws:lambda:${local.region}:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.invokesfn_lambda_name}" //module.invokesfn_lambda[0].arn
+  function_response_types = ["ReportBatchItemFailures"]
+  depends_on              = [module.invokesfn_lambda]
+}
+
+// Rush and bulk orders get their own queues so a backlog in one lane does not hold back the others, standard orders
+// keep using the legacy order queue. invokesfn caps the running executions of each lane and postpones throttled
+// orders, the batching below weighs how often each lane is polled.
+resource "aws_sqs_queue" "priority_order" {
+  for_each = local.priority_order_queues
+
+  name                       = "${local.resource_name_prefix}-sqs-receiveOrder-${each.key}"
+  delay_seconds              = local.legacy_order_queue.delay_seconds
+  max_message_size           = local.legacy_order_queue.max_message_size
+  message_retention_seconds  = local.legacy_order_queue.message_retention_seconds
+  receive_wait_time_seconds  = local.legacy_order_queue.receive_wait_time_seconds
+  visibility_timeout_seconds = local.legacy_order_queue.visibility_timeout_seconds
+  // throttled orders are received again after every backoff, only give up on them after days of waiting
+  redrive_policy = jsonencode({
+    deadLetterTargetArn = aws_sqs_queue.order_dead_letter.arn
+    maxReceiveCount     = each.value.max_receive_count
+  })
+}
+
+// Orders invokesfn cannot decode, route or validate, kept for inspection instead of being redelivered.
+// invokesfn is allowed to send to it through aws_iam_policy.invokesfn_order_access.
+resource "aws_sqs_queue" "order_dead_letter" {
+  name                      = "${local.resource_name_prefix}-sqs-receiveOrder-dlq"
+  message_retention_seconds = 1209600
+}
+
+// Moves rejected orders to the dead letter queue and describes the existing execution of a duplicate order from
+// invokesfn lambda
+resource "aws_iam_policy" "invokesfn_order_access" {
+  name   = "${local.resource_name_prefix}-policy-invokesfn-order-access"
+  policy = <<POLICY
+{
+    "Version": "2012-10-17",
+    "Statement": [
+        {
+            "Action": [
+                "sqs:SendMessage"
+            ],
+            "Resource": [
+                "${aws_sqs_queue.order_dead_letter.arn}"
+            ],
+            "Effect": "Allow",
+            "Sid": "OrderDeadLetterQueue"
+        },
+        {
+            "Action": [
+                "states:DescribeExecution"
+            ],
+            "Resource": [
+                "arn:aws:states:${local.region}:${local.account_id}:execution:${local.resource_name_prefix}-*"
+            ],
+            "Effect": "Allow",
+            "Sid": "DuplicateOrderExecutions"
+        }
+    ]
+}
+POLICY
+}
+
+resource "aws_lambda_event_source_mapping" "event_trigger_sqs_priority" {
+  for_each = aws_sqs_queue.priority_order
+
+  event_source_arn                   = each.value.arn
+  function_name                      = "arn:aws:lambda:${local.region}:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.invokesfn_lambda_name}"
+  function_response_types            = ["ReportBatchItemFailures"]
+  batch_size                         = local.priority_order_queues[each.key].batch_size
+  maximum_batching_window_in_seconds = local.priority_order_queues[each.key].maximum_batching_window_in_seconds
+  depends_on                         = [module.invokesfn_lambda]
 }
 
 resource "aws_sns_topic_subscription" "lambda_sns_subscription" {
@@ -152,6 +227,133 @@ ${module.config.environment_config_map.sns_domain_event_subscription_legacy_sqs}
     
 }
 
+// Aborted, timed out and failed executions never reach the state machine's own catch, forward them to datastore lambda
+// so running steps are failed, their vendor jobs cancelled and their slots released.
+resource "aws_cloudwatch_event_rule" "sfn_execution_aborted" {
+  name          = "${local.resource_name_prefix}-rule-sfn-execution-aborted"
+  description   = "Step function executions that were aborted, timed out or failed"
+  event_pattern = <<EOD
+{
+  "source": ["aws.states"],
+  "detail-type": ["Step Functions Execution Status Change"],
+  "detail": {
+    "status": ["ABORTED", "TIMED_OUT", "FAILED"],
+    "stateMachineArn": [{ "prefix": "arn:aws:states:${local.region}:${local.account_id}:stateMachine:${local.resource_name_prefix}" }]
+  }
+}
+EOD
+}
+
+resource "aws_cloudwatch_event_target" "sfn_execution_aborted_datastore" {
+  rule = aws_cloudwatch_event_rule.sfn_execution_aborted.name
+  arn  = "arn:aws:lambda:${local.region}:${local.account_id}:function:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.datastore_lambda_name}"
+
+  input_transformer {
+    input_paths = {
+      workflowId = "$.detail.name"
+    }
+    input_template = <<EOD
+{"action": "abort", "workflowId": <workflowId>}
+EOD
+  }
+}
+
+resource "aws_lambda_permission" "sfn_execution_aborted_datastore" {
+  statement_id  = "AllowExecutionFromSfnAbortedRule"
+  action        = "lambda:InvokeFunction"
+  function_name = "${local.resource_name_prefix}-lambda-${module.config.environment_config_map.datastore_lambda_name}"
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.sfn_execution_aborted.arn
+  depends_on    = [module.lambda]
+}
+
+// Archives of finished workflows purged from DocumentDB, kept until they are deleted by hand
+resource "aws_s3_bucket" "workflow_archive" {
+  bucket = "${local.resource_name_prefix}-s3-workflow-archive"
+  acl    = "private"
+
+  server_side_encryption_configuration {
+    rule {
+      apply_server_side_encryption_by_default {
+        sse_algorithm = "AES256"
+      }
+    }
+  }
+
+  lifecycle_rule {
+    id      = "archive-to-glacier"
+    enabled = true
+
+    transition {
+      days          = 90
+      storage_class = "GLACIER"
+    }
+  }
+}
+
+resource "aws_s3_bucket_public_access_block" "workflow_archive" {
+  bucket                  = aws_s3_bucket.workflow_archive.id
+  block_public_acls       = true
+  block_public_policy     = true
+  ignore_public_acls      = true
+  restrict_public_buckets = true
+}
+
+// Writes, reads back to verify and restores archives from datastore lambda
+resource "aws_iam_policy" "workflow_archive_access" {
+  name   = "${local.resource_name_prefix}-policy-workflow-archive-access"
+  policy = <<POLICY
+{
+    "Version": "2012-10-17",
+    "Statement": [
+        {
+            "Action": [
+                "s3:PutObject",
+                "s3:GetObject"
+            ],
+            "Resource": [
+                "${aws_s3_bucket.workflow_archive.arn}/*"
+            ],
+            "Effect": "Allow",
+            "Sid": "WorkflowArchiveObjects"
+        },
+        {
+            "Action": [
+                "s3:ListBucket"
+            ],
+            "Resource": [
+                "${aws_s3_bucket.workflow_archive.arn}"
+            ],
+            "Effect": "Allow",
+            "Sid": "WorkflowArchiveBucket"
+        }
+    ]
+}
+POLICY
+}
+
+// Nightly move of old finished workflows from DocumentDB to the archive bucket configured on datastore lambda
+resource "aws_cloudwatch_event_rule" "archive_workflows" {
+  name                = "${local.resource_name_prefix}-rule-archive-workflows"
+  description         = "Archive finished workflows to S3 and purge them from DocumentDB"
+  schedule_expression = "cron(0 8 * * ? *)"
+}
+
+resource "aws_cloudwatch_event_target" "archive_workflows_datastore" {
+  rule  = aws_cloudwatch_event_rule.archive_workflows.name
+  arn   = "arn:aws:lambda:${local.region}:${local.account_id}:function:${local.resource_name_prefix}-lambda-${module.config.environment_config_map.datastore_lambda_name}"
+  input = jsonencode({ action = "archive" })
+}
+
+resource "aws_lambda_permission" "archive_workflows_datastore" {
+  statement_id  = "AllowExecutionFromArchiveRule"
+  action        = "lambda:InvokeFunction"
+  function_name = "${local.resource_name_prefix}-lambda-${module.config.environment_config_map.datastore_lambda_name}"
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.archive_workflows.arn
+  depends_on    = [module.lambda]
+}
+
 data "aws_caller_identity" "current" {}
 
 // Useful to troubleshoot role issues